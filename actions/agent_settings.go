@@ -0,0 +1,262 @@
+package actions
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/sykesm/kubernetes-cpi/agent"
+	"github.com/sykesm/kubernetes-cpi/kubecluster"
+	"k8s.io/client-go/1.4/pkg/api"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// SettingsKind is the kind of object that holds the agent instance settings.
+type SettingsKind string
+
+const (
+	SettingsConfigMap SettingsKind = "ConfigMap"
+	SettingsSecret    SettingsKind = "Secret"
+)
+
+const instanceSettingsKey = "instance_settings"
+
+// agentSettings are the instance settings of an agent and the object they
+// were read from.
+type agentSettings struct {
+	Settings *agent.Settings
+
+	kind      SettingsKind
+	configMap *v1.ConfigMap
+	secret    *v1.Secret
+}
+
+// vmMeta returns the labels and owners of the object the settings were read
+// from.
+func (s *agentSettings) vmMeta() vmMeta {
+	if s.kind == SettingsSecret {
+		return vmMeta{labels: s.secret.Labels, annotations: s.secret.Annotations, ownerReferences: s.secret.OwnerReferences}
+	}
+	return vmMeta{labels: s.configMap.Labels, annotations: s.configMap.Annotations, ownerReferences: s.configMap.OwnerReferences}
+}
+
+func resolveSettingsKind(kind SettingsKind) (SettingsKind, error) {
+	switch kind {
+	case "", SettingsConfigMap:
+		return SettingsConfigMap, nil
+	case SettingsSecret:
+		return SettingsSecret, nil
+	default:
+		return "", fmt.Errorf("%s is not a supported agent settings kind", kind)
+	}
+}
+
+func otherSettingsKind(kind SettingsKind) SettingsKind {
+	if kind == SettingsSecret {
+		return SettingsConfigMap
+	}
+	return SettingsSecret
+}
+
+// createAgentSettings stores new instance settings in an object of the
+// requested kind.
+func createAgentSettings(client kubecluster.Client, kind SettingsKind, ns, agentID string, vm vmMeta, instanceSettings *agent.Settings) error {
+	kind, err := resolveSettingsKind(kind)
+	if err != nil {
+		return err
+	}
+
+	instanceJSON, err := json.Marshal(instanceSettings)
+	if err != nil {
+		return err
+	}
+
+	meta := vm.objectMeta(agentName(agentID), ns)
+
+	if kind == SettingsSecret {
+		_, err = client.Secrets().Create(&v1.Secret{
+			ObjectMeta: meta,
+			Type:       v1.SecretTypeOpaque,
+			Data: map[string][]byte{
+				instanceSettingsKey: instanceJSON,
+			},
+		})
+		return err
+	}
+
+	_, err = client.ConfigMaps().Create(&v1.ConfigMap{
+		ObjectMeta: meta,
+		Data: map[string]string{
+			instanceSettingsKey: string(instanceJSON),
+		},
+	})
+	return err
+}
+
+// getAgentSettings reads the instance settings from an object of the
+// requested kind. Settings of agents created before the kind was changed are
+// read from the other kind.
+func getAgentSettings(client kubecluster.Client, kind SettingsKind, agentID string) (*agentSettings, error) {
+	kind, err := resolveSettingsKind(kind)
+	if err != nil {
+		return nil, err
+	}
+
+	stored, err := getAgentSettingsOfKind(client, kind, agentID)
+	if err == nil || !isNotFoundStatusError(err) {
+		return stored, err
+	}
+
+	stored, fallbackErr := getAgentSettingsOfKind(client, otherSettingsKind(kind), agentID)
+	if fallbackErr != nil {
+		if isNotFoundStatusError(fallbackErr) {
+			return nil, err
+		}
+		return nil, fallbackErr
+	}
+
+	return stored, nil
+}
+
+func getAgentSettingsOfKind(client kubecluster.Client, kind SettingsKind, agentID string) (*agentSettings, error) {
+	stored := &agentSettings{kind: kind}
+
+	var instanceJSON []byte
+	if kind == SettingsSecret {
+		secret, err := client.Secrets().Get(agentName(agentID))
+		if err != nil {
+			return nil, err
+		}
+		stored.secret = secret
+		instanceJSON = secret.Data[instanceSettingsKey]
+	} else {
+		cm, err := client.ConfigMaps().Get(agentName(agentID))
+		if err != nil {
+			return nil, err
+		}
+		stored.configMap = cm
+		instanceJSON = []byte(cm.Data[instanceSettingsKey])
+	}
+
+	var settings agent.Settings
+	err := json.Unmarshal(instanceJSON, &settings)
+	if err != nil {
+		return nil, err
+	}
+	stored.Settings = &settings
+
+	return stored, nil
+}
+
+// saveAgentSettings writes the settings to an object of the requested kind.
+// When the settings were read from the other kind they are copied to a new
+// object and the kind of the old object is returned so it can be removed
+// once nothing mounts it. Settings written to a secret always return the
+// config map kind so a config map left by an interrupted move is removed.
+func saveAgentSettings(client kubecluster.Client, kind SettingsKind, agentID string, stored *agentSettings) (SettingsKind, error) {
+	kind, err := resolveSettingsKind(kind)
+	if err != nil {
+		return "", err
+	}
+
+	instanceJSON, err := json.Marshal(stored.Settings)
+	if err != nil {
+		return "", err
+	}
+
+	if stored.kind == kind && kind == SettingsSecret {
+		if stored.secret.Data == nil {
+			stored.secret.Data = map[string][]byte{}
+		}
+		stored.secret.Data[instanceSettingsKey] = instanceJSON
+		_, err = client.Secrets().Update(stored.secret)
+		if err != nil {
+			return "", err
+		}
+		return SettingsConfigMap, nil
+	}
+
+	if stored.kind == kind {
+		if stored.configMap.Data == nil {
+			stored.configMap.Data = map[string]string{}
+		}
+		stored.configMap.Data[instanceSettingsKey] = string(instanceJSON)
+		_, err = client.ConfigMaps().Update(stored.configMap)
+		return "", err
+	}
+
+	err = createAgentSettings(client, kind, client.Namespace(), agentID, stored.vmMeta(), stored.Settings)
+	if err != nil {
+		return "", err
+	}
+
+	return stored.kind, nil
+}
+
+// deleteAgentSettingsOfKind removes the settings object of one kind. Missing
+// objects are ignored.
+func deleteAgentSettingsOfKind(client kubecluster.Client, kind SettingsKind, agentID string) error {
+	var err error
+	if kind == SettingsSecret {
+		err = client.Secrets().Delete(agentName(agentID), &api.DeleteOptions{GracePeriodSeconds: int64Ptr(0)})
+	} else {
+		err = client.ConfigMaps().Delete(agentName(agentID), &api.DeleteOptions{GracePeriodSeconds: int64Ptr(0)})
+	}
+	if err != nil && !isNotFoundStatusError(err) {
+		return err
+	}
+	return nil
+}
+
+// deleteAgentSettings removes the settings of an agent whichever kind of
+// object holds them.
+func deleteAgentSettings(client kubecluster.Client, agentID string) error {
+	for _, kind := range []SettingsKind{SettingsConfigMap, SettingsSecret} {
+		err := deleteAgentSettingsOfKind(client, kind, agentID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func agentSettingsVolumeSource(kind SettingsKind, agentID string) v1.VolumeSource {
+	items := []v1.KeyToPath{{
+		Key:  instanceSettingsKey,
+		Path: "instance_settings.json",
+	}}
+
+	if kind == SettingsSecret {
+		return v1.VolumeSource{
+			Secret: &v1.SecretVolumeSource{
+				SecretName: agentName(agentID),
+				Items:      items,
+			},
+		}
+	}
+
+	return v1.VolumeSource{
+		ConfigMap: &v1.ConfigMapVolumeSource{
+			LocalObjectReference: v1.LocalObjectReference{
+				Name: agentName(agentID),
+			},
+			Items: items,
+		},
+	}
+}
+
+// setAgentSettingsVolume points the bosh-config volume at the settings object
+// of the requested kind. It returns true if the spec was changed.
+func setAgentSettingsVolume(spec *v1.PodSpec, kind SettingsKind, agentID string) bool {
+	for i := range spec.Volumes {
+		volume := &spec.Volumes[i]
+		if volume.Name != "bosh-config" {
+			continue
+		}
+		if kind == SettingsSecret && volume.Secret != nil || kind != SettingsSecret && volume.ConfigMap != nil {
+			return false
+		}
+		volume.VolumeSource = agentSettingsVolumeSource(kind, agentID)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+package actions
+
+import (
+	"fmt"
+	"strconv"
+)
+
+type VMResources struct {
+	CPU               uint `json:"cpu"`
+	RAM               uint `json:"ram"`
+	EphemeralDiskSize uint `json:"ephemeral_disk_size"`
+}
+
+// VMPropertiesCalculator translates BOSH vm_resources into VM cloud
+// properties. Limits are set to the requested resources while requests are
+// scaled down by the overcommit ratios. A zero ratio is treated as 1.
+type VMPropertiesCalculator struct {
+	CPUOvercommitRatio    float64
+	MemoryOvercommitRatio float64
+}
+
+func (c *VMPropertiesCalculator) CalculateVMCloudProperties(vmResources VMResources) (VMCloudProperties, error) {
+	cpuRatio, err := overcommitRatio("cpu", c.CPUOvercommitRatio)
+	if err != nil {
+		return VMCloudProperties{}, err
+	}
+
+	memoryRatio, err := overcommitRatio("memory", c.MemoryOvercommitRatio)
+	if err != nil {
+		return VMCloudProperties{}, err
+	}
+
+	limits := ResourceList{}
+	requests := ResourceList{}
+
+	if vmResources.CPU > 0 {
+		milliCPU := uint64(vmResources.CPU) * 1000
+		limits[ResourceCPU] = strconv.FormatUint(milliCPU, 10) + "m"
+		requests[ResourceCPU] = strconv.FormatUint(scale(milliCPU, cpuRatio), 10) + "m"
+	}
+
+	if vmResources.RAM > 0 {
+		limits[ResourceMemory] = fmt.Sprintf("%dMi", vmResources.RAM)
+		requests[ResourceMemory] = fmt.Sprintf("%dMi", scale(uint64(vmResources.RAM), memoryRatio))
+	}
+
+	return VMCloudProperties{
+		Resources: Resources{
+			Limits:   limits,
+			Requests: requests,
+		},
+		EphemeralDiskSize: vmResources.EphemeralDiskSize,
+	}, nil
+}
+
+func overcommitRatio(name string, ratio float64) (float64, error) {
+	switch {
+	case ratio == 0:
+		return 1, nil
+	case ratio < 1:
+		return 0, fmt.Errorf("%s overcommit ratio must be at least 1: %g", name, ratio)
+	default:
+		return ratio, nil
+	}
+}
+
+// scale divides the value by the ratio without letting a non-zero value drop
+// to zero.
+func scale(value uint64, ratio float64) uint64 {
+	scaled := uint64(float64(value) / ratio)
+	if scaled == 0 && value > 0 {
+		return 1
+	}
+	return scaled
+}
@@ -0,0 +1,110 @@
+package actions_test
+
+import (
+	"github.com/sykesm/kubernetes-cpi/actions"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CalculateVMCloudProperties", func() {
+	var (
+		vmResources actions.VMResources
+
+		calculator *actions.VMPropertiesCalculator
+	)
+
+	BeforeEach(func() {
+		vmResources = actions.VMResources{
+			CPU:               2,
+			RAM:               4096,
+			EphemeralDiskSize: 10240,
+		}
+
+		calculator = &actions.VMPropertiesCalculator{}
+	})
+
+	It("sets requests and limits to the requested resources", func() {
+		cloudProps, err := calculator.CalculateVMCloudProperties(vmResources)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(cloudProps.Resources).To(Equal(actions.Resources{
+			Limits: actions.ResourceList{
+				actions.ResourceCPU:    "2000m",
+				actions.ResourceMemory: "4096Mi",
+			},
+			Requests: actions.ResourceList{
+				actions.ResourceCPU:    "2000m",
+				actions.ResourceMemory: "4096Mi",
+			},
+		}))
+	})
+
+	It("sets the ephemeral disk size", func() {
+		cloudProps, err := calculator.CalculateVMCloudProperties(vmResources)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cloudProps.EphemeralDiskSize).To(Equal(uint(10240)))
+	})
+
+	It("leaves the context empty", func() {
+		cloudProps, err := calculator.CalculateVMCloudProperties(vmResources)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cloudProps.Context).To(BeEmpty())
+	})
+
+	Context("when overcommit ratios are configured", func() {
+		BeforeEach(func() {
+			calculator.CPUOvercommitRatio = 4
+			calculator.MemoryOvercommitRatio = 2
+		})
+
+		It("scales the requests down by the ratios", func() {
+			cloudProps, err := calculator.CalculateVMCloudProperties(vmResources)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(cloudProps.Resources.Limits).To(Equal(actions.ResourceList{
+				actions.ResourceCPU:    "2000m",
+				actions.ResourceMemory: "4096Mi",
+			}))
+			Expect(cloudProps.Resources.Requests).To(Equal(actions.ResourceList{
+				actions.ResourceCPU:    "500m",
+				actions.ResourceMemory: "2048Mi",
+			}))
+		})
+	})
+
+	Context("when no cpu or ram is requested", func() {
+		BeforeEach(func() {
+			vmResources = actions.VMResources{}
+		})
+
+		It("returns empty resource lists", func() {
+			cloudProps, err := calculator.CalculateVMCloudProperties(vmResources)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cloudProps.Resources.Limits).To(BeEmpty())
+			Expect(cloudProps.Resources.Requests).To(BeEmpty())
+		})
+	})
+
+	Context("when the cpu overcommit ratio is less than one", func() {
+		BeforeEach(func() {
+			calculator.CPUOvercommitRatio = 0.5
+		})
+
+		It("returns an error", func() {
+			_, err := calculator.CalculateVMCloudProperties(vmResources)
+			Expect(err).To(MatchError("cpu overcommit ratio must be at least 1: 0.5"))
+		})
+	})
+
+	Context("when the memory overcommit ratio is less than one", func() {
+		BeforeEach(func() {
+			calculator.MemoryOvercommitRatio = 0.25
+		})
+
+		It("returns an error", func() {
+			_, err := calculator.CalculateVMCloudProperties(vmResources)
+			Expect(err).To(MatchError("memory overcommit ratio must be at least 1: 0.25"))
+		})
+	})
+})
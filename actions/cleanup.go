@@ -0,0 +1,365 @@
+package actions
+
+import (
+	"sort"
+	"time"
+
+	"code.cloudfoundry.org/clock"
+
+	"github.com/sykesm/kubernetes-cpi/config"
+	"github.com/sykesm/kubernetes-cpi/cpi"
+	"github.com/sykesm/kubernetes-cpi/kubecluster"
+	"k8s.io/client-go/1.4/pkg/api"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/labels"
+)
+
+// Orphan is an object labelled for an agent or disk that no longer exists.
+type Orphan struct {
+	Context    string `json:"context"`
+	Namespace  string `json:"namespace"`
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	AgentID    string `json:"agent_id,omitempty"`
+	DiskID     string `json:"disk_id,omitempty"`
+	AgeSeconds int64  `json:"age_seconds"`
+	Deleted    bool   `json:"deleted"`
+}
+
+// OrphanCleaner finds objects left behind by failed creates, interrupted
+// recreates and manual deletes. Objects labelled for an agent are orphans
+// when the agent pod does not exist and the agent is not one of the KnownVMs.
+// Disk claims are orphans when KnownDisks is set and does not contain the
+// disk. Namespaces created for a deployment are orphans once nothing of a VM
+// or disk remains in them and no known VM or disk is in them. Orphans
+// younger than MinAge are reported but never deleted so VMs and disks that
+// are being created are left alone; ages are measured from object creation
+// so KnownVMs protects VMs whose pod is being recreated.
+type OrphanCleaner struct {
+	ClientProvider kubecluster.ClientProvider
+	Clock          clock.Clock
+	MinAge         time.Duration
+
+	// DirectorUUID restricts the cleanup to the objects of one director.
+	DirectorUUID string
+
+	// KnownDisks are the disks recorded by the director.
+	KnownDisks []cpi.DiskCID
+
+	// KnownVMs are the VMs recorded by the director. Their objects are kept
+	// while their pod is missing.
+	KnownVMs []cpi.VMCID
+
+	// NamespacePolicies holds the namespace policy of each context. The
+	// namespaces created for deployments are cleaned up as well.
+	NamespacePolicies map[string]config.NamespacePolicy
+}
+
+// Cleanup reports the orphans in the contexts and deletes those older than
+// MinAge when deleteOrphans is set.
+func (c *OrphanCleaner) Cleanup(contexts []string, deleteOrphans bool) ([]Orphan, error) {
+	orphans := []Orphan{}
+	for _, context := range contexts {
+		client, err := c.ClientProvider.New(context)
+		if err != nil {
+			return nil, err
+		}
+
+		err = forEachNamespace(client, c.NamespacePolicies[context], c.DirectorUUID, func(client kubecluster.Client) error {
+			found, err := c.findOrphans(client)
+			if err != nil {
+				return err
+			}
+
+			err = c.deleteOrphans(client, found, deleteOrphans)
+			if err != nil {
+				return err
+			}
+			orphans = append(orphans, found...)
+
+			// the namespace is checked once its orphans are gone
+			namespaceOrphan, err := c.findNamespaceOrphan(client)
+			if err != nil || namespaceOrphan == nil {
+				return err
+			}
+
+			found = []Orphan{*namespaceOrphan}
+			err = c.deleteOrphans(client, found, deleteOrphans)
+			if err != nil {
+				return err
+			}
+			orphans = append(orphans, found...)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return orphans, nil
+}
+
+func (c *OrphanCleaner) deleteOrphans(client kubecluster.Client, orphans []Orphan, deleteOrphans bool) error {
+	for i := range orphans {
+		if deleteOrphans && time.Duration(orphans[i].AgeSeconds)*time.Second >= c.MinAge {
+			err := c.deleteOrphan(client, orphans[i])
+			if err != nil {
+				return err
+			}
+			orphans[i].Deleted = true
+		}
+	}
+	return nil
+}
+
+func (c *OrphanCleaner) findOrphans(client kubecluster.Client) ([]Orphan, error) {
+	liveAgents, err := c.liveAgents(client)
+	if err != nil {
+		return nil, err
+	}
+
+	agentSelector, err := directorSelector(c.DirectorUUID, "bosh.cloudfoundry.org/agent-id")
+	if err != nil {
+		return nil, err
+	}
+	objects, err := listAgentObjects(client, api.ListOptions{LabelSelector: agentSelector})
+	if err != nil {
+		return nil, err
+	}
+
+	orphans := []Orphan{}
+	for kind, metas := range objects {
+		for _, meta := range metas {
+			if liveAgents[meta.Labels["bosh.cloudfoundry.org/agent-id"]] {
+				continue
+			}
+			// persistent disks outlive their agent
+			if _, ok := meta.Labels["bosh.cloudfoundry.org/disk-id"]; ok {
+				continue
+			}
+			agentID := objectID(meta, "bosh.cloudfoundry.org/agent-id")
+			orphans = append(orphans, c.newOrphan(client, kind, meta, agentID, ""))
+		}
+	}
+
+	diskOrphans, err := c.findDiskOrphans(client, liveAgents)
+	if err != nil {
+		return nil, err
+	}
+	orphans = append(orphans, diskOrphans...)
+
+	sort.Sort(byKindAndName(orphans))
+	return orphans, nil
+}
+
+func (c *OrphanCleaner) findDiskOrphans(client kubecluster.Client, liveAgents map[string]bool) ([]Orphan, error) {
+	if c.KnownDisks == nil {
+		return nil, nil
+	}
+
+	knownDisks := map[string]bool{}
+	for _, diskCID := range c.KnownDisks {
+		cid, err := diskCID.Decode()
+		if err != nil {
+			return nil, err
+		}
+		knownDisks[cid.ID] = true
+	}
+
+	diskSelector, err := directorSelector(c.DirectorUUID, "bosh.cloudfoundry.org/disk-id")
+	if err != nil {
+		return nil, err
+	}
+	pvcList, err := client.PersistentVolumeClaims().List(api.ListOptions{LabelSelector: diskSelector})
+	if err != nil {
+		return nil, err
+	}
+
+	orphans := []Orphan{}
+	for _, pvc := range pvcList.Items {
+		diskID := objectID(pvc.ObjectMeta, "bosh.cloudfoundry.org/disk-id")
+		if knownDisks[diskID] || liveAgents[pvc.Labels["bosh.cloudfoundry.org/agent-id"]] {
+			continue
+		}
+		agentID := objectID(pvc.ObjectMeta, "bosh.cloudfoundry.org/agent-id")
+		orphans = append(orphans, c.newOrphan(client, "PersistentVolumeClaim", pvc.ObjectMeta, agentID, diskID))
+	}
+
+	return orphans, nil
+}
+
+// findNamespaceOrphan returns the namespace of the client when it is an empty
+// deployment namespace that holds none of the KnownVMs and KnownDisks.
+func (c *OrphanCleaner) findNamespaceOrphan(client kubecluster.Client) (*Orphan, error) {
+	namespace, err := emptyDeploymentNamespace(client)
+	if err != nil || namespace == nil {
+		return nil, err
+	}
+
+	var known []cpi.CID
+	for _, vmCID := range c.KnownVMs {
+		cid, err := vmCID.Decode()
+		if err != nil {
+			return nil, err
+		}
+		known = append(known, cid)
+	}
+	for _, diskCID := range c.KnownDisks {
+		cid, err := diskCID.Decode()
+		if err != nil {
+			return nil, err
+		}
+		known = append(known, cid)
+	}
+	for _, cid := range known {
+		if cid.Context == client.Context() && cid.Namespace == namespace.Name {
+			return nil, nil
+		}
+	}
+
+	orphan := c.newOrphan(client, "Namespace", namespace.ObjectMeta, "", "")
+	orphan.Namespace = namespace.Name
+	return &orphan, nil
+}
+
+// liveAgents returns the agent label values of the pods and the KnownVMs.
+// Pods of every director count so objects shared with another director are
+// never removed.
+func (c *OrphanCleaner) liveAgents(client kubecluster.Client) (map[string]bool, error) {
+	agentSelector, err := labels.Parse("bosh.cloudfoundry.org/agent-id")
+	if err != nil {
+		return nil, err
+	}
+
+	podList, err := client.Pods().List(api.ListOptions{LabelSelector: agentSelector})
+	if err != nil {
+		return nil, err
+	}
+
+	agents := map[string]bool{}
+	for _, pod := range podList.Items {
+		agents[pod.Labels["bosh.cloudfoundry.org/agent-id"]] = true
+	}
+	for _, vmCID := range c.KnownVMs {
+		cid, err := vmCID.Decode()
+		if err != nil {
+			return nil, err
+		}
+		agents[labelValue(cid.ID)] = true
+	}
+	return agents, nil
+}
+
+func (c *OrphanCleaner) newOrphan(client kubecluster.Client, kind string, meta v1.ObjectMeta, agentID, diskID string) Orphan {
+	return Orphan{
+		Context:    client.Context(),
+		Namespace:  client.Namespace(),
+		Kind:       kind,
+		Name:       meta.Name,
+		AgentID:    agentID,
+		DiskID:     diskID,
+		AgeSeconds: int64(c.Clock.Since(meta.CreationTimestamp.Time) / time.Second),
+	}
+}
+
+func (c *OrphanCleaner) deleteOrphan(client kubecluster.Client, orphan Orphan) error {
+	// disk claims are removed the way delete_disk removes them
+	if orphan.DiskID != "" {
+		diskDeleter := &DiskDeleter{ClientProvider: c.ClientProvider}
+		return diskDeleter.DeleteDisk(cpi.NewDiskCID(orphan.Context, orphan.Namespace, orphan.DiskID))
+	}
+
+	options := &api.DeleteOptions{GracePeriodSeconds: int64Ptr(0)}
+
+	var err error
+	switch orphan.Kind {
+	case "Namespace":
+		err = client.Core().Namespaces().Delete(orphan.Name, options)
+	case "ConfigMap":
+		err = client.ConfigMaps().Delete(orphan.Name, options)
+	case "Secret":
+		err = client.Secrets().Delete(orphan.Name, options)
+	case "Service":
+		err = client.Services().Delete(orphan.Name, options)
+	case "ServiceAccount":
+		err = client.ServiceAccounts().Delete(orphan.Name, options)
+	case "RoleBinding":
+		err = client.RoleBindings().Delete(orphan.Name, options)
+	case "PersistentVolumeClaim":
+		err = client.PersistentVolumeClaims().Delete(orphan.Name, options)
+	}
+	if err != nil && !isNotFoundStatusError(err) {
+		return err
+	}
+	return nil
+}
+
+// listAgentObjects lists the metadata of the objects the CPI creates for
+// agents by kind.
+func listAgentObjects(client kubecluster.Client, options api.ListOptions) (map[string][]v1.ObjectMeta, error) {
+	objects := map[string][]v1.ObjectMeta{}
+
+	configMaps, err := client.ConfigMaps().List(options)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range configMaps.Items {
+		objects["ConfigMap"] = append(objects["ConfigMap"], item.ObjectMeta)
+	}
+
+	secrets, err := client.Secrets().List(options)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range secrets.Items {
+		objects["Secret"] = append(objects["Secret"], item.ObjectMeta)
+	}
+
+	services, err := client.Services().List(options)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range services.Items {
+		objects["Service"] = append(objects["Service"], item.ObjectMeta)
+	}
+
+	serviceAccounts, err := client.ServiceAccounts().List(options)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range serviceAccounts.Items {
+		objects["ServiceAccount"] = append(objects["ServiceAccount"], item.ObjectMeta)
+	}
+
+	// the role bindings can't exist when the RBAC API is unavailable
+	roleBindings, err := client.RoleBindings().List(options)
+	if err != nil && !isNotFoundStatusError(err) && !isForbiddenStatusError(err) {
+		return nil, err
+	}
+	if err == nil {
+		for _, item := range roleBindings.Items {
+			objects["RoleBinding"] = append(objects["RoleBinding"], item.ObjectMeta)
+		}
+	}
+
+	claims, err := client.PersistentVolumeClaims().List(options)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range claims.Items {
+		objects["PersistentVolumeClaim"] = append(objects["PersistentVolumeClaim"], item.ObjectMeta)
+	}
+
+	return objects, nil
+}
+
+type byKindAndName []Orphan
+
+func (o byKindAndName) Len() int      { return len(o) }
+func (o byKindAndName) Swap(i, j int) { o[i], o[j] = o[j], o[i] }
+func (o byKindAndName) Less(i, j int) bool {
+	if o[i].Kind != o[j].Kind {
+		return o[i].Kind < o[j].Kind
+	}
+	return o[i].Name < o[j].Name
+}
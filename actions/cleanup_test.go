@@ -0,0 +1,335 @@
+package actions_test
+
+import (
+	"errors"
+	"time"
+
+	"code.cloudfoundry.org/clock/fakeclock"
+	"github.com/sykesm/kubernetes-cpi/actions"
+	"github.com/sykesm/kubernetes-cpi/config"
+	"github.com/sykesm/kubernetes-cpi/cpi"
+	"github.com/sykesm/kubernetes-cpi/kubecluster/fakes"
+	"k8s.io/client-go/1.4/kubernetes/fake"
+	kubeerrors "k8s.io/client-go/1.4/pkg/api/errors"
+	"k8s.io/client-go/1.4/pkg/api/unversioned"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/runtime"
+	"k8s.io/client-go/1.4/testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("OrphanCleaner", func() {
+	var (
+		fakeClient   *fakes.Client
+		fakeProvider *fakes.ClientProvider
+		fakeClock    *fakeclock.FakeClock
+		now          time.Time
+
+		cleaner *actions.OrphanCleaner
+	)
+
+	objectMeta := func(name string, age time.Duration, labels map[string]string) v1.ObjectMeta {
+		return v1.ObjectMeta{
+			Name:              name,
+			Namespace:         "bosh-namespace",
+			Labels:            labels,
+			CreationTimestamp: unversioned.NewTime(now.Add(-age)),
+		}
+	}
+
+	BeforeEach(func() {
+		now = time.Now()
+		fakeClock = fakeclock.NewFakeClock(now)
+
+		fakeClient = fakes.NewClient()
+		fakeClient.ContextReturns("bosh")
+		fakeClient.NamespaceReturns("bosh-namespace")
+		fakeClient.Clientset = *fake.NewSimpleClientset(
+			&v1.PodList{Items: []v1.Pod{
+				{ObjectMeta: objectMeta("agent-live", 2*time.Hour, map[string]string{"bosh.cloudfoundry.org/agent-id": "live"})},
+			}},
+			&v1.ConfigMapList{Items: []v1.ConfigMap{
+				{ObjectMeta: objectMeta("agent-live", 2*time.Hour, map[string]string{"bosh.cloudfoundry.org/agent-id": "live"})},
+				{ObjectMeta: objectMeta("agent-gone", 2*time.Hour, map[string]string{"bosh.cloudfoundry.org/agent-id": "gone"})},
+				{ObjectMeta: objectMeta("vm-new", time.Minute, map[string]string{"bosh.cloudfoundry.org/agent-id": "new"})},
+				{ObjectMeta: objectMeta("unrelated", 2*time.Hour, nil)},
+			}},
+			&v1.ServiceList{Items: []v1.Service{
+				{ObjectMeta: objectMeta("service-gone", 3*time.Hour, map[string]string{"bosh.cloudfoundry.org/agent-id": "gone"})},
+			}},
+			&v1.PersistentVolumeClaimList{Items: []v1.PersistentVolumeClaim{
+				{ObjectMeta: objectMeta("ephemeral-gone", 2*time.Hour, map[string]string{"bosh.cloudfoundry.org/agent-id": "gone"})},
+				{ObjectMeta: objectMeta("disk-attached", 2*time.Hour, map[string]string{
+					"bosh.cloudfoundry.org/agent-id": "gone",
+					"bosh.cloudfoundry.org/disk-id":  "attached",
+				})},
+				{ObjectMeta: objectMeta("disk-known", 2*time.Hour, map[string]string{"bosh.cloudfoundry.org/disk-id": "known"})},
+				{ObjectMeta: objectMeta("disk-unknown", 2*time.Hour, map[string]string{"bosh.cloudfoundry.org/disk-id": "unknown"})},
+			}},
+		)
+
+		fakeProvider = &fakes.ClientProvider{}
+		fakeProvider.NewReturns(fakeClient, nil)
+
+		cleaner = &actions.OrphanCleaner{
+			ClientProvider: fakeProvider,
+			Clock:          fakeClock,
+			MinAge:         time.Hour,
+		}
+	})
+
+	It("gets a client for each context", func() {
+		_, err := cleaner.Cleanup([]string{"bosh", "other"}, false)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(fakeProvider.NewCallCount()).To(Equal(2))
+		Expect(fakeProvider.NewArgsForCall(0)).To(Equal("bosh"))
+		Expect(fakeProvider.NewArgsForCall(1)).To(Equal("other"))
+	})
+
+	It("reports objects labelled for agents without a pod", func() {
+		orphans, err := cleaner.Cleanup([]string{"bosh"}, false)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(orphans).To(Equal([]actions.Orphan{
+			{Context: "bosh", Namespace: "bosh-namespace", Kind: "ConfigMap", Name: "agent-gone", AgentID: "gone", AgeSeconds: 7200},
+			{Context: "bosh", Namespace: "bosh-namespace", Kind: "ConfigMap", Name: "vm-new", AgentID: "new", AgeSeconds: 60},
+			{Context: "bosh", Namespace: "bosh-namespace", Kind: "PersistentVolumeClaim", Name: "ephemeral-gone", AgentID: "gone", AgeSeconds: 7200},
+			{Context: "bosh", Namespace: "bosh-namespace", Kind: "Service", Name: "service-gone", AgentID: "gone", AgeSeconds: 10800},
+		}))
+	})
+
+	It("does not delete anything on a dry run", func() {
+		_, err := cleaner.Cleanup([]string{"bosh"}, false)
+		Expect(err).NotTo(HaveOccurred())
+
+		for _, action := range fakeClient.Actions() {
+			Expect(action.GetVerb()).To(Or(Equal("list"), Equal("get")))
+		}
+	})
+
+	Context("when deleting the orphans", func() {
+		It("deletes the orphans older than the minimum age", func() {
+			orphans, err := cleaner.Cleanup([]string{"bosh"}, true)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(orphans).To(HaveLen(4))
+			Expect(orphans[0].Deleted).To(BeTrue())
+			Expect(orphans[1].Deleted).To(BeFalse())
+			Expect(orphans[2].Deleted).To(BeTrue())
+			Expect(orphans[3].Deleted).To(BeTrue())
+
+			matches := fakeClient.MatchingActions("delete", "configmaps")
+			Expect(matches).To(HaveLen(1))
+			Expect(matches[0].(testing.DeleteAction).GetName()).To(Equal("agent-gone"))
+
+			matches = fakeClient.MatchingActions("delete", "persistentvolumeclaims")
+			Expect(matches).To(HaveLen(1))
+			Expect(matches[0].(testing.DeleteAction).GetName()).To(Equal("ephemeral-gone"))
+
+			matches = fakeClient.MatchingActions("delete", "services")
+			Expect(matches).To(HaveLen(1))
+			Expect(matches[0].(testing.DeleteAction).GetName()).To(Equal("service-gone"))
+		})
+
+		Context("when a delete fails", func() {
+			BeforeEach(func() {
+				fakeClient.PrependReactor("delete", "services", func(action testing.Action) (bool, runtime.Object, error) {
+					return true, nil, errors.New("welp")
+				})
+			})
+
+			It("returns an error", func() {
+				_, err := cleaner.Cleanup([]string{"bosh"}, true)
+				Expect(err).To(MatchError("welp"))
+			})
+		})
+	})
+
+	Context("when the director disks are known", func() {
+		BeforeEach(func() {
+			cleaner.KnownDisks = []cpi.DiskCID{cpi.NewDiskCID("bosh", "bosh-namespace", "known")}
+		})
+
+		It("reports the claims of unknown disks", func() {
+			orphans, err := cleaner.Cleanup([]string{"bosh"}, false)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(orphans).To(ContainElement(actions.Orphan{
+				Context: "bosh", Namespace: "bosh-namespace", Kind: "PersistentVolumeClaim", Name: "disk-unknown", DiskID: "unknown", AgeSeconds: 7200,
+			}))
+			Expect(orphans).To(ContainElement(actions.Orphan{
+				Context: "bosh", Namespace: "bosh-namespace", Kind: "PersistentVolumeClaim", Name: "disk-attached", AgentID: "gone", DiskID: "attached", AgeSeconds: 7200,
+			}))
+			Expect(orphans).To(HaveLen(6))
+		})
+
+		It("deletes the claims of unknown disks", func() {
+			_, err := cleaner.Cleanup([]string{"bosh"}, true)
+			Expect(err).NotTo(HaveOccurred())
+
+			var deleted []string
+			for _, action := range fakeClient.MatchingActions("delete", "persistentvolumeclaims") {
+				deleted = append(deleted, action.(testing.DeleteAction).GetName())
+			}
+			Expect(deleted).To(ConsistOf("ephemeral-gone", "disk-attached", "disk-unknown"))
+		})
+	})
+
+	Context("when the director VMs are known", func() {
+		BeforeEach(func() {
+			cleaner.KnownVMs = []cpi.VMCID{cpi.NewVMCID("bosh", "bosh-namespace", "gone")}
+		})
+
+		It("does not report the objects of known VMs without a pod", func() {
+			orphans, err := cleaner.Cleanup([]string{"bosh"}, false)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(orphans).To(Equal([]actions.Orphan{
+				{Context: "bosh", Namespace: "bosh-namespace", Kind: "ConfigMap", Name: "vm-new", AgentID: "new", AgeSeconds: 60},
+			}))
+		})
+
+		Context("when a known VM CID is invalid", func() {
+			BeforeEach(func() {
+				cleaner.KnownVMs = []cpi.VMCID{cpi.VMCID("gone")}
+			})
+
+			It("returns an error", func() {
+				_, err := cleaner.Cleanup([]string{"bosh"}, true)
+				Expect(err).To(HaveOccurred())
+				Expect(fakeClient.MatchingActions("delete", "configmaps")).To(BeEmpty())
+			})
+		})
+	})
+
+	Context("when a namespace created for a deployment is empty", func() {
+		BeforeEach(func() {
+			cleaner.NamespacePolicies = map[string]config.NamespacePolicy{
+				"bosh": {DeploymentTemplate: "{{.Namespace}}-{{.Deployment}}"},
+			}
+
+			_, err := fakeClient.Core().Namespaces().Create(&v1.Namespace{
+				ObjectMeta: v1.ObjectMeta{
+					Name:              "bosh-deployment",
+					Labels:            map[string]string{"bosh.cloudfoundry.org/deployment": "deployment"},
+					CreationTimestamp: unversioned.NewTime(now.Add(-2 * time.Hour)),
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("reports the namespace", func() {
+			orphans, err := cleaner.Cleanup([]string{"bosh"}, false)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(orphans).To(ContainElement(actions.Orphan{
+				Context: "bosh", Namespace: "bosh-deployment", Kind: "Namespace", Name: "bosh-deployment", AgeSeconds: 7200,
+			}))
+		})
+
+		It("deletes the namespace", func() {
+			_, err := cleaner.Cleanup([]string{"bosh"}, true)
+			Expect(err).NotTo(HaveOccurred())
+
+			matches := fakeClient.MatchingActions("delete", "namespaces")
+			Expect(matches).To(HaveLen(1))
+			Expect(matches[0].(testing.DeleteAction).GetName()).To(Equal("bosh-deployment"))
+		})
+
+		Context("when pods remain in the namespace", func() {
+			BeforeEach(func() {
+				_, err := fakeClient.Core().Pods("bosh-deployment").Create(&v1.Pod{ObjectMeta: v1.ObjectMeta{Name: "agent-other", Namespace: "bosh-deployment"}})
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("keeps the namespace", func() {
+				_, err := cleaner.Cleanup([]string{"bosh"}, true)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeClient.MatchingActions("delete", "namespaces")).To(BeEmpty())
+			})
+		})
+
+		Context("when claims remain in the namespace", func() {
+			BeforeEach(func() {
+				_, err := fakeClient.Core().PersistentVolumeClaims("bosh-deployment").Create(&v1.PersistentVolumeClaim{ObjectMeta: v1.ObjectMeta{Name: "disk-id", Namespace: "bosh-deployment"}})
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("keeps the namespace", func() {
+				_, err := cleaner.Cleanup([]string{"bosh"}, true)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeClient.MatchingActions("delete", "namespaces")).To(BeEmpty())
+			})
+		})
+
+		Context("when a known VM is in the namespace", func() {
+			BeforeEach(func() {
+				cleaner.KnownVMs = []cpi.VMCID{cpi.NewVMCID("bosh", "bosh-deployment", "recreating")}
+			})
+
+			It("keeps the namespace", func() {
+				_, err := cleaner.Cleanup([]string{"bosh"}, true)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeClient.MatchingActions("delete", "namespaces")).To(BeEmpty())
+			})
+		})
+	})
+
+	Context("when the director UUID is set", func() {
+		BeforeEach(func() {
+			cleaner.DirectorUUID = "director-uuid"
+		})
+
+		It("only considers objects of the director", func() {
+			orphans, err := cleaner.Cleanup([]string{"bosh"}, false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(orphans).To(BeEmpty())
+
+			matches := fakeClient.MatchingActions("list", "configmaps")
+			Expect(matches).To(HaveLen(1))
+			Expect(matches[0].(testing.ListAction).GetListRestrictions().Labels.String()).To(Equal("bosh.cloudfoundry.org/agent-id,bosh.cloudfoundry.org/director-uuid=director-uuid"))
+		})
+	})
+
+	Context("when the client cannot be created", func() {
+		BeforeEach(func() {
+			fakeProvider.NewReturns(nil, errors.New("boom"))
+		})
+
+		It("returns an error", func() {
+			_, err := cleaner.Cleanup([]string{"bosh"}, false)
+			Expect(err).To(MatchError("boom"))
+		})
+	})
+
+	Context("when listing the pods fails", func() {
+		BeforeEach(func() {
+			fakeClient.PrependReactor("list", "pods", func(action testing.Action) (bool, runtime.Object, error) {
+				return true, nil, errors.New("welp")
+			})
+		})
+
+		It("returns an error", func() {
+			_, err := cleaner.Cleanup([]string{"bosh"}, false)
+			Expect(err).To(MatchError("welp"))
+		})
+	})
+
+	Context("when the RBAC API is not available", func() {
+		BeforeEach(func() {
+			fakeClient.PrependReactor("list", "rolebindings", func(action testing.Action) (bool, runtime.Object, error) {
+				gr := unversioned.GroupResource{Group: "rbac.authorization.k8s.io", Resource: "rolebindings"}
+				return true, nil, kubeerrors.NewForbidden(gr, "", errors.New("rbac-welp"))
+			})
+		})
+
+		It("reports the other orphans", func() {
+			orphans, err := cleaner.Cleanup([]string{"bosh"}, false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(orphans).To(HaveLen(4))
+		})
+	})
+})
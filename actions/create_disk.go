@@ -2,21 +2,38 @@ package actions
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/sykesm/kubernetes-cpi/cpi"
 	"github.com/sykesm/kubernetes-cpi/kubecluster"
 	"k8s.io/client-go/1.4/pkg/api/resource"
+	"k8s.io/client-go/1.4/pkg/api/unversioned"
 	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/util/validation"
+)
+
+const (
+	VolumeModeFilesystem = "Filesystem"
+	VolumeModeBlock      = "Block"
+
+	StorageClassAnnotation = "volume.beta.kubernetes.io/storage-class"
+	VolumeModeAnnotation   = "bosh.cloudfoundry.org/volume-mode"
 )
 
 type CreateDiskCloudProperties struct {
-	Context string `json:"context"`
+	Context      string            `json:"context"`
+	StorageClass string            `json:"storage_class,omitempty"`
+	AccessModes  []string          `json:"access_modes,omitempty"`
+	VolumeMode   string            `json:"volume_mode,omitempty"`
+	Selector     map[string]string `json:"selector,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
 }
 
 // DiskCreator simply creates a PersistentVolumeClaim. The attach process will
 // turn the claim into a volume mounted into the pod.
 type DiskCreator struct {
 	ClientProvider    kubecluster.ClientProvider
+	DirectorUUID      string
 	GUIDGeneratorFunc func() (string, error)
 }
 
@@ -31,21 +48,62 @@ func (d *DiskCreator) CreateDisk(size uint, cloudProps CreateDiskCloudProperties
 		return "", err
 	}
 
+	accessModes, err := getAccessModes(cloudProps.AccessModes)
+	if err != nil {
+		return "", err
+	}
+
+	annotations, err := getClaimAnnotations(cloudProps)
+	if err != nil {
+		return "", err
+	}
+
+	diskLabels, idAnnotations := idLabels(directorLabels(d.DirectorUUID, nil), "bosh.cloudfoundry.org/disk-id", diskID)
+	for k, v := range idAnnotations {
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[k] = v
+	}
+
 	client, err := d.ClientProvider.New(cloudProps.Context)
 	if err != nil {
 		return "", err
 	}
 
+	// create the disk next to the VM when the VM is in a deployment
+	// namespace of the context
+	if vmcid != "" {
+		cid, err := vmcid.Decode()
+		if err != nil {
+			return "", err
+		}
+		if cid.Context == client.Context() && cid.Namespace != "" && cid.Namespace != client.Namespace() {
+			client = client.WithNamespace(cid.Namespace)
+		}
+	}
+
+	// fail before creating the claim when it exceeds the quota
+	err = checkQuota(client.Core(), client.Namespace(), claimQuotaUsage(volumeSize, cloudProps.StorageClass))
+	if err != nil {
+		return "", err
+	}
+
+	var selector *unversioned.LabelSelector
+	if len(cloudProps.Selector) > 0 {
+		selector = &unversioned.LabelSelector{MatchLabels: cloudProps.Selector}
+	}
+
 	_, err = client.PersistentVolumeClaims().Create(&v1.PersistentVolumeClaim{
 		ObjectMeta: v1.ObjectMeta{
-			Name:      "disk-" + diskID,
-			Namespace: client.Namespace(),
-			Labels: map[string]string{
-				"bosh.cloudfoundry.org/disk-id": diskID,
-			},
+			Name:        diskName(diskID),
+			Namespace:   client.Namespace(),
+			Annotations: annotations,
+			Labels:      diskLabels,
 		},
 		Spec: v1.PersistentVolumeClaimSpec{
-			AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+			AccessModes: accessModes,
+			Selector:    selector,
 			Resources: v1.ResourceRequirements{
 				Requests: v1.ResourceList{
 					v1.ResourceStorage: volumeSize,
@@ -57,5 +115,58 @@ func (d *DiskCreator) CreateDisk(size uint, cloudProps CreateDiskCloudProperties
 		return "", err
 	}
 
-	return NewDiskCID(client.Context(), diskID), nil
+	return cpi.NewDiskCID(client.Context(), client.Namespace(), diskID), nil
+}
+
+func getAccessModes(modes []string) ([]v1.PersistentVolumeAccessMode, error) {
+	if len(modes) == 0 {
+		return []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce}, nil
+	}
+
+	accessModes := []v1.PersistentVolumeAccessMode{}
+	for _, mode := range modes {
+		switch v1.PersistentVolumeAccessMode(mode) {
+		case v1.ReadWriteOnce, v1.ReadOnlyMany, v1.ReadWriteMany:
+			accessModes = append(accessModes, v1.PersistentVolumeAccessMode(mode))
+		default:
+			return nil, fmt.Errorf("%s is not a supported access mode", mode)
+		}
+	}
+
+	return accessModes, nil
+}
+
+// getClaimAnnotations merges the annotations from the cloud properties with
+// the storage class and volume mode annotations. The storage class is
+// expressed as an annotation because the claim spec of this client API
+// version has no storage class field. Nil is returned when there are none.
+func getClaimAnnotations(cloudProps CreateDiskCloudProperties) (map[string]string, error) {
+	annotations := map[string]string{}
+	for k, v := range cloudProps.Annotations {
+		if errs := validation.IsQualifiedName(k); len(errs) != 0 {
+			return nil, fmt.Errorf("%s is not a valid annotation key: %s", k, strings.Join(errs, ", "))
+		}
+		annotations[k] = v
+	}
+
+	if cloudProps.StorageClass != "" {
+		annotations[StorageClassAnnotation] = cloudProps.StorageClass
+	}
+
+	switch cloudProps.VolumeMode {
+	case "":
+	case VolumeModeFilesystem:
+		annotations[VolumeModeAnnotation] = cloudProps.VolumeMode
+	case VolumeModeBlock:
+		// the claim spec and containers of this client API version cannot
+		// describe raw block volumes so the disk could never be attached
+		return nil, fmt.Errorf("%s volume mode is not supported by this Kubernetes client", cloudProps.VolumeMode)
+	default:
+		return nil, fmt.Errorf("%s is not a supported volume mode", cloudProps.VolumeMode)
+	}
+
+	if len(annotations) == 0 {
+		return nil, nil
+	}
+	return annotations, nil
 }
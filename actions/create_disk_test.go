@@ -3,7 +3,9 @@ package actions_test
 import (
 	"errors"
 
+	kubeerrors "k8s.io/client-go/1.4/pkg/api/errors"
 	"k8s.io/client-go/1.4/pkg/api/resource"
+	"k8s.io/client-go/1.4/pkg/api/unversioned"
 	"k8s.io/client-go/1.4/pkg/api/v1"
 	"k8s.io/client-go/1.4/pkg/runtime"
 	"k8s.io/client-go/1.4/testing"
@@ -34,7 +36,7 @@ var _ = Describe("CreateDisk", func() {
 		fakeProvider = &fakes.ClientProvider{}
 		fakeProvider.NewReturns(fakeClient, nil)
 
-		vmcid = actions.NewVMCID("bosh", "agent-id")
+		vmcid = cpi.NewVMCID("bosh", "bosh-namespace", "agent-id")
 		cloudProps = actions.CreateDiskCloudProperties{
 			Context: "bosh",
 		}
@@ -56,7 +58,7 @@ var _ = Describe("CreateDisk", func() {
 	It("creates a persistent volume claim", func() {
 		diskCID, err := diskCreator.CreateDisk(1000, cloudProps, vmcid)
 		Expect(err).NotTo(HaveOccurred())
-		Expect(diskCID).To(Equal(cpi.DiskCID("bosh:disk-guid")))
+		Expect(diskCID).To(Equal(cpi.NewDiskCID("bosh", "bosh-namespace", "disk-guid")))
 
 		matches := fakeClient.MatchingActions("create", "persistentvolumeclaims")
 		Expect(matches).To(HaveLen(1))
@@ -84,6 +86,193 @@ var _ = Describe("CreateDisk", func() {
 		}))
 	})
 
+	Context("when the director UUID is set", func() {
+		BeforeEach(func() {
+			diskCreator.DirectorUUID = "director-uuid"
+		})
+
+		It("labels the claim with the director UUID", func() {
+			_, err := diskCreator.CreateDisk(1000, cloudProps, vmcid)
+			Expect(err).NotTo(HaveOccurred())
+
+			pvc := fakeClient.MatchingActions("create", "persistentvolumeclaims")[0].(testing.CreateAction).GetObject().(*v1.PersistentVolumeClaim)
+			Expect(pvc.Labels).To(Equal(map[string]string{
+				"bosh.cloudfoundry.org/disk-id":       "disk-guid",
+				"bosh.cloudfoundry.org/director-uuid": "director-uuid",
+			}))
+		})
+	})
+
+	Context("when the VM is in a deployment namespace of the context", func() {
+		BeforeEach(func() {
+			vmcid = cpi.NewVMCID("bosh", "bosh-namespace-my-deployment", "agent-id")
+		})
+
+		It("creates the claim in the namespace of the VM", func() {
+			diskCID, err := diskCreator.CreateDisk(1000, cloudProps, vmcid)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(diskCID).To(Equal(cpi.NewDiskCID("bosh", "bosh-namespace-my-deployment", "disk-guid")))
+
+			matches := fakeClient.MatchingActions("create", "persistentvolumeclaims")
+			Expect(matches).To(HaveLen(1))
+			Expect(matches[0].(testing.CreateAction).GetNamespace()).To(Equal("bosh-namespace-my-deployment"))
+		})
+
+		Context("when the cloud properties use the default context", func() {
+			BeforeEach(func() {
+				cloudProps.Context = ""
+			})
+
+			It("creates the claim in the namespace of the VM", func() {
+				diskCID, err := diskCreator.CreateDisk(1000, cloudProps, vmcid)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(diskCID).To(Equal(cpi.NewDiskCID("bosh", "bosh-namespace-my-deployment", "disk-guid")))
+			})
+		})
+	})
+
+	Context("when the namespace has a resource quota", func() {
+		BeforeEach(func() {
+			_, err := fakeClient.Core().ResourceQuotas("bosh-namespace").Create(&v1.ResourceQuota{
+				ObjectMeta: v1.ObjectMeta{Name: "storage", Namespace: "bosh-namespace"},
+				Spec: v1.ResourceQuotaSpec{
+					Hard: v1.ResourceList{
+						v1.ResourceRequestsStorage:                                    resource.MustParse("10Gi"),
+						"fast-ssd.storageclass.storage.k8s.io/persistentvolumeclaims": resource.MustParse("2"),
+					},
+				},
+				Status: v1.ResourceQuotaStatus{
+					Used: v1.ResourceList{
+						v1.ResourceRequestsStorage:                                    resource.MustParse("9Gi"),
+						"fast-ssd.storageclass.storage.k8s.io/persistentvolumeclaims": resource.MustParse("2"),
+					},
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("creates the claim when it fits", func() {
+			_, err := diskCreator.CreateDisk(1000, cloudProps, vmcid)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeClient.MatchingActions("create", "persistentvolumeclaims")).To(HaveLen(1))
+		})
+
+		It("returns a QuotaExceededError when the claim does not fit", func() {
+			_, err := diskCreator.CreateDisk(2048, cloudProps, vmcid)
+			Expect(err).To(Equal(cpi.QuotaExceededError{
+				Namespace: "bosh-namespace",
+				Quota:     "storage",
+				Resource:  "requests.storage",
+				Requested: "2Gi",
+				Used:      "9Gi",
+				Hard:      "10Gi",
+			}))
+			Expect(fakeClient.MatchingActions("create", "persistentvolumeclaims")).To(BeEmpty())
+		})
+
+		It("checks the quota of the storage class of the claim", func() {
+			cloudProps.StorageClass = "fast-ssd"
+
+			_, err := diskCreator.CreateDisk(100, cloudProps, vmcid)
+			Expect(err).To(BeAssignableToTypeOf(cpi.QuotaExceededError{}))
+			Expect(err.(cpi.QuotaExceededError).Resource).To(Equal("fast-ssd.storageclass.storage.k8s.io/persistentvolumeclaims"))
+		})
+
+		Context("when the CPI may not list resource quotas", func() {
+			BeforeEach(func() {
+				fakeClient.PrependReactor("list", "resourcequotas", func(action testing.Action) (bool, runtime.Object, error) {
+					gr := unversioned.GroupResource{Group: "", Resource: "resourcequotas"}
+					return true, nil, kubeerrors.NewForbidden(gr, "", errors.New("quota-welp"))
+				})
+			})
+
+			It("creates the claim without a quota check", func() {
+				_, err := diskCreator.CreateDisk(2048, cloudProps, vmcid)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeClient.MatchingActions("create", "persistentvolumeclaims")).To(HaveLen(1))
+			})
+		})
+	})
+
+	Context("when claim properties are present in the cloud properties", func() {
+		BeforeEach(func() {
+			cloudProps = actions.CreateDiskCloudProperties{
+				Context:      "bosh",
+				StorageClass: "fast-ssd",
+				AccessModes:  []string{"ReadWriteOnce", "ReadOnlyMany"},
+				VolumeMode:   "Filesystem",
+				Selector:     map[string]string{"tier": "database"},
+				Annotations:  map[string]string{"example.com/owner": "data-team"},
+			}
+		})
+
+		It("applies them to the persistent volume claim", func() {
+			_, err := diskCreator.CreateDisk(1000, cloudProps, vmcid)
+			Expect(err).NotTo(HaveOccurred())
+
+			matches := fakeClient.MatchingActions("create", "persistentvolumeclaims")
+			Expect(matches).To(HaveLen(1))
+
+			pvc := matches[0].(testing.CreateAction).GetObject().(*v1.PersistentVolumeClaim)
+			Expect(pvc.Annotations).To(Equal(map[string]string{
+				"volume.beta.kubernetes.io/storage-class": "fast-ssd",
+				"bosh.cloudfoundry.org/volume-mode":       "Filesystem",
+				"example.com/owner":                       "data-team",
+			}))
+			Expect(pvc.Spec.AccessModes).To(Equal([]v1.PersistentVolumeAccessMode{v1.ReadWriteOnce, v1.ReadOnlyMany}))
+			Expect(pvc.Spec.Selector).To(Equal(&unversioned.LabelSelector{
+				MatchLabels: map[string]string{"tier": "database"},
+			}))
+		})
+	})
+
+	Context("when an unsupported access mode is requested", func() {
+		BeforeEach(func() {
+			cloudProps.AccessModes = []string{"ReadWriteSometimes"}
+		})
+
+		It("returns an error", func() {
+			_, err := diskCreator.CreateDisk(1000, cloudProps, vmcid)
+			Expect(err).To(MatchError("ReadWriteSometimes is not a supported access mode"))
+			Expect(fakeClient.MatchingActions("create", "persistentvolumeclaims")).To(BeEmpty())
+		})
+	})
+
+	Context("when an unsupported volume mode is requested", func() {
+		BeforeEach(func() {
+			cloudProps.VolumeMode = "Tape"
+		})
+
+		It("returns an error", func() {
+			_, err := diskCreator.CreateDisk(1000, cloudProps, vmcid)
+			Expect(err).To(MatchError("Tape is not a supported volume mode"))
+			Expect(fakeClient.MatchingActions("create", "persistentvolumeclaims")).To(BeEmpty())
+		})
+	})
+
+	Context("when the Block volume mode is requested", func() {
+		BeforeEach(func() {
+			cloudProps.VolumeMode = "Block"
+		})
+
+		It("returns an error", func() {
+			_, err := diskCreator.CreateDisk(1000, cloudProps, vmcid)
+			Expect(err).To(MatchError("Block volume mode is not supported by this Kubernetes client"))
+			Expect(fakeClient.MatchingActions("create", "persistentvolumeclaims")).To(BeEmpty())
+		})
+	})
+
+	Context("when an annotation key is invalid", func() {
+		BeforeEach(func() {
+			cloudProps.Annotations = map[string]string{"not a key": "value"}
+		})
+
+		It("returns an error", func() {
+			_, err := diskCreator.CreateDisk(1000, cloudProps, vmcid)
+			Expect(err).To(MatchError(HavePrefix("not a key is not a valid annotation key")))
+		})
+	})
+
 	Context("when getting the client fails", func() {
 		BeforeEach(func() {
 			fakeProvider.NewReturns(nil, errors.New("boom"))
@@ -1,9 +1,9 @@
 package actions
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/sykesm/kubernetes-cpi/agent"
 	"github.com/sykesm/kubernetes-cpi/config"
@@ -15,11 +15,20 @@ import (
 	"k8s.io/client-go/1.4/pkg/api/resource"
 	"k8s.io/client-go/1.4/pkg/api/unversioned"
 	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/util/validation"
 )
 
 type VMCreator struct {
 	AgentConfig    *config.Agent
 	ClientProvider kubecluster.ClientProvider
+	DirectorUUID   string
+
+	// PrivilegedContexts holds the contexts that permit privileged
+	// containers.
+	PrivilegedContexts map[string]bool
+
+	// NamespacePolicies holds the namespace policy of each context.
+	NamespacePolicies map[string]config.NamespacePolicy
 }
 
 type Service struct {
@@ -39,8 +48,14 @@ type Port struct {
 type ResourceName string
 
 const (
-	ResourceCPU    ResourceName = "cpu"
-	ResourceMemory ResourceName = "memory"
+	ResourceCPU              ResourceName = "cpu"
+	ResourceMemory           ResourceName = "memory"
+	ResourceStorage          ResourceName = "storage"
+	ResourceEphemeralStorage ResourceName = "ephemeral-storage"
+
+	// ResourceHugePagesPrefix is the prefix of huge page resources. The
+	// suffix is the page size, e.g. hugepages-2Mi.
+	ResourceHugePagesPrefix = "hugepages-"
 )
 
 type ResourceList map[ResourceName]string
@@ -51,9 +66,21 @@ type Resources struct {
 }
 
 type VMCloudProperties struct {
-	Context   string    `json:"context"`
-	Services  []Service `json:"services,omitempty"`
-	Resources Resources `json:"resources,omitempty"`
+	Context           string    `json:"context"`
+	Services          []Service `json:"services,omitempty"`
+	Resources         Resources `json:"resources,omitempty"`
+	EphemeralDiskSize uint      `json:"ephemeral_disk_size,omitempty"`
+
+	// PersistentEphemeralDisk backs /var/vcap/data with a claim that
+	// survives pod recreation and is deleted with the VM.
+	PersistentEphemeralDisk bool `json:"persistent_ephemeral_disk,omitempty"`
+
+	SecurityContext SecurityContext `json:"security_context,omitempty"`
+	ServiceAccount  *ServiceAccount `json:"service_account,omitempty"`
+
+	// ImagePullPolicy defaults to IfNotPresent for digest pinned stemcells
+	// and Always otherwise.
+	ImagePullPolicy string `json:"image_pull_policy,omitempty"`
 }
 
 func (v *VMCreator) Create(
@@ -65,20 +92,67 @@ func (v *VMCreator) Create(
 	env cpi.Environment,
 ) (cpi.VMCID, error) {
 
+	// names and labels are derived from the agent ID
+	if agentID == "" {
+		return "", errors.New("an agent ID is required")
+	}
+
 	// only one network is supported
 	network, err := getNetwork(networks)
 	if err != nil {
 		return "", err
 	}
 
+	pullPolicy, err := imagePullPolicy(cloudProps.ImagePullPolicy, stemcellCID)
+	if err != nil {
+		return "", err
+	}
+
 	// create the client set
-	client, err := v.ClientProvider.New(cloudProps.Context)
+	contextClient, err := v.ClientProvider.New(cloudProps.Context)
+	if err != nil {
+		return "", err
+	}
+
+	// the client resolves the default context to the current context
+	security, err := getContainerSecurity(contextClient.Context(), cloudProps.SecurityContext, v.PrivilegedContexts[contextClient.Context()])
+	if err != nil {
+		return "", err
+	}
+	security = withServiceAccount(security, agentID, cloudProps.ServiceAccount)
+
+	// stemcell pull secrets are created in the namespace of the context
+	contextNamespace := contextClient.Namespace()
+	contextSecrets := contextClient.Secrets()
+
+	// use the namespace of the deployment when the context has one per
+	// deployment
+	client, namespaceLabels, err := deploymentClient(contextClient, v.NamespacePolicies[contextClient.Context()], v.DirectorUUID, deploymentName(env))
 	if err != nil {
 		return "", err
 	}
 
 	// create the target namespace if it doesn't already exist
-	err = createNamespace(client.Core(), client.Namespace())
+	err = createNamespace(client.Core(), client.Namespace(), namespaceLabels)
+	if err != nil {
+		return "", err
+	}
+
+	// maintain the quota and limits of the namespace policy
+	err = ensureNamespacePolicy(client.Core(), client.Namespace(), v.NamespacePolicies[contextClient.Context()])
+	if err != nil {
+		return "", err
+	}
+
+	// size the ephemeral disk
+	ephemeralSize := ephemeralDiskSize(cloudProps, env)
+	resources := cloudProps.Resources
+	if !cloudProps.PersistentEphemeralDisk && ephemeralSize > 0 {
+		resources = withEphemeralStorage(resources, ephemeralSize)
+	}
+
+	// fail before creating anything when the VM exceeds the quota
+	err = checkVMQuota(client.Core(), client.Namespace(), resources, cloudProps.PersistentEphemeralDisk, ephemeralSize)
 	if err != nil {
 		return "", err
 	}
@@ -92,25 +166,84 @@ func (v *VMCreator) Create(
 		return "", err
 	}
 
-	// create the config map
-	_, err = createConfigMap(client.ConfigMaps(), ns, agentID, instanceSettings)
+	// label everything created for the VM with the owning director and
+	// make it owned by the VM anchor
+	agentLabels, agentAnnotations := idLabels(directorLabels(v.DirectorUUID, nil), "bosh.cloudfoundry.org/agent-id", agentID)
+	vm, err := createVMAnchor(client.ConfigMaps(), ns, agentID, vmMeta{labels: agentLabels, annotations: agentAnnotations})
+	if err != nil {
+		return "", err
+	}
+
+	// store the agent settings
+	settingsKind := SettingsKind(v.AgentConfig.SettingsKind)
+	err = createAgentSettings(client, settingsKind, ns, agentID, vm, instanceSettings)
 	if err != nil {
 		return "", err
 	}
 
 	// create the service
-	err = createServices(client.Services(), ns, agentID, cloudProps.Services)
+	err = createServices(client.Services(), ns, agentID, vm, cloudProps.Services)
 	if err != nil {
 		return "", err
 	}
 
+	// create the service account and its role bindings
+	err = createServiceAccount(client, ns, agentID, vm, cloudProps.ServiceAccount)
+	if err != nil {
+		return "", err
+	}
+
+	// create the claim backing the ephemeral disk if necessary
+	ephemeralSource := v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}}
+	if cloudProps.PersistentEphemeralDisk {
+		_, err = createEphemeralDiskClaim(client.PersistentVolumeClaims(), ns, agentID, vm, ephemeralSize)
+		if err != nil {
+			return "", err
+		}
+		ephemeralSource = v1.VolumeSource{
+			PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{
+				ClaimName: ephemeralName(agentID),
+			},
+		}
+	}
+
+	// use the pull secret created with the stemcell
+	pullSecrets, err := getStemcellPullSecrets(contextSecrets, stemcellCID)
+	if err != nil {
+		return "", err
+	}
+	if len(pullSecrets) != 0 && client.Namespace() != contextNamespace {
+		err = copyStemcellPullSecret(contextSecrets, client.Secrets(), client.Namespace(), stemcellCID)
+		if err != nil {
+			return "", err
+		}
+	}
+	security.ImagePullSecrets = pullSecrets
+
 	// create the pod
-	_, err = createPod(client.Pods(), ns, agentID, string(stemcellCID), *network, cloudProps.Resources)
+	_, err = createPod(client.Pods(), ns, agentID, vm, string(stemcellCID), pullPolicy, *network, resources, settingsKind, ephemeralSource, security)
 	if err != nil {
 		return "", err
 	}
 
-	return NewVMCID(client.Context(), agentID), nil
+	return cpi.NewVMCID(client.Context(), client.Namespace(), agentID), nil
+}
+
+// imagePullPolicy returns the configured pull policy or, by default,
+// IfNotPresent for images pinned to a digest and Always for tags, which may
+// move.
+func imagePullPolicy(policy string, stemcellCID cpi.StemcellCID) (v1.PullPolicy, error) {
+	switch v1.PullPolicy(policy) {
+	case v1.PullAlways, v1.PullIfNotPresent, v1.PullNever:
+		return v1.PullPolicy(policy), nil
+	case "":
+		if strings.Contains(string(stemcellCID), "@sha256:") {
+			return v1.PullIfNotPresent, nil
+		}
+		return v1.PullAlways, nil
+	default:
+		return "", fmt.Errorf("%s is not a supported image pull policy", policy)
+	}
 }
 
 func getNetwork(networks cpi.Networks) (*cpi.Network, error) {
@@ -154,14 +287,17 @@ func (v *VMCreator) InstanceSettings(agentID string, networks cpi.Networks, env
 	return settings, nil
 }
 
-func createNamespace(coreClient core.CoreInterface, namespace string) error {
-	_, err := coreClient.Namespaces().Get(namespace)
+func createNamespace(coreClient core.CoreInterface, namespace string, labels map[string]string) error {
+	existing, err := coreClient.Namespaces().Get(namespace)
 	if err == nil {
+		if existing.Status.Phase == v1.NamespaceTerminating {
+			return fmt.Errorf("Namespace %q is being deleted; retry once it is gone", namespace)
+		}
 		return nil
 	}
 
 	_, err = coreClient.Namespaces().Create(&v1.Namespace{
-		ObjectMeta: v1.ObjectMeta{Name: namespace},
+		ObjectMeta: v1.ObjectMeta{Name: namespace, Labels: labels},
 	})
 	if err == nil {
 		return nil
@@ -175,27 +311,7 @@ func createNamespace(coreClient core.CoreInterface, namespace string) error {
 	return err
 }
 
-func createConfigMap(configMapService core.ConfigMapInterface, ns, agentID string, instanceSettings *agent.Settings) (*v1.ConfigMap, error) {
-	instanceJSON, err := json.Marshal(instanceSettings)
-	if err != nil {
-		return nil, err
-	}
-
-	return configMapService.Create(&v1.ConfigMap{
-		ObjectMeta: v1.ObjectMeta{
-			Name:      "agent-" + agentID,
-			Namespace: ns,
-			Labels: map[string]string{
-				"bosh.cloudfoundry.org/agent-id": agentID,
-			},
-		},
-		Data: map[string]string{
-			"instance_settings": string(instanceJSON),
-		},
-	})
-}
-
-func createServices(serviceClient core.ServiceInterface, ns, agentID string, services []Service) error {
+func createServices(serviceClient core.ServiceInterface, ns, agentID string, vm vmMeta, services []Service) error {
 	for _, svc := range services {
 		serviceType := v1.ServiceTypeClusterIP
 		if svc.Type == "NodePort" {
@@ -214,19 +330,13 @@ func createServices(serviceClient core.ServiceInterface, ns, agentID string, ser
 		}
 
 		service := &v1.Service{
-			ObjectMeta: v1.ObjectMeta{
-				Name:      svc.Name,
-				Namespace: ns,
-				Labels: map[string]string{
-					"bosh.cloudfoundry.org/agent-id": agentID,
-				},
-			},
+			ObjectMeta: vm.objectMeta(svc.Name, ns),
 			Spec: v1.ServiceSpec{
 				Type:      serviceType,
 				ClusterIP: svc.ClusterIP,
 				Ports:     ports,
 				Selector: map[string]string{
-					"bosh.cloudfoundry.org/agent-id": agentID,
+					"bosh.cloudfoundry.org/agent-id": labelValue(agentID),
 				},
 			},
 		}
@@ -240,11 +350,109 @@ func createServices(serviceClient core.ServiceInterface, ns, agentID string, ser
 	return nil
 }
 
-func createPod(podClient core.PodInterface, ns, agentID, image string, network cpi.Network, resources Resources) (*v1.Pod, error) {
-	trueValue := true
-	rootUID := int64(0)
+// ephemeralDiskSize returns the ephemeral disk size in MiB from the cloud
+// properties or, when absent there, from the bosh section of the environment.
+func ephemeralDiskSize(cloudProps VMCloudProperties, env cpi.Environment) uint {
+	if cloudProps.EphemeralDiskSize > 0 {
+		return cloudProps.EphemeralDiskSize
+	}
+
+	boshEnv, ok := env["bosh"].(map[string]interface{})
+	if !ok {
+		return 0
+	}
+
+	// numbers in the environment have been decoded from JSON
+	if size, ok := boshEnv["ephemeral_disk_size"].(float64); ok && size > 0 {
+		return uint(size)
+	}
+	return 0
+}
+
+// withEphemeralStorage returns a copy of the resources with an
+// ephemeral-storage request and limit of the ephemeral disk size. The client
+// API does not expose an EmptyDir size limit so the container's ephemeral
+// storage is used to bound /var/vcap/data. Explicitly configured values win
+// and the derived limit and request are adjusted so the request never exceeds
+// the limit.
+func withEphemeralStorage(resources Resources, size uint) Resources {
+	quantity := fmt.Sprintf("%dMi", size)
+	result := Resources{
+		Limits:   ResourceList{ResourceEphemeralStorage: quantity},
+		Requests: ResourceList{ResourceEphemeralStorage: quantity},
+	}
+	for k, v := range resources.Limits {
+		result.Limits[k] = v
+	}
+	for k, v := range resources.Requests {
+		result.Requests[k] = v
+	}
+
+	diskSize := resource.MustParse(quantity)
+	if request, ok := configuredQuantity(resources.Requests, ResourceEphemeralStorage); ok && !hasResource(resources.Limits, ResourceEphemeralStorage) {
+		if request.Cmp(diskSize) > 0 {
+			result.Limits[ResourceEphemeralStorage] = resources.Requests[ResourceEphemeralStorage]
+		}
+	}
+	if limit, ok := configuredQuantity(resources.Limits, ResourceEphemeralStorage); ok && !hasResource(resources.Requests, ResourceEphemeralStorage) {
+		if limit.Cmp(diskSize) < 0 {
+			result.Requests[ResourceEphemeralStorage] = resources.Limits[ResourceEphemeralStorage]
+		}
+	}
+
+	return result
+}
+
+func hasResource(resourceList ResourceList, name ResourceName) bool {
+	_, ok := resourceList[name]
+	return ok
+}
+
+// configuredQuantity parses a configured resource. Invalid quantities are
+// reported when the pod resources are built.
+func configuredQuantity(resourceList ResourceList, name ResourceName) (resource.Quantity, bool) {
+	value, ok := resourceList[name]
+	if !ok {
+		return resource.Quantity{}, false
+	}
+	quantity, err := resource.ParseQuantity(value)
+	if err != nil {
+		return resource.Quantity{}, false
+	}
+	return quantity, true
+}
 
+func createEphemeralDiskClaim(pvcClient core.PersistentVolumeClaimInterface, ns, agentID string, vm vmMeta, size uint) (*v1.PersistentVolumeClaim, error) {
+	if size == 0 {
+		return nil, errors.New("an ephemeral disk size is required for a persistent ephemeral disk")
+	}
+
+	volumeSize, err := resource.ParseQuantity(fmt.Sprintf("%dMi", size))
+	if err != nil {
+		return nil, err
+	}
+
+	return pvcClient.Create(&v1.PersistentVolumeClaim{
+		ObjectMeta: vm.objectMeta(ephemeralName(agentID), ns),
+		Spec: v1.PersistentVolumeClaimSpec{
+			AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+			Resources: v1.ResourceRequirements{
+				Requests: v1.ResourceList{
+					v1.ResourceStorage: volumeSize,
+				},
+			},
+		},
+	})
+}
+
+func createPod(podClient core.PodInterface, ns, agentID string, vm vmMeta, image string, pullPolicy v1.PullPolicy, network cpi.Network, resources Resources, settingsKind SettingsKind, ephemeralSource v1.VolumeSource, security containerSecurity) (*v1.Pod, error) {
 	annotations := map[string]string{}
+	for k, v := range vm.annotations {
+		annotations[k] = v
+	}
+	for k, v := range security.Annotations {
+		annotations[k] = v
+	}
 	if len(network.IP) > 0 {
 		annotations["bosh.cloudfoundry.org/ip-address"] = network.IP
 	}
@@ -254,56 +462,39 @@ func createPod(podClient core.PodInterface, ns, agentID, image string, network c
 		return nil, err
 	}
 
+	meta := vm.objectMeta(agentName(agentID), ns)
+	meta.Annotations = annotations
+
 	return podClient.Create(&v1.Pod{
-		ObjectMeta: v1.ObjectMeta{
-			Name:        "agent-" + agentID,
-			Namespace:   ns,
-			Annotations: annotations,
-			Labels: map[string]string{
-				"bosh.cloudfoundry.org/agent-id": agentID,
-			},
-		},
+		ObjectMeta: meta,
 		Spec: v1.PodSpec{
-			Hostname: agentID,
+			Hostname:           hostname(agentID),
+			ServiceAccountName: security.ServiceAccountName,
+			ImagePullSecrets:   security.ImagePullSecrets,
 			Containers: []v1.Container{{
 				Name:            "bosh-job",
 				Image:           image,
-				ImagePullPolicy: v1.PullAlways,
+				ImagePullPolicy: pullPolicy,
 				Command:         []string{"/usr/sbin/runsvdir-start"},
 				Args:            []string{},
 				Resources:       resourceReqs,
-				SecurityContext: &v1.SecurityContext{
-					Privileged: &trueValue,
-					RunAsUser:  &rootUID,
-				},
-				VolumeMounts: []v1.VolumeMount{{
+				SecurityContext: security.SecurityContext,
+				VolumeMounts: append([]v1.VolumeMount{{
 					Name:      "bosh-config",
 					MountPath: "/var/vcap/bosh/instance_settings.json",
 					SubPath:   "instance_settings.json",
 				}, {
 					Name:      "bosh-ephemeral",
 					MountPath: "/var/vcap/data",
-				}},
+				}}, security.VolumeMounts...),
 			}},
-			Volumes: []v1.Volume{{
-				Name: "bosh-config",
-				VolumeSource: v1.VolumeSource{
-					ConfigMap: &v1.ConfigMapVolumeSource{
-						LocalObjectReference: v1.LocalObjectReference{
-							Name: "agent-" + agentID,
-						},
-						Items: []v1.KeyToPath{{
-							Key:  "instance_settings",
-							Path: "instance_settings.json",
-						}},
-					},
-				},
+			Volumes: append([]v1.Volume{{
+				Name:         "bosh-config",
+				VolumeSource: agentSettingsVolumeSource(settingsKind, agentID),
 			}, {
-				Name: "bosh-ephemeral",
-				VolumeSource: v1.VolumeSource{
-					EmptyDir: &v1.EmptyDirVolumeSource{},
-				},
-			}},
+				Name:         "bosh-ephemeral",
+				VolumeSource: ephemeralSource,
+			}}, security.Volumes...),
 		},
 	})
 }
@@ -319,6 +510,16 @@ func getPodResourceRequirements(resources Resources) (v1.ResourceRequirements, e
 		return v1.ResourceRequirements{}, err
 	}
 
+	for name, request := range requests {
+		limit, ok := limits[name]
+		if !ok {
+			continue
+		}
+		if request.Cmp(limit) > 0 {
+			return v1.ResourceRequirements{}, fmt.Errorf("%s request %s exceeds limit %s", name, request.String(), limit.String())
+		}
+	}
+
 	return v1.ResourceRequirements{Limits: limits, Requests: requests}, nil
 }
 
@@ -334,23 +535,58 @@ func getResourceList(resourceList ResourceList) (v1.ResourceList, error) {
 			return nil, err
 		}
 
+		if quantity.Sign() < 0 {
+			return nil, fmt.Errorf("%s quantity %s must not be negative", k, v)
+		}
+
 		name, err := kubeResourceName(k)
 		if err != nil {
 			return nil, err
 		}
+
+		if isExtendedResourceName(name) && quantity.MilliValue()%1000 != 0 {
+			return nil, fmt.Errorf("%s quantity %s must be a whole number", k, v)
+		}
+
 		list[name] = quantity
 	}
 
 	return list, nil
 }
 
+// kubeResourceName maps a cloud property resource name to a Kubernetes
+// resource name. The standard compute resources, huge pages of a valid size,
+// and domain qualified extended resources (e.g. nvidia.com/gpu) are accepted.
 func kubeResourceName(name ResourceName) (v1.ResourceName, error) {
 	switch name {
-	case ResourceMemory:
-		return v1.ResourceMemory, nil
-	case ResourceCPU:
-		return v1.ResourceCPU, nil
-	default:
-		return "", fmt.Errorf("%s is not a supported resource type", name)
+	case ResourceCPU, ResourceMemory, ResourceStorage, ResourceEphemeralStorage:
+		return v1.ResourceName(name), nil
+	}
+
+	if strings.HasPrefix(string(name), ResourceHugePagesPrefix) {
+		pageSize, err := resource.ParseQuantity(strings.TrimPrefix(string(name), ResourceHugePagesPrefix))
+		if err != nil || pageSize.Sign() <= 0 {
+			return "", fmt.Errorf("%s is not a valid huge page resource", name)
+		}
+		return v1.ResourceName(name), nil
+	}
+
+	if isExtendedResourceName(v1.ResourceName(name)) {
+		if errs := validation.IsQualifiedName(string(name)); len(errs) != 0 {
+			return "", fmt.Errorf("%s is not a valid resource name: %s", name, strings.Join(errs, ", "))
+		}
+		return v1.ResourceName(name), nil
+	}
+
+	return "", fmt.Errorf("%s is not a supported resource type", name)
+}
+
+// isExtendedResourceName returns true for resources that are qualified with a
+// domain outside of kubernetes.io.
+func isExtendedResourceName(name v1.ResourceName) bool {
+	parts := strings.SplitN(string(name), "/", 2)
+	if len(parts) != 2 {
+		return false
 	}
+	return parts[0] != "kubernetes.io" && !strings.HasSuffix(parts[0], ".kubernetes.io")
 }
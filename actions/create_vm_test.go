@@ -3,12 +3,17 @@ package actions_test
 import (
 	"encoding/json"
 	"errors"
+	"strings"
 
 	kubeerrors "k8s.io/client-go/1.4/pkg/api/errors"
+	"k8s.io/client-go/1.4/pkg/api/meta"
+	"k8s.io/client-go/1.4/pkg/api/meta/metatypes"
 	"k8s.io/client-go/1.4/pkg/api/resource"
 	"k8s.io/client-go/1.4/pkg/api/unversioned"
 	"k8s.io/client-go/1.4/pkg/api/v1"
+	rbac "k8s.io/client-go/1.4/pkg/apis/rbac/v1alpha1"
 	"k8s.io/client-go/1.4/pkg/runtime"
+	"k8s.io/client-go/1.4/pkg/types"
 	"k8s.io/client-go/1.4/testing"
 
 	"github.com/sykesm/kubernetes-cpi/actions"
@@ -49,8 +54,9 @@ var _ = Describe("CreateVM", func() {
 		}
 
 		vmCreator = &actions.VMCreator{
-			ClientProvider: fakeProvider,
-			AgentConfig:    agentConf,
+			ClientProvider:     fakeProvider,
+			AgentConfig:        agentConf,
+			PrivilegedContexts: map[string]bool{"bosh": true},
 		}
 
 		agentID = "agent-id"
@@ -82,7 +88,138 @@ var _ = Describe("CreateVM", func() {
 		It("returns a VM Cloud ID", func() {
 			vmcid, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
 			Expect(err).NotTo(HaveOccurred())
-			Expect(vmcid).To(Equal(actions.NewVMCID("bosh", agentID)))
+			Expect(vmcid).To(Equal(cpi.NewVMCID("bosh", "bosh-namespace", agentID)))
+		})
+
+		Context("when the director UUID is set", func() {
+			BeforeEach(func() {
+				vmCreator.DirectorUUID = "director-uuid"
+				cloudProps.Services = []actions.Service{{Name: "service-name"}}
+				cloudProps.ServiceAccount = &actions.ServiceAccount{Roles: []string{"role"}}
+				cloudProps.PersistentEphemeralDisk = true
+				cloudProps.EphemeralDiskSize = 1024
+			})
+
+			It("labels every object created for the VM with it", func() {
+				_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+				Expect(err).NotTo(HaveOccurred())
+
+				expectedLabels := map[string]string{
+					"bosh.cloudfoundry.org/agent-id":      agentID,
+					"bosh.cloudfoundry.org/director-uuid": "director-uuid",
+				}
+				for _, resource := range []string{"pods", "services", "configmaps", "serviceaccounts", "rolebindings", "persistentvolumeclaims"} {
+					matches := fakeClient.MatchingActions("create", resource)
+					Expect(matches).NotTo(BeEmpty(), resource)
+
+					for _, match := range matches {
+						object, err := meta.Accessor(match.(testing.CreateAction).GetObject())
+						Expect(err).NotTo(HaveOccurred())
+						Expect(object.GetLabels()).To(Equal(expectedLabels), resource)
+					}
+				}
+			})
+		})
+
+		Context("when the VM has services, a service account, and an ephemeral disk claim", func() {
+			BeforeEach(func() {
+				fakeClient.PrependReactor("create", "configmaps", func(action testing.Action) (bool, runtime.Object, error) {
+					configMap := action.(testing.CreateAction).GetObject().(*v1.ConfigMap)
+					configMap.UID = types.UID("anchor-uid")
+					return false, nil, nil
+				})
+				cloudProps.Services = []actions.Service{{Name: "service-name"}}
+				cloudProps.ServiceAccount = &actions.ServiceAccount{Roles: []string{"role"}}
+				cloudProps.PersistentEphemeralDisk = true
+				cloudProps.EphemeralDiskSize = 1024
+			})
+
+			It("creates an anchor that owns every object of the VM", func() {
+				_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+				Expect(err).NotTo(HaveOccurred())
+
+				anchor := fakeClient.MatchingActions("create", "configmaps")[0].(testing.CreateAction).GetObject().(*v1.ConfigMap)
+				Expect(anchor.Name).To(Equal("vm-" + agentID))
+				Expect(anchor.Namespace).To(Equal("bosh-namespace"))
+				Expect(anchor.Labels).To(Equal(map[string]string{"bosh.cloudfoundry.org/agent-id": agentID}))
+				Expect(anchor.OwnerReferences).To(BeEmpty())
+
+				expectedOwners := []metatypes.OwnerReference{{
+					APIVersion: "v1",
+					Kind:       "ConfigMap",
+					Name:       "vm-" + agentID,
+					UID:        types.UID("anchor-uid"),
+				}}
+				for _, resource := range []string{"pods", "services", "configmaps", "serviceaccounts", "rolebindings", "persistentvolumeclaims"} {
+					matches := fakeClient.MatchingActions("create", resource)
+					Expect(matches).NotTo(BeEmpty(), resource)
+
+					object, err := meta.Accessor(matches[len(matches)-1].(testing.CreateAction).GetObject())
+					Expect(err).NotTo(HaveOccurred())
+					Expect(object.GetOwnerReferences()).To(Equal(expectedOwners), resource)
+				}
+			})
+		})
+
+		Context("when the agent ID is not a valid name", func() {
+			BeforeEach(func() {
+				agentID = "Agent_" + strings.Repeat("x", 70)
+				cloudProps.Services = []actions.Service{{Name: "service-name"}}
+				cloudProps.ServiceAccount = &actions.ServiceAccount{Roles: []string{"role"}}
+				cloudProps.PersistentEphemeralDisk = true
+				cloudProps.EphemeralDiskSize = 1024
+			})
+
+			It("shortens the names and labels and records the agent ID in annotations", func() {
+				vmcid, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+				Expect(err).NotTo(HaveOccurred())
+
+				cid, err := vmcid.Decode()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(cid.ID).To(Equal(agentID))
+
+				for _, resource := range []string{"pods", "configmaps", "serviceaccounts", "rolebindings", "persistentvolumeclaims"} {
+					for _, match := range fakeClient.MatchingActions("create", resource) {
+						object, err := meta.Accessor(match.(testing.CreateAction).GetObject())
+						Expect(err).NotTo(HaveOccurred())
+						Expect(object.GetName()).To(MatchRegexp(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`), resource)
+						Expect(len(object.GetName())).To(BeNumerically("<=", 63), resource)
+
+						Expect(len(object.GetLabels()["bosh.cloudfoundry.org/agent-id"])).To(BeNumerically("<=", 63), resource)
+						Expect(object.GetAnnotations()).To(HaveKeyWithValue("bosh.cloudfoundry.org/agent-id", agentID), resource)
+					}
+				}
+
+				pod := fakeClient.MatchingActions("create", "pods")[0].(testing.CreateAction).GetObject().(*v1.Pod)
+				Expect(pod.Name).To(HavePrefix("agent-agent-xxx"))
+				Expect(len(pod.Spec.Hostname)).To(BeNumerically("<=", 63))
+
+				service := fakeClient.MatchingActions("create", "services")[0].(testing.CreateAction).GetObject().(*v1.Service)
+				Expect(service.Spec.Selector).To(Equal(map[string]string{
+					"bosh.cloudfoundry.org/agent-id": pod.Labels["bosh.cloudfoundry.org/agent-id"],
+				}))
+			})
+
+			It("derives the same names for the same agent ID", func() {
+				_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+				Expect(err).NotTo(HaveOccurred())
+
+				pod := fakeClient.MatchingActions("create", "pods")[0].(testing.CreateAction).GetObject().(*v1.Pod)
+
+				finder := &actions.VMFinder{ClientProvider: fakeProvider}
+				_, found, err := finder.FindVM(cpi.NewVMCID("bosh", "bosh-namespace", agentID))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(found).NotTo(BeNil())
+				Expect(found.Name).To(Equal(pod.Name))
+			})
+		})
+
+		Context("when the agent ID is empty", func() {
+			It("returns an error before creating anything", func() {
+				_, err := vmCreator.Create("", stemcellCID, cloudProps, networks, diskCIDs, env)
+				Expect(err).To(MatchError("an agent ID is required"))
+				Expect(fakeClient.Actions()).To(BeEmpty())
+			})
 		})
 
 		It("gets a client with the context from the cloud properties", func() {
@@ -115,6 +252,115 @@ var _ = Describe("CreateVM", func() {
 			Expect(namespace.Name).To(Equal("bosh-namespace"))
 		})
 
+		Context("when the context has a namespace per deployment", func() {
+			BeforeEach(func() {
+				vmCreator.DirectorUUID = "director-uuid"
+				vmCreator.NamespacePolicies = map[string]config.NamespacePolicy{
+					"bosh": {
+						DeploymentTemplate: "{{.Namespace}}-{{.Deployment}}",
+						Labels:             map[string]string{"team": "bosh"},
+					},
+				}
+				env = cpi.Environment{
+					"bosh": map[string]interface{}{
+						"groups": []interface{}{"director", "my-deployment", "instance-group"},
+					},
+				}
+			})
+
+			It("creates the VM in the namespace of the deployment", func() {
+				vmcid, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(vmcid).To(Equal(cpi.NewVMCID("bosh", "bosh-namespace-my-deployment", agentID)))
+
+				pod := fakeClient.MatchingActions("create", "pods")[0].(testing.CreateAction).GetObject().(*v1.Pod)
+				Expect(pod.Namespace).To(Equal("bosh-namespace-my-deployment"))
+			})
+
+			Context("when the cloud properties use the default context", func() {
+				BeforeEach(func() {
+					cloudProps.Context = ""
+				})
+
+				It("applies the policy of the context the client resolved", func() {
+					vmcid, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(vmcid).To(Equal(cpi.NewVMCID("bosh", "bosh-namespace-my-deployment", agentID)))
+				})
+			})
+
+			It("labels the namespace", func() {
+				_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+				Expect(err).NotTo(HaveOccurred())
+
+				matches := fakeClient.MatchingActions("create", "namespaces")
+				Expect(matches).To(HaveLen(1))
+
+				namespace := matches[0].(testing.CreateAction).GetObject().(*v1.Namespace)
+				Expect(namespace.Name).To(Equal("bosh-namespace-my-deployment"))
+				Expect(namespace.Labels).To(Equal(map[string]string{
+					"team":                                "bosh",
+					"bosh.cloudfoundry.org/deployment":    "my-deployment",
+					"bosh.cloudfoundry.org/director-uuid": "director-uuid",
+				}))
+			})
+
+			Context("when the stemcell has a pull secret", func() {
+				BeforeEach(func() {
+					stemcellManager := &actions.StemcellManager{
+						ClientProvider: fakeProvider,
+						Contexts:       []string{"bosh"},
+					}
+					_, err := stemcellManager.CreateStemcell("/ignored/path", actions.StemcellCloudProperties{
+						Image:       string(stemcellCID),
+						Credentials: &actions.RegistryCredentials{Server: "registry.example.com"},
+					})
+					Expect(err).NotTo(HaveOccurred())
+				})
+
+				It("copies the pull secret into the namespace of the deployment", func() {
+					_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+					Expect(err).NotTo(HaveOccurred())
+
+					matches := fakeClient.MatchingActions("create", "secrets")
+					Expect(matches).To(HaveLen(2))
+
+					original := matches[0].(testing.CreateAction).GetObject().(*v1.Secret)
+					copied := matches[1].(testing.CreateAction).GetObject().(*v1.Secret)
+					Expect(copied.Name).To(Equal(original.Name))
+					Expect(copied.Namespace).To(Equal("bosh-namespace-my-deployment"))
+					Expect(copied.Data).To(Equal(original.Data))
+				})
+			})
+
+			Context("when the environment does not name the deployment", func() {
+				BeforeEach(func() {
+					env = cpi.Environment{}
+				})
+
+				It("uses the namespace of the context", func() {
+					vmcid, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(vmcid).To(Equal(cpi.NewVMCID("bosh", "bosh-namespace", agentID)))
+
+					namespace := fakeClient.MatchingActions("create", "namespaces")[0].(testing.CreateAction).GetObject().(*v1.Namespace)
+					Expect(namespace.Labels).To(Equal(map[string]string{"team": "bosh"}))
+				})
+			})
+
+			Context("when the template is invalid", func() {
+				BeforeEach(func() {
+					vmCreator.NamespacePolicies["bosh"] = config.NamespacePolicy{DeploymentTemplate: "{{.Missing"}
+				})
+
+				It("returns an error before creating anything", func() {
+					_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+					Expect(err).To(HaveOccurred())
+					Expect(fakeClient.MatchingActions("create", "namespaces")).To(BeEmpty())
+				})
+			})
+		})
+
 		Context("when the namespace already exists", func() {
 			BeforeEach(func() {
 				fakeClient = fakes.NewClient(
@@ -132,6 +378,22 @@ var _ = Describe("CreateVM", func() {
 				Expect(fakeClient.MatchingActions("get", "namespaces")).To(HaveLen(1))
 				Expect(fakeClient.MatchingActions("create", "namespaces")).To(HaveLen(0))
 			})
+
+			Context("when the namespace is being deleted", func() {
+				BeforeEach(func() {
+					namespace, err := fakeClient.Core().Namespaces().Get("bosh-namespace")
+					Expect(err).NotTo(HaveOccurred())
+					namespace.Status.Phase = v1.NamespaceTerminating
+					_, err = fakeClient.Core().Namespaces().Update(namespace)
+					Expect(err).NotTo(HaveOccurred())
+				})
+
+				It("returns an error before creating anything else", func() {
+					_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+					Expect(err).To(MatchError(`Namespace "bosh-namespace" is being deleted; retry once it is gone`))
+					Expect(fakeClient.MatchingActions("create", "pods")).To(BeEmpty())
+				})
+			})
 		})
 
 		Context("when the namespace create fails with StatusReasonAlreadyExists", func() {
@@ -165,6 +427,293 @@ var _ = Describe("CreateVM", func() {
 			})
 		})
 
+		Context("when the namespace policy declares a quota and limit range", func() {
+			BeforeEach(func() {
+				vmCreator.NamespacePolicies = map[string]config.NamespacePolicy{
+					"bosh": {
+						ResourceQuota: map[string]string{"pods": "20", "requests.storage": "100Gi"},
+						LimitRange: &config.LimitRange{
+							Default:        map[string]string{"cpu": "1", "memory": "1Gi"},
+							DefaultRequest: map[string]string{"cpu": "500m"},
+						},
+					},
+				}
+			})
+
+			It("creates them in the namespace", func() {
+				_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+				Expect(err).NotTo(HaveOccurred())
+
+				matches := fakeClient.MatchingActions("create", "resourcequotas")
+				Expect(matches).To(HaveLen(1))
+				quota := matches[0].(testing.CreateAction).GetObject().(*v1.ResourceQuota)
+				Expect(quota.Name).To(Equal("bosh-cpi"))
+				Expect(quota.Namespace).To(Equal("bosh-namespace"))
+				Expect(quota.Spec.Hard).To(Equal(v1.ResourceList{
+					v1.ResourcePods:            resource.MustParse("20"),
+					v1.ResourceRequestsStorage: resource.MustParse("100Gi"),
+				}))
+
+				matches = fakeClient.MatchingActions("create", "limitranges")
+				Expect(matches).To(HaveLen(1))
+				limitRange := matches[0].(testing.CreateAction).GetObject().(*v1.LimitRange)
+				Expect(limitRange.Name).To(Equal("bosh-cpi"))
+				Expect(limitRange.Namespace).To(Equal("bosh-namespace"))
+				Expect(limitRange.Spec.Limits).To(Equal([]v1.LimitRangeItem{{
+					Type: v1.LimitTypeContainer,
+					Default: v1.ResourceList{
+						v1.ResourceCPU:    resource.MustParse("1"),
+						v1.ResourceMemory: resource.MustParse("1Gi"),
+					},
+					DefaultRequest: v1.ResourceList{
+						v1.ResourceCPU: resource.MustParse("500m"),
+					},
+				}}))
+			})
+
+			Context("when they already match the policy", func() {
+				BeforeEach(func() {
+					_, err := vmCreator.Create("other-agent-id", stemcellCID, cloudProps, networks, diskCIDs, env)
+					Expect(err).NotTo(HaveOccurred())
+				})
+
+				It("leaves them alone", func() {
+					_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+					Expect(err).NotTo(HaveOccurred())
+
+					Expect(fakeClient.MatchingActions("create", "resourcequotas")).To(HaveLen(1))
+					Expect(fakeClient.MatchingActions("update", "resourcequotas")).To(BeEmpty())
+					Expect(fakeClient.MatchingActions("create", "limitranges")).To(HaveLen(1))
+					Expect(fakeClient.MatchingActions("update", "limitranges")).To(BeEmpty())
+				})
+			})
+
+			Context("when the policy has changed", func() {
+				BeforeEach(func() {
+					_, err := vmCreator.Create("other-agent-id", stemcellCID, cloudProps, networks, diskCIDs, env)
+					Expect(err).NotTo(HaveOccurred())
+
+					vmCreator.NamespacePolicies["bosh"] = config.NamespacePolicy{
+						ResourceQuota: map[string]string{"pods": "40"},
+					}
+				})
+
+				It("updates the quota and removes the limit range", func() {
+					_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+					Expect(err).NotTo(HaveOccurred())
+
+					matches := fakeClient.MatchingActions("update", "resourcequotas")
+					Expect(matches).To(HaveLen(1))
+					quota := matches[0].(testing.UpdateAction).GetObject().(*v1.ResourceQuota)
+					Expect(quota.Spec.Hard).To(Equal(v1.ResourceList{v1.ResourcePods: resource.MustParse("40")}))
+
+					matches = fakeClient.MatchingActions("delete", "limitranges")
+					Expect(matches).To(HaveLen(1))
+					Expect(matches[0].(testing.DeleteAction).GetName()).To(Equal("bosh-cpi"))
+				})
+			})
+
+			Context("when the cloud properties use the default context", func() {
+				BeforeEach(func() {
+					cloudProps.Context = ""
+				})
+
+				It("applies the policy of the context the client resolved", func() {
+					_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(fakeClient.MatchingActions("create", "resourcequotas")).To(HaveLen(1))
+					Expect(fakeClient.MatchingActions("create", "limitranges")).To(HaveLen(1))
+				})
+			})
+
+			Context("when a quantity is invalid", func() {
+				BeforeEach(func() {
+					vmCreator.NamespacePolicies["bosh"] = config.NamespacePolicy{
+						ResourceQuota: map[string]string{"pods": "lots"},
+					}
+				})
+
+				It("returns an error before creating the VM", func() {
+					_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+					Expect(err).To(MatchError(HavePrefix("resource quota pods:")))
+					Expect(fakeClient.MatchingActions("create", "pods")).To(BeEmpty())
+				})
+			})
+		})
+
+		Context("when the namespace policy declares no quota or limit range", func() {
+			BeforeEach(func() {
+				vmCreator.NamespacePolicies = map[string]config.NamespacePolicy{
+					"bosh": {Labels: map[string]string{"team": "bosh"}},
+				}
+			})
+
+			It("leaves the quotas and limit ranges of the namespace alone", func() {
+				_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(fakeClient.MatchingActions("get", "resourcequotas")).To(BeEmpty())
+				Expect(fakeClient.MatchingActions("get", "limitranges")).To(BeEmpty())
+			})
+		})
+
+		Context("when the namespace has a resource quota", func() {
+			var quota *v1.ResourceQuota
+
+			BeforeEach(func() {
+				cloudProps.Resources = actions.Resources{
+					Limits:   actions.ResourceList{actions.ResourceMemory: "2Gi"},
+					Requests: actions.ResourceList{actions.ResourceMemory: "1Gi"},
+				}
+
+				quota = &v1.ResourceQuota{
+					ObjectMeta: v1.ObjectMeta{Name: "compute", Namespace: "bosh-namespace"},
+					Spec: v1.ResourceQuotaSpec{
+						Hard: v1.ResourceList{
+							v1.ResourcePods:   resource.MustParse("10"),
+							v1.ResourceMemory: resource.MustParse("8Gi"),
+						},
+					},
+					Status: v1.ResourceQuotaStatus{
+						Used: v1.ResourceList{
+							v1.ResourcePods:   resource.MustParse("3"),
+							v1.ResourceMemory: resource.MustParse("6Gi"),
+						},
+					},
+				}
+			})
+
+			JustBeforeEach(func() {
+				_, err := fakeClient.Core().ResourceQuotas("bosh-namespace").Create(quota)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("creates the VM when it fits", func() {
+				_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeClient.MatchingActions("create", "pods")).To(HaveLen(1))
+			})
+
+			Context("when the CPI may not list resource quotas", func() {
+				BeforeEach(func() {
+					quota.Status.Used[v1.ResourceMemory] = resource.MustParse("7500Mi")
+					fakeClient.PrependReactor("list", "resourcequotas", func(action testing.Action) (bool, runtime.Object, error) {
+						gr := unversioned.GroupResource{Group: "", Resource: "resourcequotas"}
+						return true, nil, kubeerrors.NewForbidden(gr, "", errors.New("quota-welp"))
+					})
+				})
+
+				It("creates the VM without a quota check", func() {
+					_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(fakeClient.MatchingActions("create", "pods")).To(HaveLen(1))
+				})
+			})
+
+			Context("when the CPI may not list limit ranges", func() {
+				BeforeEach(func() {
+					fakeClient.PrependReactor("list", "limitranges", func(action testing.Action) (bool, runtime.Object, error) {
+						gr := unversioned.GroupResource{Group: "", Resource: "limitranges"}
+						return true, nil, kubeerrors.NewForbidden(gr, "", errors.New("limits-welp"))
+					})
+				})
+
+				It("checks the quota without limit range defaults", func() {
+					_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(fakeClient.MatchingActions("create", "pods")).To(HaveLen(1))
+				})
+			})
+
+			Context("when listing the limit ranges fails", func() {
+				BeforeEach(func() {
+					fakeClient.PrependReactor("list", "limitranges", func(action testing.Action) (bool, runtime.Object, error) {
+						return true, nil, errors.New("limits-welp")
+					})
+				})
+
+				It("returns an error", func() {
+					_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+					Expect(err).To(MatchError("limits-welp"))
+				})
+			})
+
+			Context("when the VM does not fit", func() {
+				BeforeEach(func() {
+					quota.Status.Used[v1.ResourceMemory] = resource.MustParse("7500Mi")
+				})
+
+				It("returns a QuotaExceededError before creating anything", func() {
+					_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+					Expect(err).To(Equal(cpi.QuotaExceededError{
+						Namespace: "bosh-namespace",
+						Quota:     "compute",
+						Resource:  "memory",
+						Requested: "1Gi",
+						Used:      "7500Mi",
+						Hard:      "8Gi",
+					}))
+					Expect(err.Error()).To(Equal(`Resource quota "compute" in namespace "bosh-namespace" is exceeded: requested 1Gi memory with 7500Mi of 8Gi used`))
+
+					Expect(fakeClient.MatchingActions("create", "configmaps")).To(BeEmpty())
+					Expect(fakeClient.MatchingActions("create", "pods")).To(BeEmpty())
+				})
+			})
+
+			Context("when the pod count is exhausted", func() {
+				BeforeEach(func() {
+					quota.Status.Used[v1.ResourcePods] = resource.MustParse("10")
+				})
+
+				It("returns a QuotaExceededError", func() {
+					_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+					Expect(err).To(BeAssignableToTypeOf(cpi.QuotaExceededError{}))
+					Expect(err.(cpi.QuotaExceededError).Resource).To(Equal("pods"))
+				})
+			})
+
+			Context("when the limit range of the namespace supplies the request", func() {
+				BeforeEach(func() {
+					cloudProps.Resources = actions.Resources{}
+					quota.Spec.Hard = v1.ResourceList{v1.ResourceRequestsCPU: resource.MustParse("2")}
+					quota.Status.Used = v1.ResourceList{v1.ResourceRequestsCPU: resource.MustParse("1500m")}
+
+					_, err := fakeClient.Core().LimitRanges("bosh-namespace").Create(&v1.LimitRange{
+						ObjectMeta: v1.ObjectMeta{Name: "defaults", Namespace: "bosh-namespace"},
+						Spec: v1.LimitRangeSpec{
+							Limits: []v1.LimitRangeItem{{
+								Type:    v1.LimitTypeContainer,
+								Default: v1.ResourceList{v1.ResourceCPU: resource.MustParse("1")},
+							}},
+						},
+					})
+					Expect(err).NotTo(HaveOccurred())
+				})
+
+				It("counts the defaulted request", func() {
+					_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+					Expect(err).To(BeAssignableToTypeOf(cpi.QuotaExceededError{}))
+					Expect(err.(cpi.QuotaExceededError).Resource).To(Equal("requests.cpu"))
+				})
+			})
+
+			Context("when the persistent ephemeral disk does not fit", func() {
+				BeforeEach(func() {
+					cloudProps.PersistentEphemeralDisk = true
+					cloudProps.EphemeralDiskSize = 2048
+					quota.Spec.Hard[v1.ResourceRequestsStorage] = resource.MustParse("10Gi")
+					quota.Status.Used[v1.ResourceRequestsStorage] = resource.MustParse("9Gi")
+				})
+
+				It("returns a QuotaExceededError", func() {
+					_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+					Expect(err).To(BeAssignableToTypeOf(cpi.QuotaExceededError{}))
+					Expect(err.(cpi.QuotaExceededError).Resource).To(Equal("requests.storage"))
+					Expect(fakeClient.MatchingActions("create", "persistentvolumeclaims")).To(BeEmpty())
+				})
+			})
+		})
+
 		Context("when no networks are defined", func() {
 			BeforeEach(func() {
 				networks = cpi.Networks{}
@@ -211,14 +760,14 @@ var _ = Describe("CreateVM", func() {
 			Expect(err).NotTo(HaveOccurred())
 
 			matches := fakeClient.MatchingActions("create", "configmaps")
-			Expect(matches).To(HaveLen(1))
+			Expect(matches).To(HaveLen(2))
 
 			instanceSettings, err := vmCreator.InstanceSettings(agentID, networks, env)
 			Expect(err).NotTo(HaveOccurred())
 			instanceJSON, err := json.Marshal(instanceSettings)
 			Expect(err).NotTo(HaveOccurred())
 
-			configMap := matches[0].(testing.CreateAction).GetObject().(*v1.ConfigMap)
+			configMap := matches[1].(testing.CreateAction).GetObject().(*v1.ConfigMap)
 			Expect(configMap.Name).To(Equal("agent-" + agentID))
 			Expect(configMap.Labels["bosh.cloudfoundry.org/agent-id"]).To(Equal(agentID))
 			Expect(configMap.Data["instance_settings"]).To(MatchJSON(instanceJSON))
@@ -238,14 +787,76 @@ var _ = Describe("CreateVM", func() {
 			})
 		})
 
-		Context("when service definitions are present in the cloud properties", func() {
+		Context("when the agent settings are stored in a secret", func() {
 			BeforeEach(func() {
-				cloudProps.Services = []actions.Service{
-					{
-						Name: "director",
-						Type: "NodePort",
-						Ports: []actions.Port{
-							{Name: "agent", Protocol: "TCP", Port: 6868, NodePort: 32068},
+				agentConf.SettingsKind = "Secret"
+			})
+
+			It("creates a secret instead of a config map", func() {
+				_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+				Expect(err).NotTo(HaveOccurred())
+
+				matches := fakeClient.MatchingActions("create", "configmaps")
+				Expect(matches).To(HaveLen(1))
+				Expect(matches[0].(testing.CreateAction).GetObject().(*v1.ConfigMap).Name).To(Equal("vm-" + agentID))
+
+				matches = fakeClient.MatchingActions("create", "secrets")
+				Expect(matches).To(HaveLen(1))
+
+				instanceSettings, err := vmCreator.InstanceSettings(agentID, networks, env)
+				Expect(err).NotTo(HaveOccurred())
+				instanceJSON, err := json.Marshal(instanceSettings)
+				Expect(err).NotTo(HaveOccurred())
+
+				secret := matches[0].(testing.CreateAction).GetObject().(*v1.Secret)
+				Expect(secret.Name).To(Equal("agent-" + agentID))
+				Expect(secret.Labels["bosh.cloudfoundry.org/agent-id"]).To(Equal(agentID))
+				Expect(secret.Type).To(Equal(v1.SecretTypeOpaque))
+				Expect(secret.Data["instance_settings"]).To(MatchJSON(instanceJSON))
+			})
+
+			It("mounts the secret at the instance settings path", func() {
+				_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+				Expect(err).NotTo(HaveOccurred())
+
+				matches := fakeClient.MatchingActions("create", "pods")
+				Expect(matches).To(HaveLen(1))
+
+				pod := matches[0].(testing.CreateAction).GetObject().(*v1.Pod)
+				Expect(pod.Spec.Volumes).To(ContainElement(v1.Volume{
+					Name: "bosh-config",
+					VolumeSource: v1.VolumeSource{
+						Secret: &v1.SecretVolumeSource{
+							SecretName: "agent-" + agentID,
+							Items: []v1.KeyToPath{{
+								Key:  "instance_settings",
+								Path: "instance_settings.json",
+							}},
+						},
+					},
+				}))
+			})
+		})
+
+		Context("when the agent settings kind is not supported", func() {
+			BeforeEach(func() {
+				agentConf.SettingsKind = "Vault"
+			})
+
+			It("returns an error", func() {
+				_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+				Expect(err).To(MatchError("Vault is not a supported agent settings kind"))
+			})
+		})
+
+		Context("when service definitions are present in the cloud properties", func() {
+			BeforeEach(func() {
+				cloudProps.Services = []actions.Service{
+					{
+						Name: "director",
+						Type: "NodePort",
+						Ports: []actions.Port{
+							{Name: "agent", Protocol: "TCP", Port: 6868, NodePort: 32068},
 							{Name: "director", Protocol: "TCP", Port: 25555, NodePort: 32067},
 						},
 					},
@@ -361,6 +972,341 @@ var _ = Describe("CreateVM", func() {
 				}))
 		})
 
+		Context("when the stemcell has a pull secret", func() {
+			BeforeEach(func() {
+				stemcellManager := &actions.StemcellManager{
+					ClientProvider: fakeProvider,
+					Contexts:       []string{"bosh"},
+				}
+				_, err := stemcellManager.CreateStemcell("/ignored/path", actions.StemcellCloudProperties{
+					Image:       string(stemcellCID),
+					Credentials: &actions.RegistryCredentials{Server: "registry.example.com"},
+				})
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("references the pull secret from the pod", func() {
+				_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+				Expect(err).NotTo(HaveOccurred())
+
+				secret := fakeClient.MatchingActions("create", "secrets")[0].(testing.CreateAction).GetObject().(*v1.Secret)
+
+				matches := fakeClient.MatchingActions("create", "pods")
+				Expect(matches).To(HaveLen(1))
+
+				pod := matches[0].(testing.CreateAction).GetObject().(*v1.Pod)
+				Expect(pod.Spec.ImagePullSecrets).To(Equal([]v1.LocalObjectReference{{Name: secret.Name}}))
+			})
+		})
+
+		It("does not reference a pull secret when the stemcell has none", func() {
+			_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+			Expect(err).NotTo(HaveOccurred())
+
+			matches := fakeClient.MatchingActions("create", "pods")
+			pod := matches[0].(testing.CreateAction).GetObject().(*v1.Pod)
+			Expect(pod.Spec.ImagePullSecrets).To(BeEmpty())
+		})
+
+		Context("when the stemcell is pinned to a digest", func() {
+			BeforeEach(func() {
+				stemcellCID = cpi.StemcellCID("sykesm/kubernetes-stemcell@sha256:" + strings.Repeat("0", 64))
+			})
+
+			It("pulls the image only if it is not present", func() {
+				_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+				Expect(err).NotTo(HaveOccurred())
+
+				pod := fakeClient.MatchingActions("create", "pods")[0].(testing.CreateAction).GetObject().(*v1.Pod)
+				Expect(pod.Spec.Containers[0].ImagePullPolicy).To(Equal(v1.PullIfNotPresent))
+			})
+		})
+
+		Context("when an image pull policy is present in the cloud properties", func() {
+			BeforeEach(func() {
+				cloudProps.ImagePullPolicy = "Never"
+			})
+
+			It("uses the configured pull policy", func() {
+				_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+				Expect(err).NotTo(HaveOccurred())
+
+				pod := fakeClient.MatchingActions("create", "pods")[0].(testing.CreateAction).GetObject().(*v1.Pod)
+				Expect(pod.Spec.Containers[0].ImagePullPolicy).To(Equal(v1.PullNever))
+			})
+
+			Context("when the pull policy is not supported", func() {
+				BeforeEach(func() {
+					cloudProps.ImagePullPolicy = "Sometimes"
+				})
+
+				It("returns an error before creating anything", func() {
+					_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+					Expect(err).To(MatchError("Sometimes is not a supported image pull policy"))
+					Expect(fakeClient.Actions()).To(BeEmpty())
+				})
+			})
+		})
+
+		It("runs the pod with the default service account", func() {
+			_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(fakeClient.MatchingActions("create", "serviceaccounts")).To(BeEmpty())
+
+			matches := fakeClient.MatchingActions("create", "pods")
+			pod := matches[0].(testing.CreateAction).GetObject().(*v1.Pod)
+			Expect(pod.Spec.ServiceAccountName).To(BeEmpty())
+		})
+
+		Context("when a service account is requested", func() {
+			BeforeEach(func() {
+				cloudProps.ServiceAccount = &actions.ServiceAccount{
+					ClusterRoles: []string{"view"},
+					Roles:        []string{"broker"},
+				}
+			})
+
+			It("creates a service account for the agent", func() {
+				_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+				Expect(err).NotTo(HaveOccurred())
+
+				matches := fakeClient.MatchingActions("create", "serviceaccounts")
+				Expect(matches).To(HaveLen(1))
+
+				serviceAccount := matches[0].(testing.CreateAction).GetObject().(*v1.ServiceAccount)
+				Expect(serviceAccount.Name).To(Equal("agent-" + agentID))
+				Expect(serviceAccount.Namespace).To(Equal("bosh-namespace"))
+				Expect(serviceAccount.Labels).To(Equal(map[string]string{"bosh.cloudfoundry.org/agent-id": agentID}))
+			})
+
+			It("binds the service account to the roles", func() {
+				_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+				Expect(err).NotTo(HaveOccurred())
+
+				matches := fakeClient.MatchingActions("create", "rolebindings")
+				Expect(matches).To(HaveLen(2))
+
+				subjects := []rbac.Subject{{Kind: "ServiceAccount", Name: "agent-" + agentID, Namespace: "bosh-namespace"}}
+
+				binding := matches[0].(testing.CreateAction).GetObject().(*rbac.RoleBinding)
+				Expect(binding.Name).To(Equal("agent-agent-id-0"))
+				Expect(binding.Labels).To(Equal(map[string]string{"bosh.cloudfoundry.org/agent-id": agentID}))
+				Expect(binding.Subjects).To(Equal(subjects))
+				Expect(binding.RoleRef).To(Equal(v1.ObjectReference{Kind: "ClusterRole", Name: "view"}))
+
+				binding = matches[1].(testing.CreateAction).GetObject().(*rbac.RoleBinding)
+				Expect(binding.Name).To(Equal("agent-agent-id-1"))
+				Expect(binding.Subjects).To(Equal(subjects))
+				Expect(binding.RoleRef).To(Equal(v1.ObjectReference{Kind: "Role", Namespace: "bosh-namespace", Name: "broker"}))
+			})
+
+			It("runs the pod as the service account", func() {
+				_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+				Expect(err).NotTo(HaveOccurred())
+
+				matches := fakeClient.MatchingActions("create", "pods")
+				pod := matches[0].(testing.CreateAction).GetObject().(*v1.Pod)
+				Expect(pod.Spec.ServiceAccountName).To(Equal("agent-" + agentID))
+				Expect(pod.Spec.Containers[0].VolumeMounts).To(HaveLen(2))
+			})
+
+			Context("when the token should not be mounted", func() {
+				BeforeEach(func() {
+					automount := false
+					cloudProps.ServiceAccount.AutomountToken = &automount
+				})
+
+				It("masks the service account token path", func() {
+					_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+					Expect(err).NotTo(HaveOccurred())
+
+					matches := fakeClient.MatchingActions("create", "pods")
+					pod := matches[0].(testing.CreateAction).GetObject().(*v1.Pod)
+					Expect(pod.Spec.Containers[0].VolumeMounts).To(ContainElement(v1.VolumeMount{
+						Name:      "bosh-no-api-token",
+						MountPath: "/var/run/secrets/kubernetes.io/serviceaccount",
+						ReadOnly:  true,
+					}))
+					Expect(pod.Spec.Volumes).To(ContainElement(v1.Volume{
+						Name:         "bosh-no-api-token",
+						VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}},
+					}))
+				})
+			})
+
+			Context("when creating a role binding fails", func() {
+				BeforeEach(func() {
+					fakeClient.PrependReactor("create", "rolebindings", func(action testing.Action) (bool, runtime.Object, error) {
+						return true, nil, errors.New("rolebinding-welp")
+					})
+				})
+
+				It("returns an error", func() {
+					_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+					Expect(err).To(MatchError("rolebinding-welp"))
+					Expect(fakeClient.MatchingActions("create", "pods")).To(BeEmpty())
+				})
+			})
+		})
+
+		Context("when the context does not permit privileged containers", func() {
+			BeforeEach(func() {
+				vmCreator.PrivilegedContexts = nil
+			})
+
+			It("creates an unprivileged container", func() {
+				_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+				Expect(err).NotTo(HaveOccurred())
+
+				matches := fakeClient.MatchingActions("create", "pods")
+				Expect(matches).To(HaveLen(1))
+
+				rootUID := int64(0)
+				pod := matches[0].(testing.CreateAction).GetObject().(*v1.Pod)
+				Expect(pod.Spec.Containers[0].SecurityContext).To(Equal(&v1.SecurityContext{
+					RunAsUser: &rootUID,
+				}))
+			})
+
+			Context("when a privileged container is requested", func() {
+				BeforeEach(func() {
+					privileged := true
+					cloudProps.SecurityContext.Privileged = &privileged
+				})
+
+				It("returns an error before creating anything", func() {
+					_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+					Expect(err).To(MatchError(`privileged containers are not permitted in context "bosh"`))
+					Expect(fakeClient.Actions()).To(BeEmpty())
+				})
+			})
+		})
+
+		Context("when the cloud properties use the default context", func() {
+			BeforeEach(func() {
+				cloudProps.Context = ""
+			})
+
+			It("applies the settings of the context the client resolved", func() {
+				_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+				Expect(err).NotTo(HaveOccurred())
+
+				pod := fakeClient.MatchingActions("create", "pods")[0].(testing.CreateAction).GetObject().(*v1.Pod)
+				Expect(*pod.Spec.Containers[0].SecurityContext.Privileged).To(BeTrue())
+			})
+		})
+
+		Context("when a security context is present in the cloud properties", func() {
+			BeforeEach(func() {
+				privileged := false
+				vcapUID := int64(1000)
+				cloudProps.SecurityContext = actions.SecurityContext{
+					Privileged: &privileged,
+					RunAsUser:  &vcapUID,
+					Capabilities: actions.Capabilities{
+						Add:  []string{"NET_ADMIN"},
+						Drop: []string{"ALL"},
+					},
+					SeccompProfile:         "runtime/default",
+					AppArmorProfile:        "localhost/bosh-job",
+					ReadOnlyRootFilesystem: true,
+					WritablePaths:          []string{"/var/vcap/sys", "/tmp/"},
+				}
+			})
+
+			It("applies it to the bosh-job container", func() {
+				_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+				Expect(err).NotTo(HaveOccurred())
+
+				matches := fakeClient.MatchingActions("create", "pods")
+				Expect(matches).To(HaveLen(1))
+
+				vcapUID := int64(1000)
+				readOnly := true
+				pod := matches[0].(testing.CreateAction).GetObject().(*v1.Pod)
+				Expect(pod.Spec.Containers[0].SecurityContext).To(Equal(&v1.SecurityContext{
+					RunAsUser: &vcapUID,
+					Capabilities: &v1.Capabilities{
+						Add:  []v1.Capability{"NET_ADMIN"},
+						Drop: []v1.Capability{"ALL"},
+					},
+					ReadOnlyRootFilesystem: &readOnly,
+				}))
+			})
+
+			It("sets the seccomp and AppArmor annotations", func() {
+				_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+				Expect(err).NotTo(HaveOccurred())
+
+				matches := fakeClient.MatchingActions("create", "pods")
+				pod := matches[0].(testing.CreateAction).GetObject().(*v1.Pod)
+				Expect(pod.Annotations).To(Equal(map[string]string{
+					"container.seccomp.security.alpha.kubernetes.io/bosh-job": "runtime/default",
+					"container.apparmor.security.beta.kubernetes.io/bosh-job": "localhost/bosh-job",
+				}))
+			})
+
+			It("mounts empty directories at the writable paths", func() {
+				_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+				Expect(err).NotTo(HaveOccurred())
+
+				matches := fakeClient.MatchingActions("create", "pods")
+				pod := matches[0].(testing.CreateAction).GetObject().(*v1.Pod)
+				Expect(pod.Spec.Containers[0].VolumeMounts).To(ContainElement(v1.VolumeMount{Name: "bosh-writable-0", MountPath: "/var/vcap/sys"}))
+				Expect(pod.Spec.Containers[0].VolumeMounts).To(ContainElement(v1.VolumeMount{Name: "bosh-writable-1", MountPath: "/tmp"}))
+				Expect(pod.Spec.Volumes).To(ContainElement(v1.Volume{
+					Name:         "bosh-writable-0",
+					VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}},
+				}))
+			})
+
+			Context("when writable paths are set without a read-only root filesystem", func() {
+				BeforeEach(func() {
+					cloudProps.SecurityContext.ReadOnlyRootFilesystem = false
+				})
+
+				It("returns an error", func() {
+					_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+					Expect(err).To(MatchError("writable_paths requires read_only_root_filesystem"))
+				})
+			})
+
+			Context("when a writable path is relative", func() {
+				BeforeEach(func() {
+					cloudProps.SecurityContext.WritablePaths = []string{"var/tmp"}
+				})
+
+				It("returns an error", func() {
+					_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+					Expect(err).To(MatchError("writable path var/tmp must be absolute"))
+				})
+			})
+
+			Context("when allow_privilege_escalation is set", func() {
+				BeforeEach(func() {
+					allow := false
+					cloudProps.SecurityContext.AllowPrivilegeEscalation = &allow
+				})
+
+				It("returns an error", func() {
+					_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+					Expect(err).To(MatchError("allow_privilege_escalation is not supported by this Kubernetes client"))
+				})
+			})
+
+			Context("when a runtime class is set", func() {
+				BeforeEach(func() {
+					cloudProps.SecurityContext.RuntimeClass = "gvisor"
+				})
+
+				It("returns an error", func() {
+					_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+					Expect(err).To(MatchError("runtime_class is not supported by this Kubernetes client"))
+				})
+			})
+		})
+
 		Context("when the network contains an IP", func() {
 			BeforeEach(func() {
 				networks = cpi.Networks{
@@ -464,6 +1410,280 @@ var _ = Describe("CreateVM", func() {
 					Expect(err).To(MatchError("goo is not a supported resource type"))
 				})
 			})
+
+			Context("when extended resource types are specified", func() {
+				BeforeEach(func() {
+					cloudProps.Resources = actions.Resources{
+						Limits: actions.ResourceList{
+							actions.ResourceEphemeralStorage: "10Gi",
+							"hugepages-2Mi":                  "512Mi",
+							"example.com/device":             "2",
+						},
+						Requests: actions.ResourceList{
+							actions.ResourceEphemeralStorage: "1Gi",
+							"hugepages-2Mi":                  "512Mi",
+							"example.com/device":             "2",
+						},
+					}
+				})
+
+				It("sets the resources on the Pod", func() {
+					_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+					Expect(err).NotTo(HaveOccurred())
+
+					matches := fakeClient.MatchingActions("create", "pods")
+					Expect(matches).To(HaveLen(1))
+
+					pod := matches[0].(testing.CreateAction).GetObject().(*v1.Pod)
+					Expect(pod.Spec.Containers[0].Resources).To(Equal(v1.ResourceRequirements{
+						Requests: v1.ResourceList{
+							"ephemeral-storage":  resource.MustParse("1Gi"),
+							"hugepages-2Mi":      resource.MustParse("512Mi"),
+							"example.com/device": resource.MustParse("2"),
+						},
+						Limits: v1.ResourceList{
+							"ephemeral-storage":  resource.MustParse("10Gi"),
+							"hugepages-2Mi":      resource.MustParse("512Mi"),
+							"example.com/device": resource.MustParse("2"),
+						},
+					}))
+				})
+			})
+
+			Context("when the huge page size is invalid", func() {
+				BeforeEach(func() {
+					cloudProps.Resources = actions.Resources{
+						Requests: actions.ResourceList{"hugepages-huge": "1Gi"},
+					}
+				})
+
+				It("returns an error", func() {
+					_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+					Expect(err).To(MatchError("hugepages-huge is not a valid huge page resource"))
+				})
+			})
+
+			Context("when an extended resource name is invalid", func() {
+				BeforeEach(func() {
+					cloudProps.Resources = actions.Resources{
+						Requests: actions.ResourceList{"example.com/not valid": "1"},
+					}
+				})
+
+				It("returns an error", func() {
+					_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+					Expect(err).To(MatchError(HavePrefix("example.com/not valid is not a valid resource name")))
+				})
+			})
+
+			Context("when an extended resource quantity is fractional", func() {
+				BeforeEach(func() {
+					cloudProps.Resources = actions.Resources{
+						Requests: actions.ResourceList{"example.com/device": "500m"},
+					}
+				})
+
+				It("returns an error", func() {
+					_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+					Expect(err).To(MatchError("example.com/device quantity 500m must be a whole number"))
+				})
+			})
+
+			Context("when a quantity is negative", func() {
+				BeforeEach(func() {
+					cloudProps.Resources = actions.Resources{
+						Requests: actions.ResourceList{actions.ResourceMemory: "-1Gi"},
+					}
+				})
+
+				It("returns an error", func() {
+					_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+					Expect(err).To(MatchError("memory quantity -1Gi must not be negative"))
+				})
+			})
+
+			Context("when a request exceeds its limit", func() {
+				BeforeEach(func() {
+					cloudProps.Resources = actions.Resources{
+						Requests: actions.ResourceList{actions.ResourceMemory: "2Gi"},
+						Limits:   actions.ResourceList{actions.ResourceMemory: "1Gi"},
+					}
+				})
+
+				It("returns an error", func() {
+					_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+					Expect(err).To(MatchError("memory request 2Gi exceeds limit 1Gi"))
+				})
+			})
+		})
+
+		Context("when an ephemeral disk size is present in the cloud properties", func() {
+			BeforeEach(func() {
+				cloudProps.EphemeralDiskSize = 2048
+			})
+
+			It("sets the ephemeral storage request and limit on the Pod", func() {
+				_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+				Expect(err).NotTo(HaveOccurred())
+
+				matches := fakeClient.MatchingActions("create", "pods")
+				Expect(matches).To(HaveLen(1))
+
+				pod := matches[0].(testing.CreateAction).GetObject().(*v1.Pod)
+				Expect(pod.Spec.Containers[0].Resources).To(Equal(v1.ResourceRequirements{
+					Requests: v1.ResourceList{"ephemeral-storage": resource.MustParse("2048Mi")},
+					Limits:   v1.ResourceList{"ephemeral-storage": resource.MustParse("2048Mi")},
+				}))
+			})
+
+			It("does not create a persistent volume claim", func() {
+				_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeClient.MatchingActions("create", "persistentvolumeclaims")).To(BeEmpty())
+			})
+
+			Context("when ephemeral storage is explicitly configured", func() {
+				BeforeEach(func() {
+					cloudProps.Resources = actions.Resources{
+						Limits: actions.ResourceList{actions.ResourceEphemeralStorage: "4Gi"},
+					}
+				})
+
+				It("keeps the configured value", func() {
+					_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+					Expect(err).NotTo(HaveOccurred())
+
+					matches := fakeClient.MatchingActions("create", "pods")
+					pod := matches[0].(testing.CreateAction).GetObject().(*v1.Pod)
+					Expect(pod.Spec.Containers[0].Resources.Limits).To(Equal(v1.ResourceList{
+						"ephemeral-storage": resource.MustParse("4Gi"),
+					}))
+				})
+			})
+		})
+
+		Context("when only an ephemeral storage request larger than the disk is configured", func() {
+			BeforeEach(func() {
+				cloudProps.EphemeralDiskSize = 2048
+				cloudProps.Resources = actions.Resources{
+					Requests: actions.ResourceList{actions.ResourceEphemeralStorage: "4Gi"},
+				}
+			})
+
+			It("raises the limit to the request", func() {
+				_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+				Expect(err).NotTo(HaveOccurred())
+
+				pod := fakeClient.MatchingActions("create", "pods")[0].(testing.CreateAction).GetObject().(*v1.Pod)
+				Expect(pod.Spec.Containers[0].Resources).To(Equal(v1.ResourceRequirements{
+					Requests: v1.ResourceList{"ephemeral-storage": resource.MustParse("4Gi")},
+					Limits:   v1.ResourceList{"ephemeral-storage": resource.MustParse("4Gi")},
+				}))
+			})
+		})
+
+		Context("when only an ephemeral storage limit smaller than the disk is configured", func() {
+			BeforeEach(func() {
+				cloudProps.EphemeralDiskSize = 2048
+				cloudProps.Resources = actions.Resources{
+					Limits: actions.ResourceList{actions.ResourceEphemeralStorage: "1Gi"},
+				}
+			})
+
+			It("lowers the request to the limit", func() {
+				_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+				Expect(err).NotTo(HaveOccurred())
+
+				pod := fakeClient.MatchingActions("create", "pods")[0].(testing.CreateAction).GetObject().(*v1.Pod)
+				Expect(pod.Spec.Containers[0].Resources).To(Equal(v1.ResourceRequirements{
+					Requests: v1.ResourceList{"ephemeral-storage": resource.MustParse("1Gi")},
+					Limits:   v1.ResourceList{"ephemeral-storage": resource.MustParse("1Gi")},
+				}))
+			})
+		})
+
+		Context("when an ephemeral disk size is present in the environment", func() {
+			BeforeEach(func() {
+				env = cpi.Environment{
+					"bosh": map[string]interface{}{"ephemeral_disk_size": float64(1024)},
+				}
+			})
+
+			It("sets the ephemeral storage request and limit on the Pod", func() {
+				_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+				Expect(err).NotTo(HaveOccurred())
+
+				matches := fakeClient.MatchingActions("create", "pods")
+				pod := matches[0].(testing.CreateAction).GetObject().(*v1.Pod)
+				Expect(pod.Spec.Containers[0].Resources.Requests).To(Equal(v1.ResourceList{
+					"ephemeral-storage": resource.MustParse("1024Mi"),
+				}))
+			})
+		})
+
+		Context("when a persistent ephemeral disk is requested", func() {
+			BeforeEach(func() {
+				cloudProps.EphemeralDiskSize = 4096
+				cloudProps.PersistentEphemeralDisk = true
+			})
+
+			It("creates a persistent volume claim for the ephemeral disk", func() {
+				_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+				Expect(err).NotTo(HaveOccurred())
+
+				matches := fakeClient.MatchingActions("create", "persistentvolumeclaims")
+				Expect(matches).To(HaveLen(1))
+
+				pvc := matches[0].(testing.CreateAction).GetObject().(*v1.PersistentVolumeClaim)
+				Expect(pvc.Name).To(Equal("ephemeral-" + agentID))
+				Expect(pvc.Labels["bosh.cloudfoundry.org/agent-id"]).To(Equal(agentID))
+				Expect(pvc.Spec.Resources.Requests).To(Equal(v1.ResourceList{
+					v1.ResourceStorage: resource.MustParse("4096Mi"),
+				}))
+			})
+
+			It("backs the ephemeral volume with the claim", func() {
+				_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+				Expect(err).NotTo(HaveOccurred())
+
+				matches := fakeClient.MatchingActions("create", "pods")
+				pod := matches[0].(testing.CreateAction).GetObject().(*v1.Pod)
+				Expect(pod.Spec.Volumes).To(ContainElement(v1.Volume{
+					Name: "bosh-ephemeral",
+					VolumeSource: v1.VolumeSource{
+						PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{
+							ClaimName: "ephemeral-" + agentID,
+						},
+					},
+				}))
+				Expect(pod.Spec.Containers[0].Resources.Limits).To(BeNil())
+			})
+
+			Context("when the ephemeral disk size is missing", func() {
+				BeforeEach(func() {
+					cloudProps.EphemeralDiskSize = 0
+				})
+
+				It("returns an error", func() {
+					_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+					Expect(err).To(MatchError("an ephemeral disk size is required for a persistent ephemeral disk"))
+					Expect(fakeClient.MatchingActions("create", "pods")).To(BeEmpty())
+				})
+			})
+
+			Context("when creating the claim fails", func() {
+				BeforeEach(func() {
+					fakeClient.PrependReactor("create", "persistentvolumeclaims", func(action testing.Action) (bool, runtime.Object, error) {
+						return true, nil, errors.New("pvc-welp")
+					})
+				})
+
+				It("returns an error", func() {
+					_, err := vmCreator.Create(agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+					Expect(err).To(MatchError("pvc-welp"))
+					Expect(fakeClient.MatchingActions("create", "pods")).To(BeEmpty())
+				})
+			})
 		})
 
 		Context("when creating the pod fails", func() {
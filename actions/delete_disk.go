@@ -1,21 +1,131 @@
 package actions
 
 import (
+	"errors"
+	"time"
+
+	"code.cloudfoundry.org/clock"
+
 	"github.com/sykesm/kubernetes-cpi/cpi"
 	"github.com/sykesm/kubernetes-cpi/kubecluster"
 	"k8s.io/client-go/1.4/pkg/api"
 )
 
+const deletionPollInterval = time.Second
+
 type DiskDeleter struct {
 	ClientProvider kubecluster.ClientProvider
+
+	// When DeletionTimeout is not zero, DeleteDisk waits up to the timeout
+	// for the claim and the volume bound to it to be removed.
+	Clock           clock.Clock
+	DeletionTimeout time.Duration
+
+	// MovedDiskContexts holds the contexts attach_disk may have moved disks
+	// into. The claim of a moved disk is deleted there.
+	MovedDiskContexts []string
 }
 
 func (d *DiskDeleter) DeleteDisk(diskCID cpi.DiskCID) error {
-	context, diskID := ParseDiskCID(diskCID)
-	client, err := d.ClientProvider.New(context)
+	cid, err := diskCID.Decode()
 	if err != nil {
 		return err
 	}
+	diskID := cid.ID
+
+	client, err := newCIDClient(d.ClientProvider, cid)
+	if err != nil {
+		return err
+	}
+
+	pvc, err := client.PersistentVolumeClaims().Get(diskName(diskID))
+	if isNotFoundStatusError(err) {
+		client, pvc, err = findMovedClaim(d.ClientProvider, d.MovedDiskContexts, diskCID)
+		if err == nil && pvc == nil {
+			return nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	pvcClient := client.PersistentVolumeClaims()
+
+	podName, err := findClaimUser(client.Pods(), api.ListOptions{}, pvc.Name, "")
+	if err != nil {
+		return err
+	}
+	if podName != "" {
+		return cpi.DiskInUseError{DiskCID: diskCID, Pod: podName}
+	}
 
-	return client.PersistentVolumeClaims().Delete("disk-"+diskID, &api.DeleteOptions{GracePeriodSeconds: int64Ptr(0)})
+	// The claim is not mounted so a finalizer left behind by an agent that
+	// was deleted with the disk attached no longer protects anything.
+	if hasFinalizer(pvc.ObjectMeta, DiskFinalizer) {
+		pvc.Finalizers = removeFinalizer(pvc.Finalizers, DiskFinalizer)
+		_, err = pvcClient.Update(pvc)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = pvcClient.Delete(pvc.Name, &api.DeleteOptions{GracePeriodSeconds: int64Ptr(0)})
+	if err != nil && !isNotFoundStatusError(err) {
+		return err
+	}
+
+	if d.DeletionTimeout != 0 {
+		err = d.waitForDeletion(client, pvc.Name, pvc.Spec.VolumeName)
+		if err != nil {
+			return err
+		}
+	}
+
+	return deleteNamespaceIfEmpty(client)
+}
+
+func (d *DiskDeleter) waitForDeletion(client kubecluster.Client, claimName, volumeName string) error {
+	timer := d.Clock.NewTimer(d.DeletionTimeout)
+	defer timer.Stop()
+
+	for {
+		claimGone, err := isGone(func() error {
+			_, err := client.PersistentVolumeClaims().Get(claimName)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		volumeGone := true
+		if claimGone && volumeName != "" {
+			volumeGone, err = isGone(func() error {
+				_, err := client.Core().PersistentVolumes().Get(volumeName)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if claimGone && volumeGone {
+			return nil
+		}
+
+		select {
+		case <-timer.C():
+			return errors.New("Timed out waiting for the disk to be deleted")
+		case <-d.Clock.After(deletionPollInterval):
+		}
+	}
+}
+
+func isGone(get func() error) (bool, error) {
+	err := get()
+	if err == nil {
+		return false, nil
+	}
+	if isNotFoundStatusError(err) {
+		return true, nil
+	}
+	return false, err
 }
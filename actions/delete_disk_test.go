@@ -2,8 +2,13 @@ package actions_test
 
 import (
 	"errors"
+	"time"
 
+	"code.cloudfoundry.org/clock/fakeclock"
+
+	kubeerrors "k8s.io/client-go/1.4/pkg/api/errors"
 	"k8s.io/client-go/1.4/pkg/api/resource"
+	"k8s.io/client-go/1.4/pkg/api/unversioned"
 	"k8s.io/client-go/1.4/pkg/api/v1"
 	"k8s.io/client-go/1.4/pkg/runtime"
 	"k8s.io/client-go/1.4/testing"
@@ -12,6 +17,7 @@ import (
 	. "github.com/onsi/gomega"
 	"github.com/sykesm/kubernetes-cpi/actions"
 	"github.com/sykesm/kubernetes-cpi/cpi"
+	"github.com/sykesm/kubernetes-cpi/kubecluster"
 	"github.com/sykesm/kubernetes-cpi/kubecluster/fakes"
 )
 
@@ -19,13 +25,14 @@ var _ = Describe("DeleteDisk", func() {
 	var (
 		fakeClient   *fakes.Client
 		fakeProvider *fakes.ClientProvider
+		fakeClock    *fakeclock.FakeClock
 		diskCID      cpi.DiskCID
 
 		diskDeleter *actions.DiskDeleter
 	)
 
 	BeforeEach(func() {
-		diskCID = actions.NewDiskCID("bosh", "disk-id")
+		diskCID = cpi.NewDiskCID("bosh", "bosh-namespace", "disk-id")
 
 		fakeClient = fakes.NewClient(&v1.PersistentVolumeClaim{
 			ObjectMeta: v1.ObjectMeta{
@@ -50,7 +57,11 @@ var _ = Describe("DeleteDisk", func() {
 		fakeProvider = &fakes.ClientProvider{}
 		fakeProvider.NewReturns(fakeClient, nil)
 
-		diskDeleter = &actions.DiskDeleter{ClientProvider: fakeProvider}
+		fakeClock = fakeclock.NewFakeClock(time.Now())
+		diskDeleter = &actions.DiskDeleter{
+			ClientProvider: fakeProvider,
+			Clock:          fakeClock,
+		}
 	})
 
 	It("gets a client for the appropriate context", func() {
@@ -72,6 +83,203 @@ var _ = Describe("DeleteDisk", func() {
 		Expect(matches[0].(testing.DeleteAction).GetNamespace()).To(Equal("bosh-namespace"))
 	})
 
+	Context("when the claim is in a namespace created for its deployment", func() {
+		BeforeEach(func() {
+			_, err := fakeClient.Core().Namespaces().Create(&v1.Namespace{
+				ObjectMeta: v1.ObjectMeta{
+					Name:   "bosh-namespace",
+					Labels: map[string]string{"bosh.cloudfoundry.org/deployment": "deployment"},
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("deletes the namespace once it is empty", func() {
+			err := diskDeleter.DeleteDisk(diskCID)
+			Expect(err).NotTo(HaveOccurred())
+
+			matches := fakeClient.MatchingActions("delete", "namespaces")
+			Expect(matches).To(HaveLen(1))
+			Expect(matches[0].(testing.DeleteAction).GetName()).To(Equal("bosh-namespace"))
+		})
+
+		Context("when the settings of a VM remain in the namespace", func() {
+			BeforeEach(func() {
+				_, err := fakeClient.Core().Secrets("bosh-namespace").Create(&v1.Secret{
+					ObjectMeta: v1.ObjectMeta{
+						Name:      "agent-other",
+						Namespace: "bosh-namespace",
+						Labels:    map[string]string{"bosh.cloudfoundry.org/agent-id": "other"},
+					},
+				})
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("keeps the namespace", func() {
+				err := diskDeleter.DeleteDisk(diskCID)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeClient.MatchingActions("delete", "namespaces")).To(BeEmpty())
+			})
+		})
+	})
+
+	Context("when the claim is in a namespace that was not created for a deployment", func() {
+		It("keeps the namespace", func() {
+			err := diskDeleter.DeleteDisk(diskCID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeClient.MatchingActions("delete", "namespaces")).To(BeEmpty())
+		})
+	})
+
+	Context("when attach_disk moved the disk into another context", func() {
+		var movedClient *fakes.Client
+
+		BeforeEach(func() {
+			diskCID = cpi.NewDiskCID("bosh", "bosh-namespace", "missing")
+
+			movedClient = fakes.NewClient(&v1.PersistentVolumeClaim{
+				ObjectMeta: v1.ObjectMeta{
+					Name:        "disk-missing",
+					Namespace:   "other-namespace",
+					Labels:      map[string]string{"bosh.cloudfoundry.org/disk-id": "missing"},
+					Annotations: map[string]string{actions.MigratedFromAnnotation: string(diskCID)},
+				},
+			})
+			movedClient.ContextReturns("other")
+			movedClient.NamespaceReturns("other-namespace")
+
+			fakeProvider.NewStub = func(context string) (kubecluster.Client, error) {
+				if context == "other" {
+					return movedClient, nil
+				}
+				return fakeClient, nil
+			}
+			diskDeleter.MovedDiskContexts = []string{"bosh", "other"}
+		})
+
+		It("deletes the moved claim", func() {
+			err := diskDeleter.DeleteDisk(diskCID)
+			Expect(err).NotTo(HaveOccurred())
+
+			matches := movedClient.MatchingActions("delete", "persistentvolumeclaims")
+			Expect(matches).To(HaveLen(1))
+			Expect(matches[0].(testing.DeleteAction).GetName()).To(Equal("disk-missing"))
+			Expect(matches[0].(testing.DeleteAction).GetNamespace()).To(Equal("other-namespace"))
+		})
+	})
+
+	Context("when the claim has already been deleted", func() {
+		BeforeEach(func() {
+			diskCID = cpi.NewDiskCID("bosh", "bosh-namespace", "missing")
+		})
+
+		It("succeeds without deleting anything", func() {
+			err := diskDeleter.DeleteDisk(diskCID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeClient.MatchingActions("delete", "persistentvolumeclaims")).To(BeEmpty())
+		})
+	})
+
+	Context("when a pod still references the claim", func() {
+		BeforeEach(func() {
+			fakeClient.PrependReactor("list", "pods", func(action testing.Action) (bool, runtime.Object, error) {
+				return true, &v1.PodList{Items: []v1.Pod{{
+					ObjectMeta: v1.ObjectMeta{Name: "agent-agent-id", Namespace: "bosh-namespace"},
+					Spec: v1.PodSpec{
+						Volumes: []v1.Volume{{
+							Name: "disk-disk-id",
+							VolumeSource: v1.VolumeSource{
+								PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: "disk-disk-id"},
+							},
+						}},
+					},
+				}}}, nil
+			})
+		})
+
+		It("returns a DiskInUseError", func() {
+			err := diskDeleter.DeleteDisk(diskCID)
+			Expect(err).To(Equal(cpi.DiskInUseError{DiskCID: diskCID, Pod: "agent-agent-id"}))
+			Expect(fakeClient.MatchingActions("delete", "persistentvolumeclaims")).To(BeEmpty())
+		})
+	})
+
+	Context("when the claim has the attached finalizer", func() {
+		BeforeEach(func() {
+			fakeClient.PrependReactor("get", "persistentvolumeclaims", func(action testing.Action) (bool, runtime.Object, error) {
+				return true, &v1.PersistentVolumeClaim{
+					ObjectMeta: v1.ObjectMeta{
+						Name:       "disk-disk-id",
+						Namespace:  "bosh-namespace",
+						Finalizers: []string{"example.com/other", actions.DiskFinalizer},
+					},
+				}, nil
+			})
+		})
+
+		It("removes the finalizer before deleting the claim", func() {
+			err := diskDeleter.DeleteDisk(diskCID)
+			Expect(err).NotTo(HaveOccurred())
+
+			matches := fakeClient.MatchingActions("update", "persistentvolumeclaims")
+			Expect(matches).To(HaveLen(1))
+
+			updated := matches[0].(testing.UpdateAction).GetObject().(*v1.PersistentVolumeClaim)
+			Expect(updated.Finalizers).To(Equal([]string{"example.com/other"}))
+			Expect(fakeClient.MatchingActions("delete", "persistentvolumeclaims")).To(HaveLen(1))
+		})
+	})
+
+	Context("when a deletion timeout is configured", func() {
+		var claimDeleted, volumeDeleted bool
+
+		BeforeEach(func() {
+			diskDeleter.DeletionTimeout = 30 * time.Second
+			claimDeleted, volumeDeleted = false, false
+
+			fakeClient.PrependReactor("get", "persistentvolumeclaims", func(action testing.Action) (bool, runtime.Object, error) {
+				if claimDeleted {
+					return true, nil, kubeerrors.NewNotFound(unversioned.GroupResource{}, "disk-disk-id")
+				}
+				return true, &v1.PersistentVolumeClaim{
+					ObjectMeta: v1.ObjectMeta{Name: "disk-disk-id", Namespace: "bosh-namespace"},
+					Spec:       v1.PersistentVolumeClaimSpec{VolumeName: "pv-name"},
+				}, nil
+			})
+			fakeClient.PrependReactor("get", "persistentvolumes", func(action testing.Action) (bool, runtime.Object, error) {
+				if volumeDeleted {
+					return true, nil, kubeerrors.NewNotFound(unversioned.GroupResource{}, "pv-name")
+				}
+				return true, &v1.PersistentVolume{ObjectMeta: v1.ObjectMeta{Name: "pv-name"}}, nil
+			})
+		})
+
+		It("waits for the claim and bound volume to be removed", func() {
+			result := make(chan error)
+			go func() { result <- diskDeleter.DeleteDisk(diskCID) }()
+
+			Consistently(result).ShouldNot(Receive())
+			claimDeleted = true
+			fakeClock.Increment(2 * time.Second)
+			Consistently(result).ShouldNot(Receive())
+
+			volumeDeleted = true
+			fakeClock.Increment(2 * time.Second)
+			Eventually(result).Should(Receive(BeNil()))
+
+			Expect(fakeClient.MatchingActions("get", "persistentvolumes")).NotTo(BeEmpty())
+		})
+
+		It("returns an error when the timeout expires", func() {
+			result := make(chan error)
+			go func() { result <- diskDeleter.DeleteDisk(diskCID) }()
+
+			Consistently(result).ShouldNot(Receive())
+			fakeClock.Increment(31 * time.Second)
+			Eventually(result).Should(Receive(MatchError("Timed out waiting for the disk to be deleted")))
+		})
+	})
+
 	Context("when getting the client fails", func() {
 		BeforeEach(func() {
 			fakeProvider.NewReturns(nil, errors.New("boom"))
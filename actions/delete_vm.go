@@ -8,17 +8,28 @@ import (
 	"k8s.io/client-go/1.4/pkg/api"
 	kubeerrors "k8s.io/client-go/1.4/pkg/api/errors"
 	"k8s.io/client-go/1.4/pkg/api/unversioned"
-	"k8s.io/client-go/1.4/pkg/labels"
 )
 
 type VMDeleter struct {
 	ClientProvider kubecluster.ClientProvider
+	DirectorUUID   string
 }
 
 func (v *VMDeleter) Delete(vmcid cpi.VMCID) error {
-	context, agentID := ParseVMCID(vmcid)
+	cid, err := vmcid.Decode()
+	if err != nil {
+		return err
+	}
+	agentID := cid.ID
 
-	client, err := v.ClientProvider.New(context)
+	client, err := newCIDClient(v.ClientProvider, cid)
+	if err != nil {
+		return err
+	}
+
+	// remove the anchor first so the garbage collector cleans up whatever
+	// the steps below fail to delete
+	err = deleteVMAnchor(client, agentID)
 	if err != nil {
 		return err
 	}
@@ -28,21 +39,31 @@ func (v *VMDeleter) Delete(vmcid cpi.VMCID) error {
 		return err
 	}
 
-	err = deleteServices(client.Services(), agentID)
+	err = deleteServices(client.Services(), v.DirectorUUID, agentID)
 	if err != nil {
 		return err
 	}
 
-	err = deleteConfigMap(client.ConfigMaps(), agentID)
+	err = deleteAgentSettings(client, agentID)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	err = deleteServiceAccount(client, v.DirectorUUID, agentID)
+	if err != nil {
+		return err
+	}
+
+	err = deleteEphemeralDiskClaim(client.PersistentVolumeClaims(), agentID)
+	if err != nil {
+		return err
+	}
+
+	return deleteNamespaceIfEmpty(client)
 }
 
-func deleteConfigMap(configMapService core.ConfigMapInterface, agentID string) error {
-	err := configMapService.Delete("agent-"+agentID, &api.DeleteOptions{GracePeriodSeconds: int64Ptr(0)})
+func deleteEphemeralDiskClaim(pvcClient core.PersistentVolumeClaimInterface, agentID string) error {
+	err := pvcClient.Delete(ephemeralName(agentID), &api.DeleteOptions{GracePeriodSeconds: int64Ptr(0)})
 	if statusError, ok := err.(*kubeerrors.StatusError); ok {
 		if statusError.Status().Reason == unversioned.StatusReasonNotFound {
 			return nil
@@ -51,29 +72,31 @@ func deleteConfigMap(configMapService core.ConfigMapInterface, agentID string) e
 	return err
 }
 
-func deleteServices(serviceClient core.ServiceInterface, agentID string) error {
-	agentSelector, err := labels.Parse("bosh.cloudfoundry.org/agent-id=" + agentID)
+func deleteServices(serviceClient core.ServiceInterface, directorUUID, agentID string) error {
+	agentSelectors, err := directorSelectors(directorUUID, "bosh.cloudfoundry.org/agent-id="+labelValue(agentID))
 	if err != nil {
 		return err
 	}
 
-	serviceList, err := serviceClient.List(api.ListOptions{LabelSelector: agentSelector})
-	if err != nil {
-		return err
-	}
-
-	for _, service := range serviceList.Items {
-		err := serviceClient.Delete(service.Name, &api.DeleteOptions{GracePeriodSeconds: int64Ptr(0)})
+	for _, agentSelector := range agentSelectors {
+		serviceList, err := serviceClient.List(api.ListOptions{LabelSelector: agentSelector})
 		if err != nil {
 			return err
 		}
+
+		for _, service := range serviceList.Items {
+			err := serviceClient.Delete(service.Name, &api.DeleteOptions{GracePeriodSeconds: int64Ptr(0)})
+			if err != nil {
+				return err
+			}
+		}
 	}
 
 	return nil
 }
 
 func deletePod(podClient core.PodInterface, agentID string) error {
-	err := podClient.Delete("agent-"+agentID, &api.DeleteOptions{GracePeriodSeconds: int64Ptr(0)})
+	err := podClient.Delete(agentName(agentID), &api.DeleteOptions{GracePeriodSeconds: int64Ptr(0)})
 	if statusError, ok := err.(*kubeerrors.StatusError); ok {
 		if statusError.Status().Reason == unversioned.StatusReasonNotFound {
 			return nil
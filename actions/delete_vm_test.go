@@ -9,7 +9,10 @@ import (
 	"github.com/sykesm/kubernetes-cpi/cpi"
 	"github.com/sykesm/kubernetes-cpi/kubecluster/fakes"
 	"k8s.io/client-go/1.4/kubernetes/fake"
+	kubeerrors "k8s.io/client-go/1.4/pkg/api/errors"
+	"k8s.io/client-go/1.4/pkg/api/unversioned"
 	"k8s.io/client-go/1.4/pkg/api/v1"
+	rbac "k8s.io/client-go/1.4/pkg/apis/rbac/v1alpha1"
 	"k8s.io/client-go/1.4/pkg/labels"
 	"k8s.io/client-go/1.4/pkg/runtime"
 	"k8s.io/client-go/1.4/testing"
@@ -34,7 +37,7 @@ var _ = Describe("DeleteVM", func() {
 		fakeProvider.NewReturns(fakeClient, nil)
 
 		agentID = "agent-id"
-		vmcid = actions.NewVMCID("bosh", agentID)
+		vmcid = cpi.NewVMCID("bosh", "bosh-namespace", agentID)
 
 		services := []v1.Service{{
 			ObjectMeta: v1.ObjectMeta{
@@ -50,6 +53,16 @@ var _ = Describe("DeleteVM", func() {
 			&v1.Pod{ObjectMeta: v1.ObjectMeta{Name: "agent-agent-id", Namespace: "bosh-namespace"}},
 			&v1.ConfigMap{ObjectMeta: v1.ObjectMeta{Name: "agent-agent-id", Namespace: "bosh-namespace"}},
 			&v1.ServiceList{Items: services},
+			&v1.ServiceAccount{ObjectMeta: v1.ObjectMeta{Name: "agent-agent-id", Namespace: "bosh-namespace"}},
+			&rbac.RoleBindingList{Items: []rbac.RoleBinding{{
+				ObjectMeta: v1.ObjectMeta{
+					Name:      "agent-agent-id-0",
+					Namespace: "bosh-namespace",
+					Labels: map[string]string{
+						"bosh.cloudfoundry.org/agent-id": agentID,
+					},
+				},
+			}}},
 		)
 
 		vmDeleter = &actions.VMDeleter{ClientProvider: fakeProvider}
@@ -104,17 +117,229 @@ var _ = Describe("DeleteVM", func() {
 		Expect(matches[0].(testing.DeleteAction).GetNamespace()).To(Equal("bosh-namespace"))
 	})
 
+	Context("when the director UUID is set", func() {
+		BeforeEach(func() {
+			vmDeleter.DirectorUUID = "director-uuid"
+		})
+
+		It("deletes services labeled with the director UUID or with no director", func() {
+			err := vmDeleter.Delete(vmcid)
+			Expect(err).NotTo(HaveOccurred())
+
+			scoped, err := labels.Parse("bosh.cloudfoundry.org/agent-id=" + agentID + ",bosh.cloudfoundry.org/director-uuid=director-uuid")
+			Expect(err).NotTo(HaveOccurred())
+			unlabelled, err := labels.Parse("bosh.cloudfoundry.org/agent-id=" + agentID + ",!bosh.cloudfoundry.org/director-uuid")
+			Expect(err).NotTo(HaveOccurred())
+
+			matches := fakeClient.MatchingActions("list", "services")
+			Expect(matches).To(HaveLen(2))
+			Expect(matches[0].(testing.ListAction).GetListRestrictions().Labels).To(Equal(scoped))
+			Expect(matches[1].(testing.ListAction).GetListRestrictions().Labels).To(Equal(unlabelled))
+			Expect(fakeClient.MatchingActions("delete", "services")).To(HaveLen(1))
+
+			matches = fakeClient.MatchingActions("list", "rolebindings")
+			Expect(matches).To(HaveLen(2))
+			Expect(matches[0].(testing.ListAction).GetListRestrictions().Labels).To(Equal(scoped))
+			Expect(matches[1].(testing.ListAction).GetListRestrictions().Labels).To(Equal(unlabelled))
+			Expect(fakeClient.MatchingActions("delete", "rolebindings")).To(HaveLen(1))
+		})
+
+		Context("when the service is labeled for another director", func() {
+			BeforeEach(func() {
+				service, err := fakeClient.Services().Get("agent-agent-id")
+				Expect(err).NotTo(HaveOccurred())
+				service.Labels["bosh.cloudfoundry.org/director-uuid"] = "other-director-uuid"
+				_, err = fakeClient.Services().Update(service)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("leaves the service alone", func() {
+				err := vmDeleter.Delete(vmcid)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeClient.MatchingActions("delete", "services")).To(BeEmpty())
+			})
+		})
+	})
+
 	It("deletes the config map", func() {
 		err := vmDeleter.Delete(vmcid)
 		Expect(err).NotTo(HaveOccurred())
 
 		matches := fakeClient.MatchingActions("delete", "configmaps")
+		Expect(matches).To(HaveLen(2))
+
+		Expect(matches[1].(testing.DeleteAction).GetName()).To(Equal("agent-" + agentID))
+		Expect(matches[1].(testing.DeleteAction).GetNamespace()).To(Equal("bosh-namespace"))
+	})
+
+	It("first deletes the VM anchor", func() {
+		err := vmDeleter.Delete(vmcid)
+		Expect(err).NotTo(HaveOccurred())
+
+		deleteAction := fakeClient.Actions()[0].(testing.DeleteAction)
+		Expect(deleteAction.GetResource().Resource).To(Equal("configmaps"))
+		Expect(deleteAction.GetName()).To(Equal("vm-" + agentID))
+		Expect(deleteAction.GetNamespace()).To(Equal("bosh-namespace"))
+	})
+
+	It("deletes the agent settings secret", func() {
+		err := vmDeleter.Delete(vmcid)
+		Expect(err).NotTo(HaveOccurred())
+
+		matches := fakeClient.MatchingActions("delete", "secrets")
 		Expect(matches).To(HaveLen(1))
 
 		Expect(matches[0].(testing.DeleteAction).GetName()).To(Equal("agent-" + agentID))
 		Expect(matches[0].(testing.DeleteAction).GetNamespace()).To(Equal("bosh-namespace"))
 	})
 
+	It("deletes the service account and its role bindings", func() {
+		err := vmDeleter.Delete(vmcid)
+		Expect(err).NotTo(HaveOccurred())
+
+		selector, err := labels.Parse("bosh.cloudfoundry.org/agent-id=" + agentID)
+		Expect(err).NotTo(HaveOccurred())
+
+		matches := fakeClient.MatchingActions("list", "rolebindings")
+		Expect(matches).To(HaveLen(1))
+		Expect(matches[0].(testing.ListAction).GetListRestrictions().Labels).To(Equal(selector))
+
+		matches = fakeClient.MatchingActions("delete", "rolebindings")
+		Expect(matches).To(HaveLen(1))
+		Expect(matches[0].(testing.DeleteAction).GetName()).To(Equal("agent-agent-id-0"))
+
+		matches = fakeClient.MatchingActions("delete", "serviceaccounts")
+		Expect(matches).To(HaveLen(1))
+		Expect(matches[0].(testing.DeleteAction).GetName()).To(Equal("agent-" + agentID))
+		Expect(matches[0].(testing.DeleteAction).GetNamespace()).To(Equal("bosh-namespace"))
+	})
+
+	Context("when the VM has no service account", func() {
+		BeforeEach(func() {
+			err := fakeClient.ServiceAccounts().Delete("agent-agent-id", nil)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("does not look for role bindings", func() {
+			err := vmDeleter.Delete(vmcid)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeClient.MatchingActions("list", "rolebindings")).To(BeEmpty())
+		})
+	})
+
+	Context("when listing role bindings is forbidden", func() {
+		BeforeEach(func() {
+			fakeClient.PrependReactor("list", "rolebindings", func(action testing.Action) (bool, runtime.Object, error) {
+				return true, nil, kubeerrors.NewForbidden(unversioned.GroupResource{Resource: "rolebindings"}, "", errors.New("no access"))
+			})
+		})
+
+		It("still deletes the service account", func() {
+			err := vmDeleter.Delete(vmcid)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeClient.MatchingActions("delete", "serviceaccounts")).To(HaveLen(1))
+		})
+	})
+
+	It("deletes the ephemeral disk claim", func() {
+		err := vmDeleter.Delete(vmcid)
+		Expect(err).NotTo(HaveOccurred())
+
+		matches := fakeClient.MatchingActions("delete", "persistentvolumeclaims")
+		Expect(matches).To(HaveLen(1))
+
+		Expect(matches[0].(testing.DeleteAction).GetName()).To(Equal("ephemeral-" + agentID))
+		Expect(matches[0].(testing.DeleteAction).GetNamespace()).To(Equal("bosh-namespace"))
+	})
+
+	Context("when the VM is in a namespace created for its deployment", func() {
+		BeforeEach(func() {
+			vmcid = cpi.NewVMCID("bosh", "bosh-deployment", agentID)
+
+			_, err := fakeClient.Core().Namespaces().Create(&v1.Namespace{
+				ObjectMeta: v1.ObjectMeta{
+					Name:   "bosh-deployment",
+					Labels: map[string]string{"bosh.cloudfoundry.org/deployment": "deployment"},
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("uses the namespace of the VM", func() {
+			err := vmDeleter.Delete(vmcid)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(fakeClient.Namespace()).To(Equal("bosh-deployment"))
+		})
+
+		It("deletes the namespace once it is empty", func() {
+			err := vmDeleter.Delete(vmcid)
+			Expect(err).NotTo(HaveOccurred())
+
+			matches := fakeClient.MatchingActions("delete", "namespaces")
+			Expect(matches).To(HaveLen(1))
+			Expect(matches[0].(testing.DeleteAction).GetName()).To(Equal("bosh-deployment"))
+		})
+
+		Context("when other pods remain in the namespace", func() {
+			BeforeEach(func() {
+				_, err := fakeClient.Core().Pods("bosh-deployment").Create(&v1.Pod{ObjectMeta: v1.ObjectMeta{Name: "agent-other", Namespace: "bosh-deployment"}})
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("keeps the namespace", func() {
+				err := vmDeleter.Delete(vmcid)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeClient.MatchingActions("delete", "namespaces")).To(BeEmpty())
+			})
+		})
+
+		Context("when claims remain in the namespace", func() {
+			BeforeEach(func() {
+				_, err := fakeClient.Core().PersistentVolumeClaims("bosh-deployment").Create(&v1.PersistentVolumeClaim{ObjectMeta: v1.ObjectMeta{Name: "disk-id", Namespace: "bosh-deployment"}})
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("keeps the namespace", func() {
+				err := vmDeleter.Delete(vmcid)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeClient.MatchingActions("delete", "namespaces")).To(BeEmpty())
+			})
+		})
+
+		Context("when another VM is being created in the namespace", func() {
+			BeforeEach(func() {
+				_, err := fakeClient.Core().ConfigMaps("bosh-deployment").Create(&v1.ConfigMap{
+					ObjectMeta: v1.ObjectMeta{
+						Name:      "vm-other",
+						Namespace: "bosh-deployment",
+						Labels:    map[string]string{"bosh.cloudfoundry.org/agent-id": "other"},
+					},
+				})
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("keeps the namespace", func() {
+				err := vmDeleter.Delete(vmcid)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeClient.MatchingActions("delete", "namespaces")).To(BeEmpty())
+			})
+		})
+	})
+
+	Context("when the namespace was not created for a deployment", func() {
+		BeforeEach(func() {
+			_, err := fakeClient.Core().Namespaces().Create(&v1.Namespace{ObjectMeta: v1.ObjectMeta{Name: "bosh-namespace"}})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("keeps the namespace", func() {
+			err := vmDeleter.Delete(vmcid)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeClient.MatchingActions("delete", "namespaces")).To(BeEmpty())
+		})
+	})
+
 	Context("when objects have already been deleted", func() {
 		BeforeEach(func() {
 			err := vmDeleter.Delete(vmcid)
@@ -125,11 +350,18 @@ var _ = Describe("DeleteVM", func() {
 			err := vmDeleter.Delete(vmcid)
 			Expect(err).NotTo(HaveOccurred())
 
-			Expect(fakeClient.Actions()).To(HaveLen(7))
+			Expect(fakeClient.Actions()).To(HaveLen(20))
+			Expect(fakeClient.MatchingActions("get", "namespaces")).To(HaveLen(2))
 			Expect(fakeClient.MatchingActions("delete", "pods")).To(HaveLen(2))
 			Expect(fakeClient.MatchingActions("list", "services")).To(HaveLen(2))
 			Expect(fakeClient.MatchingActions("delete", "services")).To(HaveLen(1))
-			Expect(fakeClient.MatchingActions("delete", "configmaps")).To(HaveLen(2))
+			Expect(fakeClient.MatchingActions("delete", "configmaps")).To(HaveLen(4))
+			Expect(fakeClient.MatchingActions("delete", "secrets")).To(HaveLen(2))
+			Expect(fakeClient.MatchingActions("get", "serviceaccounts")).To(HaveLen(2))
+			Expect(fakeClient.MatchingActions("list", "rolebindings")).To(HaveLen(1))
+			Expect(fakeClient.MatchingActions("delete", "rolebindings")).To(HaveLen(1))
+			Expect(fakeClient.MatchingActions("delete", "serviceaccounts")).To(HaveLen(1))
+			Expect(fakeClient.MatchingActions("delete", "persistentvolumeclaims")).To(HaveLen(2))
 		})
 	})
 
@@ -161,14 +393,35 @@ var _ = Describe("DeleteVM", func() {
 		})
 	})
 
-	Context("when building the agent selector fails", func() {
+	Context("when deleting the ephemeral disk claim fails", func() {
 		BeforeEach(func() {
-			vmcid = actions.NewVMCID("bosh", "**invalid**")
+			fakeClient.PrependReactor("delete", "persistentvolumeclaims", func(action testing.Action) (bool, runtime.Object, error) {
+				return true, nil, errors.New("pvc-welp")
+			})
 		})
 
 		It("returns an error", func() {
 			err := vmDeleter.Delete(vmcid)
-			Expect(err).To(MatchError(ContainSubstring("invalid label value")))
+			Expect(err).To(MatchError("pvc-welp"))
+		})
+	})
+
+	Context("when the agent ID is not a valid name", func() {
+		BeforeEach(func() {
+			vmcid = cpi.NewVMCID("bosh", "bosh-namespace", "**Invalid**")
+		})
+
+		It("deletes the objects with the shortened names", func() {
+			err := vmDeleter.Delete(vmcid)
+			Expect(err).NotTo(HaveOccurred())
+
+			matches := fakeClient.MatchingActions("delete", "pods")
+			Expect(matches).To(HaveLen(1))
+			Expect(matches[0].(testing.DeleteAction).GetName()).To(MatchRegexp(`^agent-invalid-[0-9a-f]{10}$`))
+
+			matches = fakeClient.MatchingActions("list", "services")
+			Expect(matches).To(HaveLen(1))
+			Expect(matches[0].(testing.ListAction).GetListRestrictions().Labels.String()).To(MatchRegexp(`^bosh\.cloudfoundry\.org/agent-id=Invalid-[0-9a-f]{10}$`))
 		})
 	})
 
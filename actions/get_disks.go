@@ -1,60 +1,147 @@
 package actions
 
 import (
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"sort"
+	"strings"
 
+	"github.com/sykesm/kubernetes-cpi/agent"
 	"github.com/sykesm/kubernetes-cpi/cpi"
 	"github.com/sykesm/kubernetes-cpi/kubecluster"
-	core "k8s.io/client-go/1.4/kubernetes/typed/core/v1"
+	"k8s.io/client-go/1.4/pkg/api"
 	"k8s.io/client-go/1.4/pkg/api/errors"
-	"k8s.io/client-go/1.4/pkg/api/v1"
 )
 
+// DiskGetter reports the disks of an agent by reconciling the volumes of the
+// agent pod, the persistent disks in the agent settings, and the claims
+// labelled for the agent. Disks that are missing from some of the sources are
+// still returned and the inconsistency is written to the Logger.
 type DiskGetter struct {
 	ClientProvider kubecluster.ClientProvider
+	DirectorUUID   string
+	SettingsKind   SettingsKind
+	Logger         io.Writer
+}
+
+type diskSources struct {
+	pod      bool
+	settings bool
+	claim    bool
 }
 
 func (d *DiskGetter) GetDisks(vmcid cpi.VMCID) ([]cpi.DiskCID, error) {
-	context, agentID := ParseVMCID(vmcid)
-	client, err := d.ClientProvider.New(context)
+	cid, err := vmcid.Decode()
 	if err != nil {
 		return nil, err
 	}
+	agentID := cid.ID
 
-	pod, err := client.Pods().Get("agent-" + agentID)
+	client, err := newCIDClient(d.ClientProvider, cid)
 	if err != nil {
-		if statusError, ok := err.(*errors.StatusError); ok {
-			if statusError.Status().Code == http.StatusNotFound {
-				return []cpi.DiskCID{}, nil
-			}
-		}
 		return nil, err
 	}
 
-	diskIDs := []cpi.DiskCID{}
-	for _, v := range pod.Spec.Volumes {
-		pvc, err := getPVClaim(client.PersistentVolumeClaims(), v.VolumeSource)
-		if err != nil && !isNotFoundStatusError(err) {
+	sources := map[string]*diskSources{}
+	source := func(diskID string) *diskSources {
+		if sources[diskID] == nil {
+			sources[diskID] = &diskSources{}
+		}
+		return sources[diskID]
+	}
+
+	// long disk IDs are shortened in volume names, so the names are
+	// resolved to disk IDs once the settings and claims are known
+	volumeDiskIDs := map[string]string{}
+
+	podFound := true
+	var mounted []string
+	pod, err := client.Pods().Get(agentName(agentID))
+	if err != nil {
+		if !isNotFoundStatusError(err) {
 			return nil, err
 		}
+		podFound = false
+	} else {
+		mounted = diskVolumeNames(&pod.Spec)
+	}
 
-		if pvc == nil {
-			continue
+	settings := &agent.Settings{}
+	stored, err := getAgentSettings(client, d.SettingsKind, agentID)
+	if err != nil && !isNotFoundStatusError(err) {
+		return nil, err
+	}
+	if stored != nil {
+		settings = stored.Settings
+	}
+	// Migrated disks are recorded under the disk CID known to the director.
+	settingsCIDs := map[string]cpi.DiskCID{}
+	for diskCID := range settings.Disks.Persistent {
+		decoded, err := cpi.DiskCID(diskCID).Decode()
+		if err != nil {
+			return nil, err
 		}
+		source(decoded.ID).settings = true
+		settingsCIDs[decoded.ID] = cpi.DiskCID(diskCID)
+		volumeDiskIDs[diskName(decoded.ID)] = decoded.ID
+	}
 
-		if diskID, ok := pvc.Labels["bosh.cloudfoundry.org/disk-id"]; ok {
-			diskIDs = append(diskIDs, NewDiskCID(context, diskID))
+	agentSelectors, err := directorSelectors(d.DirectorUUID, "bosh.cloudfoundry.org/agent-id="+labelValue(agentID))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, agentSelector := range agentSelectors {
+		pvcList, err := client.PersistentVolumeClaims().List(api.ListOptions{LabelSelector: agentSelector})
+		if err != nil {
+			return nil, err
+		}
+		for _, pvc := range pvcList.Items {
+			if diskID := objectID(pvc.ObjectMeta, "bosh.cloudfoundry.org/disk-id"); diskID != "" {
+				source(diskID).claim = true
+				volumeDiskIDs[pvc.Name] = diskID
+			}
 		}
 	}
 
-	return diskIDs, nil
-}
+	for _, name := range mounted {
+		diskID, ok := volumeDiskIDs[name]
+		if !ok {
+			diskID = strings.TrimPrefix(name, "disk-")
+		}
+		source(diskID).pod = true
+	}
 
-func getPVClaim(pvcClient core.PersistentVolumeClaimInterface, volumeSource v1.VolumeSource) (*v1.PersistentVolumeClaim, error) {
-	if volumeSource.PersistentVolumeClaim != nil {
-		return pvcClient.Get(volumeSource.PersistentVolumeClaim.ClaimName)
+	var diskIDs []string
+	for diskID := range sources {
+		diskIDs = append(diskIDs, diskID)
+	}
+	sort.Strings(diskIDs)
+
+	logger := d.Logger
+	if logger == nil {
+		logger = ioutil.Discard
+	}
+
+	disks := []cpi.DiskCID{}
+	for _, diskID := range diskIDs {
+		diskCID, ok := settingsCIDs[diskID]
+		if !ok {
+			diskCID = cpi.NewDiskCID(cid.Context, cid.Namespace, diskID)
+		}
+		disks = append(disks, diskCID)
+
+		s := sources[diskID]
+		if (s.pod || !podFound) && s.settings && s.claim {
+			continue
+		}
+		fmt.Fprintf(logger, "Inconsistent state for disk %s: mounted in pod: %t, in agent settings: %t, claim labelled for agent: %t\n",
+			diskCID, s.pod, s.settings, s.claim)
 	}
-	return nil, nil
+
+	return disks, nil
 }
 
 func isNotFoundStatusError(err error) bool {
@@ -63,3 +150,17 @@ func isNotFoundStatusError(err error) bool {
 	}
 	return false
 }
+
+func isForbiddenStatusError(err error) bool {
+	if statusErr, ok := err.(*errors.StatusError); ok {
+		return statusErr.Status().Code == http.StatusForbidden
+	}
+	return false
+}
+
+func isAlreadyExistsStatusError(err error) bool {
+	if statusErr, ok := err.(*errors.StatusError); ok {
+		return statusErr.Status().Code == http.StatusConflict
+	}
+	return false
+}
@@ -1,6 +1,7 @@
 package actions_test
 
 import (
+	"bytes"
 	"errors"
 
 	"github.com/sykesm/kubernetes-cpi/actions"
@@ -20,6 +21,7 @@ var _ = Describe("DiskGetter", func() {
 	var (
 		fakeClient   *fakes.Client
 		fakeProvider *fakes.ClientProvider
+		logger       *bytes.Buffer
 
 		diskGetter *actions.DiskGetter
 	)
@@ -28,9 +30,9 @@ var _ = Describe("DiskGetter", func() {
 		fakeClient = fakes.NewClient(
 			&v1.Pod{
 				ObjectMeta: v1.ObjectMeta{
-					Name:      "agent-agentID",
+					Name:      "agent-agent-id",
 					Namespace: "bosh-namespace",
-					Labels:    map[string]string{"bosh.cloudfoundry.org/agent-id": "agentID"},
+					Labels:    map[string]string{"bosh.cloudfoundry.org/agent-id": "agent-id"},
 				},
 				Spec: v1.PodSpec{
 					Volumes: []v1.Volume{{
@@ -44,40 +46,57 @@ var _ = Describe("DiskGetter", func() {
 							EmptyDir: &v1.EmptyDirVolumeSource{},
 						},
 					}, {
-						Name: "disk-diskID-1",
+						Name: "disk-disk-id-1",
 						VolumeSource: v1.VolumeSource{
-							PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: "disk-diskID-1"},
+							PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: "disk-disk-id-1"},
 						},
 					}, {
-						Name: "disk-diskID-2",
+						Name: "disk-disk-id-2",
 						VolumeSource: v1.VolumeSource{
-							PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: "disk-diskID-2"},
-						},
-					}, {
-						Name: "disk-nolabel",
-						VolumeSource: v1.VolumeSource{
-							PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: "disk-nolabel"},
+							PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: "disk-disk-id-2"},
 						},
 					}},
 				},
 			},
+			&v1.ConfigMap{
+				ObjectMeta: v1.ObjectMeta{
+					Name:      "agent-agent-id",
+					Namespace: "bosh-namespace",
+				},
+				Data: map[string]string{
+					"instance_settings": `{ "disks": { "persistent": {
+						"context-name:disk-id-1": "/mnt/disk-id-1",
+						"context-name:disk-id-2": "/mnt/disk-id-2"
+					}}}`,
+				},
+			},
 			&v1.PersistentVolumeClaimList{
 				Items: []v1.PersistentVolumeClaim{{
 					ObjectMeta: v1.ObjectMeta{
-						Name:      "disk-diskID-1",
+						Name:      "disk-disk-id-1",
 						Namespace: "bosh-namespace",
-						Labels:    map[string]string{"bosh.cloudfoundry.org/disk-id": "diskID-1"},
+						Labels: map[string]string{
+							"bosh.cloudfoundry.org/agent-id": "agent-id",
+							"bosh.cloudfoundry.org/disk-id":  "disk-id-1",
+						},
 					},
 				}, {
 					ObjectMeta: v1.ObjectMeta{
-						Name:      "disk-diskID-2",
+						Name:      "disk-disk-id-2",
 						Namespace: "bosh-namespace",
-						Labels:    map[string]string{"bosh.cloudfoundry.org/disk-id": "diskID-2-label-value"},
+						Labels: map[string]string{
+							"bosh.cloudfoundry.org/agent-id": "agent-id",
+							"bosh.cloudfoundry.org/disk-id":  "disk-id-2",
+						},
 					},
 				}, {
 					ObjectMeta: v1.ObjectMeta{
-						Name:      "disk-nolabel",
+						Name:      "disk-other",
 						Namespace: "bosh-namespace",
+						Labels: map[string]string{
+							"bosh.cloudfoundry.org/agent-id": "other-agent",
+							"bosh.cloudfoundry.org/disk-id":  "other",
+						},
 					},
 				}},
 			},
@@ -87,50 +106,114 @@ var _ = Describe("DiskGetter", func() {
 		fakeProvider = &fakes.ClientProvider{}
 		fakeProvider.NewReturns(fakeClient, nil)
 
+		logger = &bytes.Buffer{}
 		diskGetter = &actions.DiskGetter{
 			ClientProvider: fakeProvider,
+			Logger:         logger,
 		}
 	})
 
 	It("gets a client with the context from the DiskCID", func() {
-		_, err := diskGetter.GetDisks(cpi.VMCID("context-name:agentID"))
+		_, err := diskGetter.GetDisks(cpi.VMCID("context-name:agent-id"))
 		Expect(err).NotTo(HaveOccurred())
 
 		Expect(fakeProvider.NewCallCount()).To(Equal(1))
 		Expect(fakeProvider.NewArgsForCall(0)).To(Equal("context-name"))
 	})
 
-	It("retrieves the pod by name", func() {
-		_, err := diskGetter.GetDisks(cpi.VMCID("context-name:agentID"))
+	It("retrieves the pod and config map by name", func() {
+		_, err := diskGetter.GetDisks(cpi.VMCID("context-name:agent-id"))
 		Expect(err).NotTo(HaveOccurred())
 
 		matches := fakeClient.MatchingActions("get", "pods")
 		Expect(matches).To(HaveLen(1))
-		Expect(matches[0].(testing.GetAction).GetName()).To(Equal("agent-agentID"))
+		Expect(matches[0].(testing.GetAction).GetName()).To(Equal("agent-agent-id"))
+
+		matches = fakeClient.MatchingActions("get", "configmaps")
+		Expect(matches).To(HaveLen(1))
+		Expect(matches[0].(testing.GetAction).GetName()).To(Equal("agent-agent-id"))
 	})
 
-	It("retrieves pv claims", func() {
-		_, err := diskGetter.GetDisks(cpi.VMCID("context-name:agentID"))
+	It("lists the pv claims labelled for the agent", func() {
+		_, err := diskGetter.GetDisks(cpi.VMCID("context-name:agent-id"))
 		Expect(err).NotTo(HaveOccurred())
 
-		matches := fakeClient.MatchingActions("get", "persistentvolumeclaims")
-		Expect(matches).To(HaveLen(3))
-		Expect(matches[0].(testing.GetAction).GetName()).To(Equal("disk-diskID-1"))
-		Expect(matches[1].(testing.GetAction).GetName()).To(Equal("disk-diskID-2"))
-		Expect(matches[2].(testing.GetAction).GetName()).To(Equal("disk-nolabel"))
+		Expect(fakeClient.MatchingActions("get", "persistentvolumeclaims")).To(BeEmpty())
+
+		matches := fakeClient.MatchingActions("list", "persistentvolumeclaims")
+		Expect(matches).To(HaveLen(1))
+		Expect(matches[0].(testing.ListAction).GetListRestrictions().Labels.String()).To(Equal("bosh.cloudfoundry.org/agent-id=agent-id"))
 	})
 
-	It("returns cloud IDs of claimed disks", func() {
-		disks, err := diskGetter.GetDisks(cpi.VMCID("context-name:agentID"))
+	Context("when the director UUID is set", func() {
+		BeforeEach(func() {
+			diskGetter.DirectorUUID = "director-uuid"
+		})
+
+		It("lists the pv claims labelled for the agent and director or with no director", func() {
+			_, err := diskGetter.GetDisks(cpi.VMCID("context-name:agent-id"))
+			Expect(err).NotTo(HaveOccurred())
+
+			matches := fakeClient.MatchingActions("list", "persistentvolumeclaims")
+			Expect(matches).To(HaveLen(2))
+			Expect(matches[0].(testing.ListAction).GetListRestrictions().Labels.String()).To(Equal("bosh.cloudfoundry.org/agent-id=agent-id,bosh.cloudfoundry.org/director-uuid=director-uuid"))
+			Expect(matches[1].(testing.ListAction).GetListRestrictions().Labels.String()).To(Equal("bosh.cloudfoundry.org/agent-id=agent-id,!bosh.cloudfoundry.org/director-uuid"))
+		})
+
+		It("returns the disks created before claims were labelled with the director", func() {
+			disks, err := diskGetter.GetDisks(cpi.VMCID("context-name:agent-id"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(disks).To(Equal([]cpi.DiskCID{
+				cpi.DiskCID("context-name:disk-id-1"),
+				cpi.DiskCID("context-name:disk-id-2"),
+			}))
+		})
+	})
+
+	It("returns cloud IDs of the agent's disks", func() {
+		disks, err := diskGetter.GetDisks(cpi.VMCID("context-name:agent-id"))
 		Expect(err).NotTo(HaveOccurred())
 
-		Expect(disks).To(ConsistOf(
-			cpi.DiskCID("context-name:diskID-1"),
-			cpi.DiskCID("context-name:diskID-2-label-value"),
-		))
+		Expect(disks).To(Equal([]cpi.DiskCID{
+			cpi.DiskCID("context-name:disk-id-1"),
+			cpi.DiskCID("context-name:disk-id-2"),
+		}))
+		Expect(logger.String()).To(BeEmpty())
+	})
+
+	Context("when the disk ID of a claim was shortened", func() {
+		BeforeEach(func() {
+			pod, err := fakeClient.Pods().Get("agent-agent-id")
+			Expect(err).NotTo(HaveOccurred())
+			pod.Spec.Volumes[3].Name = "disk-disk-a1b2c3d4e5"
+			pod.Spec.Volumes[3].PersistentVolumeClaim.ClaimName = "disk-disk-a1b2c3d4e5"
+			_, err = fakeClient.Pods().Update(pod)
+			Expect(err).NotTo(HaveOccurred())
+
+			pvc, err := fakeClient.PersistentVolumeClaims().Get("disk-disk-id-2")
+			Expect(err).NotTo(HaveOccurred())
+			err = fakeClient.PersistentVolumeClaims().Delete("disk-disk-id-2", nil)
+			Expect(err).NotTo(HaveOccurred())
+			pvc.Name = "disk-disk-a1b2c3d4e5"
+			pvc.Labels["bosh.cloudfoundry.org/disk-id"] = "disk-a1b2c3d4e5"
+			pvc.Annotations = map[string]string{"bosh.cloudfoundry.org/disk-id": "disk-id-2"}
+			_, err = fakeClient.PersistentVolumeClaims().Create(pvc)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("resolves the disk ID from the claim annotation", func() {
+			disks, err := diskGetter.GetDisks(cpi.VMCID("context-name:agent-id"))
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(disks).To(Equal([]cpi.DiskCID{
+				cpi.DiskCID("context-name:disk-id-1"),
+				cpi.DiskCID("context-name:disk-id-2"),
+			}))
+			Expect(logger.String()).To(BeEmpty())
+		})
 	})
 
-	Context("when the pod isn't found", func() {
+	Context("when nothing is found for the agent", func() {
 		It("returns an empty list", func() {
 			disks, err := diskGetter.GetDisks(cpi.VMCID("context-name:missing"))
 			Expect(err).NotTo(HaveOccurred())
@@ -139,6 +222,62 @@ var _ = Describe("DiskGetter", func() {
 		})
 	})
 
+	Context("when the pod is absent during a recreate", func() {
+		BeforeEach(func() {
+			fakeClient.PrependReactor("get", "pods", func(action testing.Action) (bool, runtime.Object, error) {
+				return true, nil, kubeerrors.NewNotFound(unversioned.GroupResource{}, "agent-agent-id")
+			})
+		})
+
+		It("returns the disks from the agent settings and claims", func() {
+			disks, err := diskGetter.GetDisks(cpi.VMCID("context-name:agent-id"))
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(disks).To(Equal([]cpi.DiskCID{
+				cpi.DiskCID("context-name:disk-id-1"),
+				cpi.DiskCID("context-name:disk-id-2"),
+			}))
+			Expect(logger.String()).To(BeEmpty())
+		})
+	})
+
+	Context("when the sources are inconsistent", func() {
+		BeforeEach(func() {
+			fakeClient.PrependReactor("get", "configmaps", func(action testing.Action) (bool, runtime.Object, error) {
+				return true, &v1.ConfigMap{
+					ObjectMeta: v1.ObjectMeta{Name: "agent-agent-id", Namespace: "bosh-namespace"},
+					Data: map[string]string{
+						"instance_settings": `{ "disks": { "persistent": {
+							"context-name:disk-id-1": "/mnt/disk-id-1",
+							"context-name:disk-id-3": "/mnt/disk-id-3"
+						}}}`,
+					},
+				}, nil
+			})
+		})
+
+		It("returns the disks from every source", func() {
+			disks, err := diskGetter.GetDisks(cpi.VMCID("context-name:agent-id"))
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(disks).To(Equal([]cpi.DiskCID{
+				cpi.DiskCID("context-name:disk-id-1"),
+				cpi.DiskCID("context-name:disk-id-2"),
+				cpi.DiskCID("context-name:disk-id-3"),
+			}))
+		})
+
+		It("logs the inconsistencies", func() {
+			_, err := diskGetter.GetDisks(cpi.VMCID("context-name:agent-id"))
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(logger.String()).To(Equal(
+				"Inconsistent state for disk context-name:disk-id-2: mounted in pod: true, in agent settings: false, claim labelled for agent: true\n" +
+					"Inconsistent state for disk context-name:disk-id-3: mounted in pod: false, in agent settings: true, claim labelled for agent: false\n",
+			))
+		})
+	})
+
 	Context("when getting the pod fails", func() {
 		BeforeEach(func() {
 			fakeClient.PrependReactor("get", "pods", func(action testing.Action) (bool, runtime.Object, error) {
@@ -147,38 +286,34 @@ var _ = Describe("DiskGetter", func() {
 		})
 
 		It("returns an error", func() {
-			_, err := diskGetter.GetDisks(cpi.VMCID("context-name:agentID"))
+			_, err := diskGetter.GetDisks(cpi.VMCID("context-name:agent-id"))
 			Expect(err).To(MatchError("get-pod-welp"))
 		})
 	})
 
-	Context("when a pv claim can't be found", func() {
+	Context("when getting the config map fails", func() {
 		BeforeEach(func() {
-			fakeClient.PrependReactor("get", "persistentvolumeclaims", func(action testing.Action) (bool, runtime.Object, error) {
-				if action.(testing.GetAction).GetName() == "disk-diskID-1" {
-					return true, nil, kubeerrors.NewNotFound(unversioned.GroupResource{}, "disk-diskID-1")
-				}
-				return false, nil, nil
+			fakeClient.PrependReactor("get", "configmaps", func(action testing.Action) (bool, runtime.Object, error) {
+				return true, nil, errors.New("get-cm-welp")
 			})
 		})
 
-		It("it ignores the error", func() {
-			disks, err := diskGetter.GetDisks(cpi.VMCID("context-name:agentID"))
-			Expect(err).NotTo(HaveOccurred())
-			Expect(disks).To(ConsistOf(cpi.DiskCID("context-name:diskID-2-label-value")))
+		It("returns an error", func() {
+			_, err := diskGetter.GetDisks(cpi.VMCID("context-name:agent-id"))
+			Expect(err).To(MatchError("get-cm-welp"))
 		})
 	})
 
-	Context("when getting a pv claim fails", func() {
+	Context("when listing the pv claims fails", func() {
 		BeforeEach(func() {
-			fakeClient.PrependReactor("get", "persistentvolumeclaims", func(action testing.Action) (bool, runtime.Object, error) {
-				return true, nil, errors.New("get-pvc-welp")
+			fakeClient.PrependReactor("list", "persistentvolumeclaims", func(action testing.Action) (bool, runtime.Object, error) {
+				return true, nil, errors.New("list-pvc-welp")
 			})
 		})
 
 		It("returns an error", func() {
-			_, err := diskGetter.GetDisks(cpi.VMCID("context-name:agentID"))
-			Expect(err).To(MatchError("get-pvc-welp"))
+			_, err := diskGetter.GetDisks(cpi.VMCID("context-name:agent-id"))
+			Expect(err).To(MatchError("list-pvc-welp"))
 		})
 	})
 })
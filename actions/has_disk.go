@@ -4,30 +4,52 @@ import (
 	"github.com/sykesm/kubernetes-cpi/cpi"
 	"github.com/sykesm/kubernetes-cpi/kubecluster"
 	"k8s.io/client-go/1.4/pkg/api"
-	"k8s.io/client-go/1.4/pkg/labels"
 )
 
 type DiskFinder struct {
 	ClientProvider kubecluster.ClientProvider
+	DirectorUUID   string
+
+	// MovedDiskContexts holds the contexts attach_disk may have moved disks
+	// into.
+	MovedDiskContexts []string
 }
 
 func (d *DiskFinder) HasDisk(diskCID cpi.DiskCID) (bool, error) {
-	context, diskID := ParseDiskCID(diskCID)
-	diskSelector, err := labels.Parse("bosh.cloudfoundry.org/disk-id=" + diskID)
+	cid, err := diskCID.Decode()
 	if err != nil {
 		return false, err
 	}
 
-	client, err := d.ClientProvider.New(context)
+	diskSelectors, err := directorSelectors(d.DirectorUUID, "bosh.cloudfoundry.org/disk-id="+labelValue(cid.ID))
 	if err != nil {
 		return false, err
 	}
 
-	listOptions := api.ListOptions{LabelSelector: diskSelector}
-	pvcList, err := client.PersistentVolumeClaims().List(listOptions)
+	client, err := newCIDClient(d.ClientProvider, cid)
 	if err != nil {
 		return false, err
 	}
 
-	return len(pvcList.Items) > 0, nil
+	for _, diskSelector := range diskSelectors {
+		listOptions := api.ListOptions{LabelSelector: diskSelector}
+		pvcList, err := client.PersistentVolumeClaims().List(listOptions)
+		if err != nil {
+			return false, err
+		}
+
+		if len(pvcList.Items) > 0 {
+			return true, nil
+		}
+	}
+
+	if len(d.MovedDiskContexts) == 0 {
+		return false, nil
+	}
+
+	_, pvc, err := findMovedClaim(d.ClientProvider, d.MovedDiskContexts, diskCID)
+	if err != nil {
+		return false, err
+	}
+	return pvc != nil, nil
 }
@@ -5,6 +5,7 @@ import (
 
 	"github.com/sykesm/kubernetes-cpi/actions"
 	"github.com/sykesm/kubernetes-cpi/cpi"
+	"github.com/sykesm/kubernetes-cpi/kubecluster"
 	"github.com/sykesm/kubernetes-cpi/kubecluster/fakes"
 	"k8s.io/client-go/1.4/pkg/api/v1"
 	"k8s.io/client-go/1.4/testing"
@@ -26,9 +27,9 @@ var _ = Describe("HasDisk", func() {
 			&v1.PersistentVolumeClaimList{
 				Items: []v1.PersistentVolumeClaim{{
 					ObjectMeta: v1.ObjectMeta{
-						Name:      "disk-diskID-1",
+						Name:      "disk-disk-id-1",
 						Namespace: "bosh-namespace",
-						Labels:    map[string]string{"bosh.cloudfoundry.org/disk-id": "diskID-1"},
+						Labels:    map[string]string{"bosh.cloudfoundry.org/disk-id": "disk-id-1"},
 					},
 				}},
 			},
@@ -44,7 +45,7 @@ var _ = Describe("HasDisk", func() {
 	})
 
 	It("gets a client with the context from the DiskCID", func() {
-		_, err := diskFinder.HasDisk(cpi.DiskCID("context-name:diskID-1"))
+		_, err := diskFinder.HasDisk(cpi.DiskCID("context-name:disk-id-1"))
 		Expect(err).NotTo(HaveOccurred())
 
 		Expect(fakeProvider.NewCallCount()).To(Equal(1))
@@ -52,16 +53,16 @@ var _ = Describe("HasDisk", func() {
 	})
 
 	It("lists disks labled with the disk ID", func() {
-		_, err := diskFinder.HasDisk(cpi.DiskCID("context-name:diskID-1"))
+		_, err := diskFinder.HasDisk(cpi.DiskCID("context-name:disk-id-1"))
 		Expect(err).NotTo(HaveOccurred())
 
 		Expect(fakeClient.Actions()).To(HaveLen(1))
 		listAction := fakeClient.Actions()[0].(testing.ListAction)
-		Expect(listAction.GetListRestrictions().Labels.String()).To(Equal("bosh.cloudfoundry.org/disk-id=diskID-1"))
+		Expect(listAction.GetListRestrictions().Labels.String()).To(Equal("bosh.cloudfoundry.org/disk-id=disk-id-1"))
 	})
 
 	It("returns true when the disk is found", func() {
-		found, err := diskFinder.HasDisk(cpi.DiskCID("context-name:diskID-1"))
+		found, err := diskFinder.HasDisk(cpi.DiskCID("context-name:disk-id-1"))
 		Expect(err).NotTo(HaveOccurred())
 		Expect(found).To(BeTrue())
 	})
@@ -72,6 +73,101 @@ var _ = Describe("HasDisk", func() {
 		Expect(found).To(BeFalse())
 	})
 
+	Context("when attach_disk moved the disk into another context", func() {
+		BeforeEach(func() {
+			movedClient := fakes.NewClient(&v1.PersistentVolumeClaim{
+				ObjectMeta: v1.ObjectMeta{
+					Name:        "disk-missing",
+					Namespace:   "other-namespace",
+					Labels:      map[string]string{"bosh.cloudfoundry.org/disk-id": "missing"},
+					Annotations: map[string]string{actions.MigratedFromAnnotation: "context-name:missing"},
+				},
+			})
+			movedClient.NamespaceReturns("other-namespace")
+
+			fakeProvider.NewStub = func(context string) (kubecluster.Client, error) {
+				if context == "other" {
+					return movedClient, nil
+				}
+				return fakeClient, nil
+			}
+			diskFinder.MovedDiskContexts = []string{"context-name", "other"}
+		})
+
+		It("returns true", func() {
+			found, err := diskFinder.HasDisk(cpi.DiskCID("context-name:missing"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(found).To(BeTrue())
+		})
+
+		It("returns false for a disk that was not moved", func() {
+			found, err := diskFinder.HasDisk(cpi.DiskCID("context-name:unknown"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(found).To(BeFalse())
+		})
+
+		Context("when the claim was moved into a deployment namespace", func() {
+			BeforeEach(func() {
+				movedClient := fakes.NewClient(&v1.PersistentVolumeClaim{
+					ObjectMeta: v1.ObjectMeta{
+						Name:        "disk-missing",
+						Namespace:   "other-namespace-my-deployment",
+						Labels:      map[string]string{"bosh.cloudfoundry.org/disk-id": "missing"},
+						Annotations: map[string]string{actions.MigratedFromAnnotation: "context-name:missing"},
+					},
+				})
+				movedClient.NamespaceReturns("other-namespace")
+
+				fakeProvider.NewStub = func(context string) (kubecluster.Client, error) {
+					if context == "other" {
+						return movedClient, nil
+					}
+					return fakeClient, nil
+				}
+			})
+
+			It("returns true", func() {
+				found, err := diskFinder.HasDisk(cpi.DiskCID("context-name:missing"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(found).To(BeTrue())
+			})
+		})
+	})
+
+	Context("when the director UUID is set", func() {
+		BeforeEach(func() {
+			diskFinder.DirectorUUID = "director-uuid"
+		})
+
+		It("lists disks labeled with the director UUID and then disks with no director", func() {
+			found, err := diskFinder.HasDisk(cpi.DiskCID("context-name:disk-id-1"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(found).To(BeTrue())
+
+			Expect(fakeClient.Actions()).To(HaveLen(2))
+			listAction := fakeClient.Actions()[0].(testing.ListAction)
+			Expect(listAction.GetListRestrictions().Labels.String()).To(Equal("bosh.cloudfoundry.org/director-uuid=director-uuid,bosh.cloudfoundry.org/disk-id=disk-id-1"))
+			listAction = fakeClient.Actions()[1].(testing.ListAction)
+			Expect(listAction.GetListRestrictions().Labels.String()).To(Equal("!bosh.cloudfoundry.org/director-uuid,bosh.cloudfoundry.org/disk-id=disk-id-1"))
+		})
+
+		Context("when the disk is labeled for another director", func() {
+			BeforeEach(func() {
+				pvc, err := fakeClient.PersistentVolumeClaims().Get("disk-disk-id-1")
+				Expect(err).NotTo(HaveOccurred())
+				pvc.Labels["bosh.cloudfoundry.org/director-uuid"] = "other-director-uuid"
+				_, err = fakeClient.PersistentVolumeClaims().Update(pvc)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("returns false", func() {
+				found, err := diskFinder.HasDisk(cpi.DiskCID("context-name:disk-id-1"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(found).To(BeFalse())
+			})
+		})
+	})
+
 	Context("when the client cannot be created", func() {
 		BeforeEach(func() {
 			fakeProvider.NewReturns(nil, errors.New("welp"))
@@ -83,10 +179,13 @@ var _ = Describe("HasDisk", func() {
 		})
 	})
 
-	Context("when the label can't be parsed", func() {
-		It("returns an error", func() {
+	Context("when the disk ID is not a valid label value", func() {
+		It("selects claims labeled with the shortened disk ID", func() {
 			_, err := diskFinder.HasDisk(cpi.DiskCID("context-name:%&^*****@*^"))
-			Expect(err).To(HaveOccurred())
+			Expect(err).NotTo(HaveOccurred())
+
+			listAction := fakeClient.Actions()[0].(testing.ListAction)
+			Expect(listAction.GetListRestrictions().Labels.String()).To(MatchRegexp(`^bosh\.cloudfoundry\.org/disk-id=[0-9a-f]{10}$`))
 		})
 	})
 })
@@ -5,11 +5,11 @@ import (
 	"github.com/sykesm/kubernetes-cpi/kubecluster"
 	"k8s.io/client-go/1.4/pkg/api"
 	"k8s.io/client-go/1.4/pkg/api/v1"
-	"k8s.io/client-go/1.4/pkg/labels"
 )
 
 type VMFinder struct {
 	ClientProvider kubecluster.ClientProvider
+	DirectorUUID   string
 }
 
 func (f *VMFinder) HasVM(vmcid cpi.VMCID) (bool, error) {
@@ -18,25 +18,31 @@ func (f *VMFinder) HasVM(vmcid cpi.VMCID) (bool, error) {
 }
 
 func (f *VMFinder) FindVM(vmcid cpi.VMCID) (string, *v1.Pod, error) {
-	context, agentID := ParseVMCID(vmcid)
-	agentSelector, err := labels.Parse("bosh.cloudfoundry.org/agent-id=" + agentID)
+	cid, err := vmcid.Decode()
 	if err != nil {
 		return "", nil, err
 	}
 
-	client, err := f.ClientProvider.New(context)
+	agentSelectors, err := directorSelectors(f.DirectorUUID, "bosh.cloudfoundry.org/agent-id="+labelValue(cid.ID))
 	if err != nil {
 		return "", nil, err
 	}
 
-	listOptions := api.ListOptions{LabelSelector: agentSelector}
-	podList, err := client.Pods().List(listOptions)
+	client, err := newCIDClient(f.ClientProvider, cid)
 	if err != nil {
 		return "", nil, err
 	}
 
-	if len(podList.Items) > 0 {
-		return context, &podList.Items[0], nil
+	for _, agentSelector := range agentSelectors {
+		listOptions := api.ListOptions{LabelSelector: agentSelector}
+		podList, err := client.Pods().List(listOptions)
+		if err != nil {
+			return "", nil, err
+		}
+
+		if len(podList.Items) > 0 {
+			return cid.Context, &podList.Items[0], nil
+		}
 	}
 
 	return "", nil, nil
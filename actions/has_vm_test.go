@@ -25,9 +25,9 @@ var _ = Describe("VMFinder", func() {
 		fakeClient = fakes.NewClient(&v1.PodList{
 			Items: []v1.Pod{{
 				ObjectMeta: v1.ObjectMeta{
-					Name:      "agent-agentID",
+					Name:      "agent-agent-id",
 					Namespace: "bosh-namespace",
-					Labels:    map[string]string{"bosh.cloudfoundry.org/agent-id": "agentID"},
+					Labels:    map[string]string{"bosh.cloudfoundry.org/agent-id": "agent-id"},
 				},
 			}},
 		})
@@ -42,7 +42,7 @@ var _ = Describe("VMFinder", func() {
 
 	Describe("HasVM", func() {
 		It("gets a client with the context from the VMCID", func() {
-			_, err := vmFinder.HasVM(cpi.VMCID("context-name:agentID"))
+			_, err := vmFinder.HasVM(cpi.VMCID("context-name:agent-id"))
 			Expect(err).NotTo(HaveOccurred())
 
 			Expect(fakeProvider.NewCallCount()).To(Equal(1))
@@ -50,7 +50,7 @@ var _ = Describe("VMFinder", func() {
 		})
 
 		It("returns true when the pod is found", func() {
-			found, err := vmFinder.HasVM(cpi.VMCID("context-name:agentID"))
+			found, err := vmFinder.HasVM(cpi.VMCID("context-name:agent-id"))
 			Expect(err).NotTo(HaveOccurred())
 			Expect(found).To(BeTrue())
 		})
@@ -67,7 +67,7 @@ var _ = Describe("VMFinder", func() {
 			})
 
 			It("returns an error", func() {
-				_, err := vmFinder.HasVM(cpi.VMCID("context-name:agentID"))
+				_, err := vmFinder.HasVM(cpi.VMCID("context-name:agent-id"))
 				Expect(err).To(MatchError("welp"))
 			})
 		})
@@ -75,30 +75,78 @@ var _ = Describe("VMFinder", func() {
 
 	Describe("FindVM", func() {
 		It("uses the client for the context in the VMCID", func() {
-			_, _, err := vmFinder.FindVM(cpi.VMCID("context-name:agentID"))
+			_, _, err := vmFinder.FindVM(cpi.VMCID("context-name:agent-id"))
 			Expect(err).NotTo(HaveOccurred())
 
 			Expect(fakeProvider.NewCallCount()).To(Equal(1))
 			Expect(fakeProvider.NewArgsForCall(0)).To(Equal("context-name"))
 		})
 
-		It("selects pods labeled with the agentID in the VMCID", func() {
-			_, _, err := vmFinder.FindVM(cpi.VMCID("context-name:agentID"))
+		It("uses the namespace recorded in the VMCID", func() {
+			fakeClient.NamespaceReturns("bosh-namespace")
+
+			_, _, err := vmFinder.FindVM(cpi.NewVMCID("context-name", "other-namespace", "agent-id"))
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(fakeClient.Namespace()).To(Equal("other-namespace"))
+		})
+
+		It("selects pods labeled with the agent-id in the VMCID", func() {
+			_, _, err := vmFinder.FindVM(cpi.VMCID("context-name:agent-id"))
 			Expect(err).NotTo(HaveOccurred())
 
 			Expect(fakeClient.Actions()).To(HaveLen(1))
 			listAction := fakeClient.Actions()[0].(testing.ListAction)
-			Expect(listAction.GetListRestrictions().Labels.String()).To(Equal("bosh.cloudfoundry.org/agent-id=agentID"))
+			Expect(listAction.GetListRestrictions().Labels.String()).To(Equal("bosh.cloudfoundry.org/agent-id=agent-id"))
 		})
 
 		It("returns the context name and matching pod", func() {
-			context, pod, err := vmFinder.FindVM(cpi.VMCID("context-name:agentID"))
+			context, pod, err := vmFinder.FindVM(cpi.VMCID("context-name:agent-id"))
 			Expect(err).NotTo(HaveOccurred())
 
 			Expect(context).To(Equal("context-name"))
 
 			Expect(pod).NotTo(BeNil())
-			Expect(pod.Name).To(Equal("agent-agentID"))
+			Expect(pod.Name).To(Equal("agent-agent-id"))
+		})
+
+		Context("when the director UUID is set", func() {
+			BeforeEach(func() {
+				vmFinder.DirectorUUID = "director-uuid"
+			})
+
+			It("selects pods labeled with the director UUID", func() {
+				_, _, err := vmFinder.FindVM(cpi.VMCID("context-name:agent-id"))
+				Expect(err).NotTo(HaveOccurred())
+
+				listAction := fakeClient.Actions()[0].(testing.ListAction)
+				Expect(listAction.GetListRestrictions().Labels.String()).To(Equal("bosh.cloudfoundry.org/agent-id=agent-id,bosh.cloudfoundry.org/director-uuid=director-uuid"))
+			})
+
+			It("finds pods created before pods were labeled with the director", func() {
+				_, pod, err := vmFinder.FindVM(cpi.VMCID("context-name:agent-id"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(pod).NotTo(BeNil())
+
+				listAction := fakeClient.Actions()[1].(testing.ListAction)
+				Expect(listAction.GetListRestrictions().Labels.String()).To(Equal("bosh.cloudfoundry.org/agent-id=agent-id,!bosh.cloudfoundry.org/director-uuid"))
+			})
+
+			Context("when the pod is labeled for another director", func() {
+				BeforeEach(func() {
+					pod, err := fakeClient.Core().Pods("bosh-namespace").Get("agent-agent-id")
+					Expect(err).NotTo(HaveOccurred())
+					pod.Labels["bosh.cloudfoundry.org/director-uuid"] = "other-director-uuid"
+					_, err = fakeClient.Core().Pods("bosh-namespace").Update(pod)
+					Expect(err).NotTo(HaveOccurred())
+				})
+
+				It("does not find the pod", func() {
+					_, pod, err := vmFinder.FindVM(cpi.VMCID("context-name:agent-id"))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(pod).To(BeNil())
+				})
+			})
 		})
 
 		Context("when the client cannot be created", func() {
@@ -107,15 +155,26 @@ var _ = Describe("VMFinder", func() {
 			})
 
 			It("returns an error", func() {
-				_, _, err := vmFinder.FindVM(cpi.VMCID("context-name:agentID"))
+				_, _, err := vmFinder.FindVM(cpi.VMCID("context-name:agent-id"))
 				Expect(err).To(MatchError("welp"))
 			})
 		})
 
-		Context("when the label can't be parsed", func() {
+		Context("when the VMCID is invalid", func() {
 			It("returns an error", func() {
+				_, _, err := vmFinder.FindVM(cpi.VMCID("agent-id"))
+				Expect(err).To(MatchError(`Invalid VM CID "agent-id"`))
+				Expect(fakeProvider.NewCallCount()).To(Equal(0))
+			})
+		})
+
+		Context("when the agent ID is not a valid label value", func() {
+			It("selects pods labeled with the shortened agent ID", func() {
 				_, _, err := vmFinder.FindVM(cpi.VMCID("context-name:%&^*****@*^"))
-				Expect(err).To(HaveOccurred())
+				Expect(err).NotTo(HaveOccurred())
+
+				listAction := fakeClient.Actions()[0].(testing.ListAction)
+				Expect(listAction.GetListRestrictions().Labels.String()).To(MatchRegexp(`^bosh\.cloudfoundry\.org/agent-id=[0-9a-f]{10}$`))
 			})
 		})
 
@@ -127,7 +186,7 @@ var _ = Describe("VMFinder", func() {
 			})
 
 			It("returns an error", func() {
-				_, _, err := vmFinder.FindVM(cpi.VMCID("context-name:agentID"))
+				_, _, err := vmFinder.FindVM(cpi.VMCID("context-name:agent-id"))
 				Expect(err).To(MatchError("welp"))
 				Expect(fakeClient.Actions()).To(HaveLen(1))
 			})
@@ -0,0 +1,368 @@
+package actions
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"code.cloudfoundry.org/clock"
+
+	"github.com/sykesm/kubernetes-cpi/cpi"
+	"github.com/sykesm/kubernetes-cpi/kubecluster"
+	"k8s.io/client-go/1.4/pkg/api"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/labels"
+)
+
+const (
+	MigratedFromAnnotation      = "bosh.cloudfoundry.org/migrated-from"
+	MigrationCompleteAnnotation = "bosh.cloudfoundry.org/migration-complete"
+
+	// MigrationPort is the port the migration helper image listens on. In
+	// send mode a GET streams a tar archive of /data, in receive mode a PUT
+	// extracts the request body into /data.
+	MigrationPort = 8080
+)
+
+// DiskStreamer moves a tar stream between migration helper pods.
+type DiskStreamer interface {
+	Open(client kubecluster.Client, podName string) (io.ReadCloser, error)
+	Write(client kubecluster.Client, podName string, r io.Reader) error
+}
+
+// ProxyStreamer streams through the API server pod proxy so the source and
+// target contexts do not need network connectivity to each other.
+type ProxyStreamer struct{}
+
+func (p *ProxyStreamer) Open(client kubecluster.Client, podName string) (io.ReadCloser, error) {
+	return client.Core().GetRESTClient().Get().
+		Namespace(client.Namespace()).
+		Resource("pods").
+		Name(fmt.Sprintf("%s:%d", podName, MigrationPort)).
+		SubResource("proxy").
+		Stream()
+}
+
+func (p *ProxyStreamer) Write(client kubecluster.Client, podName string, r io.Reader) error {
+	return client.Core().GetRESTClient().Put().
+		Namespace(client.Namespace()).
+		Resource("pods").
+		Name(fmt.Sprintf("%s:%d", podName, MigrationPort)).
+		SubResource("proxy").
+		Body(r).
+		Do().
+		Error()
+}
+
+// DiskMigrator copies the contents of a disk into a claim with the same disk
+// ID in another context using a pair of helper pods.
+type DiskMigrator struct {
+	ClientProvider kubecluster.ClientProvider
+	Streamer       DiskStreamer
+
+	Image           string
+	Clock           clock.Clock
+	PodReadyTimeout time.Duration
+}
+
+func (m *DiskMigrator) MigrateDisk(diskCID cpi.DiskCID, targetContext string) (cpi.DiskCID, error) {
+	return m.migrateDisk(diskCID, targetContext, "")
+}
+
+// migrateDisk copies the disk into the target namespace of the target
+// context. An empty namespace selects the namespace of the context.
+func (m *DiskMigrator) migrateDisk(diskCID cpi.DiskCID, targetContext, targetNamespace string) (cpi.DiskCID, error) {
+	if m.Image == "" {
+		return "", errors.New("a migration image is required to migrate disks")
+	}
+
+	cid, err := diskCID.Decode()
+	if err != nil {
+		return "", err
+	}
+	if cid.Context == targetContext {
+		return "", fmt.Errorf("Disk %q is already in context %q", diskCID, targetContext)
+	}
+	diskID := cid.ID
+
+	source, err := newCIDClient(m.ClientProvider, cid)
+	if err != nil {
+		return "", err
+	}
+
+	target, err := m.ClientProvider.New(targetContext)
+	if err != nil {
+		return "", err
+	}
+	if targetNamespace != "" && targetNamespace != target.Namespace() {
+		target = target.WithNamespace(targetNamespace)
+	}
+
+	claimName := diskName(diskID)
+	targetCID := cpi.NewDiskCID(target.Context(), target.Namespace(), diskID)
+
+	existing, err := target.PersistentVolumeClaims().Get(claimName)
+	if err == nil {
+		if existing.Annotations[MigratedFromAnnotation] != string(diskCID) {
+			return "", fmt.Errorf("Claim %q already exists in context %q", claimName, targetContext)
+		}
+		if existing.Annotations[MigrationCompleteAnnotation] != "true" {
+			return "", fmt.Errorf("An incomplete migration of disk %q exists in context %q", diskCID, targetContext)
+		}
+		return targetCID, nil
+	}
+	if !isNotFoundStatusError(err) {
+		return "", err
+	}
+
+	sourceClaim, err := source.PersistentVolumeClaims().Get(claimName)
+	if err != nil {
+		return "", err
+	}
+
+	podName, err := findClaimUser(source.Pods(), api.ListOptions{}, claimName, "")
+	if err != nil {
+		return "", err
+	}
+	if podName != "" {
+		return "", cpi.DiskInUseError{DiskCID: diskCID, Pod: podName}
+	}
+
+	err = createNamespace(target.Core(), target.Namespace(), nil)
+	if err != nil {
+		return "", err
+	}
+
+	targetClaim, err := target.PersistentVolumeClaims().Create(migrationClaim(sourceClaim, target.Namespace(), diskCID))
+	if err != nil {
+		return "", err
+	}
+
+	err = m.transfer(source, target, diskID, claimName)
+	if err != nil {
+		target.PersistentVolumeClaims().Delete(claimName, &api.DeleteOptions{})
+		return "", err
+	}
+
+	targetClaim.Annotations[MigrationCompleteAnnotation] = "true"
+	_, err = target.PersistentVolumeClaims().Update(targetClaim)
+	if err != nil {
+		return "", err
+	}
+
+	return targetCID, nil
+}
+
+// MoveDisk migrates a disk into the context and namespace of a VM for
+// attach_disk and deletes the source claim once the copy is complete. The
+// director keeps using the CID of the source disk, so the moved claim is
+// found again by its migrated-from annotation.
+func (m *DiskMigrator) MoveDisk(diskCID cpi.DiskCID, vm cpi.CID) error {
+	_, err := m.migrateDisk(diskCID, vm.Context, vm.Namespace)
+	if err != nil {
+		return err
+	}
+
+	cid, err := diskCID.Decode()
+	if err != nil {
+		return err
+	}
+
+	source, err := newCIDClient(m.ClientProvider, cid)
+	if err != nil {
+		return err
+	}
+
+	pvcClient := source.PersistentVolumeClaims()
+	pvc, err := pvcClient.Get(diskName(cid.ID))
+	if err != nil {
+		if isNotFoundStatusError(err) {
+			return nil
+		}
+		return err
+	}
+
+	if hasFinalizer(pvc.ObjectMeta, DiskFinalizer) {
+		pvc.Finalizers = removeFinalizer(pvc.Finalizers, DiskFinalizer)
+		_, err = pvcClient.Update(pvc)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = pvcClient.Delete(pvc.Name, &api.DeleteOptions{})
+	if err != nil && !isNotFoundStatusError(err) {
+		return err
+	}
+	return nil
+}
+
+// findMovedClaim looks for the claim a disk was moved into by attach_disk in
+// the other contexts. Claims moved into deployment namespaces are found when
+// the context may list claims in all namespaces. A nil claim is returned
+// when there is none.
+func findMovedClaim(provider kubecluster.ClientProvider, contexts []string, diskCID cpi.DiskCID) (kubecluster.Client, *v1.PersistentVolumeClaim, error) {
+	cid, err := diskCID.Decode()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	selector, err := labels.Parse("bosh.cloudfoundry.org/disk-id=" + labelValue(cid.ID))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, context := range contexts {
+		if context == cid.Context {
+			continue
+		}
+
+		client, err := provider.New(context)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		listOptions := api.ListOptions{LabelSelector: selector}
+		pvcList, err := client.Core().PersistentVolumeClaims(api.NamespaceAll).List(listOptions)
+		if isForbiddenStatusError(err) {
+			pvcList, err = client.PersistentVolumeClaims().List(listOptions)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		for i := range pvcList.Items {
+			pvc := &pvcList.Items[i]
+			if pvc.Annotations[MigratedFromAnnotation] != string(diskCID) {
+				continue
+			}
+			if pvc.Namespace != "" && pvc.Namespace != client.Namespace() {
+				client = client.WithNamespace(pvc.Namespace)
+			}
+			return client, pvc, nil
+		}
+	}
+
+	return nil, nil, nil
+}
+
+func (m *DiskMigrator) transfer(source, target kubecluster.Client, diskID, claimName string) error {
+	podName := migrationName(diskID)
+
+	_, err := source.Pods().Create(migrationPod(podName, source.Namespace(), claimName, m.Image, "send", true))
+	if err != nil {
+		return err
+	}
+	defer source.Pods().Delete(podName, &api.DeleteOptions{GracePeriodSeconds: int64Ptr(0)})
+
+	_, err = target.Pods().Create(migrationPod(podName, target.Namespace(), claimName, m.Image, "receive", false))
+	if err != nil {
+		return err
+	}
+	defer target.Pods().Delete(podName, &api.DeleteOptions{GracePeriodSeconds: int64Ptr(0)})
+
+	for _, client := range []kubecluster.Client{source, target} {
+		err = m.waitForRunning(client, podName)
+		if err != nil {
+			return err
+		}
+	}
+
+	stream, err := m.Streamer.Open(source, podName)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	return m.Streamer.Write(target, podName, stream)
+}
+
+func (m *DiskMigrator) waitForRunning(client kubecluster.Client, podName string) error {
+	timer := m.Clock.NewTimer(m.PodReadyTimeout)
+	defer timer.Stop()
+
+	for {
+		pod, err := client.Pods().Get(podName)
+		if err != nil {
+			return err
+		}
+
+		switch pod.Status.Phase {
+		case v1.PodRunning:
+			return nil
+		case v1.PodFailed, v1.PodSucceeded:
+			return fmt.Errorf("Migration pod %q exited with phase %s", podName, pod.Status.Phase)
+		}
+
+		select {
+		case <-timer.C():
+			return errors.New("Migration pod start failed with a timeout")
+		case <-m.Clock.After(deletionPollInterval):
+		}
+	}
+}
+
+func migrationClaim(source *v1.PersistentVolumeClaim, ns string, sourceCID cpi.DiskCID) *v1.PersistentVolumeClaim {
+	annotations := map[string]string{}
+	for _, key := range []string{StorageClassAnnotation, VolumeModeAnnotation, DiskIDAnnotation} {
+		if value, ok := source.Annotations[key]; ok {
+			annotations[key] = value
+		}
+	}
+	annotations[MigratedFromAnnotation] = string(sourceCID)
+
+	labels := map[string]string{
+		"bosh.cloudfoundry.org/disk-id": source.Labels["bosh.cloudfoundry.org/disk-id"],
+	}
+	if directorUUID, ok := source.Labels[DirectorUUIDLabel]; ok {
+		labels[DirectorUUIDLabel] = directorUUID
+	}
+
+	return &v1.PersistentVolumeClaim{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        source.Name,
+			Namespace:   ns,
+			Annotations: annotations,
+			Labels:      labels,
+		},
+		Spec: v1.PersistentVolumeClaimSpec{
+			AccessModes: source.Spec.AccessModes,
+			Resources:   source.Spec.Resources,
+		},
+	}
+}
+
+func migrationPod(name, ns, claimName, image, mode string, readOnly bool) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      name,
+			Namespace: ns,
+			Labels: map[string]string{
+				"bosh.cloudfoundry.org/disk-migration": claimName,
+			},
+		},
+		Spec: v1.PodSpec{
+			RestartPolicy: v1.RestartPolicyNever,
+			Containers: []v1.Container{{
+				Name:  "migrate",
+				Image: image,
+				Args:  []string{mode},
+				Ports: []v1.ContainerPort{{ContainerPort: MigrationPort}},
+				VolumeMounts: []v1.VolumeMount{{
+					Name:      "data",
+					MountPath: "/data",
+					ReadOnly:  readOnly,
+				}},
+			}},
+			Volumes: []v1.Volume{{
+				Name: "data",
+				VolumeSource: v1.VolumeSource{
+					PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{
+						ClaimName: claimName,
+						ReadOnly:  readOnly,
+					},
+				},
+			}},
+		},
+	}
+}
@@ -0,0 +1,346 @@
+package actions_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"code.cloudfoundry.org/clock/fakeclock"
+
+	"k8s.io/client-go/1.4/pkg/api/resource"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/runtime"
+	"k8s.io/client-go/1.4/testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sykesm/kubernetes-cpi/actions"
+	"github.com/sykesm/kubernetes-cpi/cpi"
+	"github.com/sykesm/kubernetes-cpi/kubecluster"
+	"github.com/sykesm/kubernetes-cpi/kubecluster/fakes"
+)
+
+type fakeStreamer struct {
+	data     string
+	openPods []string
+	received string
+	writeErr error
+}
+
+func (f *fakeStreamer) Open(client kubecluster.Client, podName string) (io.ReadCloser, error) {
+	f.openPods = append(f.openPods, client.Context()+"/"+podName)
+	return ioutil.NopCloser(bytes.NewBufferString(f.data)), nil
+}
+
+func (f *fakeStreamer) Write(client kubecluster.Client, podName string, r io.Reader) error {
+	if f.writeErr != nil {
+		return f.writeErr
+	}
+	b, err := ioutil.ReadAll(r)
+	f.received = string(b)
+	return err
+}
+
+var _ = Describe("MigrateDisk", func() {
+	var (
+		sourceClient *fakes.Client
+		targetClient *fakes.Client
+		fakeProvider *fakes.ClientProvider
+		streamer     *fakeStreamer
+		diskCID      cpi.DiskCID
+
+		diskMigrator *actions.DiskMigrator
+	)
+
+	runningPod := func(action testing.Action) (bool, runtime.Object, error) {
+		return true, &v1.Pod{
+			ObjectMeta: v1.ObjectMeta{Name: action.(testing.GetAction).GetName()},
+			Status:     v1.PodStatus{Phase: v1.PodRunning},
+		}, nil
+	}
+
+	BeforeEach(func() {
+		diskCID = cpi.DiskCID("source:disk-id")
+
+		sourceClient = fakes.NewClient(&v1.PersistentVolumeClaim{
+			ObjectMeta: v1.ObjectMeta{
+				Name:      "disk-disk-id",
+				Namespace: "source-namespace",
+				Labels: map[string]string{
+					"bosh.cloudfoundry.org/disk-id": "disk-id",
+				},
+				Annotations: map[string]string{
+					actions.StorageClassAnnotation: "fast",
+					"example.com/unrelated":        "value",
+				},
+			},
+			Spec: v1.PersistentVolumeClaimSpec{
+				AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+				Resources: v1.ResourceRequirements{
+					Requests: v1.ResourceList{
+						v1.ResourceStorage: resource.MustParse("20Mi"),
+					},
+				},
+			},
+		})
+		sourceClient.ContextReturns("source")
+		sourceClient.NamespaceReturns("source-namespace")
+		sourceClient.PrependReactor("get", "pods", runningPod)
+
+		targetClient = fakes.NewClient()
+		targetClient.ContextReturns("target")
+		targetClient.NamespaceReturns("target-namespace")
+		targetClient.PrependReactor("get", "pods", runningPod)
+
+		fakeProvider = &fakes.ClientProvider{}
+		fakeProvider.NewStub = func(context string) (kubecluster.Client, error) {
+			if context == "target" {
+				return targetClient, nil
+			}
+			return sourceClient, nil
+		}
+
+		streamer = &fakeStreamer{data: "tar-stream"}
+		diskMigrator = &actions.DiskMigrator{
+			ClientProvider:  fakeProvider,
+			Streamer:        streamer,
+			Image:           "migration-image",
+			Clock:           fakeclock.NewFakeClock(time.Now()),
+			PodReadyTimeout: 30 * time.Second,
+		}
+	})
+
+	It("returns the CID of the disk in the target context", func() {
+		newCID, err := diskMigrator.MigrateDisk(diskCID, "target")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(newCID).To(Equal(cpi.NewDiskCID("target", "target-namespace", "disk-id")))
+	})
+
+	It("creates a claim like the source claim in the target context", func() {
+		_, err := diskMigrator.MigrateDisk(diskCID, "target")
+		Expect(err).NotTo(HaveOccurred())
+
+		matches := targetClient.MatchingActions("create", "persistentvolumeclaims")
+		Expect(matches).To(HaveLen(1))
+
+		pvc := matches[0].(testing.CreateAction).GetObject().(*v1.PersistentVolumeClaim)
+		Expect(pvc.Name).To(Equal("disk-disk-id"))
+		Expect(pvc.Namespace).To(Equal("target-namespace"))
+		Expect(pvc.Labels).To(Equal(map[string]string{"bosh.cloudfoundry.org/disk-id": "disk-id"}))
+		Expect(pvc.Annotations).To(HaveKeyWithValue(actions.StorageClassAnnotation, "fast"))
+		Expect(pvc.Annotations).To(HaveKeyWithValue(actions.MigratedFromAnnotation, "source:disk-id"))
+		Expect(pvc.Annotations).NotTo(HaveKey("example.com/unrelated"))
+		Expect(pvc.Spec.AccessModes).To(ConsistOf(v1.ReadWriteOnce))
+		Expect(pvc.Spec.Resources.Requests[v1.ResourceStorage]).To(Equal(resource.MustParse("20Mi")))
+	})
+
+	It("streams the disk between helper pods mounting the claims", func() {
+		_, err := diskMigrator.MigrateDisk(diskCID, "target")
+		Expect(err).NotTo(HaveOccurred())
+
+		matches := sourceClient.MatchingActions("create", "pods")
+		Expect(matches).To(HaveLen(1))
+		sender := matches[0].(testing.CreateAction).GetObject().(*v1.Pod)
+		Expect(sender.Name).To(Equal("migrate-disk-id"))
+		Expect(sender.Spec.Containers[0].Image).To(Equal("migration-image"))
+		Expect(sender.Spec.Containers[0].Args).To(Equal([]string{"send"}))
+		Expect(sender.Spec.Volumes[0].PersistentVolumeClaim.ClaimName).To(Equal("disk-disk-id"))
+		Expect(sender.Spec.Volumes[0].PersistentVolumeClaim.ReadOnly).To(BeTrue())
+
+		matches = targetClient.MatchingActions("create", "pods")
+		Expect(matches).To(HaveLen(1))
+		receiver := matches[0].(testing.CreateAction).GetObject().(*v1.Pod)
+		Expect(receiver.Spec.Containers[0].Args).To(Equal([]string{"receive"}))
+		Expect(receiver.Spec.Volumes[0].PersistentVolumeClaim.ReadOnly).To(BeFalse())
+
+		Expect(streamer.openPods).To(Equal([]string{"source/migrate-disk-id"}))
+		Expect(streamer.received).To(Equal("tar-stream"))
+	})
+
+	It("marks the migration complete and deletes the helper pods", func() {
+		_, err := diskMigrator.MigrateDisk(diskCID, "target")
+		Expect(err).NotTo(HaveOccurred())
+
+		matches := targetClient.MatchingActions("update", "persistentvolumeclaims")
+		Expect(matches).To(HaveLen(1))
+		pvc := matches[0].(testing.UpdateAction).GetObject().(*v1.PersistentVolumeClaim)
+		Expect(pvc.Annotations).To(HaveKeyWithValue(actions.MigrationCompleteAnnotation, "true"))
+
+		Expect(sourceClient.MatchingActions("delete", "pods")).To(HaveLen(1))
+		Expect(targetClient.MatchingActions("delete", "pods")).To(HaveLen(1))
+	})
+
+	It("leaves the source claim in place", func() {
+		_, err := diskMigrator.MigrateDisk(diskCID, "target")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sourceClient.MatchingActions("delete", "persistentvolumeclaims")).To(BeEmpty())
+	})
+
+	Context("when no migration image is configured", func() {
+		BeforeEach(func() {
+			diskMigrator.Image = ""
+		})
+
+		It("returns an error before creating anything", func() {
+			_, err := diskMigrator.MigrateDisk(diskCID, "target")
+			Expect(err).To(MatchError("a migration image is required to migrate disks"))
+			Expect(fakeProvider.NewCallCount()).To(Equal(0))
+		})
+	})
+
+	Describe("MoveDisk", func() {
+		It("deletes the source claim after the copy", func() {
+			err := diskMigrator.MoveDisk(diskCID, cpi.CID{Context: "target"})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(targetClient.MatchingActions("update", "persistentvolumeclaims")).To(HaveLen(1))
+			matches := sourceClient.MatchingActions("delete", "persistentvolumeclaims")
+			Expect(matches).To(HaveLen(1))
+			Expect(matches[0].(testing.DeleteAction).GetName()).To(Equal("disk-disk-id"))
+		})
+
+		Context("when the VM is in a deployment namespace", func() {
+			It("creates the claim in the namespace of the VM", func() {
+				err := diskMigrator.MoveDisk(diskCID, cpi.CID{Context: "target", Namespace: "target-deployment", ID: "agent-id"})
+				Expect(err).NotTo(HaveOccurred())
+
+				matches := targetClient.MatchingActions("create", "persistentvolumeclaims")
+				Expect(matches).To(HaveLen(1))
+				Expect(matches[0].GetNamespace()).To(Equal("target-deployment"))
+			})
+		})
+
+		Context("when the transfer fails", func() {
+			BeforeEach(func() {
+				streamer.writeErr = errors.New("stream-welp")
+			})
+
+			It("keeps the source claim", func() {
+				err := diskMigrator.MoveDisk(diskCID, cpi.CID{Context: "target"})
+				Expect(err).To(MatchError("stream-welp"))
+				Expect(sourceClient.MatchingActions("delete", "persistentvolumeclaims")).To(BeEmpty())
+			})
+		})
+
+		Context("when the source claim has already been deleted", func() {
+			BeforeEach(func() {
+				targetClient.PrependReactor("get", "persistentvolumeclaims", func(action testing.Action) (bool, runtime.Object, error) {
+					return true, &v1.PersistentVolumeClaim{
+						ObjectMeta: v1.ObjectMeta{
+							Name: "disk-disk-id",
+							Annotations: map[string]string{
+								actions.MigratedFromAnnotation:      "source:disk-id",
+								actions.MigrationCompleteAnnotation: "true",
+							},
+						},
+					}, nil
+				})
+				err := sourceClient.PersistentVolumeClaims().Delete("disk-disk-id", nil)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("succeeds", func() {
+				err := diskMigrator.MoveDisk(diskCID, cpi.CID{Context: "target"})
+				Expect(err).NotTo(HaveOccurred())
+			})
+		})
+	})
+
+	Context("when the disk has already been migrated", func() {
+		BeforeEach(func() {
+			targetClient.PrependReactor("get", "persistentvolumeclaims", func(action testing.Action) (bool, runtime.Object, error) {
+				return true, &v1.PersistentVolumeClaim{
+					ObjectMeta: v1.ObjectMeta{
+						Name: "disk-disk-id",
+						Annotations: map[string]string{
+							actions.MigratedFromAnnotation:      "source:disk-id",
+							actions.MigrationCompleteAnnotation: "true",
+						},
+					},
+				}, nil
+			})
+		})
+
+		It("returns the target CID without copying", func() {
+			newCID, err := diskMigrator.MigrateDisk(diskCID, "target")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(newCID).To(Equal(cpi.NewDiskCID("target", "target-namespace", "disk-id")))
+			Expect(targetClient.MatchingActions("create", "persistentvolumeclaims")).To(BeEmpty())
+			Expect(streamer.openPods).To(BeEmpty())
+		})
+	})
+
+	Context("when an unrelated claim exists in the target context", func() {
+		BeforeEach(func() {
+			targetClient.PrependReactor("get", "persistentvolumeclaims", func(action testing.Action) (bool, runtime.Object, error) {
+				return true, &v1.PersistentVolumeClaim{ObjectMeta: v1.ObjectMeta{Name: "disk-disk-id"}}, nil
+			})
+		})
+
+		It("returns an error", func() {
+			_, err := diskMigrator.MigrateDisk(diskCID, "target")
+			Expect(err).To(MatchError(`Claim "disk-disk-id" already exists in context "target"`))
+		})
+	})
+
+	Context("when the source disk is in use", func() {
+		BeforeEach(func() {
+			sourceClient.PrependReactor("list", "pods", func(action testing.Action) (bool, runtime.Object, error) {
+				return true, &v1.PodList{Items: []v1.Pod{{
+					ObjectMeta: v1.ObjectMeta{Name: "agent-agent-id"},
+					Spec: v1.PodSpec{
+						Volumes: []v1.Volume{{
+							Name: "disk-disk-id",
+							VolumeSource: v1.VolumeSource{
+								PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: "disk-disk-id"},
+							},
+						}},
+					},
+				}}}, nil
+			})
+		})
+
+		It("returns a DiskInUseError", func() {
+			_, err := diskMigrator.MigrateDisk(diskCID, "target")
+			Expect(err).To(Equal(cpi.DiskInUseError{DiskCID: diskCID, Pod: "agent-agent-id"}))
+			Expect(targetClient.MatchingActions("create", "persistentvolumeclaims")).To(BeEmpty())
+		})
+	})
+
+	Context("when the target context is the source context", func() {
+		It("returns an error", func() {
+			_, err := diskMigrator.MigrateDisk(diskCID, "source")
+			Expect(err).To(MatchError(`Disk "source:disk-id" is already in context "source"`))
+		})
+	})
+
+	Context("when a helper pod fails", func() {
+		BeforeEach(func() {
+			targetClient.PrependReactor("get", "pods", func(action testing.Action) (bool, runtime.Object, error) {
+				return true, &v1.Pod{Status: v1.PodStatus{Phase: v1.PodFailed}}, nil
+			})
+		})
+
+		It("returns an error and deletes the target claim", func() {
+			_, err := diskMigrator.MigrateDisk(diskCID, "target")
+			Expect(err).To(MatchError(`Migration pod "migrate-disk-id" exited with phase Failed`))
+			Expect(targetClient.MatchingActions("delete", "persistentvolumeclaims")).To(HaveLen(1))
+			Expect(targetClient.MatchingActions("delete", "pods")).To(HaveLen(1))
+		})
+	})
+
+	Context("when the transfer fails", func() {
+		BeforeEach(func() {
+			streamer.writeErr = errors.New("stream-welp")
+		})
+
+		It("returns an error and deletes the target claim", func() {
+			_, err := diskMigrator.MigrateDisk(diskCID, "target")
+			Expect(err).To(MatchError("stream-welp"))
+			Expect(targetClient.MatchingActions("delete", "persistentvolumeclaims")).To(HaveLen(1))
+			Expect(targetClient.MatchingActions("update", "persistentvolumeclaims")).To(BeEmpty())
+		})
+	})
+})
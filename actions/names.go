@@ -0,0 +1,142 @@
+package actions
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/util/validation"
+)
+
+// The full agent and disk IDs are recorded in these annotations when the
+// label values derived from them had to be shortened. They share their keys
+// with the labels.
+const (
+	AgentIDAnnotation = "bosh.cloudfoundry.org/agent-id"
+	DiskIDAnnotation  = "bosh.cloudfoundry.org/disk-id"
+)
+
+// Agent and disk IDs are chosen by the director, so object names, host names
+// and label values derived from them may be too long for Kubernetes or use
+// characters it rejects. Valid names are used verbatim so the objects of
+// existing VMs and disks keep their names; anything else is sanitised,
+// truncated and suffixed with a hash of the ID so that it stays unique.
+const (
+	maxNameLength  = validation.DNS1123LabelMaxLength
+	nameHashLength = 10
+)
+
+func agentName(agentID string) string     { return objectName("agent-", agentID) }
+func ephemeralName(agentID string) string { return objectName("ephemeral-", agentID) }
+func vmAnchorName(agentID string) string  { return objectName("vm-", agentID) }
+func diskName(diskID string) string       { return objectName("disk-", diskID) }
+func migrationName(diskID string) string  { return objectName("migrate-", diskID) }
+
+// hostname returns the host name of the agent pod.
+func hostname(agentID string) string { return objectName("", agentID) }
+
+// objectName returns a DNS label for the object of an ID. The prefix must
+// itself be a valid start of a DNS label.
+func objectName(prefix, id string) string {
+	name := prefix + id
+	if len(validation.IsDNS1123Label(name)) == 0 {
+		return name
+	}
+
+	sanitised := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		default:
+			return '-'
+		}
+	}, name)
+
+	return shortened(sanitised, "-", id)
+}
+
+// labelValue returns the value of the agent-id or disk-id label of an ID.
+func labelValue(id string) string {
+	if len(validation.IsValidLabelValue(id)) == 0 {
+		return id
+	}
+
+	sanitised := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		default:
+			return '-'
+		}
+	}, id)
+
+	return shortened(sanitised, "-_.", id)
+}
+
+// shortened truncates a sanitised name so that a hash of the ID fits after
+// it and trims the characters that may not start or end a name.
+func shortened(sanitised, trim, id string) string {
+	sum := sha256.Sum256([]byte(id))
+	hash := hex.EncodeToString(sum[:])[:nameHashLength]
+
+	for strings.Contains(sanitised, "--") {
+		sanitised = strings.Replace(sanitised, "--", "-", -1)
+	}
+	if len(sanitised) > maxNameLength-nameHashLength-1 {
+		sanitised = sanitised[:maxNameLength-nameHashLength-1]
+	}
+	sanitised = strings.Trim(sanitised, trim)
+	if sanitised == "" {
+		return hash
+	}
+	return sanitised + "-" + hash
+}
+
+// idLabels returns the labels with the label of an ID added and, when the
+// label value is not the ID itself, annotations recording the full ID.
+func idLabels(labels map[string]string, key, id string) (map[string]string, map[string]string) {
+	result := map[string]string{}
+	for k, v := range labels {
+		result[k] = v
+	}
+	result[key] = labelValue(id)
+
+	if result[key] == id {
+		return result, nil
+	}
+	return result, map[string]string{key: id}
+}
+
+// setObjectID labels an existing object with an ID the way idLabels does.
+func setObjectID(meta *v1.ObjectMeta, key, id string) {
+	if meta.Labels == nil {
+		meta.Labels = map[string]string{}
+	}
+	meta.Labels[key] = labelValue(id)
+
+	if meta.Labels[key] == id {
+		delete(meta.Annotations, key)
+		return
+	}
+	if meta.Annotations == nil {
+		meta.Annotations = map[string]string{}
+	}
+	meta.Annotations[key] = id
+}
+
+// removeObjectID removes the label and annotation of an ID.
+func removeObjectID(meta *v1.ObjectMeta, key string) {
+	delete(meta.Labels, key)
+	delete(meta.Annotations, key)
+}
+
+// objectID returns the full ID recorded on an object by idLabels.
+func objectID(meta v1.ObjectMeta, key string) string {
+	if id, ok := meta.Annotations[key]; ok {
+		return id
+	}
+	return meta.Labels[key]
+}
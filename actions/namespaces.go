@@ -0,0 +1,191 @@
+package actions
+
+import (
+	"bytes"
+	"text/template"
+
+	"github.com/sykesm/kubernetes-cpi/config"
+	"github.com/sykesm/kubernetes-cpi/cpi"
+	"github.com/sykesm/kubernetes-cpi/kubecluster"
+	"k8s.io/client-go/1.4/pkg/api"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/labels"
+)
+
+// DeploymentLabel marks the namespaces created for a deployment. They are
+// removed when the last VM and disk in them are deleted. The cleanup command
+// reports the ones that are left behind.
+const DeploymentLabel = "bosh.cloudfoundry.org/deployment"
+
+// deploymentName returns the name of the deployment from the groups the
+// director sends in the VM environment. The groups start with the director
+// and deployment names.
+func deploymentName(env cpi.Environment) string {
+	boshEnv, ok := env["bosh"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+
+	groups, ok := boshEnv["groups"].([]interface{})
+	if !ok || len(groups) < 2 {
+		return ""
+	}
+
+	deployment, _ := groups[1].(string)
+	return deployment
+}
+
+// deploymentClient returns a client for the namespace of the deployment when
+// the policy places deployments in their own namespace, and the labels of
+// that namespace. The client of the context is returned otherwise.
+func deploymentClient(client kubecluster.Client, policy config.NamespacePolicy, directorUUID, deployment string) (kubecluster.Client, map[string]string, error) {
+	if policy.DeploymentTemplate == "" || deployment == "" {
+		return client, policy.Labels, nil
+	}
+
+	tmpl, err := template.New("namespace").Option("missingkey=error").Parse(policy.DeploymentTemplate)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var name bytes.Buffer
+	err = tmpl.Execute(&name, map[string]string{
+		"Deployment": deployment,
+		"Namespace":  client.Namespace(),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	labels := directorLabels(directorUUID, policy.Labels)
+	labels[DeploymentLabel] = labelValue(deployment)
+
+	return client.WithNamespace(objectName("", name.String())), labels, nil
+}
+
+// deleteNamespaceIfEmpty removes a namespace created for a deployment once
+// nothing of a VM or disk remains in it.
+func deleteNamespaceIfEmpty(client kubecluster.Client) error {
+	namespace, err := emptyDeploymentNamespace(client)
+	if err != nil || namespace == nil {
+		return err
+	}
+
+	err = client.Core().Namespaces().Delete(namespace.Name, &api.DeleteOptions{})
+	if err != nil && !isNotFoundStatusError(err) {
+		return err
+	}
+	return nil
+}
+
+// emptyDeploymentNamespace returns the namespace of the client when it was
+// created for a deployment and no pods, claims or agent config maps, secrets
+// and services remain in it. A create_vm in progress has created its anchor
+// config map before the pod. Objects that are being deleted do not count.
+func emptyDeploymentNamespace(client kubecluster.Client) (*v1.Namespace, error) {
+	namespace, err := client.Core().Namespaces().Get(client.Namespace())
+	if err != nil {
+		if isNotFoundStatusError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if _, ok := namespace.Labels[DeploymentLabel]; !ok || namespace.Status.Phase == v1.NamespaceTerminating {
+		return nil, nil
+	}
+
+	podList, err := client.Pods().List(api.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, pod := range podList.Items {
+		if pod.DeletionTimestamp == nil {
+			return nil, nil
+		}
+	}
+
+	pvcList, err := client.PersistentVolumeClaims().List(api.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, pvc := range pvcList.Items {
+		if pvc.DeletionTimestamp == nil {
+			return nil, nil
+		}
+	}
+
+	agentSelector, err := labels.Parse("bosh.cloudfoundry.org/agent-id")
+	if err != nil {
+		return nil, err
+	}
+	listOptions := api.ListOptions{LabelSelector: agentSelector}
+
+	configMapList, err := client.ConfigMaps().List(listOptions)
+	if err != nil {
+		return nil, err
+	}
+	for _, configMap := range configMapList.Items {
+		if configMap.DeletionTimestamp == nil {
+			return nil, nil
+		}
+	}
+
+	secretList, err := client.Secrets().List(listOptions)
+	if err != nil {
+		return nil, err
+	}
+	for _, secret := range secretList.Items {
+		if secret.DeletionTimestamp == nil {
+			return nil, nil
+		}
+	}
+
+	serviceList, err := client.Services().List(listOptions)
+	if err != nil {
+		return nil, err
+	}
+	for _, service := range serviceList.Items {
+		if service.DeletionTimestamp == nil {
+			return nil, nil
+		}
+	}
+
+	return namespace, nil
+}
+
+// forEachNamespace calls fn with the client of the context and, when the
+// policy places deployments in their own namespace, with a client for each
+// namespace created for a deployment of the director. An empty director UUID
+// includes the namespaces of every director.
+func forEachNamespace(client kubecluster.Client, policy config.NamespacePolicy, directorUUID string, fn func(kubecluster.Client) error) error {
+	var namespaces []v1.Namespace
+	if policy.DeploymentTemplate != "" {
+		selector, err := directorSelector(directorUUID, DeploymentLabel)
+		if err != nil {
+			return err
+		}
+
+		namespaceList, err := client.Core().Namespaces().List(api.ListOptions{LabelSelector: selector})
+		if err != nil {
+			return err
+		}
+		namespaces = namespaceList.Items
+	}
+
+	err := fn(client)
+	if err != nil {
+		return err
+	}
+
+	for _, namespace := range namespaces {
+		if namespace.Name == client.Namespace() {
+			continue
+		}
+		err := fn(client.WithNamespace(namespace.Name))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,148 @@
+package actions
+
+import (
+	"fmt"
+	"time"
+
+	"code.cloudfoundry.org/clock"
+	"github.com/sykesm/kubernetes-cpi/cpi"
+	"github.com/sykesm/kubernetes-cpi/kubecluster"
+	"k8s.io/client-go/1.4/pkg/api"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	extensions "k8s.io/client-go/1.4/pkg/apis/extensions/v1beta1"
+	"k8s.io/client-go/1.4/pkg/labels"
+)
+
+const DefaultPrePullTimeout = 10 * time.Minute
+
+// ImagePrePuller warms a stemcell image on every node of a context with a
+// short-lived DaemonSet so pods created from the stemcell start without
+// waiting for the image to be pulled.
+type ImagePrePuller struct {
+	Clock   clock.Clock
+	Timeout time.Duration
+}
+
+// PrePull runs the DaemonSet until the image has been pulled onto every node
+// the DaemonSet is scheduled to and then removes it.
+func (p *ImagePrePuller) PrePull(client kubecluster.Client, stemcellCID cpi.StemcellCID, pullSecrets []v1.LocalObjectReference) error {
+	// remove the DaemonSet of an interrupted pre-pull
+	err := deletePrePull(client, stemcellCID)
+	if err != nil {
+		return err
+	}
+
+	pullPolicy, err := imagePullPolicy("", stemcellCID)
+	if err != nil {
+		return err
+	}
+
+	stemcellLabel := map[string]string{
+		"bosh.cloudfoundry.org/stemcell": stemcellPullSecretName(stemcellCID),
+	}
+	gracePeriod := int64(0)
+
+	_, err = client.DaemonSets().Create(&extensions.DaemonSet{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      prePullName(stemcellCID),
+			Namespace: client.Namespace(),
+			Labels:    stemcellLabel,
+			Annotations: map[string]string{
+				"bosh.cloudfoundry.org/stemcell-cid": string(stemcellCID),
+			},
+		},
+		Spec: extensions.DaemonSetSpec{
+			Selector: &extensions.LabelSelector{MatchLabels: stemcellLabel},
+			Template: v1.PodTemplateSpec{
+				ObjectMeta: v1.ObjectMeta{Labels: stemcellLabel},
+				Spec: v1.PodSpec{
+					ImagePullSecrets:              pullSecrets,
+					TerminationGracePeriodSeconds: &gracePeriod,
+					Containers: []v1.Container{{
+						Name:            "pre-pull",
+						Image:           string(stemcellCID),
+						ImagePullPolicy: pullPolicy,
+						Command:         []string{"/bin/sh", "-c", "sleep 86400"},
+					}},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	defer deletePrePull(client, stemcellCID)
+
+	return p.waitForPulled(client, stemcellCID)
+}
+
+// waitForPulled waits until the pre-pull container has started on each node
+// the DaemonSet is scheduled to.
+func (p *ImagePrePuller) waitForPulled(client kubecluster.Client, stemcellCID cpi.StemcellCID) error {
+	timer := p.Clock.NewTimer(p.Timeout)
+	defer timer.Stop()
+
+	selector, err := labels.Parse("bosh.cloudfoundry.org/stemcell=" + stemcellPullSecretName(stemcellCID))
+	if err != nil {
+		return err
+	}
+
+	for {
+		daemonSet, err := client.DaemonSets().Get(prePullName(stemcellCID))
+		if err != nil {
+			return err
+		}
+
+		podList, err := client.Pods().List(api.ListOptions{LabelSelector: selector})
+		if err != nil {
+			return err
+		}
+
+		pulled := int32(0)
+		for _, pod := range podList.Items {
+			if isImagePulled(pod) {
+				pulled++
+			}
+		}
+
+		desired := daemonSet.Status.DesiredNumberScheduled
+		if desired > 0 && pulled >= desired {
+			return nil
+		}
+
+		select {
+		case <-timer.C():
+			return fmt.Errorf("Pre-pull of stemcell %q in context %q failed with a timeout: pulled on %d of %d nodes", stemcellCID, client.Context(), pulled, desired)
+		case <-p.Clock.After(deletionPollInterval):
+		}
+	}
+}
+
+func isImagePulled(pod v1.Pod) bool {
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.ImageID != "" || status.State.Running != nil || status.State.Terminated != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func prePullName(stemcellCID cpi.StemcellCID) string {
+	return "pre-pull-" + stemcellPullSecretName(stemcellCID)
+}
+
+// deletePrePull removes the pre-pull DaemonSet of a stemcell and asks for
+// its pods to be garbage collected. Deleting the pods directly races with the
+// DaemonSet controller recreating them.
+func deletePrePull(client kubecluster.Client, stemcellCID cpi.StemcellCID) error {
+	orphanDependents := false
+	err := client.DaemonSets().Delete(prePullName(stemcellCID), &api.DeleteOptions{
+		GracePeriodSeconds: int64Ptr(0),
+		OrphanDependents:   &orphanDependents,
+	})
+	if err != nil && !isNotFoundStatusError(err) {
+		return err
+	}
+	return nil
+}
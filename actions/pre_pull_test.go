@@ -0,0 +1,202 @@
+package actions_test
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/clock/fakeclock"
+	"github.com/sykesm/kubernetes-cpi/actions"
+	"github.com/sykesm/kubernetes-cpi/cpi"
+	"github.com/sykesm/kubernetes-cpi/kubecluster/fakes"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	extensions "k8s.io/client-go/1.4/pkg/apis/extensions/v1beta1"
+	"k8s.io/client-go/1.4/pkg/runtime"
+	"k8s.io/client-go/1.4/testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ImagePrePuller", func() {
+	var (
+		fakeClient  *fakes.Client
+		fakeClock   *fakeclock.FakeClock
+		stemcellCID cpi.StemcellCID
+		pullSecrets []v1.LocalObjectReference
+		pulledPods  int
+
+		prePuller *actions.ImagePrePuller
+	)
+
+	BeforeEach(func() {
+		fakeClient = fakes.NewClient()
+		fakeClient.ContextReturns("bosh")
+		fakeClient.NamespaceReturns("bosh-namespace")
+
+		stemcellCID = cpi.StemcellCID("sykesm/kubernetes-stemcell:999")
+		pullSecrets = []v1.LocalObjectReference{{Name: "pull-secret"}}
+		pulledPods = 2
+
+		fakeClient.PrependReactor("get", "daemonsets", func(action testing.Action) (bool, runtime.Object, error) {
+			return true, &extensions.DaemonSet{
+				Status: extensions.DaemonSetStatus{DesiredNumberScheduled: 2},
+			}, nil
+		})
+		fakeClient.PrependReactor("list", "pods", func(action testing.Action) (bool, runtime.Object, error) {
+			selector := action.(testing.ListAction).GetListRestrictions().Labels.String()
+			if !strings.HasPrefix(selector, "bosh.cloudfoundry.org/stemcell=") {
+				return false, nil, nil
+			}
+
+			podList := &v1.PodList{}
+			for i := 0; i < 2; i++ {
+				pod := v1.Pod{
+					ObjectMeta: v1.ObjectMeta{
+						Labels: map[string]string{"bosh.cloudfoundry.org/stemcell": selector[len("bosh.cloudfoundry.org/stemcell="):]},
+					},
+					Status: v1.PodStatus{
+						ContainerStatuses: []v1.ContainerStatus{{
+							State: v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: "ContainerCreating"}},
+						}},
+					},
+				}
+				if i < pulledPods {
+					pod.Status.ContainerStatuses[0].State = v1.ContainerState{Running: &v1.ContainerStateRunning{}}
+					pod.Status.ContainerStatuses[0].ImageID = "docker://sha256:image-id"
+				}
+				podList.Items = append(podList.Items, pod)
+			}
+			return true, podList, nil
+		})
+
+		fakeClock = fakeclock.NewFakeClock(time.Now())
+		prePuller = &actions.ImagePrePuller{
+			Clock:   fakeClock,
+			Timeout: 30 * time.Second,
+		}
+	})
+
+	It("creates a DaemonSet that runs the stemcell image", func() {
+		err := prePuller.PrePull(fakeClient, stemcellCID, pullSecrets)
+		Expect(err).NotTo(HaveOccurred())
+
+		matches := fakeClient.MatchingActions("create", "daemonsets")
+		Expect(matches).To(HaveLen(1))
+
+		daemonSet := matches[0].(testing.CreateAction).GetObject().(*extensions.DaemonSet)
+		Expect(daemonSet.Name).To(MatchRegexp("^pre-pull-stemcell-[0-9a-f]{16}$"))
+		Expect(daemonSet.Namespace).To(Equal("bosh-namespace"))
+		Expect(daemonSet.Annotations).To(HaveKeyWithValue("bosh.cloudfoundry.org/stemcell-cid", string(stemcellCID)))
+		Expect(daemonSet.Labels).To(HaveKey("bosh.cloudfoundry.org/stemcell"))
+		Expect(daemonSet.Spec.Selector.MatchLabels).To(Equal(daemonSet.Labels))
+		Expect(daemonSet.Spec.Template.Labels).To(Equal(daemonSet.Labels))
+
+		podSpec := daemonSet.Spec.Template.Spec
+		Expect(podSpec.ImagePullSecrets).To(Equal(pullSecrets))
+		Expect(podSpec.Containers).To(HaveLen(1))
+		Expect(podSpec.Containers[0].Image).To(Equal(string(stemcellCID)))
+		Expect(podSpec.Containers[0].ImagePullPolicy).To(Equal(v1.PullAlways))
+	})
+
+	It("removes the DaemonSet afterwards and leaves its pods to the garbage collector", func() {
+		err := prePuller.PrePull(fakeClient, stemcellCID, pullSecrets)
+		Expect(err).NotTo(HaveOccurred())
+
+		// once for an interrupted pre-pull and once when done
+		deletes := fakeClient.MatchingActions("delete", "daemonsets")
+		Expect(deletes).To(HaveLen(2))
+		Expect(fakeClient.MatchingActions("delete-collection", "pods")).To(BeEmpty())
+
+		create := fakeClient.MatchingActions("create", "daemonsets")[0].(testing.CreateAction).GetObject().(*extensions.DaemonSet)
+		Expect(deletes[1].(testing.DeleteAction).GetName()).To(Equal(create.Name))
+	})
+
+	Context("when the image is pinned to a digest", func() {
+		BeforeEach(func() {
+			stemcellCID = cpi.StemcellCID("sykesm/kubernetes-stemcell@sha256:0000000000000000000000000000000000000000000000000000000000000000")
+		})
+
+		It("pulls the image only if it is not present", func() {
+			err := prePuller.PrePull(fakeClient, stemcellCID, pullSecrets)
+			Expect(err).NotTo(HaveOccurred())
+
+			daemonSet := fakeClient.MatchingActions("create", "daemonsets")[0].(testing.CreateAction).GetObject().(*extensions.DaemonSet)
+			Expect(daemonSet.Spec.Template.Spec.Containers[0].ImagePullPolicy).To(Equal(v1.PullIfNotPresent))
+		})
+	})
+
+	Context("when the image has not been pulled on every node", func() {
+		BeforeEach(func() {
+			pulledPods = 1
+		})
+
+		It("waits for the remaining nodes", func() {
+			result := make(chan error)
+			go func() { result <- prePuller.PrePull(fakeClient, stemcellCID, pullSecrets) }()
+
+			Consistently(result).ShouldNot(Receive())
+			pulledPods = 2
+			fakeClock.Increment(2 * time.Second)
+			Eventually(result).Should(Receive(BeNil()))
+		})
+
+		It("returns an error when the timeout expires", func() {
+			result := make(chan error)
+			go func() { result <- prePuller.PrePull(fakeClient, stemcellCID, pullSecrets) }()
+
+			Consistently(result).ShouldNot(Receive())
+			fakeClock.Increment(31 * time.Second)
+			Eventually(result).Should(Receive(MatchError(
+				`Pre-pull of stemcell "sykesm/kubernetes-stemcell:999" in context "bosh" failed with a timeout: pulled on 1 of 2 nodes`,
+			)))
+
+			Expect(fakeClient.MatchingActions("delete", "daemonsets")).To(HaveLen(2))
+		})
+	})
+
+	Context("when creating the DaemonSet fails", func() {
+		BeforeEach(func() {
+			fakeClient.PrependReactor("create", "daemonsets", func(action testing.Action) (bool, runtime.Object, error) {
+				return true, nil, errors.New("daemonset-welp")
+			})
+		})
+
+		It("returns an error", func() {
+			err := prePuller.PrePull(fakeClient, stemcellCID, pullSecrets)
+			Expect(err).To(MatchError("daemonset-welp"))
+		})
+	})
+
+	Context("when used by the stemcell manager", func() {
+		var stemcellManager *actions.StemcellManager
+
+		BeforeEach(func() {
+			fakeProvider := &fakes.ClientProvider{}
+			fakeProvider.NewReturns(fakeClient, nil)
+
+			stemcellManager = &actions.StemcellManager{
+				ClientProvider: fakeProvider,
+				Contexts:       []string{"bosh"},
+				PrePuller:      prePuller,
+			}
+		})
+
+		It("pre-pulls the stemcell image with its pull secret", func() {
+			_, err := stemcellManager.CreateStemcell("/ignored/path", actions.StemcellCloudProperties{
+				Image:       string(stemcellCID),
+				Credentials: &actions.RegistryCredentials{Server: "registry.example.com"},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			secret := fakeClient.MatchingActions("create", "secrets")[0].(testing.CreateAction).GetObject().(*v1.Secret)
+			daemonSet := fakeClient.MatchingActions("create", "daemonsets")[0].(testing.CreateAction).GetObject().(*extensions.DaemonSet)
+			Expect(daemonSet.Spec.Template.Spec.ImagePullSecrets).To(Equal([]v1.LocalObjectReference{{Name: secret.Name}}))
+		})
+
+		It("removes leftover pre-pull resources when the stemcell is deleted", func() {
+			Expect(stemcellManager.DeleteStemcell(stemcellCID)).To(Succeed())
+			Expect(fakeClient.MatchingActions("delete", "daemonsets")).To(HaveLen(1))
+		})
+	})
+})
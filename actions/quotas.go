@@ -0,0 +1,327 @@
+package actions
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/sykesm/kubernetes-cpi/config"
+	"github.com/sykesm/kubernetes-cpi/cpi"
+
+	core "k8s.io/client-go/1.4/kubernetes/typed/core/v1"
+	"k8s.io/client-go/1.4/pkg/api"
+	"k8s.io/client-go/1.4/pkg/api/resource"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// NamespacePolicyName is the name of the resource quota and limit range the
+// CPI maintains in a namespace from the namespace policy of the context.
+const NamespacePolicyName = "bosh-cpi"
+
+// ensureNamespacePolicy creates or updates the resource quota and limit range
+// of the policy in the namespace. One is removed when the policy declares
+// only the other. Policies that declare neither leave the namespace alone so
+// the CPI needs no access to quotas and limit ranges without them.
+func ensureNamespacePolicy(coreClient core.CoreInterface, namespace string, policy config.NamespacePolicy) error {
+	if len(policy.ResourceQuota) == 0 && policy.LimitRange == nil {
+		return nil
+	}
+
+	hard, err := policyResourceList(policy.ResourceQuota, false)
+	if err != nil {
+		return err
+	}
+
+	err = ensureResourceQuota(coreClient.ResourceQuotas(namespace), namespace, hard)
+	if err != nil {
+		return err
+	}
+
+	var limits []v1.LimitRangeItem
+	if policy.LimitRange != nil {
+		item, err := limitRangeItem(*policy.LimitRange)
+		if err != nil {
+			return err
+		}
+		limits = []v1.LimitRangeItem{item}
+	}
+
+	return ensureLimitRange(coreClient.LimitRanges(namespace), namespace, limits)
+}
+
+func ensureResourceQuota(quotaClient core.ResourceQuotaInterface, namespace string, hard v1.ResourceList) error {
+	quota, err := quotaClient.Get(NamespacePolicyName)
+	if err != nil && !isNotFoundStatusError(err) {
+		return err
+	}
+
+	switch {
+	case err != nil && len(hard) == 0:
+		return nil
+
+	case err != nil:
+		_, err = quotaClient.Create(&v1.ResourceQuota{
+			ObjectMeta: v1.ObjectMeta{Name: NamespacePolicyName, Namespace: namespace},
+			Spec:       v1.ResourceQuotaSpec{Hard: hard},
+		})
+		return err
+
+	case len(hard) == 0:
+		err = quotaClient.Delete(NamespacePolicyName, &api.DeleteOptions{})
+		if err != nil && !isNotFoundStatusError(err) {
+			return err
+		}
+		return nil
+
+	case api.Semantic.DeepEqual(quota.Spec.Hard, hard):
+		return nil
+
+	default:
+		quota.Spec.Hard = hard
+		_, err = quotaClient.Update(quota)
+		return err
+	}
+}
+
+func ensureLimitRange(limitClient core.LimitRangeInterface, namespace string, limits []v1.LimitRangeItem) error {
+	limitRange, err := limitClient.Get(NamespacePolicyName)
+	if err != nil && !isNotFoundStatusError(err) {
+		return err
+	}
+
+	switch {
+	case err != nil && len(limits) == 0:
+		return nil
+
+	case err != nil:
+		_, err = limitClient.Create(&v1.LimitRange{
+			ObjectMeta: v1.ObjectMeta{Name: NamespacePolicyName, Namespace: namespace},
+			Spec:       v1.LimitRangeSpec{Limits: limits},
+		})
+		return err
+
+	case len(limits) == 0:
+		err = limitClient.Delete(NamespacePolicyName, &api.DeleteOptions{})
+		if err != nil && !isNotFoundStatusError(err) {
+			return err
+		}
+		return nil
+
+	case api.Semantic.DeepEqual(limitRange.Spec.Limits, limits):
+		return nil
+
+	default:
+		limitRange.Spec.Limits = limits
+		_, err = limitClient.Update(limitRange)
+		return err
+	}
+}
+
+func limitRangeItem(limits config.LimitRange) (v1.LimitRangeItem, error) {
+	item := v1.LimitRangeItem{Type: v1.LimitTypeContainer}
+
+	var err error
+	if item.Default, err = policyResourceList(limits.Default, true); err != nil {
+		return v1.LimitRangeItem{}, err
+	}
+	if item.DefaultRequest, err = policyResourceList(limits.DefaultRequest, true); err != nil {
+		return v1.LimitRangeItem{}, err
+	}
+	if item.Max, err = policyResourceList(limits.Max, true); err != nil {
+		return v1.LimitRangeItem{}, err
+	}
+	if item.Min, err = policyResourceList(limits.Min, true); err != nil {
+		return v1.LimitRangeItem{}, err
+	}
+
+	return item, nil
+}
+
+// policyResourceList parses the quantities of a namespace policy. Container
+// resources are validated like the resources of a VM; quota resources, such
+// as requests.storage or pods, are passed through.
+func policyResourceList(quantities map[string]string, container bool) (v1.ResourceList, error) {
+	if len(quantities) == 0 {
+		return nil, nil
+	}
+
+	if container {
+		resourceList := ResourceList{}
+		for k, v := range quantities {
+			resourceList[ResourceName(k)] = v
+		}
+		return getResourceList(resourceList)
+	}
+
+	list := v1.ResourceList{}
+	for k, v := range quantities {
+		quantity, err := resource.ParseQuantity(v)
+		if err != nil {
+			return nil, fmt.Errorf("resource quota %s: %s", k, err)
+		}
+		if quantity.Sign() < 0 {
+			return nil, fmt.Errorf("%s quantity %s must not be negative", k, v)
+		}
+		list[v1.ResourceName(k)] = quantity
+	}
+
+	return list, nil
+}
+
+// podQuotaUsage returns the quota resources used by a pod with the
+// requirements once the container limit defaults of the namespace have been
+// applied.
+func podQuotaUsage(requirements v1.ResourceRequirements, limitRanges []v1.LimitRange) v1.ResourceList {
+	limits := v1.ResourceList{}
+	for name, quantity := range requirements.Limits {
+		limits[name] = quantity
+	}
+	requests := v1.ResourceList{}
+	for name, quantity := range requirements.Requests {
+		requests[name] = quantity
+	}
+
+	for _, limitRange := range limitRanges {
+		for _, item := range limitRange.Spec.Limits {
+			if item.Type != v1.LimitTypeContainer {
+				continue
+			}
+			for name, quantity := range item.Default {
+				if _, ok := limits[name]; !ok {
+					limits[name] = quantity
+				}
+			}
+			for name, quantity := range item.DefaultRequest {
+				if _, ok := requests[name]; !ok {
+					requests[name] = quantity
+				}
+			}
+		}
+	}
+
+	// requests default to the limits
+	for name, quantity := range limits {
+		if _, ok := requests[name]; !ok {
+			requests[name] = quantity
+		}
+	}
+
+	usage := v1.ResourceList{v1.ResourcePods: resource.MustParse("1")}
+	for name, quantity := range requests {
+		switch name {
+		case v1.ResourceStorage:
+			continue
+		case v1.ResourceCPU, v1.ResourceMemory, v1.ResourceName(ResourceEphemeralStorage):
+			usage[name] = quantity
+		}
+		usage["requests."+name] = quantity
+	}
+	for name, quantity := range limits {
+		if name != v1.ResourceStorage {
+			usage["limits."+name] = quantity
+		}
+	}
+
+	return usage
+}
+
+// claimQuotaUsage returns the quota resources used by a claim of the size.
+func claimQuotaUsage(size resource.Quantity, storageClass string) v1.ResourceList {
+	usage := v1.ResourceList{
+		v1.ResourcePersistentVolumeClaims: resource.MustParse("1"),
+		v1.ResourceRequestsStorage:        size,
+	}
+	if storageClass != "" {
+		usage[v1.ResourceName(storageClass+".storageclass.storage.k8s.io/persistentvolumeclaims")] = resource.MustParse("1")
+		usage[v1.ResourceName(storageClass+".storageclass.storage.k8s.io/requests.storage")] = size
+	}
+	return usage
+}
+
+// addUsage returns the sum of the quota resources.
+func addUsage(usages ...v1.ResourceList) v1.ResourceList {
+	total := v1.ResourceList{}
+	for _, usage := range usages {
+		for name, quantity := range usage {
+			sum := total[name]
+			sum.Add(quantity)
+			total[name] = sum
+		}
+	}
+	return total
+}
+
+// checkQuota returns a QuotaExceededError when objects using the resources
+// would exceed a resource quota of the namespace. This gives the director a
+// clear error before anything is created instead of a Forbidden response
+// part way through.
+func checkQuota(coreClient core.CoreInterface, namespace string, usage v1.ResourceList) error {
+	quotaList, err := coreClient.ResourceQuotas(namespace).List(api.ListOptions{})
+	if err != nil {
+		// the API server still enforces quotas the CPI may not read
+		if isForbiddenStatusError(err) {
+			return nil
+		}
+		return err
+	}
+
+	names := []string{}
+	for name := range usage {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+
+	for _, quota := range quotaList.Items {
+		for _, name := range names {
+			hard, ok := quota.Spec.Hard[v1.ResourceName(name)]
+			if !ok {
+				continue
+			}
+
+			requested := usage[v1.ResourceName(name)]
+			used := quota.Status.Used[v1.ResourceName(name)]
+			total := used.DeepCopy()
+			total.Add(requested)
+			if total.Cmp(hard) > 0 {
+				return cpi.QuotaExceededError{
+					Namespace: namespace,
+					Quota:     quota.Name,
+					Resource:  name,
+					Requested: requested.String(),
+					Used:      used.String(),
+					Hard:      hard.String(),
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkVMQuota checks the quota of the namespace for the pod of a VM and the
+// claim of a persistent ephemeral disk.
+func checkVMQuota(coreClient core.CoreInterface, namespace string, resources Resources, persistentEphemeralDisk bool, ephemeralSize uint) error {
+	requirements, err := getPodResourceRequirements(resources)
+	if err != nil {
+		return err
+	}
+
+	limitRangeList, err := coreClient.LimitRanges(namespace).List(api.ListOptions{})
+	if err != nil {
+		// without access to the limit ranges their defaults are not applied
+		if !isForbiddenStatusError(err) {
+			return err
+		}
+		limitRangeList = &v1.LimitRangeList{}
+	}
+
+	usage := podQuotaUsage(requirements, limitRangeList.Items)
+	if persistentEphemeralDisk {
+		size, err := resource.ParseQuantity(fmt.Sprintf("%dMi", ephemeralSize))
+		if err != nil {
+			return err
+		}
+		usage = addUsage(usage, claimQuotaUsage(size, ""))
+	}
+
+	return checkQuota(coreClient, namespace, usage)
+}
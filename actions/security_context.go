@@ -0,0 +1,122 @@
+package actions
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+const (
+	SeccompAnnotationPrefix  = "container.seccomp.security.alpha.kubernetes.io/"
+	AppArmorAnnotationPrefix = "container.apparmor.security.beta.kubernetes.io/"
+)
+
+type Capabilities struct {
+	Add  []string `json:"add,omitempty"`
+	Drop []string `json:"drop,omitempty"`
+}
+
+// SecurityContext describes the security settings of the bosh-job container.
+// When Privileged is not set the container is privileged only if the context
+// permits privileged containers.
+type SecurityContext struct {
+	Privileged               *bool        `json:"privileged,omitempty"`
+	RunAsUser                *int64       `json:"run_as_user,omitempty"`
+	Capabilities             Capabilities `json:"capabilities,omitempty"`
+	SeccompProfile           string       `json:"seccomp_profile,omitempty"`
+	AppArmorProfile          string       `json:"apparmor_profile,omitempty"`
+	AllowPrivilegeEscalation *bool        `json:"allow_privilege_escalation,omitempty"`
+	ReadOnlyRootFilesystem   bool         `json:"read_only_root_filesystem,omitempty"`
+	WritablePaths            []string     `json:"writable_paths,omitempty"`
+	RuntimeClass             string       `json:"runtime_class,omitempty"`
+}
+
+// containerSecurity is the pod configuration derived from a SecurityContext,
+// ServiceAccount, and the stemcell pull secret.
+type containerSecurity struct {
+	ServiceAccountName string
+	ImagePullSecrets   []v1.LocalObjectReference
+	SecurityContext    *v1.SecurityContext
+	Annotations        map[string]string
+	VolumeMounts       []v1.VolumeMount
+	Volumes            []v1.Volume
+}
+
+func getContainerSecurity(context string, sc SecurityContext, privilegedAllowed bool) (containerSecurity, error) {
+	// The Kubernetes client used here predates these fields so refuse them
+	// rather than create a container that is less isolated than requested.
+	if sc.AllowPrivilegeEscalation != nil {
+		return containerSecurity{}, errors.New("allow_privilege_escalation is not supported by this Kubernetes client")
+	}
+	if sc.RuntimeClass != "" {
+		return containerSecurity{}, errors.New("runtime_class is not supported by this Kubernetes client")
+	}
+
+	privileged := privilegedAllowed
+	if sc.Privileged != nil {
+		privileged = *sc.Privileged
+	}
+	if privileged && !privilegedAllowed {
+		return containerSecurity{}, fmt.Errorf("privileged containers are not permitted in context %q", context)
+	}
+
+	rootUID := int64(0)
+	securityContext := &v1.SecurityContext{RunAsUser: &rootUID}
+	if sc.RunAsUser != nil {
+		securityContext.RunAsUser = sc.RunAsUser
+	}
+	if privileged {
+		securityContext.Privileged = &privileged
+	}
+
+	if len(sc.Capabilities.Add) > 0 || len(sc.Capabilities.Drop) > 0 {
+		securityContext.Capabilities = &v1.Capabilities{}
+		for _, c := range sc.Capabilities.Add {
+			securityContext.Capabilities.Add = append(securityContext.Capabilities.Add, v1.Capability(c))
+		}
+		for _, c := range sc.Capabilities.Drop {
+			securityContext.Capabilities.Drop = append(securityContext.Capabilities.Drop, v1.Capability(c))
+		}
+	}
+
+	security := containerSecurity{
+		SecurityContext: securityContext,
+		Annotations:     map[string]string{},
+	}
+
+	if sc.SeccompProfile != "" {
+		security.Annotations[SeccompAnnotationPrefix+"bosh-job"] = sc.SeccompProfile
+	}
+	if sc.AppArmorProfile != "" {
+		security.Annotations[AppArmorAnnotationPrefix+"bosh-job"] = sc.AppArmorProfile
+	}
+
+	if len(sc.WritablePaths) > 0 && !sc.ReadOnlyRootFilesystem {
+		return containerSecurity{}, errors.New("writable_paths requires read_only_root_filesystem")
+	}
+
+	if sc.ReadOnlyRootFilesystem {
+		securityContext.ReadOnlyRootFilesystem = &sc.ReadOnlyRootFilesystem
+
+		for i, p := range sc.WritablePaths {
+			if !path.IsAbs(p) {
+				return containerSecurity{}, fmt.Errorf("writable path %s must be absolute", p)
+			}
+
+			name := "bosh-writable-" + strconv.Itoa(i)
+			security.Volumes = append(security.Volumes, v1.Volume{
+				Name:         name,
+				VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}},
+			})
+			security.VolumeMounts = append(security.VolumeMounts, v1.VolumeMount{
+				Name:      name,
+				MountPath: path.Clean(p),
+			})
+		}
+	}
+
+	return security, nil
+}
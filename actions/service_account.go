@@ -0,0 +1,128 @@
+package actions
+
+import (
+	"strconv"
+
+	"github.com/sykesm/kubernetes-cpi/kubecluster"
+	"k8s.io/client-go/1.4/pkg/api"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	rbac "k8s.io/client-go/1.4/pkg/apis/rbac/v1alpha1"
+)
+
+// ServiceAccountTokenPath is where the service account admission controller
+// mounts the API token. The controller does not mount the token when the
+// container already has a volume at this path.
+const ServiceAccountTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// ServiceAccount requests a dedicated service account for a VM. The account
+// is bound to the named roles and cluster roles in the namespace of the VM.
+type ServiceAccount struct {
+	ClusterRoles   []string `json:"cluster_roles,omitempty"`
+	Roles          []string `json:"roles,omitempty"`
+	AutomountToken *bool    `json:"automount_token,omitempty"`
+}
+
+func createServiceAccount(client kubecluster.Client, ns, agentID string, vm vmMeta, serviceAccount *ServiceAccount) error {
+	if serviceAccount == nil {
+		return nil
+	}
+
+	_, err := client.ServiceAccounts().Create(&v1.ServiceAccount{
+		ObjectMeta: vm.objectMeta(agentName(agentID), ns),
+	})
+	if err != nil {
+		return err
+	}
+
+	var roleRefs []v1.ObjectReference
+	for _, role := range serviceAccount.ClusterRoles {
+		roleRefs = append(roleRefs, v1.ObjectReference{Kind: "ClusterRole", Name: role})
+	}
+	for _, role := range serviceAccount.Roles {
+		roleRefs = append(roleRefs, v1.ObjectReference{Kind: "Role", Namespace: ns, Name: role})
+	}
+
+	for i, roleRef := range roleRefs {
+		_, err := client.RoleBindings().Create(&rbac.RoleBinding{
+			ObjectMeta: vm.objectMeta(objectName("agent-", agentID+"-"+strconv.Itoa(i)), ns),
+			Subjects: []rbac.Subject{{
+				Kind:      "ServiceAccount",
+				Name:      agentName(agentID),
+				Namespace: ns,
+			}},
+			RoleRef: roleRef,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// withServiceAccount runs the pod as the service account of the VM and masks
+// the API token when it should not be mounted.
+func withServiceAccount(security containerSecurity, agentID string, serviceAccount *ServiceAccount) containerSecurity {
+	if serviceAccount == nil {
+		return security
+	}
+
+	security.ServiceAccountName = agentName(agentID)
+
+	if serviceAccount.AutomountToken != nil && !*serviceAccount.AutomountToken {
+		security.Volumes = append(security.Volumes, v1.Volume{
+			Name:         "bosh-no-api-token",
+			VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}},
+		})
+		security.VolumeMounts = append(security.VolumeMounts, v1.VolumeMount{
+			Name:      "bosh-no-api-token",
+			MountPath: ServiceAccountTokenPath,
+			ReadOnly:  true,
+		})
+	}
+
+	return security
+}
+
+// deleteServiceAccount deletes the service account of a VM and its role
+// bindings. Role bindings are only looked for when the service account
+// exists as the RBAC API may be disabled or not permitted to the CPI.
+func deleteServiceAccount(client kubecluster.Client, directorUUID, agentID string) error {
+	_, err := client.ServiceAccounts().Get(agentName(agentID))
+	if err != nil {
+		if isNotFoundStatusError(err) {
+			return nil
+		}
+		return err
+	}
+
+	agentSelectors, err := directorSelectors(directorUUID, "bosh.cloudfoundry.org/agent-id="+labelValue(agentID))
+	if err != nil {
+		return err
+	}
+
+	for _, agentSelector := range agentSelectors {
+		bindingList, err := client.RoleBindings().List(api.ListOptions{LabelSelector: agentSelector})
+		if err != nil {
+			// the role bindings can't exist when the RBAC API is unavailable
+			if !isNotFoundStatusError(err) && !isForbiddenStatusError(err) {
+				return err
+			}
+			break
+		}
+
+		for _, binding := range bindingList.Items {
+			err := client.RoleBindings().Delete(binding.Name, &api.DeleteOptions{GracePeriodSeconds: int64Ptr(0)})
+			if err != nil && !isNotFoundStatusError(err) {
+				return err
+			}
+		}
+	}
+
+	err = client.ServiceAccounts().Delete(agentName(agentID), &api.DeleteOptions{GracePeriodSeconds: int64Ptr(0)})
+	if err != nil && !isNotFoundStatusError(err) {
+		return err
+	}
+
+	return nil
+}
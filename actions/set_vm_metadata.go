@@ -16,14 +16,17 @@ type VMMetadataSetter struct {
 }
 
 func (v *VMMetadataSetter) SetVMMetadata(vmcid cpi.VMCID, metadata map[string]string) error {
-	context, agentID := ParseVMCID(vmcid)
+	cid, err := vmcid.Decode()
+	if err != nil {
+		return err
+	}
 
-	client, err := v.ClientProvider.New(context)
+	client, err := newCIDClient(v.ClientProvider, cid)
 	if err != nil {
 		return err
 	}
 
-	pod, err := client.Pods().Get("agent-" + agentID)
+	pod, err := client.Pods().Get(agentName(cid.ID))
 	if err != nil {
 		return err
 	}
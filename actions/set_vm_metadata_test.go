@@ -32,7 +32,7 @@ var _ = Describe("SetVMMetadata", func() {
 		fakeProvider = &fakes.ClientProvider{}
 		fakeProvider.NewReturns(fakeClient, nil)
 
-		vmcid = actions.NewVMCID("bosh", "agent-id")
+		vmcid = cpi.NewVMCID("bosh", "bosh-namespace", "agent-id")
 		metadata = map[string]string{
 			"deployment":       "kube-test-bosh",
 			"director":         "bosh-init",
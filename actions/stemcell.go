@@ -1,15 +1,571 @@
 package actions
 
-import "github.com/sykesm/kubernetes-cpi/cpi"
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/sykesm/kubernetes-cpi/config"
+	"github.com/sykesm/kubernetes-cpi/cpi"
+	"github.com/sykesm/kubernetes-cpi/kubecluster"
+	"github.com/sykesm/kubernetes-cpi/registry"
+	"gopkg.in/yaml.v2"
+	core "k8s.io/client-go/1.4/kubernetes/typed/core/v1"
+	"k8s.io/client-go/1.4/pkg/api"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/labels"
+)
 
 type StemcellCloudProperties struct {
 	Image string `json:"image"`
+
+	// Name and Version name the imported image when the stemcell image is
+	// not a stemcell tarball with a manifest.
+	Name    string `json:"name,omitempty"`
+	Version string `json:"version,omitempty"`
+
+	// Credentials or PullSecret, the name of an existing image pull secret,
+	// are used to pull the image from a private registry.
+	Credentials *RegistryCredentials `json:"credentials,omitempty"`
+	PullSecret  string               `json:"pull_secret,omitempty"`
+}
+
+type RegistryCredentials struct {
+	Server   string `json:"server"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Email    string `json:"email,omitempty"`
+}
+
+type stemcellManifest struct {
+	Name    string `yaml:"name"`
+	Version string `yaml:"version"`
+}
+
+// StemcellManager creates the image pull secret of a stemcell in each of the
+// Contexts and removes it when the stemcell is deleted. When a Registry is
+// configured, stemcells without an image in their cloud properties are
+// imported into it and stemcells with an image in it are recorded in each
+// context. When a Resolver is configured, image tags are pinned to the digest
+// they refer to so pods always run the image BOSH deployed.
+type StemcellManager struct {
+	ClientProvider kubecluster.ClientProvider
+	Contexts       []string
+	Registry       *registry.Client
+	Resolver       ImageResolver
+
+	// PrePuller, when set, warms the stemcell image on the nodes of each
+	// context when the stemcell is created.
+	PrePuller *ImagePrePuller
+
+	// NamespacePolicies holds the namespace policy of each context. The pull
+	// secrets copied into deployment namespaces are removed with them.
+	NamespacePolicies map[string]config.NamespacePolicy
+}
+
+// ImageResolver pins an image reference to the digest of its manifest.
+type ImageResolver interface {
+	Resolve(image string, credentials *RegistryCredentials) (string, error)
+}
+
+// RegistryResolver resolves image tags with the registry API. Images on the
+// host of the Registry client are resolved with it; other registries are
+// reached over HTTPS with the stemcell credentials for that registry.
+type RegistryResolver struct {
+	Registry *registry.Client
+}
+
+func (r *RegistryResolver) Resolve(image string, credentials *RegistryCredentials) (string, error) {
+	ref, err := registry.ParseReference(image)
+	if err != nil {
+		return "", err
+	}
+	if ref.Digest != "" {
+		return image, nil
+	}
+
+	digest, err := r.clientFor(ref.Host, credentials).Resolve(ref.Repository, ref.Tag)
+	if err != nil {
+		return "", err
+	}
+
+	return ref.Pinned(digest), nil
+}
+
+func (r *RegistryResolver) clientFor(host string, credentials *RegistryCredentials) *registry.Client {
+	if r.Registry != nil && r.Registry.Host() == host {
+		return r.Registry
+	}
+
+	apiHost := host
+	if host == registry.DockerHubHost {
+		apiHost = registry.DockerHubAPIHost
+	}
+
+	client := &registry.Client{URL: "https://" + apiHost}
+	if credentials != nil && registryHost(credentials.Server) == host {
+		client.Username = credentials.Username
+		client.Password = credentials.Password
+	}
+	return client
+}
+
+// registryHost returns the host of a docker config server entry. The Docker
+// Hub aliases are returned as docker.io.
+func registryHost(server string) string {
+	host := server
+	if i := strings.Index(host, "://"); i >= 0 {
+		host = host[i+3:]
+	}
+	if i := strings.Index(host, "/"); i >= 0 {
+		host = host[:i]
+	}
+
+	switch host {
+	case "index.docker.io", registry.DockerHubAPIHost:
+		return registry.DockerHubHost
+	}
+	return host
+}
+
+func (s *StemcellManager) CreateStemcell(image string, cloudProps StemcellCloudProperties) (cpi.StemcellCID, error) {
+	if cloudProps.Credentials != nil && cloudProps.PullSecret != "" {
+		return "", errors.New("only one of credentials and pull_secret may be set")
+	}
+
+	stemcellCID := cpi.StemcellCID(cloudProps.Image)
+	if cloudProps.Image == "" {
+		var err error
+		stemcellCID, err = s.importStemcell(image, cloudProps)
+		if err != nil {
+			return "", err
+		}
+	} else if s.Resolver != nil {
+		pinned, err := s.Resolver.Resolve(cloudProps.Image, cloudProps.Credentials)
+		if err != nil {
+			return "", err
+		}
+		stemcellCID = cpi.StemcellCID(pinned)
+	}
+
+	_, inRegistry := s.registryImage(stemcellCID)
+	needsPullSecret := cloudProps.Credentials != nil || cloudProps.PullSecret != ""
+	if !needsPullSecret && !inRegistry && s.PrePuller == nil {
+		return stemcellCID, nil
+	}
+
+	for _, context := range s.Contexts {
+		client, err := s.ClientProvider.New(context)
+		if err != nil {
+			return "", err
+		}
+
+		err = createNamespace(client.Core(), client.Namespace(), nil)
+		if err != nil {
+			return "", err
+		}
+
+		if needsPullSecret {
+			err = createStemcellPullSecret(client, stemcellCID, cloudProps)
+			if err != nil {
+				return "", err
+			}
+		}
+
+		if inRegistry {
+			err = createStemcellImageRecord(client, stemcellCID, cloudProps.Image == "")
+			if err != nil {
+				return "", err
+			}
+		}
+
+		if s.PrePuller != nil {
+			pullSecrets, err := getStemcellPullSecrets(client.Secrets(), stemcellCID)
+			if err != nil {
+				return "", err
+			}
+
+			err = s.PrePuller.PrePull(client, stemcellCID, pullSecrets)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return stemcellCID, nil
+}
+
+// importStemcell pushes the image of a stemcell to the registry and returns
+// a reference to the image pinned to the manifest digest. The image is either
+// a stemcell tarball with a stemcell.MF and an image archive named image, or
+// the image archive itself.
+func (s *StemcellManager) importStemcell(imagePath string, cloudProps StemcellCloudProperties) (cpi.StemcellCID, error) {
+	if s.Registry == nil {
+		return "", errors.New("Stemcell has no image and no registry is configured")
+	}
+
+	manifest := stemcellManifest{Name: cloudProps.Name, Version: cloudProps.Version}
+	archivePath := imagePath
+
+	mf, err := registry.ReadArchiveEntry(imagePath, "stemcell.MF")
+	switch err {
+	case nil:
+		err = yaml.Unmarshal(mf, &manifest)
+		if err != nil {
+			return "", err
+		}
+
+		archivePath, err = extractStemcellImage(imagePath)
+		if err != nil {
+			return "", err
+		}
+		defer os.Remove(archivePath)
+
+	case registry.ErrEntryNotFound:
+	default:
+		return "", err
+	}
+
+	if manifest.Name == "" || manifest.Version == "" {
+		return "", errors.New("Stemcell name and version are required to import the stemcell image")
+	}
+
+	repository := strings.ToLower(manifest.Name)
+	digest, err := s.Registry.PushArchive(repository, manifest.Version, archivePath)
+	if err != nil {
+		return "", err
+	}
+
+	return cpi.StemcellCID(s.Registry.Host() + "/" + repository + "@" + digest), nil
+}
+
+// extractStemcellImage copies the image archive of a stemcell tarball to a
+// temporary file.
+func extractStemcellImage(stemcellPath string) (string, error) {
+	tmp, err := ioutil.TempFile("", "stemcell-image")
+	if err != nil {
+		return "", err
+	}
+	defer tmp.Close()
+
+	err = registry.WithArchiveEntry(stemcellPath, "image", func(r io.Reader) error {
+		_, err := io.Copy(tmp, r)
+		return err
+	})
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+
+	return tmp.Name(), nil
 }
 
-func CreateStemcell(image string, cloudProps StemcellCloudProperties) (cpi.StemcellCID, error) {
-	return cpi.StemcellCID(cloudProps.Image), nil
+// DeleteStemcell removes the image pull secret and any pre-pull DaemonSet of
+// the stemcell from every context and, when the stemcell image was imported
+// into the Registry, deletes the image manifest. Nothing is deleted while an
+// agent pod in any context runs the stemcell image.
+func (s *StemcellManager) DeleteStemcell(stemcellCID cpi.StemcellCID) error {
+	var clients []kubecluster.Client
+	for _, context := range s.Contexts {
+		client, err := s.ClientProvider.New(context)
+		if err != nil {
+			return err
+		}
+
+		// pods in the namespaces of every director's deployments count
+		err = forEachNamespace(client, s.NamespacePolicies[context], "", func(client kubecluster.Client) error {
+			podName, err := findStemcellUser(client.Pods(), stemcellCID)
+			if err != nil {
+				return err
+			}
+			if podName != "" {
+				return cpi.StemcellInUseError{StemcellCID: stemcellCID, Context: context, Pod: podName}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		clients = append(clients, client)
+	}
+
+	for _, client := range clients {
+		err := deleteStemcellPullSecret(client.Secrets(), stemcellCID)
+		if err != nil {
+			return err
+		}
+
+		err = deletePrePull(client, stemcellCID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.deleteStemcellImage(clients, stemcellCID)
+}
+
+// deleteStemcellImage deletes the manifest of a stemcell image the CPI
+// imported into the Registry and removes the image records of the stemcell.
+// Manifests of images that were only referenced, that were recorded before
+// records were kept, or that another recorded stemcell still uses are left
+// in the registry.
+func (s *StemcellManager) deleteStemcellImage(clients []kubecluster.Client, stemcellCID cpi.StemcellCID) error {
+	ref, ok := s.registryImage(stemcellCID)
+	if !ok {
+		return nil
+	}
+
+	var imported, shared bool
+	for _, client := range clients {
+		records, err := listStemcellImageRecords(client.ConfigMaps())
+		if err != nil {
+			return err
+		}
+
+		for _, record := range records {
+			recordCID := record.Annotations["bosh.cloudfoundry.org/stemcell-cid"]
+			if recordCID == string(stemcellCID) {
+				imported = imported || record.Labels["bosh.cloudfoundry.org/stemcell-image"] == "imported"
+				continue
+			}
+
+			other, err := registry.ParseReference(recordCID)
+			if err == nil && other.Host == ref.Host && other.Repository == ref.Repository && other.Digest == ref.Digest {
+				shared = true
+			}
+		}
+	}
+
+	if imported && !shared {
+		err := s.Registry.DeleteManifest(ref.Repository, ref.Digest)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, client := range clients {
+		err := client.ConfigMaps().Delete(stemcellImageRecordName(stemcellCID), &api.DeleteOptions{GracePeriodSeconds: int64Ptr(0)})
+		if err != nil && !isNotFoundStatusError(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// registryImage returns the reference of a digest pinned stemcell image in
+// the Registry.
+func (s *StemcellManager) registryImage(stemcellCID cpi.StemcellCID) (registry.Reference, bool) {
+	if s.Registry == nil {
+		return registry.Reference{}, false
+	}
+
+	ref, err := registry.ParseReference(string(stemcellCID))
+	if err != nil || ref.Host != s.Registry.Host() || ref.Digest == "" {
+		return registry.Reference{}, false
+	}
+	return ref, true
+}
+
+// stemcellImageRecordName returns the name of the config map that records a
+// stemcell with an image in the Registry.
+func stemcellImageRecordName(stemcellCID cpi.StemcellCID) string {
+	return stemcellPullSecretName(stemcellCID) + "-image"
+}
+
+// createStemcellImageRecord records a stemcell with an image in the Registry
+// and whether the CPI imported the image. A record left by an earlier
+// stemcell with the same ID is replaced.
+func createStemcellImageRecord(client kubecluster.Client, stemcellCID cpi.StemcellCID, imported bool) error {
+	source := "referenced"
+	if imported {
+		source = "imported"
+	}
+
+	err := client.ConfigMaps().Delete(stemcellImageRecordName(stemcellCID), &api.DeleteOptions{GracePeriodSeconds: int64Ptr(0)})
+	if err != nil && !isNotFoundStatusError(err) {
+		return err
+	}
+
+	_, err = client.ConfigMaps().Create(&v1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      stemcellImageRecordName(stemcellCID),
+			Namespace: client.Namespace(),
+			Labels: map[string]string{
+				"bosh.cloudfoundry.org/stemcell":       stemcellPullSecretName(stemcellCID),
+				"bosh.cloudfoundry.org/stemcell-image": source,
+			},
+			Annotations: map[string]string{
+				"bosh.cloudfoundry.org/stemcell-cid": string(stemcellCID),
+			},
+		},
+	})
+	return err
+}
+
+// listStemcellImageRecords returns the image records of every stemcell in
+// the namespace.
+func listStemcellImageRecords(configMapClient core.ConfigMapInterface) ([]v1.ConfigMap, error) {
+	recordSelector, err := labels.Parse("bosh.cloudfoundry.org/stemcell-image")
+	if err != nil {
+		return nil, err
+	}
+
+	configMaps, err := configMapClient.List(api.ListOptions{LabelSelector: recordSelector})
+	if err != nil {
+		return nil, err
+	}
+
+	var records []v1.ConfigMap
+	for _, configMap := range configMaps.Items {
+		if _, ok := configMap.Annotations["bosh.cloudfoundry.org/stemcell-cid"]; ok {
+			records = append(records, configMap)
+		}
+	}
+	return records, nil
+}
+
+// stemcellPullSecretName returns the name of the image pull secret of a
+// stemcell. Image references are not valid object names so a hash is used.
+func stemcellPullSecretName(stemcellCID cpi.StemcellCID) string {
+	sum := sha256.Sum256([]byte(stemcellCID))
+	return "stemcell-" + hex.EncodeToString(sum[:])[:16]
+}
+
+func createStemcellPullSecret(client kubecluster.Client, stemcellCID cpi.StemcellCID, cloudProps StemcellCloudProperties) error {
+	secret, err := newPullSecret(client.Secrets(), client.Namespace(), stemcellCID, cloudProps)
+	if err != nil {
+		return err
+	}
+
+	err = deleteStemcellPullSecret(client.Secrets(), stemcellCID)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Secrets().Create(secret)
+	return err
+}
+
+func newPullSecret(secretClient core.SecretInterface, ns string, stemcellCID cpi.StemcellCID, cloudProps StemcellCloudProperties) (*v1.Secret, error) {
+	secret := &v1.Secret{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      stemcellPullSecretName(stemcellCID),
+			Namespace: ns,
+			Labels: map[string]string{
+				"bosh.cloudfoundry.org/stemcell": stemcellPullSecretName(stemcellCID),
+			},
+			Annotations: map[string]string{
+				"bosh.cloudfoundry.org/stemcell-cid": string(stemcellCID),
+			},
+		},
+	}
+
+	// A referenced secret is copied so the stemcell secret can be deleted
+	// with the stemcell.
+	if cloudProps.PullSecret != "" {
+		referenced, err := secretClient.Get(cloudProps.PullSecret)
+		if err != nil {
+			return nil, err
+		}
+		secret.Type = referenced.Type
+		secret.Data = referenced.Data
+		return secret, nil
+	}
+
+	creds := cloudProps.Credentials
+	dockerConfig, err := json.Marshal(map[string]interface{}{
+		creds.Server: map[string]string{
+			"username": creds.Username,
+			"password": creds.Password,
+			"email":    creds.Email,
+			"auth":     base64.StdEncoding.EncodeToString([]byte(creds.Username + ":" + creds.Password)),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	secret.Type = v1.SecretTypeDockercfg
+	secret.Data = map[string][]byte{
+		v1.DockerConfigKey: dockerConfig,
+	}
+	return secret, nil
 }
 
-func DeleteStemcell(stemcellCID cpi.StemcellCID) error {
+// getStemcellPullSecrets returns the image pull secrets to use for the
+// stemcell image.
+func getStemcellPullSecrets(secretClient core.SecretInterface, stemcellCID cpi.StemcellCID) ([]v1.LocalObjectReference, error) {
+	secret, err := secretClient.Get(stemcellPullSecretName(stemcellCID))
+	if err != nil {
+		if isNotFoundStatusError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return []v1.LocalObjectReference{{Name: secret.Name}}, nil
+}
+
+// copyStemcellPullSecret copies the pull secret of a stemcell into another
+// namespace of the context. The copy is removed with the namespace.
+func copyStemcellPullSecret(from, to core.SecretInterface, ns string, stemcellCID cpi.StemcellCID) error {
+	secret, err := from.Get(stemcellPullSecretName(stemcellCID))
+	if err != nil {
+		return err
+	}
+
+	_, err = to.Create(&v1.Secret{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        secret.Name,
+			Namespace:   ns,
+			Labels:      secret.Labels,
+			Annotations: secret.Annotations,
+		},
+		Type: secret.Type,
+		Data: secret.Data,
+	})
+	if err != nil && !isAlreadyExistsStatusError(err) {
+		return err
+	}
+	return nil
+}
+
+func deleteStemcellPullSecret(secretClient core.SecretInterface, stemcellCID cpi.StemcellCID) error {
+	err := secretClient.Delete(stemcellPullSecretName(stemcellCID), &api.DeleteOptions{GracePeriodSeconds: int64Ptr(0)})
+	if err != nil && !isNotFoundStatusError(err) {
+		return err
+	}
 	return nil
 }
+
+// findStemcellUser returns the name of an agent pod that runs the stemcell
+// image.
+func findStemcellUser(podClient core.PodInterface, stemcellCID cpi.StemcellCID) (string, error) {
+	agentSelector, err := labels.Parse("bosh.cloudfoundry.org/agent-id")
+	if err != nil {
+		return "", err
+	}
+
+	podList, err := podClient.List(api.ListOptions{LabelSelector: agentSelector})
+	if err != nil {
+		return "", err
+	}
+
+	for _, pod := range podList.Items {
+		for _, container := range pod.Spec.Containers {
+			if container.Image == string(stemcellCID) {
+				return pod.Name, nil
+			}
+		}
+	}
+
+	return "", nil
+}
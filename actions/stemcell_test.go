@@ -1,14 +1,62 @@
 package actions_test
 
 import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
 	"github.com/sykesm/kubernetes-cpi/actions"
 	"github.com/sykesm/kubernetes-cpi/cpi"
+	"github.com/sykesm/kubernetes-cpi/kubecluster"
+	"github.com/sykesm/kubernetes-cpi/kubecluster/fakes"
+	"github.com/sykesm/kubernetes-cpi/registry"
+	registryfakes "github.com/sykesm/kubernetes-cpi/registry/fakes"
+	"k8s.io/client-go/1.4/pkg/api"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/runtime"
+	"k8s.io/client-go/1.4/testing"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
 
 var _ = Describe("Stemcell", func() {
+	var (
+		fakeClients  map[string]*fakes.Client
+		fakeProvider *fakes.ClientProvider
+
+		stemcellManager *actions.StemcellManager
+	)
+
+	BeforeEach(func() {
+		fakeClients = map[string]*fakes.Client{}
+		for _, context := range []string{"context-1", "context-2"} {
+			fakeClient := fakes.NewClient(&v1.Secret{
+				ObjectMeta: v1.ObjectMeta{Name: "registry-secret", Namespace: context + "-namespace"},
+				Type:       v1.SecretTypeDockercfg,
+				Data:       map[string][]byte{v1.DockerConfigKey: []byte("docker-config")},
+			})
+			fakeClient.ContextReturns(context)
+			fakeClient.NamespaceReturns(context + "-namespace")
+			fakeClients[context] = fakeClient
+		}
+
+		fakeProvider = &fakes.ClientProvider{}
+		fakeProvider.NewStub = func(context string) (kubecluster.Client, error) {
+			return fakeClients[context], nil
+		}
+
+		stemcellManager = &actions.StemcellManager{
+			ClientProvider: fakeProvider,
+			Contexts:       []string{"context-1", "context-2"},
+		}
+	})
+
 	Describe("CreateStemcell", func() {
 		var cloudProps actions.StemcellCloudProperties
 
@@ -19,10 +67,309 @@ var _ = Describe("Stemcell", func() {
 		})
 
 		It("returns the image as a stemcell ID", func() {
-			stemcellCID, err := actions.CreateStemcell("/ignored/path", cloudProps)
+			stemcellCID, err := stemcellManager.CreateStemcell("/ignored/path", cloudProps)
 			Expect(err).NotTo(HaveOccurred())
 			Expect(stemcellCID).To(Equal(cpi.StemcellCID("cloudfoundry/kubernetes-stemcell:999")))
 		})
+
+		It("does not create a pull secret", func() {
+			_, err := stemcellManager.CreateStemcell("/ignored/path", cloudProps)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeProvider.NewCallCount()).To(Equal(0))
+		})
+
+		Context("when registry credentials are provided", func() {
+			BeforeEach(func() {
+				cloudProps.Credentials = &actions.RegistryCredentials{
+					Server:   "registry.example.com",
+					Username: "user",
+					Password: "secret",
+				}
+			})
+
+			It("creates a docker registry secret in each context", func() {
+				_, err := stemcellManager.CreateStemcell("/ignored/path", cloudProps)
+				Expect(err).NotTo(HaveOccurred())
+
+				for context, fakeClient := range fakeClients {
+					matches := fakeClient.MatchingActions("create", "secrets")
+					Expect(matches).To(HaveLen(1))
+
+					secret := matches[0].(testing.CreateAction).GetObject().(*v1.Secret)
+					Expect(secret.Name).To(MatchRegexp("^stemcell-[0-9a-f]{16}$"))
+					Expect(secret.Namespace).To(Equal(context + "-namespace"))
+					Expect(secret.Annotations).To(HaveKeyWithValue("bosh.cloudfoundry.org/stemcell-cid", "cloudfoundry/kubernetes-stemcell:999"))
+					Expect(secret.Type).To(Equal(v1.SecretTypeDockercfg))
+
+					var dockerConfig map[string]map[string]string
+					Expect(json.Unmarshal(secret.Data[v1.DockerConfigKey], &dockerConfig)).To(Succeed())
+					Expect(dockerConfig["registry.example.com"]).To(Equal(map[string]string{
+						"username": "user",
+						"password": "secret",
+						"email":    "",
+						"auth":     "dXNlcjpzZWNyZXQ=",
+					}))
+				}
+			})
+
+			It("creates the namespace before the secret", func() {
+				_, err := stemcellManager.CreateStemcell("/ignored/path", cloudProps)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeClients["context-1"].MatchingActions("create", "namespaces")).To(HaveLen(1))
+			})
+
+			Context("when creating the secret fails", func() {
+				BeforeEach(func() {
+					fakeClients["context-2"].PrependReactor("create", "secrets", func(action testing.Action) (bool, runtime.Object, error) {
+						return true, nil, errors.New("secret-welp")
+					})
+				})
+
+				It("returns an error", func() {
+					_, err := stemcellManager.CreateStemcell("/ignored/path", cloudProps)
+					Expect(err).To(MatchError("secret-welp"))
+				})
+			})
+		})
+
+		Context("when a pull secret is referenced", func() {
+			BeforeEach(func() {
+				cloudProps.PullSecret = "registry-secret"
+			})
+
+			It("copies the referenced secret in each context", func() {
+				_, err := stemcellManager.CreateStemcell("/ignored/path", cloudProps)
+				Expect(err).NotTo(HaveOccurred())
+
+				for _, fakeClient := range fakeClients {
+					matches := fakeClient.MatchingActions("create", "secrets")
+					Expect(matches).To(HaveLen(1))
+
+					secret := matches[0].(testing.CreateAction).GetObject().(*v1.Secret)
+					Expect(secret.Type).To(Equal(v1.SecretTypeDockercfg))
+					Expect(secret.Data).To(Equal(map[string][]byte{v1.DockerConfigKey: []byte("docker-config")}))
+				}
+			})
+
+			Context("when the referenced secret does not exist", func() {
+				BeforeEach(func() {
+					cloudProps.PullSecret = "missing"
+				})
+
+				It("returns an error", func() {
+					_, err := stemcellManager.CreateStemcell("/ignored/path", cloudProps)
+					Expect(err).To(HaveOccurred())
+				})
+			})
+		})
+
+		Context("when a resolver is configured", func() {
+			var (
+				fakeRegistry *registryfakes.Registry
+				server       *httptest.Server
+				host         string
+				manifest     []byte
+			)
+
+			BeforeEach(func() {
+				fakeRegistry = registryfakes.NewRegistry()
+				server = httptest.NewServer(fakeRegistry)
+				host = strings.TrimPrefix(server.URL, "http://")
+
+				manifest = []byte(`{"schemaVersion":2}`)
+				fakeRegistry.PutManifest("kubernetes-stemcell", "999", registryfakes.StoredManifest{
+					MediaType: registry.MediaTypeManifest,
+					Content:   manifest,
+				})
+
+				stemcellManager.Resolver = &actions.RegistryResolver{
+					Registry: &registry.Client{URL: server.URL},
+				}
+				cloudProps.Image = host + "/kubernetes-stemcell:999"
+			})
+
+			AfterEach(func() {
+				server.Close()
+			})
+
+			It("pins the image tag to its digest", func() {
+				stemcellCID, err := stemcellManager.CreateStemcell("/ignored/path", cloudProps)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(stemcellCID).To(Equal(cpi.StemcellCID(host + "/kubernetes-stemcell@" + registry.Digest(manifest))))
+			})
+
+			It("names the pull secret after the pinned image", func() {
+				cloudProps.PullSecret = "registry-secret"
+				stemcellCID, err := stemcellManager.CreateStemcell("/ignored/path", cloudProps)
+				Expect(err).NotTo(HaveOccurred())
+
+				secret := fakeClients["context-1"].MatchingActions("create", "secrets")[0].(testing.CreateAction).GetObject().(*v1.Secret)
+				Expect(secret.Annotations).To(HaveKeyWithValue("bosh.cloudfoundry.org/stemcell-cid", string(stemcellCID)))
+			})
+
+			Context("when the image is already pinned", func() {
+				BeforeEach(func() {
+					cloudProps.Image = host + "/kubernetes-stemcell@" + registry.Digest([]byte("other"))
+				})
+
+				It("returns the image unchanged", func() {
+					stemcellCID, err := stemcellManager.CreateStemcell("/ignored/path", cloudProps)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(stemcellCID).To(Equal(cpi.StemcellCID(cloudProps.Image)))
+					Expect(fakeRegistry.Requests()).To(BeEmpty())
+				})
+			})
+
+			Context("when the tag does not exist", func() {
+				BeforeEach(func() {
+					cloudProps.Image = host + "/kubernetes-stemcell:missing"
+				})
+
+				It("returns an error", func() {
+					_, err := stemcellManager.CreateStemcell("/ignored/path", cloudProps)
+					Expect(err).To(MatchError(ContainSubstring("failed with status 404")))
+				})
+			})
+		})
+
+		Context("when the cloud properties have no image", func() {
+			var (
+				tempDir      string
+				imagePath    string
+				fakeRegistry *registryfakes.Registry
+				server       *httptest.Server
+			)
+
+			BeforeEach(func() {
+				var err error
+				tempDir, err = ioutil.TempDir("", "stemcell")
+				Expect(err).NotTo(HaveOccurred())
+
+				imagePath = filepath.Join(tempDir, "image")
+				err = registryfakes.WriteDockerArchive(imagePath, []byte(`{"config":{}}`), []byte("layer"))
+				Expect(err).NotTo(HaveOccurred())
+
+				fakeRegistry = registryfakes.NewRegistry()
+				server = httptest.NewServer(fakeRegistry)
+
+				stemcellManager.Registry = &registry.Client{URL: server.URL}
+				cloudProps = actions.StemcellCloudProperties{}
+			})
+
+			AfterEach(func() {
+				server.Close()
+				os.RemoveAll(tempDir)
+			})
+
+			Context("when the image is a stemcell tarball", func() {
+				var stemcellPath string
+
+				BeforeEach(func() {
+					image, err := ioutil.ReadFile(imagePath)
+					Expect(err).NotTo(HaveOccurred())
+
+					tarPath := filepath.Join(tempDir, "stemcell.tar")
+					err = registryfakes.WriteTar(tarPath, []string{"stemcell.MF", "image"}, map[string][]byte{
+						"stemcell.MF": []byte("---\nname: bosh-kubernetes-ubuntu-trusty-go_agent\nversion: '3312.12'\ncloud_properties: {}\n"),
+						"image":       image,
+					})
+					Expect(err).NotTo(HaveOccurred())
+
+					tarball, err := ioutil.ReadFile(tarPath)
+					Expect(err).NotTo(HaveOccurred())
+
+					stemcellPath = filepath.Join(tempDir, "stemcell.tgz")
+					f, err := os.Create(stemcellPath)
+					Expect(err).NotTo(HaveOccurred())
+					gw := gzip.NewWriter(f)
+					gw.Write(tarball)
+					Expect(gw.Close()).To(Succeed())
+					Expect(f.Close()).To(Succeed())
+				})
+
+				It("pushes the image named by the stemcell manifest", func() {
+					_, err := stemcellManager.CreateStemcell(stemcellPath, cloudProps)
+					Expect(err).NotTo(HaveOccurred())
+
+					_, ok := fakeRegistry.Manifest("bosh-kubernetes-ubuntu-trusty-go_agent", "3312.12")
+					Expect(ok).To(BeTrue())
+				})
+
+				It("returns a digest pinned image reference", func() {
+					stemcellCID, err := stemcellManager.CreateStemcell(stemcellPath, cloudProps)
+					Expect(err).NotTo(HaveOccurred())
+
+					manifest, _ := fakeRegistry.Manifest("bosh-kubernetes-ubuntu-trusty-go_agent", "3312.12")
+					host := strings.TrimPrefix(server.URL, "http://")
+					Expect(stemcellCID).To(Equal(cpi.StemcellCID(host + "/bosh-kubernetes-ubuntu-trusty-go_agent@" + registry.Digest(manifest.Content))))
+				})
+			})
+
+			Context("when the image is an image archive", func() {
+				BeforeEach(func() {
+					cloudProps.Name = "Stemcell-Name"
+					cloudProps.Version = "1.2"
+				})
+
+				It("pushes the image named by the cloud properties", func() {
+					stemcellCID, err := stemcellManager.CreateStemcell(imagePath, cloudProps)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(string(stemcellCID)).To(ContainSubstring("/stemcell-name@sha256:"))
+
+					_, ok := fakeRegistry.Manifest("stemcell-name", "1.2")
+					Expect(ok).To(BeTrue())
+				})
+
+				It("records the imported image in each context", func() {
+					stemcellCID, err := stemcellManager.CreateStemcell(imagePath, cloudProps)
+					Expect(err).NotTo(HaveOccurred())
+
+					for _, fakeClient := range fakeClients {
+						configMaps, err := fakeClient.ConfigMaps().List(api.ListOptions{})
+						Expect(err).NotTo(HaveOccurred())
+						Expect(configMaps.Items).To(HaveLen(1))
+
+						record := configMaps.Items[0]
+						Expect(record.Labels).To(HaveKeyWithValue("bosh.cloudfoundry.org/stemcell-image", "imported"))
+						Expect(record.Annotations).To(HaveKeyWithValue("bosh.cloudfoundry.org/stemcell-cid", string(stemcellCID)))
+					}
+				})
+
+				Context("when the name or version is missing", func() {
+					BeforeEach(func() {
+						cloudProps.Version = ""
+					})
+
+					It("returns an error", func() {
+						_, err := stemcellManager.CreateStemcell(imagePath, cloudProps)
+						Expect(err).To(MatchError("Stemcell name and version are required to import the stemcell image"))
+					})
+				})
+			})
+
+			Context("when no registry is configured", func() {
+				BeforeEach(func() {
+					stemcellManager.Registry = nil
+				})
+
+				It("returns an error", func() {
+					_, err := stemcellManager.CreateStemcell(imagePath, cloudProps)
+					Expect(err).To(MatchError("Stemcell has no image and no registry is configured"))
+				})
+			})
+		})
+
+		Context("when both credentials and a pull secret are provided", func() {
+			BeforeEach(func() {
+				cloudProps.PullSecret = "registry-secret"
+				cloudProps.Credentials = &actions.RegistryCredentials{Server: "registry.example.com"}
+			})
+
+			It("returns an error", func() {
+				_, err := stemcellManager.CreateStemcell("/ignored/path", cloudProps)
+				Expect(err).To(MatchError("only one of credentials and pull_secret may be set"))
+			})
+		})
 	})
 
 	Describe("DeleteStemcell", func() {
@@ -30,10 +377,209 @@ var _ = Describe("Stemcell", func() {
 
 		BeforeEach(func() {
 			stemcellCID = cpi.StemcellCID("image-id:version")
+
+			_, err := stemcellManager.CreateStemcell("/ignored/path", actions.StemcellCloudProperties{
+				Image:      "image-id:version",
+				PullSecret: "registry-secret",
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("deletes the pull secret from each context", func() {
+			Expect(stemcellManager.DeleteStemcell(stemcellCID)).To(Succeed())
+
+			for _, fakeClient := range fakeClients {
+				// one delete replaces any existing secret during create
+				Expect(fakeClient.MatchingActions("delete", "secrets")).To(HaveLen(2))
+			}
+		})
+
+		Context("when an agent pod uses the stemcell", func() {
+			BeforeEach(func() {
+				fakeClients["context-1"].PrependReactor("list", "pods", func(action testing.Action) (bool, runtime.Object, error) {
+					return true, &v1.PodList{Items: []v1.Pod{{
+						ObjectMeta: v1.ObjectMeta{
+							Name:   "agent-agent-id",
+							Labels: map[string]string{"bosh.cloudfoundry.org/agent-id": "agent-id"},
+						},
+						Spec: v1.PodSpec{
+							Containers: []v1.Container{{Name: "bosh-job", Image: "image-id:version"}},
+						},
+					}}}, nil
+				})
+			})
+
+			It("returns a stemcell in use error", func() {
+				err := stemcellManager.DeleteStemcell(stemcellCID)
+				Expect(err).To(Equal(cpi.StemcellInUseError{
+					StemcellCID: stemcellCID,
+					Context:     "context-1",
+					Pod:         "agent-agent-id",
+				}))
+			})
+
+			It("keeps the pull secret in every context", func() {
+				stemcellManager.DeleteStemcell(stemcellCID)
+
+				for _, fakeClient := range fakeClients {
+					Expect(fakeClient.MatchingActions("delete", "secrets")).To(HaveLen(1))
+				}
+			})
+		})
+
+		Context("when listing the pods fails", func() {
+			BeforeEach(func() {
+				fakeClients["context-2"].PrependReactor("list", "pods", func(action testing.Action) (bool, runtime.Object, error) {
+					return true, nil, errors.New("pods-welp")
+				})
+			})
+
+			It("returns an error without deleting", func() {
+				Expect(stemcellManager.DeleteStemcell(stemcellCID)).To(MatchError("pods-welp"))
+				Expect(fakeClients["context-1"].MatchingActions("delete", "secrets")).To(HaveLen(1))
+			})
+		})
+
+		Context("when the stemcell has no pull secret", func() {
+			It("succeeds without error", func() {
+				Expect(stemcellManager.DeleteStemcell(cpi.StemcellCID("other:version"))).To(Succeed())
+			})
 		})
 
-		It("succeeds without error", func() {
-			Expect(actions.DeleteStemcell(stemcellCID)).To(Succeed())
+		Context("when a registry is configured", func() {
+			var (
+				tempDir      string
+				fakeRegistry *registryfakes.Registry
+				server       *httptest.Server
+				host         string
+			)
+
+			BeforeEach(func() {
+				var err error
+				tempDir, err = ioutil.TempDir("", "stemcell")
+				Expect(err).NotTo(HaveOccurred())
+
+				imagePath := filepath.Join(tempDir, "image")
+				err = registryfakes.WriteDockerArchive(imagePath, []byte(`{"config":{}}`), []byte("layer"))
+				Expect(err).NotTo(HaveOccurred())
+
+				fakeRegistry = registryfakes.NewRegistry()
+				server = httptest.NewServer(fakeRegistry)
+				host = strings.TrimPrefix(server.URL, "http://")
+
+				stemcellManager.Registry = &registry.Client{URL: server.URL}
+				stemcellCID, err = stemcellManager.CreateStemcell(imagePath, actions.StemcellCloudProperties{
+					Name:    "stemcell",
+					Version: "3312",
+				})
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			AfterEach(func() {
+				server.Close()
+				os.RemoveAll(tempDir)
+			})
+
+			It("deletes the imported stemcell image from the registry", func() {
+				Expect(stemcellManager.DeleteStemcell(stemcellCID)).To(Succeed())
+
+				_, ok := fakeRegistry.Manifest("stemcell", "3312")
+				Expect(ok).To(BeFalse())
+			})
+
+			It("removes the image record from each context", func() {
+				Expect(stemcellManager.DeleteStemcell(stemcellCID)).To(Succeed())
+
+				for _, fakeClient := range fakeClients {
+					configMaps, err := fakeClient.ConfigMaps().List(api.ListOptions{})
+					Expect(err).NotTo(HaveOccurred())
+					Expect(configMaps.Items).To(BeEmpty())
+				}
+			})
+
+			It("succeeds when the image was already deleted", func() {
+				Expect(stemcellManager.DeleteStemcell(stemcellCID)).To(Succeed())
+				Expect(stemcellManager.DeleteStemcell(stemcellCID)).To(Succeed())
+			})
+
+			Context("when another stemcell references the imported image", func() {
+				BeforeEach(func() {
+					manifest, _ := fakeRegistry.Manifest("stemcell", "3312")
+					_, err := stemcellManager.CreateStemcell("/ignored/path", actions.StemcellCloudProperties{
+						Image: host + "/stemcell:3312@" + registry.Digest(manifest.Content),
+					})
+					Expect(err).NotTo(HaveOccurred())
+				})
+
+				It("keeps the image in the registry", func() {
+					Expect(stemcellManager.DeleteStemcell(stemcellCID)).To(Succeed())
+
+					_, ok := fakeRegistry.Manifest("stemcell", "3312")
+					Expect(ok).To(BeTrue())
+				})
+			})
+
+			Context("when the stemcell references an image in the registry", func() {
+				BeforeEach(func() {
+					digest := fakeRegistry.PutManifest("referenced", "1.0", registryfakes.StoredManifest{
+						MediaType: registry.MediaTypeManifest,
+						Content:   []byte(`{"schemaVersion":2}`),
+					})
+
+					var err error
+					stemcellCID, err = stemcellManager.CreateStemcell("/ignored/path", actions.StemcellCloudProperties{
+						Image: host + "/referenced@" + digest,
+					})
+					Expect(err).NotTo(HaveOccurred())
+				})
+
+				It("keeps the image in the registry", func() {
+					Expect(stemcellManager.DeleteStemcell(stemcellCID)).To(Succeed())
+
+					_, ok := fakeRegistry.Manifest("referenced", "1.0")
+					Expect(ok).To(BeTrue())
+				})
+			})
+
+			Context("when the stemcell has no image record", func() {
+				BeforeEach(func() {
+					digest := fakeRegistry.PutManifest("unrecorded", "1.0", registryfakes.StoredManifest{
+						MediaType: registry.MediaTypeManifest,
+						Content:   []byte(`{"schemaVersion":2}`),
+					})
+					stemcellCID = cpi.StemcellCID(host + "/unrecorded@" + digest)
+				})
+
+				It("keeps the image in the registry", func() {
+					Expect(stemcellManager.DeleteStemcell(stemcellCID)).To(Succeed())
+
+					_, ok := fakeRegistry.Manifest("unrecorded", "1.0")
+					Expect(ok).To(BeTrue())
+				})
+			})
+
+			Context("when the stemcell image is in another registry", func() {
+				BeforeEach(func() {
+					manifest, _ := fakeRegistry.Manifest("stemcell", "3312")
+					stemcellCID = cpi.StemcellCID("registry.example.com/stemcell@" + registry.Digest(manifest.Content))
+				})
+
+				It("leaves the registry alone", func() {
+					requests := len(fakeRegistry.Requests())
+					Expect(stemcellManager.DeleteStemcell(stemcellCID)).To(Succeed())
+					Expect(fakeRegistry.Requests()).To(HaveLen(requests))
+				})
+			})
+
+			Context("when the registry fails to delete the image", func() {
+				BeforeEach(func() {
+					server.Close()
+				})
+
+				It("returns an error", func() {
+					Expect(stemcellManager.DeleteStemcell(stemcellCID)).To(HaveOccurred())
+				})
+			})
 		})
 	})
 })
@@ -1,28 +1,71 @@
 package actions
 
 import (
-	"strings"
-
 	uuid "github.com/nu7hatch/gouuid"
 	"github.com/sykesm/kubernetes-cpi/cpi"
+	"github.com/sykesm/kubernetes-cpi/kubecluster"
+	"k8s.io/client-go/1.4/pkg/labels"
 )
 
-func NewVMCID(context, agentID string) cpi.VMCID {
-	return cpi.VMCID(context + ":" + agentID)
+// DirectorUUIDLabel identifies the director that owns an object so directors
+// sharing a namespace only see their own resources.
+const DirectorUUIDLabel = "bosh.cloudfoundry.org/director-uuid"
+
+// newCIDClient returns a client for the context and namespace of a decoded
+// CID. Legacy CIDs have no namespace and use the one configured for the
+// context.
+func newCIDClient(provider kubecluster.ClientProvider, cid cpi.CID) (kubecluster.Client, error) {
+	client, err := provider.New(cid.Context)
+	if err != nil {
+		return nil, err
+	}
+
+	if cid.Namespace != "" && cid.Namespace != client.Namespace() {
+		return client.WithNamespace(cid.Namespace), nil
+	}
+	return client, nil
 }
 
-func ParseVMCID(vmcid cpi.VMCID) (context, agentID string) {
-	parts := strings.SplitN(string(vmcid), ":", 2)
-	return parts[0], parts[1]
+// directorLabels returns the labels with the director UUID label added when
+// the director sent its UUID.
+func directorLabels(directorUUID string, l map[string]string) map[string]string {
+	result := map[string]string{}
+	for k, v := range l {
+		result[k] = v
+	}
+	if directorUUID != "" {
+		result[DirectorUUIDLabel] = directorUUID
+	}
+	return result
 }
 
-func NewDiskCID(context, diskID string) cpi.DiskCID {
-	return cpi.DiskCID(context + ":" + diskID)
+// directorSelector parses the selector and scopes it to the director UUID
+// when the director sent one.
+func directorSelector(directorUUID, selector string) (labels.Selector, error) {
+	if directorUUID != "" {
+		selector += "," + DirectorUUIDLabel + "=" + directorUUID
+	}
+	return labels.Parse(selector)
 }
 
-func ParseDiskCID(diskCID cpi.DiskCID) (context, diskID string) {
-	parts := strings.SplitN(string(diskCID), ":", 2)
-	return parts[0], parts[1]
+// directorSelectors returns the selectors of the objects that belong to the
+// director UUID: the objects labelled with it and the objects created before
+// the CPI labelled objects with a director UUID. Without a UUID the one
+// selector matches the objects of every director.
+func directorSelectors(directorUUID, selector string) ([]labels.Selector, error) {
+	scoped, err := directorSelector(directorUUID, selector)
+	if err != nil {
+		return nil, err
+	}
+	if directorUUID == "" {
+		return []labels.Selector{scoped}, nil
+	}
+
+	unlabelled, err := labels.Parse(selector + ",!" + DirectorUUIDLabel)
+	if err != nil {
+		return nil, err
+	}
+	return []labels.Selector{scoped, unlabelled}, nil
 }
 
 func CreateGUID() (string, error) {
@@ -0,0 +1,61 @@
+package actions
+
+import (
+	"github.com/sykesm/kubernetes-cpi/kubecluster"
+
+	core "k8s.io/client-go/1.4/kubernetes/typed/core/v1"
+	"k8s.io/client-go/1.4/pkg/api"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// vmMeta holds the labels, annotations and owner references shared by the
+// objects created for a VM.
+type vmMeta struct {
+	labels          map[string]string
+	annotations     map[string]string
+	ownerReferences []v1.OwnerReference
+}
+
+func (m vmMeta) objectMeta(name, ns string) v1.ObjectMeta {
+	return v1.ObjectMeta{
+		Name:            name,
+		Namespace:       ns,
+		Labels:          m.labels,
+		Annotations:     m.annotations,
+		OwnerReferences: m.ownerReferences,
+	}
+}
+
+// createVMAnchor creates the ConfigMap that owns the objects of a VM. Unlike
+// the agent pod it survives pod recreation, so deleting it lets the garbage
+// collector remove everything that belongs to the VM.
+func createVMAnchor(configMapClient core.ConfigMapInterface, ns, agentID string, vm vmMeta) (vmMeta, error) {
+	anchor, err := configMapClient.Create(&v1.ConfigMap{
+		ObjectMeta: vm.objectMeta(vmAnchorName(agentID), ns),
+	})
+	if err != nil {
+		return vmMeta{}, err
+	}
+
+	vm.ownerReferences = []v1.OwnerReference{{
+		APIVersion: "v1",
+		Kind:       "ConfigMap",
+		Name:       anchor.Name,
+		UID:        anchor.UID,
+	}}
+	return vm, nil
+}
+
+// deleteVMAnchor removes the anchor of a VM and asks for its dependents to
+// be garbage collected. VMs created before anchors were introduced have none.
+func deleteVMAnchor(client kubecluster.Client, agentID string) error {
+	orphanDependents := false
+	err := client.ConfigMaps().Delete(vmAnchorName(agentID), &api.DeleteOptions{
+		GracePeriodSeconds: int64Ptr(0),
+		OrphanDependents:   &orphanDependents,
+	})
+	if err != nil && !isNotFoundStatusError(err) {
+		return err
+	}
+	return nil
+}
@@ -1,10 +1,12 @@
 package actions
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
+	"path"
 	"reflect"
+	"sort"
+	"strings"
 	"time"
 
 	"code.cloudfoundry.org/clock"
@@ -25,8 +27,33 @@ type VolumeManager struct {
 	Clock             clock.Clock
 	PodReadyTimeout   time.Duration
 	PostRecreateDelay time.Duration
+
+	// CoalesceWindow is how long to wait after recording disk changes in the
+	// agent settings before recreating the pod. Changes recorded for the same
+	// agent by concurrent requests during the window are applied by a single
+	// pod recreate.
+	CoalesceWindow time.Duration
+
+	// DiskMountRoots maps a context name to the directory that persistent
+	// disks are mounted under. Contexts without an entry use
+	// DefaultDiskMountRoot.
+	DiskMountRoots map[string]string
+
+	// SettingsKind is the kind of object that holds the agent settings.
+	// Settings found in the other kind are moved when the pod is recreated.
+	SettingsKind SettingsKind
+
+	// When Migrator is set, disks from another context are migrated into the
+	// context of the VM before they are attached. The agent settings keep the
+	// disk CID known to the director.
+	Migrator *DiskMigrator
 }
 
+const DefaultDiskMountRoot = "/mnt"
+
+// DiskFinalizer is set on claims while they are attached to an agent.
+const DiskFinalizer = "bosh.cloudfoundry.org/disk-attached"
+
 type Operation int
 
 const (
@@ -34,59 +61,170 @@ const (
 	Remove
 )
 
+// DiskOperation is a pending attach or detach of a persistent disk.
+type DiskOperation struct {
+	Operation Operation
+	DiskCID   cpi.DiskCID
+}
+
+type diskOperation struct {
+	op      Operation
+	diskID  string
+	diskCID cpi.DiskCID
+}
+
 func (v *VolumeManager) AttachDisk(vmcid cpi.VMCID, diskCID cpi.DiskCID) error {
-	vmContext, agentID := ParseVMCID(vmcid)
-	context, diskID := ParseDiskCID(diskCID)
-	if context != vmContext {
-		return fmt.Errorf("Kubernetes disk and resource pool contexts must be the same: disk: %q, resource pool: %q", context, vmContext)
+	return v.UpdateDisks(vmcid, DiskOperation{Operation: Add, DiskCID: diskCID})
+}
+
+func (v *VolumeManager) DetachDisk(vmcid cpi.VMCID, diskCID cpi.DiskCID) error {
+	return v.UpdateDisks(vmcid, DiskOperation{Operation: Remove, DiskCID: diskCID})
+}
+
+// UpdateDisks applies a set of attach and detach operations to an agent with
+// a single pod recreate.
+func (v *VolumeManager) UpdateDisks(vmcid cpi.VMCID, operations ...DiskOperation) error {
+	vm, err := vmcid.Decode()
+	if err != nil {
+		return err
 	}
+	agentID := vm.ID
 
-	client, err := v.ClientProvider.New(context)
+	client, err := newCIDClient(v.ClientProvider, vm)
 	if err != nil {
 		return err
 	}
 
-	err = v.recreatePod(client, Add, agentID, diskID)
+	var ops []diskOperation
+	for _, operation := range operations {
+		disk, err := operation.DiskCID.Decode()
+		if err != nil {
+			return err
+		}
+		if disk.Context != vm.Context {
+			if v.Migrator == nil {
+				return fmt.Errorf("Kubernetes disk and resource pool contexts must be the same: disk: %q, resource pool: %q", disk.Context, vm.Context)
+			}
+			// the claim keeps its name in the context of the VM and the
+			// director keeps the CID of the source disk
+			if operation.Operation == Add {
+				err := v.Migrator.MoveDisk(operation.DiskCID, vm)
+				if err != nil {
+					return err
+				}
+			}
+		} else if disk.Namespace != "" && disk.Namespace != client.Namespace() {
+			return fmt.Errorf("Kubernetes disk and VM namespaces must be the same: disk: %q, VM: %q", disk.Namespace, client.Namespace())
+		}
+		ops = append(ops, diskOperation{op: operation.Operation, diskID: disk.ID, diskCID: operation.DiskCID})
+	}
+
+	var claims []*v1.PersistentVolumeClaim
+	for _, op := range ops {
+		if op.op != Add {
+			continue
+		}
+
+		pvc, err := client.PersistentVolumeClaims().Get(diskName(op.diskID))
+		if err != nil {
+			return err
+		}
+		claims = append(claims, pvc)
+
+		if isReadWriteOnce(pvc) {
+			podName, err := findOtherAgentPod(client.Pods(), pvc.Name, agentID)
+			if err != nil {
+				return err
+			}
+			if podName != "" {
+				return fmt.Errorf("Disk %q is ReadWriteOnce and is attached to pod %q", op.diskCID, podName)
+			}
+		}
+	}
+
+	for _, pvc := range claims {
+		if hasFinalizer(pvc.ObjectMeta, DiskFinalizer) && objectID(pvc.ObjectMeta, "bosh.cloudfoundry.org/agent-id") == agentID {
+			continue
+		}
+		if !hasFinalizer(pvc.ObjectMeta, DiskFinalizer) {
+			pvc.Finalizers = append(pvc.Finalizers, DiskFinalizer)
+		}
+		setObjectID(&pvc.ObjectMeta, "bosh.cloudfoundry.org/agent-id", agentID)
+		_, err = client.PersistentVolumeClaims().Update(pvc)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = v.recreatePod(client, agentID, ops)
 	if err != nil {
 		return err
 	}
 
+	for _, op := range ops {
+		if op.op == Remove {
+			err = releaseDisk(client, diskName(op.diskID), agentID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
 	return nil
 }
 
-func (v *VolumeManager) DetachDisk(vmcid cpi.VMCID, diskCID cpi.DiskCID) error {
-	vmContext, agentID := ParseVMCID(vmcid)
-	context, diskID := ParseDiskCID(diskCID)
-	if context != vmContext {
-		return fmt.Errorf("Kubernetes disk and resource pool contexts must be the same: disk: %q, resource pool: %q", context, vmContext)
+func (v *VolumeManager) mountRoot(context string) string {
+	if root, ok := v.DiskMountRoots[context]; ok && root != "" {
+		return root
 	}
+	return DefaultDiskMountRoot
+}
 
-	client, err := v.ClientProvider.New(context)
+func (v *VolumeManager) recreatePod(client kubecluster.Client, agentID string, ops []diskOperation) error {
+	podService := client.Pods()
+	pod, err := podService.Get(agentName(agentID))
 	if err != nil {
 		return err
 	}
 
-	err = v.recreatePod(client, Remove, agentID, diskID)
+	settings, legacyKind, err := updateSettingsDisks(client, v.SettingsKind, agentID, ops, v.mountRoot(client.Context()), diskVolumeNames(&pod.Spec))
 	if err != nil {
 		return err
 	}
 
-	return nil
-}
+	if v.CoalesceWindow > 0 {
+		v.Clock.Sleep(v.CoalesceWindow)
 
-func (v *VolumeManager) recreatePod(client kubecluster.Client, op Operation, agentID string, diskID string) error {
-	podService := client.Pods()
-	pod, err := podService.Get("agent-" + agentID)
+		pod, err = podService.Get(agentName(agentID))
+		if err != nil {
+			return err
+		}
+
+		stored, err := getAgentSettings(client, v.SettingsKind, agentID)
+		if err != nil {
+			return err
+		}
+		settings = stored.Settings
+	}
+
+	kind, err := resolveSettingsKind(v.SettingsKind)
 	if err != nil {
 		return err
 	}
 
-	err = updateConfigMapDisks(client, op, agentID, diskID)
+	volumesChanged, err := reconcileVolumes(&pod.Spec, settings.Disks.Persistent)
 	if err != nil {
 		return err
 	}
-
-	updateVolumes(op, &pod.Spec, diskID)
+	settingsMoved := setAgentSettingsVolume(&pod.Spec, kind, agentID)
+	if !volumesChanged && !settingsMoved {
+		// Another request has already recreated the pod with the desired
+		// volumes; wait for it rather than recreating it again.
+		if isAgentContainerRunning(pod) {
+			return nil
+		}
+		return v.waitForRecreate(podService, agentID, pod.ResourceVersion)
+	}
 
 	if pod.Annotations == nil {
 		pod.Annotations = map[string]string{}
@@ -97,14 +235,15 @@ func (v *VolumeManager) recreatePod(client kubecluster.Client, op Operation, age
 	}
 
 	pod.ObjectMeta = v1.ObjectMeta{
-		Name:        pod.Name,
-		Namespace:   pod.Namespace,
-		Annotations: pod.Annotations,
-		Labels:      pod.Labels,
+		Name:            pod.Name,
+		Namespace:       pod.Namespace,
+		Annotations:     pod.Annotations,
+		Labels:          pod.Labels,
+		OwnerReferences: pod.OwnerReferences,
 	}
 	pod.Status = v1.PodStatus{}
 
-	err = podService.Delete("agent-"+agentID, &api.DeleteOptions{GracePeriodSeconds: int64Ptr(0)})
+	err = podService.Delete(agentName(agentID), &api.DeleteOptions{GracePeriodSeconds: int64Ptr(0)})
 	if err != nil {
 		return err
 	}
@@ -114,7 +253,22 @@ func (v *VolumeManager) recreatePod(client kubecluster.Client, op Operation, age
 		return err
 	}
 
-	ready, err := v.waitForPod(podService, agentID, updated.ResourceVersion)
+	err = v.waitForRecreate(podService, agentID, updated.ResourceVersion)
+	if err != nil {
+		return err
+	}
+
+	// The recreated pod mounts the settings of the configured kind so the
+	// object they were moved from is no longer needed.
+	if legacyKind != "" {
+		return deleteAgentSettingsOfKind(client, legacyKind, agentID)
+	}
+
+	return nil
+}
+
+func (v *VolumeManager) waitForRecreate(podService core.PodInterface, agentID, resourceVersion string) error {
+	ready, err := v.waitForPod(podService, agentID, resourceVersion)
 	if err != nil {
 		return err
 	}
@@ -129,61 +283,222 @@ func (v *VolumeManager) recreatePod(client kubecluster.Client, op Operation, age
 	return nil
 }
 
-func updateConfigMapDisks(client kubecluster.Client, op Operation, agentID, diskID string) error {
-	configMapService := client.ConfigMaps()
-	cm, err := configMapService.Get("agent-" + agentID)
+// updateSettingsDisks records the disk operations in the agent settings and
+// returns the updated settings. A cpi.DiskNotAttachedError is returned when a
+// disk being removed is neither in the settings nor mounted in the pod. When
+// the settings were moved to the configured kind of object, the kind they
+// were moved from is returned.
+func updateSettingsDisks(client kubecluster.Client, kind SettingsKind, agentID string, ops []diskOperation, mountRoot string, mounted []string) (*agent.Settings, SettingsKind, error) {
+	stored, err := getAgentSettings(client, kind, agentID)
 	if err != nil {
-		return err
+		return nil, "", err
 	}
+	settings := stored.Settings
 
-	var settings agent.Settings
-	err = json.Unmarshal([]byte(cm.Data["instance_settings"]), &settings)
+	if settings.Disks.Persistent == nil {
+		settings.Disks.Persistent = map[string]string{}
+	}
+
+	attached := map[string]bool{}
+	for _, name := range mounted {
+		attached[name] = true
+	}
+
+	for _, op := range ops {
+		diskCID := string(op.diskCID)
+		switch op.op {
+		case Add:
+			if _, ok := settings.Disks.Persistent[diskCID]; !ok {
+				settings.Disks.Persistent[diskCID] = path.Join(mountRoot, op.diskID)
+			}
+		case Remove:
+			if _, ok := settings.Disks.Persistent[diskCID]; !ok && !attached[diskName(op.diskID)] {
+				return nil, "", cpi.DiskNotAttachedError{}
+			}
+			delete(settings.Disks.Persistent, diskCID)
+		}
+	}
+
+	legacyKind, err := saveAgentSettings(client, kind, agentID, stored)
 	if err != nil {
-		return err
+		return nil, "", err
 	}
 
-	diskCID := string(NewDiskCID(client.Context(), diskID))
-	if settings.Disks.Persistent == nil {
-		settings.Disks.Persistent = map[string]string{}
+	return settings, legacyKind, nil
+}
+
+// isReadWriteOnce returns true when the claim can only be mounted by a
+// single node.
+func isReadWriteOnce(pvc *v1.PersistentVolumeClaim) bool {
+	readWriteOnce := false
+	for _, mode := range pvc.Spec.AccessModes {
+		switch mode {
+		case v1.ReadWriteOnce:
+			readWriteOnce = true
+		case v1.ReadOnlyMany, v1.ReadWriteMany:
+			return false
+		}
+	}
+	return readWriteOnce
+}
+
+// findOtherAgentPod returns the name of an agent pod, other than the pod of
+// the agent, that mounts the claim.
+func findOtherAgentPod(podClient core.PodInterface, claimName, agentID string) (string, error) {
+	agentSelector, err := labels.Parse("bosh.cloudfoundry.org/agent-id")
+	if err != nil {
+		return "", err
+	}
+
+	return findClaimUser(podClient, api.ListOptions{LabelSelector: agentSelector}, claimName, agentName(agentID))
+}
+
+// findClaimUser returns the name of the first listed pod, other than the
+// excluded pod, that has a volume for the claim.
+func findClaimUser(podClient core.PodInterface, listOptions api.ListOptions, claimName, excludedPod string) (string, error) {
+	podList, err := podClient.List(listOptions)
+	if err != nil {
+		return "", err
 	}
 
-	switch op {
-	case Add:
-		settings.Disks.Persistent[diskCID] = "/mnt/" + diskID
-	case Remove:
-		delete(settings.Disks.Persistent, diskCID)
+	for _, pod := range podList.Items {
+		if pod.Name == excludedPod {
+			continue
+		}
+		for _, v := range pod.Spec.Volumes {
+			if v.PersistentVolumeClaim != nil && v.PersistentVolumeClaim.ClaimName == claimName {
+				return pod.Name, nil
+			}
+		}
 	}
 
-	settingsJSON, err := json.Marshal(settings)
+	return "", nil
+}
+
+// releaseDisk removes the CPI finalizer that protects an attached claim from
+// deletion and the agent label that associates it with the agent. A shared
+// claim that another agent pod still mounts is handed over to that agent
+// instead, and a claim labelled for another agent is left alone. Missing
+// claims are ignored.
+func releaseDisk(client kubecluster.Client, claimName, agentID string) error {
+	pvcClient := client.PersistentVolumeClaims()
+	pvc, err := pvcClient.Get(claimName)
 	if err != nil {
+		if isNotFoundStatusError(err) {
+			return nil
+		}
 		return err
 	}
 
-	cm.Data["instance_settings"] = string(settingsJSON)
+	_, labelled := pvc.Labels["bosh.cloudfoundry.org/agent-id"]
+	if !labelled && !hasFinalizer(pvc.ObjectMeta, DiskFinalizer) {
+		return nil
+	}
+	if labelled && objectID(pvc.ObjectMeta, "bosh.cloudfoundry.org/agent-id") != agentID {
+		return nil
+	}
 
-	_, err = configMapService.Update(cm)
+	podName, err := findOtherAgentPod(client.Pods(), claimName, agentID)
 	if err != nil {
 		return err
 	}
+	if podName != "" {
+		pod, err := client.Pods().Get(podName)
+		if err != nil {
+			return err
+		}
+		setObjectID(&pvc.ObjectMeta, "bosh.cloudfoundry.org/agent-id", objectID(pod.ObjectMeta, "bosh.cloudfoundry.org/agent-id"))
+		_, err = pvcClient.Update(pvc)
+		return err
+	}
 
-	return nil
+	removeObjectID(&pvc.ObjectMeta, "bosh.cloudfoundry.org/agent-id")
+	pvc.Finalizers = removeFinalizer(pvc.Finalizers, DiskFinalizer)
+	_, err = pvcClient.Update(pvc)
+	return err
+}
+
+func hasFinalizer(meta v1.ObjectMeta, finalizer string) bool {
+	for _, f := range meta.Finalizers {
+		if f == finalizer {
+			return true
+		}
+	}
+	return false
+}
+
+func removeFinalizer(finalizers []string, finalizer string) []string {
+	result := []string{}
+	for _, f := range finalizers {
+		if f != finalizer {
+			result = append(result, f)
+		}
+	}
+	return result
 }
 
-func updateVolumes(op Operation, spec *v1.PodSpec, diskID string) {
-	switch op {
-	case Add:
-		addVolume(spec, diskID)
-	case Remove:
-		removeVolume(spec, diskID)
+// reconcileVolumes adds and removes persistent disk volumes so that the pod
+// spec matches the persistent disks in the agent settings. It returns true if
+// the spec was changed.
+func reconcileVolumes(spec *v1.PodSpec, persistent map[string]string) (bool, error) {
+	desired := map[string]string{}
+	diskIDs := map[string]string{}
+	for diskCID, mountPath := range persistent {
+		cid, err := cpi.DiskCID(diskCID).Decode()
+		if err != nil {
+			return false, err
+		}
+		desired[diskName(cid.ID)] = mountPath
+		diskIDs[diskName(cid.ID)] = cid.ID
+	}
+
+	changed := false
+	for _, name := range diskVolumeNames(spec) {
+		if _, ok := desired[name]; !ok {
+			removeVolume(spec, name)
+			changed = true
+		}
+	}
+
+	attached := map[string]bool{}
+	for _, name := range diskVolumeNames(spec) {
+		attached[name] = true
+	}
+
+	var names []string
+	for name := range desired {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !attached[name] {
+			addVolume(spec, diskIDs[name], desired[name])
+			changed = true
+		}
+	}
+
+	return changed, nil
+}
+
+// diskVolumeNames returns the names of the persistent disk volumes mounted in
+// the pod.
+func diskVolumeNames(spec *v1.PodSpec) []string {
+	var names []string
+	for _, v := range spec.Volumes {
+		if v.PersistentVolumeClaim != nil && strings.HasPrefix(v.Name, "disk-") {
+			names = append(names, v.Name)
+		}
 	}
+	return names
 }
 
-func addVolume(spec *v1.PodSpec, diskID string) {
+func addVolume(spec *v1.PodSpec, diskID, mountPath string) {
 	spec.Volumes = append(spec.Volumes, v1.Volume{
-		Name: "disk-" + diskID,
+		Name: diskName(diskID),
 		VolumeSource: v1.VolumeSource{
 			PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{
-				ClaimName: "disk-" + diskID,
+				ClaimName: diskName(diskID),
 			},
 		},
 	})
@@ -191,17 +506,17 @@ func addVolume(spec *v1.PodSpec, diskID string) {
 	for i, c := range spec.Containers {
 		if c.Name == "bosh-job" {
 			spec.Containers[i].VolumeMounts = append(c.VolumeMounts, v1.VolumeMount{
-				Name:      "disk-" + diskID,
-				MountPath: "/mnt/" + diskID,
+				Name:      diskName(diskID),
+				MountPath: mountPath,
 			})
 			break
 		}
 	}
 }
 
-func removeVolume(spec *v1.PodSpec, diskID string) {
+func removeVolume(spec *v1.PodSpec, name string) {
 	for i, v := range spec.Volumes {
-		if v.Name == "disk-"+diskID {
+		if v.Name == name {
 			spec.Volumes = append(spec.Volumes[:i], spec.Volumes[i+1:]...)
 			break
 		}
@@ -210,7 +525,7 @@ func removeVolume(spec *v1.PodSpec, diskID string) {
 	for i, c := range spec.Containers {
 		if c.Name == "bosh-job" {
 			for j, v := range c.VolumeMounts {
-				if v.Name == "disk-"+diskID {
+				if v.Name == name {
 					spec.Containers[i].VolumeMounts = append(c.VolumeMounts[:j], c.VolumeMounts[j+1:]...)
 					break
 				}
@@ -220,7 +535,7 @@ func removeVolume(spec *v1.PodSpec, diskID string) {
 }
 
 func (v *VolumeManager) waitForPod(podService core.PodInterface, agentID string, resourceVersion string) (bool, error) {
-	agentSelector, err := labels.Parse("bosh.cloudfoundry.org/agent-id=" + agentID)
+	agentSelector, err := labels.Parse("bosh.cloudfoundry.org/agent-id=" + labelValue(agentID))
 	if err != nil {
 		return false, err
 	}
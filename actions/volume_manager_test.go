@@ -13,6 +13,7 @@ import (
 	"github.com/sykesm/kubernetes-cpi/actions"
 	"github.com/sykesm/kubernetes-cpi/agent"
 	"github.com/sykesm/kubernetes-cpi/cpi"
+	"github.com/sykesm/kubernetes-cpi/kubecluster"
 	"github.com/sykesm/kubernetes-cpi/kubecluster/fakes"
 
 	"k8s.io/client-go/1.4/pkg/api/v1"
@@ -35,8 +36,8 @@ var _ = Describe("VolumeManager", func() {
 	)
 
 	BeforeEach(func() {
-		vmcid = actions.NewVMCID("context-name", "agent-id")
-		diskCID = actions.NewDiskCID("context-name", "disk-id")
+		vmcid = cpi.VMCID("context-name:agent-id")
+		diskCID = cpi.DiskCID("context-name:disk-id")
 
 		agentMeta = v1.ObjectMeta{
 			Name:      "agent-agent-id",
@@ -47,6 +48,12 @@ var _ = Describe("VolumeManager", func() {
 			Labels: map[string]string{
 				"key": "value",
 			},
+			OwnerReferences: []v1.OwnerReference{{
+				APIVersion: "v1",
+				Kind:       "ConfigMap",
+				Name:       "vm-agent-id",
+				UID:        "anchor-uid",
+			}},
 		}
 
 		fakeProvider = &fakes.ClientProvider{}
@@ -105,6 +112,13 @@ var _ = Describe("VolumeManager", func() {
 						"instance_settings": `{}`,
 					},
 				},
+				&v1.PersistentVolumeClaim{
+					ObjectMeta: v1.ObjectMeta{
+						Name:      "disk-disk-id",
+						Namespace: "bosh-namespace",
+						Labels:    map[string]string{"bosh.cloudfoundry.org/disk-id": "disk-id"},
+					},
+				},
 				initialPod,
 			)
 			fakeClient.ContextReturns("context-name")
@@ -363,8 +377,8 @@ var _ = Describe("VolumeManager", func() {
 
 		Context("when the vmcid context and diskcid context are different", func() {
 			BeforeEach(func() {
-				vmcid = actions.NewVMCID("rp-ctx", "agent-id")
-				diskCID = actions.NewDiskCID("disk-ctx", "disk-id")
+				vmcid = cpi.VMCID("rp-ctx:agent-id")
+				diskCID = cpi.DiskCID("disk-ctx:disk-id")
 			})
 
 			It("returns an error", func() {
@@ -373,6 +387,270 @@ var _ = Describe("VolumeManager", func() {
 			})
 		})
 
+		Context("when disk migration is enabled and the disk is in another context", func() {
+			var (
+				migrationProvider *fakes.ClientProvider
+				sourceClient      *fakes.Client
+			)
+
+			BeforeEach(func() {
+				diskCID = cpi.DiskCID("disk-ctx:disk-id")
+
+				sourceClient = fakes.NewClient(&v1.PersistentVolumeClaim{
+					ObjectMeta: v1.ObjectMeta{Name: "disk-disk-id", Namespace: "source-namespace"},
+				})
+				sourceClient.ContextReturns("disk-ctx")
+				sourceClient.NamespaceReturns("source-namespace")
+
+				migrationProvider = &fakes.ClientProvider{}
+				migrationProvider.NewStub = func(context string) (kubecluster.Client, error) {
+					if context == "disk-ctx" {
+						return sourceClient, nil
+					}
+					return fakeClient, nil
+				}
+				volumeManager.Migrator = &actions.DiskMigrator{
+					ClientProvider: migrationProvider,
+					Image:          "migration-image",
+					Clock:          fakeClock,
+				}
+
+				fakeClient.PrependReactor("get", "persistentvolumeclaims", func(action testing.Action) (bool, runtime.Object, error) {
+					return true, &v1.PersistentVolumeClaim{
+						ObjectMeta: v1.ObjectMeta{
+							Name:      "disk-disk-id",
+							Namespace: "bosh-namespace",
+							Annotations: map[string]string{
+								actions.MigratedFromAnnotation:      "disk-ctx:disk-id",
+								actions.MigrationCompleteAnnotation: "true",
+							},
+						},
+					}, nil
+				})
+			})
+
+			It("migrates the disk into the context of the VM", func() {
+				err := volumeManager.AttachDisk(vmcid, diskCID)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(migrationProvider.NewCallCount()).To(Equal(3))
+				Expect(migrationProvider.NewArgsForCall(0)).To(Equal("disk-ctx"))
+				Expect(migrationProvider.NewArgsForCall(1)).To(Equal("context-name"))
+			})
+
+			It("deletes the source claim once the disk has been moved", func() {
+				err := volumeManager.AttachDisk(vmcid, diskCID)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(migrationProvider.NewArgsForCall(2)).To(Equal("disk-ctx"))
+				matches := sourceClient.MatchingActions("delete", "persistentvolumeclaims")
+				Expect(matches).To(HaveLen(1))
+				Expect(matches[0].(testing.DeleteAction).GetName()).To(Equal("disk-disk-id"))
+			})
+
+			It("attaches the migrated claim under the original disk CID", func() {
+				err := volumeManager.AttachDisk(vmcid, diskCID)
+				Expect(err).NotTo(HaveOccurred())
+
+				matches := fakeClient.MatchingActions("update", "configmaps")
+				Expect(matches).To(HaveLen(1))
+
+				updated := matches[0].(testing.UpdateAction).GetObject().(*v1.ConfigMap)
+				var settings agent.Settings
+				Expect(json.Unmarshal([]byte(updated.Data["instance_settings"]), &settings)).To(Succeed())
+				Expect(settings.Disks.Persistent).To(Equal(map[string]string{"disk-ctx:disk-id": "/mnt/disk-id"}))
+
+				matches = fakeClient.MatchingActions("create", "pods")
+				Expect(matches).To(HaveLen(1))
+				pod := matches[0].(testing.CreateAction).GetObject().(*v1.Pod)
+				var volumeNames []string
+				for _, v := range pod.Spec.Volumes {
+					volumeNames = append(volumeNames, v.Name)
+				}
+				Expect(volumeNames).To(ContainElement("disk-disk-id"))
+			})
+
+			Context("when the migration fails", func() {
+				BeforeEach(func() {
+					migrationProvider.NewStub = nil
+					migrationProvider.NewReturns(nil, errors.New("migrate-welp"))
+				})
+
+				It("returns the error without changing the agent", func() {
+					err := volumeManager.AttachDisk(vmcid, diskCID)
+					Expect(err).To(MatchError("migrate-welp"))
+					Expect(fakeClient.MatchingActions("update", "configmaps")).To(BeEmpty())
+				})
+			})
+		})
+
+		Context("when a disk mount root is configured for the context", func() {
+			BeforeEach(func() {
+				volumeManager.DiskMountRoots = map[string]string{"context-name": "/var/vcap/disks"}
+			})
+
+			It("records the mount path in the agent settings", func() {
+				err := volumeManager.AttachDisk(vmcid, diskCID)
+				Expect(err).NotTo(HaveOccurred())
+
+				matches := fakeClient.MatchingActions("update", "configmaps")
+				Expect(matches).To(HaveLen(1))
+
+				updated := matches[0].(testing.UpdateAction).GetObject().(*v1.ConfigMap)
+				var settings agent.Settings
+				Expect(json.Unmarshal([]byte(updated.Data["instance_settings"]), &settings)).To(Succeed())
+				Expect(settings.Disks.Persistent).To(HaveKeyWithValue("context-name:disk-id", "/var/vcap/disks/disk-id"))
+			})
+
+			It("mounts the volume under the mount root", func() {
+				err := volumeManager.AttachDisk(vmcid, diskCID)
+				Expect(err).NotTo(HaveOccurred())
+
+				matches := fakeClient.MatchingActions("create", "pods")
+				Expect(matches).To(HaveLen(1))
+
+				updated := matches[0].(testing.CreateAction).GetObject().(*v1.Pod)
+				Expect(updated.Spec.Containers[0].VolumeMounts).To(ContainElement(
+					v1.VolumeMount{
+						Name:      "disk-disk-id",
+						MountPath: "/var/vcap/disks/disk-id",
+					},
+				))
+			})
+		})
+
+		Context("when the pod already mounts the disks in the agent settings", func() {
+			BeforeEach(func() {
+				fakeClient.PrependReactor("get", "pods", func(action testing.Action) (bool, runtime.Object, error) {
+					pod := *initialPod
+					pod.Spec.Volumes = []v1.Volume{}
+					addDiskVolume(&pod.Spec, "disk-id", "/mnt/disk-id")
+					return true, &pod, nil
+				})
+			})
+
+			It("does not recreate the pod", func() {
+				err := volumeManager.AttachDisk(vmcid, diskCID)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(fakeClient.MatchingActions("delete", "pods")).To(BeEmpty())
+				Expect(fakeClient.MatchingActions("create", "pods")).To(BeEmpty())
+			})
+		})
+
+		Context("when the disk is ReadWriteOnce", func() {
+			BeforeEach(func() {
+				fakeClient.PrependReactor("get", "persistentvolumeclaims", func(action testing.Action) (bool, runtime.Object, error) {
+					return true, &v1.PersistentVolumeClaim{
+						ObjectMeta: v1.ObjectMeta{Name: "disk-disk-id", Namespace: "bosh-namespace"},
+						Spec: v1.PersistentVolumeClaimSpec{
+							AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+						},
+					}, nil
+				})
+			})
+
+			It("checks the agent pods for other mounts", func() {
+				err := volumeManager.AttachDisk(vmcid, diskCID)
+				Expect(err).NotTo(HaveOccurred())
+
+				matches := fakeClient.MatchingActions("list", "pods")
+				Expect(matches).To(HaveLen(1))
+				Expect(matches[0].(testing.ListAction).GetListRestrictions().Labels.String()).To(Equal("bosh.cloudfoundry.org/agent-id"))
+			})
+
+			Context("and it is mounted by another agent pod", func() {
+				BeforeEach(func() {
+					fakeClient.PrependReactor("list", "pods", func(action testing.Action) (bool, runtime.Object, error) {
+						other := v1.Pod{
+							ObjectMeta: v1.ObjectMeta{
+								Name:      "agent-other",
+								Namespace: "bosh-namespace",
+								Labels:    map[string]string{"bosh.cloudfoundry.org/agent-id": "other"},
+							},
+							Spec: v1.PodSpec{Containers: []v1.Container{{Name: "bosh-job"}}},
+						}
+						addDiskVolume(&other.Spec, "disk-id", "/mnt/disk-id")
+						return true, &v1.PodList{Items: []v1.Pod{*initialPod, other}}, nil
+					})
+				})
+
+				It("returns an error without recreating the pod", func() {
+					err := volumeManager.AttachDisk(vmcid, diskCID)
+					Expect(err).To(MatchError(`Disk "context-name:disk-id" is ReadWriteOnce and is attached to pod "agent-other"`))
+					Expect(fakeClient.MatchingActions("update", "configmaps")).To(BeEmpty())
+					Expect(fakeClient.MatchingActions("delete", "pods")).To(BeEmpty())
+				})
+			})
+		})
+
+		Context("when a coalesce window is configured", func() {
+			BeforeEach(func() {
+				volumeManager.CoalesceWindow = 5 * time.Second
+			})
+
+			It("rereads the pod and agent settings after the window", func() {
+				result := make(chan error)
+				go func() { result <- volumeManager.AttachDisk(vmcid, diskCID) }()
+
+				Eventually(func() []testing.Action {
+					return fakeClient.MatchingActions("update", "configmaps")
+				}).Should(HaveLen(1))
+				Consistently(result).ShouldNot(Receive())
+
+				fakeClock.Increment(6 * time.Second)
+				Eventually(result).Should(Receive(BeNil()))
+
+				Expect(fakeClient.MatchingActions("get", "pods")).To(HaveLen(2))
+				Expect(fakeClient.MatchingActions("get", "configmaps")).To(HaveLen(2))
+				Expect(fakeClient.MatchingActions("create", "pods")).To(HaveLen(1))
+			})
+		})
+
+		It("retrieves the persistent volume claim for the disk", func() {
+			err := volumeManager.AttachDisk(vmcid, diskCID)
+			Expect(err).NotTo(HaveOccurred())
+
+			matches := fakeClient.MatchingActions("get", "persistentvolumeclaims")
+			Expect(matches).To(HaveLen(1))
+			Expect(matches[0].(testing.GetAction).GetName()).To(Equal("disk-disk-id"))
+		})
+
+		It("protects the persistent volume claim with the attached finalizer", func() {
+			err := volumeManager.AttachDisk(vmcid, diskCID)
+			Expect(err).NotTo(HaveOccurred())
+
+			matches := fakeClient.MatchingActions("update", "persistentvolumeclaims")
+			Expect(matches).To(HaveLen(1))
+
+			updated := matches[0].(testing.UpdateAction).GetObject().(*v1.PersistentVolumeClaim)
+			Expect(updated.Finalizers).To(ConsistOf(actions.DiskFinalizer))
+		})
+
+		It("labels the persistent volume claim with the agent ID", func() {
+			err := volumeManager.AttachDisk(vmcid, diskCID)
+			Expect(err).NotTo(HaveOccurred())
+
+			matches := fakeClient.MatchingActions("update", "persistentvolumeclaims")
+			Expect(matches).To(HaveLen(1))
+
+			updated := matches[0].(testing.UpdateAction).GetObject().(*v1.PersistentVolumeClaim)
+			Expect(updated.Labels).To(HaveKeyWithValue("bosh.cloudfoundry.org/agent-id", "agent-id"))
+			Expect(updated.Labels).To(HaveKeyWithValue("bosh.cloudfoundry.org/disk-id", "disk-id"))
+		})
+
+		Context("when the persistent volume claim does not exist", func() {
+			BeforeEach(func() {
+				diskCID = cpi.DiskCID("context-name:missing")
+			})
+
+			It("returns an error without recreating the pod", func() {
+				err := volumeManager.AttachDisk(vmcid, diskCID)
+				Expect(err).To(HaveOccurred())
+				Expect(fakeClient.MatchingActions("delete", "pods")).To(BeEmpty())
+			})
+		})
+
 		Context("when getting the config map fails", func() {
 			BeforeEach(func() {
 				fakeClient.PrependReactor("get", "configmaps", func(action testing.Action) (bool, runtime.Object, error) {
@@ -595,6 +873,93 @@ var _ = Describe("VolumeManager", func() {
 			Expect(settings.Disks.Persistent).NotTo(HaveKey("context-name:disk-id"))
 		})
 
+		Context("when the agent settings are configured to be stored in a secret", func() {
+			BeforeEach(func() {
+				volumeManager.SettingsKind = actions.SettingsSecret
+
+				fakeClient.PrependReactor("get", "pods", func(action testing.Action) (bool, runtime.Object, error) {
+					pod := *initialPod
+					pod.Spec.Volumes = append([]v1.Volume{{
+						Name: "bosh-config",
+						VolumeSource: v1.VolumeSource{
+							ConfigMap: &v1.ConfigMapVolumeSource{
+								LocalObjectReference: v1.LocalObjectReference{Name: "agent-agent-id"},
+							},
+						},
+					}}, initialPodSpec.Volumes...)
+					return true, &pod, nil
+				})
+			})
+
+			It("moves the settings from the config map to a secret", func() {
+				err := volumeManager.DetachDisk(vmcid, diskCID)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(fakeClient.MatchingActions("update", "configmaps")).To(BeEmpty())
+
+				matches := fakeClient.MatchingActions("create", "secrets")
+				Expect(matches).To(HaveLen(1))
+
+				secret := matches[0].(testing.CreateAction).GetObject().(*v1.Secret)
+				Expect(secret.Name).To(Equal("agent-agent-id"))
+
+				var settings agent.Settings
+				Expect(json.Unmarshal(secret.Data["instance_settings"], &settings)).To(Succeed())
+				Expect(settings.Disks.Persistent).To(BeEmpty())
+			})
+
+			It("recreates the pod with the secret mounted", func() {
+				err := volumeManager.DetachDisk(vmcid, diskCID)
+				Expect(err).NotTo(HaveOccurred())
+
+				matches := fakeClient.MatchingActions("create", "pods")
+				Expect(matches).To(HaveLen(1))
+
+				pod := matches[0].(testing.CreateAction).GetObject().(*v1.Pod)
+				Expect(pod.Spec.Volumes).To(HaveLen(1))
+				Expect(pod.Spec.Volumes[0].Name).To(Equal("bosh-config"))
+				Expect(pod.Spec.Volumes[0].ConfigMap).To(BeNil())
+				Expect(pod.Spec.Volumes[0].Secret.SecretName).To(Equal("agent-agent-id"))
+			})
+
+			It("deletes the config map after the pod is recreated", func() {
+				err := volumeManager.DetachDisk(vmcid, diskCID)
+				Expect(err).NotTo(HaveOccurred())
+
+				matches := fakeClient.MatchingActions("delete", "configmaps")
+				Expect(matches).To(HaveLen(1))
+				Expect(matches[0].(testing.DeleteAction).GetName()).To(Equal("agent-agent-id"))
+			})
+
+			Context("when an interrupted move left both the secret and the config map", func() {
+				BeforeEach(func() {
+					_, err := fakeClient.Secrets().Create(&v1.Secret{
+						ObjectMeta: agentMeta,
+						Data: map[string][]byte{
+							"instance_settings": []byte(`{ "disks": {"persistent": { "context-name:disk-id": "/mnt/disk-id" }} }`),
+						},
+					})
+					Expect(err).NotTo(HaveOccurred())
+					fakeClient.ClearActions()
+				})
+
+				It("updates the secret and deletes the config map", func() {
+					err := volumeManager.DetachDisk(vmcid, diskCID)
+					Expect(err).NotTo(HaveOccurred())
+
+					Expect(fakeClient.MatchingActions("create", "secrets")).To(BeEmpty())
+					Expect(fakeClient.MatchingActions("update", "secrets")).To(HaveLen(1))
+
+					matches := fakeClient.MatchingActions("delete", "configmaps")
+					Expect(matches).To(HaveLen(1))
+					Expect(matches[0].(testing.DeleteAction).GetName()).To(Equal("agent-agent-id"))
+
+					_, err = fakeClient.ConfigMaps().Get("agent-agent-id")
+					Expect(err).To(HaveOccurred())
+				})
+			})
+		})
+
 		It("retrieves, deletes, and recreates the pod", func() {
 			err := volumeManager.DetachDisk(vmcid, diskCID)
 			Expect(err).NotTo(HaveOccurred())
@@ -799,10 +1164,189 @@ var _ = Describe("VolumeManager", func() {
 			Eventually(result).Should(Receive(BeNil()))
 		})
 
+		Context("when the persistent volume claim is attached to the agent", func() {
+			BeforeEach(func() {
+				fakeClient.PrependReactor("get", "persistentvolumeclaims", func(action testing.Action) (bool, runtime.Object, error) {
+					return true, &v1.PersistentVolumeClaim{
+						ObjectMeta: v1.ObjectMeta{
+							Name:       "disk-disk-id",
+							Namespace:  "bosh-namespace",
+							Finalizers: []string{actions.DiskFinalizer},
+							Labels: map[string]string{
+								"bosh.cloudfoundry.org/agent-id": "agent-id",
+								"bosh.cloudfoundry.org/disk-id":  "disk-id",
+							},
+						},
+					}, nil
+				})
+				fakeClient.PrependReactor("update", "persistentvolumeclaims", func(action testing.Action) (bool, runtime.Object, error) {
+					return true, action.(testing.UpdateAction).GetObject(), nil
+				})
+			})
+
+			It("removes the finalizer and agent label after the pod is recreated", func() {
+				err := volumeManager.DetachDisk(vmcid, diskCID)
+				Expect(err).NotTo(HaveOccurred())
+
+				matches := fakeClient.MatchingActions("update", "persistentvolumeclaims")
+				Expect(matches).To(HaveLen(1))
+
+				updated := matches[0].(testing.UpdateAction).GetObject().(*v1.PersistentVolumeClaim)
+				Expect(updated.Finalizers).To(BeEmpty())
+				Expect(updated.Labels).To(Equal(map[string]string{"bosh.cloudfoundry.org/disk-id": "disk-id"}))
+			})
+
+			Context("when the claim is shared", func() {
+				sharedClaim := func(agentID string) *v1.PersistentVolumeClaim {
+					return &v1.PersistentVolumeClaim{
+						ObjectMeta: v1.ObjectMeta{
+							Name:       "disk-disk-id",
+							Namespace:  "bosh-namespace",
+							Finalizers: []string{actions.DiskFinalizer},
+							Labels: map[string]string{
+								"bosh.cloudfoundry.org/agent-id": agentID,
+								"bosh.cloudfoundry.org/disk-id":  "disk-id",
+							},
+						},
+						Spec: v1.PersistentVolumeClaimSpec{
+							AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteMany},
+						},
+					}
+				}
+
+				Context("when it is labelled for another agent", func() {
+					BeforeEach(func() {
+						fakeClient.PrependReactor("get", "persistentvolumeclaims", func(action testing.Action) (bool, runtime.Object, error) {
+							return true, sharedClaim("other-agent-id"), nil
+						})
+					})
+
+					It("leaves the finalizer and label of the other agent", func() {
+						err := volumeManager.DetachDisk(vmcid, diskCID)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(fakeClient.MatchingActions("update", "persistentvolumeclaims")).To(BeEmpty())
+					})
+				})
+
+				Context("when another agent pod still mounts it", func() {
+					BeforeEach(func() {
+						fakeClient.PrependReactor("get", "persistentvolumeclaims", func(action testing.Action) (bool, runtime.Object, error) {
+							return true, sharedClaim("agent-id"), nil
+						})
+
+						_, err := fakeClient.Pods().Create(&v1.Pod{
+							ObjectMeta: v1.ObjectMeta{
+								Name:      "agent-other-agent-id",
+								Namespace: "bosh-namespace",
+								Labels:    map[string]string{"bosh.cloudfoundry.org/agent-id": "other-agent-id"},
+							},
+							Spec: v1.PodSpec{
+								Volumes: []v1.Volume{{
+									Name: "disk-disk-id",
+									VolumeSource: v1.VolumeSource{
+										PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: "disk-disk-id"},
+									},
+								}},
+							},
+						})
+						Expect(err).NotTo(HaveOccurred())
+					})
+
+					It("keeps the finalizer and hands the claim over to the other agent", func() {
+						err := volumeManager.DetachDisk(vmcid, diskCID)
+						Expect(err).NotTo(HaveOccurred())
+
+						matches := fakeClient.MatchingActions("update", "persistentvolumeclaims")
+						Expect(matches).To(HaveLen(1))
+
+						updated := matches[0].(testing.UpdateAction).GetObject().(*v1.PersistentVolumeClaim)
+						Expect(updated.Finalizers).To(ConsistOf(actions.DiskFinalizer))
+						Expect(updated.Labels).To(HaveKeyWithValue("bosh.cloudfoundry.org/agent-id", "other-agent-id"))
+					})
+				})
+			})
+		})
+
+		Context("when the disk is not attached", func() {
+			BeforeEach(func() {
+				diskCID = cpi.DiskCID("context-name:other-disk-id")
+			})
+
+			It("returns a DiskNotAttachedError", func() {
+				err := volumeManager.DetachDisk(vmcid, diskCID)
+				Expect(err).To(Equal(cpi.DiskNotAttachedError{}))
+			})
+
+			It("does not update the agent settings or recreate the pod", func() {
+				volumeManager.DetachDisk(vmcid, diskCID)
+				Expect(fakeClient.MatchingActions("update", "configmaps")).To(BeEmpty())
+				Expect(fakeClient.MatchingActions("delete", "pods")).To(BeEmpty())
+			})
+		})
+
+		Context("when the disk is only mounted in the pod", func() {
+			BeforeEach(func() {
+				fakeClient.PrependReactor("get", "configmaps", func(action testing.Action) (bool, runtime.Object, error) {
+					return true, &v1.ConfigMap{
+						ObjectMeta: agentMeta,
+						Data:       map[string]string{"instance_settings": `{}`},
+					}, nil
+				})
+			})
+
+			It("removes the volume", func() {
+				err := volumeManager.DetachDisk(vmcid, diskCID)
+				Expect(err).NotTo(HaveOccurred())
+
+				matches := fakeClient.MatchingActions("create", "pods")
+				Expect(matches).To(HaveLen(1))
+
+				updated := matches[0].(testing.CreateAction).GetObject().(*v1.Pod)
+				Expect(updated.Spec.Volumes).To(BeEmpty())
+			})
+		})
+
+		Context("when attach and detach operations are applied together", func() {
+			var newDiskCID cpi.DiskCID
+
+			BeforeEach(func() {
+				newDiskCID = cpi.DiskCID("context-name:new-disk-id")
+				fakeClient.PrependReactor("get", "persistentvolumeclaims", func(action testing.Action) (bool, runtime.Object, error) {
+					return true, &v1.PersistentVolumeClaim{
+						ObjectMeta: v1.ObjectMeta{Name: "disk-new-disk-id", Namespace: "bosh-namespace"},
+					}, nil
+				})
+				fakeClient.PrependReactor("update", "persistentvolumeclaims", func(action testing.Action) (bool, runtime.Object, error) {
+					return true, action.(testing.UpdateAction).GetObject(), nil
+				})
+			})
+
+			It("recreates the pod once with the updated volumes", func() {
+				err := volumeManager.UpdateDisks(vmcid,
+					actions.DiskOperation{Operation: actions.Add, DiskCID: newDiskCID},
+					actions.DiskOperation{Operation: actions.Remove, DiskCID: diskCID},
+				)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(fakeClient.MatchingActions("update", "configmaps")).To(HaveLen(1))
+				Expect(fakeClient.MatchingActions("delete", "pods")).To(HaveLen(1))
+
+				matches := fakeClient.MatchingActions("create", "pods")
+				Expect(matches).To(HaveLen(1))
+
+				updated := matches[0].(testing.CreateAction).GetObject().(*v1.Pod)
+				Expect(updated.Spec.Volumes).To(HaveLen(1))
+				Expect(updated.Spec.Volumes[0].Name).To(Equal("disk-new-disk-id"))
+				Expect(updated.Spec.Containers[0].VolumeMounts).To(ConsistOf(
+					v1.VolumeMount{Name: "disk-new-disk-id", MountPath: "/mnt/new-disk-id"},
+				))
+			})
+		})
+
 		Context("when the vmcid context and diskcid context are different", func() {
 			BeforeEach(func() {
-				vmcid = actions.NewVMCID("rp-ctx", "agent-id")
-				diskCID = actions.NewDiskCID("disk-ctx", "disk-id")
+				vmcid = cpi.VMCID("rp-ctx:agent-id")
+				diskCID = cpi.DiskCID("disk-ctx:disk-id")
 			})
 
 			It("returns an error", func() {
@@ -812,3 +1356,18 @@ var _ = Describe("VolumeManager", func() {
 		})
 	})
 })
+
+func addDiskVolume(spec *v1.PodSpec, diskID, mountPath string) {
+	spec.Volumes = append(spec.Volumes, v1.Volume{
+		Name: "disk-" + diskID,
+		VolumeSource: v1.VolumeSource{
+			PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{
+				ClaimName: "disk-" + diskID,
+			},
+		},
+	})
+	spec.Containers[0].VolumeMounts = append(spec.Containers[0].VolumeMounts, v1.VolumeMount{
+		Name:      "disk-" + diskID,
+		MountPath: mountPath,
+	})
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 	"time"
 
 	"code.cloudfoundry.org/clock"
@@ -14,6 +16,7 @@ import (
 	"github.com/sykesm/kubernetes-cpi/config"
 	"github.com/sykesm/kubernetes-cpi/cpi"
 	"github.com/sykesm/kubernetes-cpi/kubecluster"
+	"github.com/sykesm/kubernetes-cpi/registry"
 )
 
 const (
@@ -33,6 +36,66 @@ var kubeConfigFlag = flag.String(
 	"Path to the serialized kubernetes configuration file",
 )
 
+var cpuOvercommitRatioFlag = flag.Float64(
+	"cpuOvercommitRatio",
+	1.0,
+	"Ratio of CPU limits to requests for calculated VM cloud properties",
+)
+
+var memoryOvercommitRatioFlag = flag.Float64(
+	"memoryOvercommitRatio",
+	1.0,
+	"Ratio of memory limits to requests for calculated VM cloud properties",
+)
+
+var diskDeletionTimeoutFlag = flag.Duration(
+	"diskDeletionTimeout",
+	0,
+	"Time to wait for a deleted disk's claim and volume to be removed; zero does not wait",
+)
+
+var coalesceWindowFlag = flag.Duration(
+	"coalesceWindow",
+	0,
+	"Time to wait for further disk changes before recreating a VM's pod; zero recreates immediately",
+)
+
+var migrateDisksOnAttachFlag = flag.Bool(
+	"migrateDisksOnAttach",
+	false,
+	"Migrate disks from another context into the VM's context when they are attached",
+)
+
+var migrationImageFlag = flag.String(
+	"migrationImage",
+	"",
+	"Image of the helper pods that stream disk contents during a migration",
+)
+
+var registryConfigFlag = flag.String(
+	"registryConfig",
+	"",
+	"Path to the serialized configuration of the registry that stemcell images are imported into and deleted from",
+)
+
+var pinStemcellDigestsFlag = flag.Bool(
+	"pinStemcellDigests",
+	true,
+	"Resolve stemcell image tags to the digest they refer to when the stemcell is created",
+)
+
+var prePullStemcellsFlag = flag.Bool(
+	"prePullStemcells",
+	false,
+	"Pull stemcell images onto every node when the stemcell is created",
+)
+
+var prePullTimeoutFlag = flag.Duration(
+	"prePullTimeout",
+	actions.DefaultPrePullTimeout,
+	"Time to wait for a stemcell image to be pulled onto every node",
+)
+
 var debugFlag = flag.Bool(
 	"debug",
 	false,
@@ -47,11 +110,38 @@ func main() {
 		panic(err)
 	}
 
+	provider := &kubecluster.Provider{
+		Config: kubeConf.ClientConfig(),
+	}
+
+	if flag.Arg(0) == "migrate-disk" {
+		err = migrateDisk(provider, flag.Args()[1:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "cleanup" {
+		err = cleanup(provider, kubeConf, flag.Args()[1:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	agentConf, err := loadAgentConfig(*agentConfigFlag)
 	if err != nil {
 		panic(err)
 	}
 
+	registryClient, err := newRegistryClient(*registryConfigFlag)
+	if err != nil {
+		panic(err)
+	}
+
 	payload, err := ioutil.ReadAll(os.Stdin)
 	if err != nil {
 		panic(err)
@@ -65,34 +155,69 @@ func main() {
 		panic(err)
 	}
 
-	provider := &kubecluster.Provider{
-		Config: kubeConf.ClientConfig(),
-	}
+	// actions write diagnostics for the response log here
+	var cpiLog bytes.Buffer
 
 	var result *cpi.Response
 	switch req.Method {
 
 	// Stemcell Management
 	case "create_stemcell":
-		result, err = cpi.Dispatch(&req, actions.CreateStemcell)
+		stemcellManager := &actions.StemcellManager{
+			ClientProvider: provider,
+			Contexts:       kubeConf.ContextNames(),
+			Registry:       registryClient,
+		}
+		if *pinStemcellDigestsFlag {
+			stemcellManager.Resolver = &actions.RegistryResolver{Registry: stemcellManager.Registry}
+		}
+		if *prePullStemcellsFlag {
+			stemcellManager.PrePuller = &actions.ImagePrePuller{
+				Clock:   clock.NewClock(),
+				Timeout: *prePullTimeoutFlag,
+			}
+		}
+		result, err = cpi.Dispatch(&req, stemcellManager.CreateStemcell)
 
 	case "delete_stemcell":
-		result, err = cpi.Dispatch(&req, actions.DeleteStemcell)
+		stemcellManager := &actions.StemcellManager{
+			ClientProvider:    provider,
+			Contexts:          kubeConf.ContextNames(),
+			NamespacePolicies: kubeConf.NamespacePolicies(),
+			Registry:          registryClient,
+		}
+		result, err = cpi.Dispatch(&req, stemcellManager.DeleteStemcell)
 
 	// VM management
 	case "create_vm":
 		vmCreator := &actions.VMCreator{
-			AgentConfig:    agentConf,
-			ClientProvider: provider,
+			AgentConfig:        agentConf,
+			ClientProvider:     provider,
+			DirectorUUID:       req.Context.DirectorUUID,
+			PrivilegedContexts: kubeConf.PrivilegedContexts(),
+			NamespacePolicies:  kubeConf.NamespacePolicies(),
 		}
 		result, err = cpi.Dispatch(&req, vmCreator.Create)
 
 	case "delete_vm":
-		vmDeleter := &actions.VMDeleter{ClientProvider: provider}
+		vmDeleter := &actions.VMDeleter{
+			ClientProvider: provider,
+			DirectorUUID:   req.Context.DirectorUUID,
+		}
 		result, err = cpi.Dispatch(&req, vmDeleter.Delete)
 
+	case "calculate_vm_cloud_properties":
+		vmPropertiesCalculator := &actions.VMPropertiesCalculator{
+			CPUOvercommitRatio:    *cpuOvercommitRatioFlag,
+			MemoryOvercommitRatio: *memoryOvercommitRatioFlag,
+		}
+		result, err = cpi.Dispatch(&req, vmPropertiesCalculator.CalculateVMCloudProperties)
+
 	case "has_vm":
-		vmFinder := &actions.VMFinder{ClientProvider: provider}
+		vmFinder := &actions.VMFinder{
+			ClientProvider: provider,
+			DirectorUUID:   req.Context.DirectorUUID,
+		}
 		result, err = cpi.Dispatch(&req, vmFinder.HasVM)
 
 	case "set_vm_metadata":
@@ -103,6 +228,7 @@ func main() {
 	case "create_disk":
 		diskCreator := actions.DiskCreator{
 			ClientProvider:    provider,
+			DirectorUUID:      req.Context.DirectorUUID,
 			GUIDGeneratorFunc: actions.CreateGUID,
 		}
 		result, err = cpi.Dispatch(&req, diskCreator.CreateDisk)
@@ -113,15 +239,34 @@ func main() {
 			Clock:             clock.NewClock(),
 			PodReadyTimeout:   DefaultPodReadyTimeout,
 			PostRecreateDelay: DefaultPostRecreateDelay,
+			CoalesceWindow:    *coalesceWindowFlag,
+			DiskMountRoots:    kubeConf.DiskMountRoots(),
+			SettingsKind:      actions.SettingsKind(agentConf.SettingsKind),
+		}
+		if *migrateDisksOnAttachFlag {
+			volumeManager.Migrator = newDiskMigrator(provider)
 		}
 		result, err = cpi.Dispatch(&req, volumeManager.AttachDisk)
 
 	case "has_disk":
-		diskFinder := actions.DiskFinder{ClientProvider: provider}
+		diskFinder := actions.DiskFinder{
+			ClientProvider: provider,
+			DirectorUUID:   req.Context.DirectorUUID,
+		}
+		if *migrateDisksOnAttachFlag {
+			diskFinder.MovedDiskContexts = kubeConf.ContextNames()
+		}
 		result, err = cpi.Dispatch(&req, diskFinder.HasDisk)
 
 	case "delete_disk":
-		diskDeleter := actions.DiskDeleter{ClientProvider: provider}
+		diskDeleter := actions.DiskDeleter{
+			ClientProvider:  provider,
+			Clock:           clock.NewClock(),
+			DeletionTimeout: *diskDeletionTimeoutFlag,
+		}
+		if *migrateDisksOnAttachFlag {
+			diskDeleter.MovedDiskContexts = kubeConf.ContextNames()
+		}
 		result, err = cpi.Dispatch(&req, diskDeleter.DeleteDisk)
 
 	case "detach_disk":
@@ -130,11 +275,22 @@ func main() {
 			Clock:             clock.NewClock(),
 			PodReadyTimeout:   DefaultPodReadyTimeout,
 			PostRecreateDelay: DefaultPostRecreateDelay,
+			CoalesceWindow:    *coalesceWindowFlag,
+			DiskMountRoots:    kubeConf.DiskMountRoots(),
+			SettingsKind:      actions.SettingsKind(agentConf.SettingsKind),
+		}
+		if *migrateDisksOnAttachFlag {
+			volumeManager.Migrator = newDiskMigrator(provider)
 		}
 		result, err = cpi.Dispatch(&req, volumeManager.DetachDisk)
 
 	case "get_disks":
-		diskGetter := actions.DiskGetter{ClientProvider: provider}
+		diskGetter := actions.DiskGetter{
+			ClientProvider: provider,
+			DirectorUUID:   req.Context.DirectorUUID,
+			SettingsKind:   actions.SettingsKind(agentConf.SettingsKind),
+			Logger:         &cpiLog,
+		}
 		result, err = cpi.Dispatch(&req, diskGetter.GetDisks)
 
 	// Not implemented
@@ -158,6 +314,10 @@ func main() {
 		panic(err)
 	}
 
+	if result != nil {
+		result.Log = cpiLog.String()
+	}
+
 	response, err := json.Marshal(result)
 	if err != nil {
 		panic(err)
@@ -167,6 +327,142 @@ func main() {
 	fmt.Printf("%s", response)
 }
 
+// migrateDisk implements the migrate-disk subcommand. The CID of the migrated
+// disk is written to os.Stdout.
+func migrateDisk(provider kubecluster.ClientProvider, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("Usage: %s [flags] migrate-disk DISK_CID TARGET_CONTEXT", os.Args[0])
+	}
+
+	diskCID, err := newDiskMigrator(provider).MigrateDisk(cpi.DiskCID(args[0]), args[1])
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(diskCID)
+	return nil
+}
+
+// cleanup implements the cleanup subcommand. A JSON report of the orphaned
+// objects is written to os.Stdout; they are only deleted with -delete.
+func cleanup(provider kubecluster.ClientProvider, kubeConf *config.Kubernetes, args []string) error {
+	flags := flag.NewFlagSet("cleanup", flag.ContinueOnError)
+	deleteFlag := flags.Bool("delete", false, "Delete the orphans instead of only reporting them; requires -knownVMs")
+	minAgeFlag := flags.Duration("minAge", time.Hour, "Minimum age of the orphans that are deleted")
+	directorUUIDFlag := flags.String("directorUUID", "", "Only clean up the objects of this director")
+	knownDisksFlag := flags.String("knownDisks", "", "Path to a file with the CIDs of the director's disks, one per line; disk claims are only checked when set")
+	knownVMsFlag := flags.String("knownVMs", "", "Path to a file with the CIDs of the director's VMs, one per line; their objects are kept while their pod is missing")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	// the known disks are those of one director; the claims of any other
+	// director would all be reported as orphans
+	if *knownDisksFlag != "" && *directorUUIDFlag == "" {
+		return fmt.Errorf("-knownDisks requires -directorUUID")
+	}
+
+	// the age of an object counts from its creation, so without the known VMs
+	// the objects of a VM whose pod is being recreated look like orphans
+	if *deleteFlag && *knownVMsFlag == "" {
+		return fmt.Errorf("-delete requires -knownVMs")
+	}
+
+	cleaner := &actions.OrphanCleaner{
+		ClientProvider:    provider,
+		Clock:             clock.NewClock(),
+		MinAge:            *minAgeFlag,
+		DirectorUUID:      *directorUUIDFlag,
+		NamespacePolicies: kubeConf.NamespacePolicies(),
+	}
+
+	if *knownDisksFlag != "" {
+		lines, err := readLines(*knownDisksFlag)
+		if err != nil {
+			return err
+		}
+		cleaner.KnownDisks = []cpi.DiskCID{}
+		for _, line := range lines {
+			cleaner.KnownDisks = append(cleaner.KnownDisks, cpi.DiskCID(line))
+		}
+	}
+
+	if *knownVMsFlag != "" {
+		lines, err := readLines(*knownVMsFlag)
+		if err != nil {
+			return err
+		}
+		for _, line := range lines {
+			cleaner.KnownVMs = append(cleaner.KnownVMs, cpi.VMCID(line))
+		}
+	}
+
+	orphans, err := cleaner.Cleanup(kubeConf.ContextNames(), *deleteFlag)
+	if err != nil {
+		return err
+	}
+
+	report, err := json.Marshal(struct {
+		DryRun  bool             `json:"dry_run"`
+		MinAge  string           `json:"min_age"`
+		Orphans []actions.Orphan `json:"orphans"`
+	}{
+		DryRun:  !*deleteFlag,
+		MinAge:  minAgeFlag.String(),
+		Orphans: orphans,
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s\n", report)
+	return nil
+}
+
+// readLines returns the lines of a file that are not blank.
+func readLines(path string) ([]string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(contents), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+func newRegistryClient(path string) (*registry.Client, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	registryConf, err := loadRegistryConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &registry.Client{
+		URL:      registryConf.URL,
+		Username: registryConf.Username,
+		Password: registryConf.Password,
+	}, nil
+}
+
+func newDiskMigrator(provider kubecluster.ClientProvider) *actions.DiskMigrator {
+	return &actions.DiskMigrator{
+		ClientProvider:  provider,
+		Streamer:        &actions.ProxyStreamer{},
+		Image:           *migrationImageFlag,
+		Clock:           clock.NewClock(),
+		PodReadyTimeout: DefaultPodReadyTimeout,
+	}
+}
+
 func debugJSON(stem string, payload []byte) {
 	if *debugFlag {
 		fmt.Fprintf(os.Stderr, `{ "%s": %s }%c`, stem, payload, '\n')
@@ -204,3 +500,19 @@ func loadAgentConfig(path string) (*config.Agent, error) {
 
 	return &agentConf, nil
 }
+
+func loadRegistryConfig(path string) (*config.Registry, error) {
+	registryConfigFile, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer registryConfigFile.Close()
+
+	var registryConf config.Registry
+	err = json.NewDecoder(registryConfigFile).Decode(&registryConf)
+	if err != nil {
+		return nil, err
+	}
+
+	return &registryConf, nil
+}
@@ -4,4 +4,9 @@ type Agent struct {
 	Blobstore  interface{} `json:"blobstore,omitempty"`
 	MessageBus string      `json:"mbus"`
 	NTPServers []string    `json:"ntp,omitempty"`
+
+	// SettingsKind selects the kind of object, ConfigMap or Secret, that
+	// holds the agent instance settings. The settings include the message
+	// bus and blobstore credentials.
+	SettingsKind string `json:"settings_kind,omitempty"`
 }
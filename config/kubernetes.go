@@ -1,6 +1,10 @@
 package config
 
-import clientcmdapi "k8s.io/client-go/1.4/tools/clientcmd/api"
+import (
+	"sort"
+
+	clientcmdapi "k8s.io/client-go/1.4/tools/clientcmd/api"
+)
 
 type Cluster struct {
 	Server                   string `json:"server"`
@@ -20,6 +24,45 @@ type Context struct {
 	Cluster   string `json:"cluster"`
 	AuthInfo  string `json:"user"`
 	Namespace string `json:"namespace"`
+
+	// DiskMountRoot is the directory persistent disks are mounted under.
+	DiskMountRoot string `json:"disk_mount_root,omitempty"`
+
+	// AllowPrivileged permits privileged containers in the context.
+	AllowPrivileged bool `json:"allow_privileged,omitempty"`
+
+	// NamespacePolicy controls the namespaces the CPI creates in the context.
+	NamespacePolicy NamespacePolicy `json:"namespace_policy,omitempty"`
+}
+
+// NamespacePolicy controls the namespaces the CPI creates.
+type NamespacePolicy struct {
+	// DeploymentTemplate, when set, places the VMs of each BOSH deployment in
+	// their own namespace. It is a text/template executed with the
+	// Deployment name and the Namespace of the context, for example
+	// "{{.Namespace}}-{{.Deployment}}".
+	DeploymentTemplate string `json:"deployment_template,omitempty"`
+
+	// Labels are applied to the namespaces created by the CPI.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// ResourceQuota holds the hard limits of the quota the CPI maintains in
+	// the namespaces it creates VMs in, for example "pods": "20" or
+	// "requests.storage": "500Gi".
+	ResourceQuota map[string]string `json:"resource_quota,omitempty"`
+
+	// LimitRange holds the container limits the CPI maintains in the
+	// namespaces it creates VMs in.
+	LimitRange *LimitRange `json:"limit_range,omitempty"`
+}
+
+// LimitRange holds the default, minimum and maximum container resources of
+// a namespace, for example "cpu": "500m".
+type LimitRange struct {
+	Default        map[string]string `json:"default,omitempty"`
+	DefaultRequest map[string]string `json:"default_request,omitempty"`
+	Max            map[string]string `json:"max,omitempty"`
+	Min            map[string]string `json:"min,omitempty"`
 }
 
 type Kubernetes struct {
@@ -45,6 +88,52 @@ func (k Kubernetes) ClientConfig() clientcmdapi.Config {
 	return *cc
 }
 
+// ContextNames returns the sorted names of the configured contexts.
+func (k Kubernetes) ContextNames() []string {
+	names := []string{}
+	for name := range k.Contexts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DiskMountRoots returns the persistent disk mount root of each context that
+// has one configured.
+func (k Kubernetes) DiskMountRoots() map[string]string {
+	roots := map[string]string{}
+	for name, context := range k.Contexts {
+		if context.DiskMountRoot != "" {
+			roots[name] = context.DiskMountRoot
+		}
+	}
+	return roots
+}
+
+// PrivilegedContexts returns the contexts that permit privileged containers.
+func (k Kubernetes) PrivilegedContexts() map[string]bool {
+	privileged := map[string]bool{}
+	for name, context := range k.Contexts {
+		if context.AllowPrivileged {
+			privileged[name] = true
+		}
+	}
+	return privileged
+}
+
+// NamespacePolicies returns the namespace policy of each context that has
+// one configured.
+func (k Kubernetes) NamespacePolicies() map[string]NamespacePolicy {
+	policies := map[string]NamespacePolicy{}
+	for name, context := range k.Contexts {
+		policy := context.NamespacePolicy
+		if policy.DeploymentTemplate != "" || len(policy.Labels) != 0 || len(policy.ResourceQuota) != 0 || policy.LimitRange != nil {
+			policies[name] = policy
+		}
+	}
+	return policies
+}
+
 func (a *AuthInfo) api() *clientcmdapi.AuthInfo {
 	info := clientcmdapi.NewAuthInfo()
 	info.Token = a.Token
@@ -22,7 +22,9 @@ var _ = Describe("Kubernetes Config", func() {
 				"minikube": { "certificate_authority_data": "certificate-authority-data", "server": "https://192.168.64.17:8443" }
 			},
 			"contexts": {
-				"bosh": { "cluster": "bosh", "user": "bosh", "namespace": "bosh" },
+				"bosh": { "cluster": "bosh", "user": "bosh", "namespace": "bosh", "disk_mount_root": "/var/vcap/disks", "allow_privileged": true,
+					"namespace_policy": { "deployment_template": "bosh-{{.Deployment}}", "labels": { "team": "bosh" },
+						"resource_quota": { "pods": "20" }, "limit_range": { "default": { "cpu": "1" }, "max": { "memory": "8Gi" } } } },
 				"minikube": { "cluster": "minikube", "user": "minikube", "namespace": "minikube" },
 				"no-namespace": { "cluster": "bosh", "user": "minikube" }
 			},
@@ -50,9 +52,20 @@ var _ = Describe("Kubernetes Config", func() {
 
 		Expect(kubeConf.Contexts).To(HaveLen(3))
 		Expect(kubeConf.Contexts["bosh"]).To(Equal(&config.Context{
-			Cluster:   "bosh",
-			AuthInfo:  "bosh",
-			Namespace: "bosh",
+			Cluster:         "bosh",
+			AuthInfo:        "bosh",
+			Namespace:       "bosh",
+			DiskMountRoot:   "/var/vcap/disks",
+			AllowPrivileged: true,
+			NamespacePolicy: config.NamespacePolicy{
+				DeploymentTemplate: "bosh-{{.Deployment}}",
+				Labels:             map[string]string{"team": "bosh"},
+				ResourceQuota:      map[string]string{"pods": "20"},
+				LimitRange: &config.LimitRange{
+					Default: map[string]string{"cpu": "1"},
+					Max:     map[string]string{"memory": "8Gi"},
+				},
+			},
 		}))
 		Expect(kubeConf.Contexts["minikube"]).To(Equal(&config.Context{
 			Cluster:   "minikube",
@@ -77,6 +90,44 @@ var _ = Describe("Kubernetes Config", func() {
 		Expect(kubeConf.CurrentContext).To(Equal("minikube"))
 	})
 
+	Describe("ContextNames", func() {
+		It("returns the sorted context names", func() {
+			Expect(kubeConf.ContextNames()).To(Equal([]string{"bosh", "minikube", "no-namespace"}))
+		})
+	})
+
+	Describe("DiskMountRoots", func() {
+		It("returns the mount roots of contexts that configure one", func() {
+			Expect(kubeConf.DiskMountRoots()).To(Equal(map[string]string{
+				"bosh": "/var/vcap/disks",
+			}))
+		})
+	})
+
+	Describe("PrivilegedContexts", func() {
+		It("returns the contexts that allow privileged containers", func() {
+			Expect(kubeConf.PrivilegedContexts()).To(Equal(map[string]bool{
+				"bosh": true,
+			}))
+		})
+	})
+
+	Describe("NamespacePolicies", func() {
+		It("returns the namespace policies of contexts that configure one", func() {
+			Expect(kubeConf.NamespacePolicies()).To(Equal(map[string]config.NamespacePolicy{
+				"bosh": {
+					DeploymentTemplate: "bosh-{{.Deployment}}",
+					Labels:             map[string]string{"team": "bosh"},
+					ResourceQuota:      map[string]string{"pods": "20"},
+					LimitRange: &config.LimitRange{
+						Default: map[string]string{"cpu": "1"},
+						Max:     map[string]string{"memory": "8Gi"},
+					},
+				},
+			}))
+		})
+	})
+
 	Describe("ClientConfig", func() {
 		BeforeEach(func() {
 			kubeConf = config.Kubernetes{
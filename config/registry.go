@@ -0,0 +1,9 @@
+package config
+
+// Registry holds the location of and credentials for the registry that
+// stemcell images are imported into and deleted from.
+type Registry struct {
+	URL      string `json:"url"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
@@ -0,0 +1,33 @@
+package config_test
+
+import (
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sykesm/kubernetes-cpi/config"
+)
+
+var _ = Describe("Registry Config", func() {
+	var configData []byte
+	var registryConf config.Registry
+
+	BeforeEach(func() {
+		configData = []byte(`{
+			"url": "https://registry.example.com",
+			"username": "stemcell-importer",
+			"password": "registry-password"
+		}`)
+
+		err := json.Unmarshal([]byte(configData), &registryConf)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("deserializes the config data", func() {
+		Expect(registryConf).To(Equal(config.Registry{
+			URL:      "https://registry.example.com",
+			Username: "stemcell-importer",
+			Password: "registry-password",
+		}))
+	})
+})
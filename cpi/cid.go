@@ -0,0 +1,83 @@
+package cpi
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// cidVersion prefixes CIDs that record the namespace. CIDs without it are
+// legacy "context:id" CIDs.
+const cidVersion = "v1"
+
+// CID is a decoded VM or disk cloud ID. The namespace of a legacy CID is
+// empty, which means the namespace configured for the context.
+type CID struct {
+	Context   string
+	Namespace string
+	ID        string
+}
+
+func (c CID) encode() string {
+	// without a namespace the legacy form round trips unchanged
+	if c.Namespace == "" && c.Context != cidVersion && !strings.Contains(c.Context, ":") {
+		return c.Context + ":" + c.ID
+	}
+
+	return strings.Join([]string{
+		cidVersion,
+		url.QueryEscape(c.Context),
+		url.QueryEscape(c.Namespace),
+		url.QueryEscape(c.ID),
+	}, ":")
+}
+
+func NewVMCID(context, namespace, agentID string) VMCID {
+	return VMCID(CID{Context: context, Namespace: namespace, ID: agentID}.encode())
+}
+
+// Decode returns the context, namespace and agent ID of the VM.
+func (v VMCID) Decode() (CID, error) {
+	return decodeCID("VM", string(v))
+}
+
+func NewDiskCID(context, namespace, diskID string) DiskCID {
+	return DiskCID(CID{Context: context, Namespace: namespace, ID: diskID}.encode())
+}
+
+// Decode returns the context, namespace and ID of the disk.
+func (d DiskCID) Decode() (CID, error) {
+	return decodeCID("disk", string(d))
+}
+
+func decodeCID(kind, cid string) (CID, error) {
+	parts := strings.Split(cid, ":")
+
+	if parts[0] != cidVersion {
+		// legacy CIDs are the context and the ID
+		parts = strings.SplitN(cid, ":", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return CID{}, fmt.Errorf("Invalid %s CID %q", kind, cid)
+		}
+		return CID{Context: parts[0], ID: parts[1]}, nil
+	}
+
+	if len(parts) != 4 {
+		return CID{}, fmt.Errorf("Invalid %s CID %q: expected %s:context:namespace:id", kind, cid, cidVersion)
+	}
+
+	var decoded [3]string
+	for i, part := range parts[1:] {
+		value, err := url.QueryUnescape(part)
+		if err != nil {
+			return CID{}, fmt.Errorf("Invalid %s CID %q: %s", kind, cid, err)
+		}
+		decoded[i] = value
+	}
+
+	if decoded[2] == "" {
+		return CID{}, fmt.Errorf("Invalid %s CID %q: the ID is empty", kind, cid)
+	}
+
+	return CID{Context: decoded[0], Namespace: decoded[1], ID: decoded[2]}, nil
+}
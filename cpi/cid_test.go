@@ -0,0 +1,80 @@
+package cpi_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sykesm/kubernetes-cpi/cpi"
+)
+
+var _ = Describe("CIDs", func() {
+	Describe("VMCID", func() {
+		It("records the context, namespace and agent ID", func() {
+			vmcid := cpi.NewVMCID("context-name", "bosh-namespace", "agent-id")
+			Expect(vmcid).To(Equal(cpi.VMCID("v1:context-name:bosh-namespace:agent-id")))
+
+			cid, err := vmcid.Decode()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cid).To(Equal(cpi.CID{Context: "context-name", Namespace: "bosh-namespace", ID: "agent-id"}))
+		})
+
+		It("escapes colons", func() {
+			vmcid := cpi.NewVMCID("user@cluster:443", "bosh-namespace", "agent-id")
+			Expect(vmcid).To(Equal(cpi.VMCID("v1:user%40cluster%3A443:bosh-namespace:agent-id")))
+
+			cid, err := vmcid.Decode()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cid).To(Equal(cpi.CID{Context: "user@cluster:443", Namespace: "bosh-namespace", ID: "agent-id"}))
+		})
+
+		It("decodes legacy CIDs without a namespace", func() {
+			cid, err := cpi.VMCID("context-name:agent-id").Decode()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cid).To(Equal(cpi.CID{Context: "context-name", ID: "agent-id"}))
+		})
+
+		It("keeps the legacy form when there is no namespace", func() {
+			Expect(cpi.NewVMCID("context-name", "", "agent-id")).To(Equal(cpi.VMCID("context-name:agent-id")))
+		})
+
+		It("rejects CIDs without an ID", func() {
+			_, err := cpi.VMCID("agent-id").Decode()
+			Expect(err).To(MatchError(`Invalid VM CID "agent-id"`))
+
+			_, err = cpi.VMCID("context-name:").Decode()
+			Expect(err).To(MatchError(`Invalid VM CID "context-name:"`))
+
+			_, err = cpi.VMCID("v1:context-name:bosh-namespace:").Decode()
+			Expect(err).To(MatchError(`Invalid VM CID "v1:context-name:bosh-namespace:": the ID is empty`))
+		})
+
+		It("rejects malformed versioned CIDs", func() {
+			_, err := cpi.VMCID("v1:context-name:agent-id").Decode()
+			Expect(err).To(MatchError(`Invalid VM CID "v1:context-name:agent-id": expected v1:context:namespace:id`))
+
+			_, err = cpi.VMCID("v1:context%zz:bosh-namespace:agent-id").Decode()
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("DiskCID", func() {
+		It("records the context, namespace and disk ID", func() {
+			diskCID := cpi.NewDiskCID("context-name", "bosh-namespace", "disk-id")
+			Expect(diskCID).To(Equal(cpi.DiskCID("v1:context-name:bosh-namespace:disk-id")))
+
+			cid, err := diskCID.Decode()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cid).To(Equal(cpi.CID{Context: "context-name", Namespace: "bosh-namespace", ID: "disk-id"}))
+		})
+
+		It("decodes legacy CIDs without a namespace", func() {
+			cid, err := cpi.DiskCID("context-name:disk-id").Decode()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cid).To(Equal(cpi.CID{Context: "context-name", ID: "disk-id"}))
+		})
+
+		It("rejects CIDs without an ID", func() {
+			_, err := cpi.DiskCID("disk-id").Decode()
+			Expect(err).To(MatchError(`Invalid disk CID "disk-id"`))
+		})
+	})
+})
@@ -25,6 +25,12 @@ type ResponseError struct {
 	CanRetry bool   `json:"ok_to_retry"`
 }
 
+// TypedError is implemented by errors that map to a Bosh::Clouds error class.
+type TypedError interface {
+	error
+	Type() string
+}
+
 func Dispatch(req *Request, actionFunc interface{}) (*Response, error) {
 	actionValue := reflect.ValueOf(actionFunc)
 	actionType := actionValue.Type()
@@ -110,6 +116,9 @@ func newResponse(result []reflect.Value) (*Response, error) {
 	if errValue.IsValid() && !errValue.IsNil() {
 		err := errValue.Interface().(error)
 		resp.Error = &ResponseError{Message: err.Error()}
+		if typed, ok := err.(TypedError); ok {
+			resp.Error.Type = typed.Type()
+		}
 	}
 
 	return resp, nil
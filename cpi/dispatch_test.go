@@ -57,6 +57,17 @@ var _ = Describe("Dispatch", func() {
 		})
 	})
 
+	Context("when the action returns a typed error", func() {
+		It("sets the error type in the response", func() {
+			resp, err := cpi.Dispatch(req, delegate.ReturnTypedErr)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.Error).To(Equal(&cpi.ResponseError{
+				Type:    "Bosh::Clouds::DiskNotAttached",
+				Message: "Disk not attached",
+			}))
+		})
+	})
+
 	Context("when the action takes more arguments than were provided", func() {
 		It("returns an error", func() {
 			_, err := cpi.Dispatch(req, delegate.OneStringArg)
@@ -207,6 +218,11 @@ func (d *Delegate) ReturnErr(msg string) error {
 	return errors.New(msg)
 }
 
+func (d *Delegate) ReturnTypedErr() error {
+	d.CallCount++
+	return cpi.DiskNotAttachedError{}
+}
+
 func (d *Delegate) OneStringArg(s string) error {
 	d.CallCount++
 	return nil
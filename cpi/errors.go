@@ -1,5 +1,7 @@
 package cpi
 
+import "fmt"
+
 type NotSupportedError struct{}
 
 func (e NotSupportedError) Type() string  { return "Bosh::Clouds::NotSupported" }
@@ -14,3 +16,41 @@ type DiskNotAttachedError struct{}
 
 func (e DiskNotAttachedError) Type() string  { return "Bosh::Clouds::DiskNotAttached" }
 func (e DiskNotAttachedError) Error() string { return "Disk not attached" }
+
+type DiskInUseError struct {
+	DiskCID DiskCID
+	Pod     string
+}
+
+func (e DiskInUseError) Type() string { return "Bosh::Clouds::CloudError" }
+func (e DiskInUseError) Error() string {
+	return fmt.Sprintf("Disk %q is in use by pod %q", e.DiskCID, e.Pod)
+}
+
+type StemcellInUseError struct {
+	StemcellCID StemcellCID
+	Context     string
+	Pod         string
+}
+
+func (e StemcellInUseError) Type() string { return "Bosh::Clouds::CloudError" }
+func (e StemcellInUseError) Error() string {
+	return fmt.Sprintf("Stemcell %q is in use by pod %q in context %q", e.StemcellCID, e.Pod, e.Context)
+}
+
+// QuotaExceededError is returned before creating objects that a resource
+// quota would reject. It is not retried as the quota has to be raised or
+// other objects removed first.
+type QuotaExceededError struct {
+	Namespace string
+	Quota     string
+	Resource  string
+	Requested string
+	Used      string
+	Hard      string
+}
+
+func (e QuotaExceededError) Type() string { return "Bosh::Clouds::CloudError" }
+func (e QuotaExceededError) Error() string {
+	return fmt.Sprintf("Resource quota %q in namespace %q is exceeded: requested %s %s with %s of %s used", e.Quota, e.Namespace, e.Requested, e.Resource, e.Used, e.Hard)
+}
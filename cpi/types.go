@@ -16,9 +16,6 @@ type Network struct {
 	CloudProperties map[string]interface{} `json:"cloud_properties"`
 }
 
-// TODO: Add methods to extract context and ID  from the disk and VM ID's.
-// TODO: Move NewVMCID and NewDiskCID from actions here
-
 type DiskCID string
 
 type Environment map[string]interface{}
@@ -3,17 +3,26 @@ package kubecluster
 import (
 	"k8s.io/client-go/1.4/kubernetes"
 	core "k8s.io/client-go/1.4/kubernetes/typed/core/v1"
+	extensions "k8s.io/client-go/1.4/kubernetes/typed/extensions/v1beta1"
+	rbac "k8s.io/client-go/1.4/kubernetes/typed/rbac/v1alpha1"
 )
 
 type Client interface {
 	Context() string
 	Namespace() string
 
+	// WithNamespace returns a client for another namespace of the context.
+	WithNamespace(namespace string) Client
+
 	Core() core.CoreInterface
 
 	ConfigMaps() core.ConfigMapInterface
+	DaemonSets() extensions.DaemonSetInterface
 	PersistentVolumeClaims() core.PersistentVolumeClaimInterface
 	Pods() core.PodInterface
+	RoleBindings() rbac.RoleBindingInterface
+	Secrets() core.SecretInterface
+	ServiceAccounts() core.ServiceAccountInterface
 	Services() core.ServiceInterface
 }
 
@@ -34,10 +43,22 @@ func (c *client) Namespace() string {
 	return c.namespace
 }
 
+func (c *client) WithNamespace(namespace string) Client {
+	return &client{
+		context:   c.context,
+		namespace: namespace,
+		Clientset: c.Clientset,
+	}
+}
+
 func (c *client) ConfigMaps() core.ConfigMapInterface {
 	return c.Core().ConfigMaps(c.namespace)
 }
 
+func (c *client) DaemonSets() extensions.DaemonSetInterface {
+	return c.Extensions().DaemonSets(c.namespace)
+}
+
 func (c *client) PersistentVolumeClaims() core.PersistentVolumeClaimInterface {
 	return c.Core().PersistentVolumeClaims(c.namespace)
 }
@@ -46,6 +67,18 @@ func (c *client) Pods() core.PodInterface {
 	return c.Core().Pods(c.namespace)
 }
 
+func (c *client) RoleBindings() rbac.RoleBindingInterface {
+	return c.Rbac().RoleBindings(c.namespace)
+}
+
+func (c *client) Secrets() core.SecretInterface {
+	return c.Core().Secrets(c.namespace)
+}
+
+func (c *client) ServiceAccounts() core.ServiceAccountInterface {
+	return c.Core().ServiceAccounts(c.namespace)
+}
+
 func (c *client) Services() core.ServiceInterface {
 	return c.Core().Services(c.namespace)
 }
@@ -4,6 +4,8 @@ import (
 	"github.com/sykesm/kubernetes-cpi/kubecluster"
 	"k8s.io/client-go/1.4/kubernetes/fake"
 	core "k8s.io/client-go/1.4/kubernetes/typed/core/v1"
+	extensions "k8s.io/client-go/1.4/kubernetes/typed/extensions/v1beta1"
+	rbac "k8s.io/client-go/1.4/kubernetes/typed/rbac/v1alpha1"
 	"k8s.io/client-go/1.4/pkg/runtime"
 	"k8s.io/client-go/1.4/testing"
 )
@@ -30,14 +32,29 @@ type Client struct {
 	fake.Clientset
 }
 
+// WithNamespace switches the fake to the namespace so the actions of every
+// namespace are recorded by the one fake.
+func (c *Client) WithNamespace(namespace string) kubecluster.Client {
+	c.NamespaceReturns(namespace)
+	return c
+}
+
 func (c *Client) ConfigMaps() core.ConfigMapInterface {
 	return c.Core().ConfigMaps(c.Namespace())
 }
 
+func (c *Client) ServiceAccounts() core.ServiceAccountInterface {
+	return c.Core().ServiceAccounts(c.Namespace())
+}
+
 func (c *Client) Services() core.ServiceInterface {
 	return c.Core().Services(c.Namespace())
 }
 
+func (c *Client) DaemonSets() extensions.DaemonSetInterface {
+	return c.Extensions().DaemonSets(c.Namespace())
+}
+
 func (c *Client) PersistentVolumeClaims() core.PersistentVolumeClaimInterface {
 	return c.Core().PersistentVolumeClaims(c.Namespace())
 }
@@ -46,6 +63,14 @@ func (c *Client) Pods() core.PodInterface {
 	return c.Core().Pods(c.Namespace())
 }
 
+func (c *Client) RoleBindings() rbac.RoleBindingInterface {
+	return c.Rbac().RoleBindings(c.Namespace())
+}
+
+func (c *Client) Secrets() core.SecretInterface {
+	return c.Core().Secrets(c.Namespace())
+}
+
 func (c *Client) MatchingActions(verb, resource string) []testing.Action {
 	result := []testing.Action{}
 	for _, action := range c.Actions() {
@@ -0,0 +1,239 @@
+package registry
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+const MediaTypeOCIManifest = "application/vnd.oci.image.manifest.v1+json"
+
+var ErrEntryNotFound = errors.New("archive entry not found")
+
+// dockerManifest is an entry of the manifest.json written by docker save.
+type dockerManifest struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+type ociIndex struct {
+	Manifests []Descriptor `json:"manifests"`
+}
+
+// PushArchive pushes the image in a docker save archive or an OCI image
+// layout archive to the repository and tags it. The archive may be gzip
+// compressed. The digest of the pushed manifest is returned.
+func (c *Client) PushArchive(repository, tag, archivePath string) (string, error) {
+	manifestJSON, err := ReadArchiveEntry(archivePath, "manifest.json")
+	if err == nil {
+		return c.pushDockerArchive(repository, tag, archivePath, manifestJSON)
+	}
+	if err != ErrEntryNotFound {
+		return "", err
+	}
+
+	indexJSON, err := ReadArchiveEntry(archivePath, "index.json")
+	if err == nil {
+		return c.pushOCIArchive(repository, tag, archivePath, indexJSON)
+	}
+	if err != ErrEntryNotFound {
+		return "", err
+	}
+
+	return "", fmt.Errorf("%s is not a docker or OCI image archive", archivePath)
+}
+
+func (c *Client) pushDockerArchive(repository, tag, archivePath string, manifestJSON []byte) (string, error) {
+	var dockerManifests []dockerManifest
+	err := json.Unmarshal(manifestJSON, &dockerManifests)
+	if err != nil {
+		return "", err
+	}
+	if len(dockerManifests) != 1 {
+		return "", fmt.Errorf("Expected one image in archive, found %d", len(dockerManifests))
+	}
+
+	config, err := ReadArchiveEntry(archivePath, dockerManifests[0].Config)
+	if err != nil {
+		return "", err
+	}
+
+	manifest := Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeManifest,
+		Config: Descriptor{
+			MediaType: MediaTypeImageConfig,
+			Size:      int64(len(config)),
+			Digest:    Digest(config),
+		},
+	}
+
+	err = c.PushBlob(repository, manifest.Config.Digest, manifest.Config.Size, bytes.NewReader(config))
+	if err != nil {
+		return "", err
+	}
+
+	for _, layer := range dockerManifests[0].Layers {
+		desc, err := c.pushDockerLayer(repository, archivePath, layer)
+		if err != nil {
+			return "", err
+		}
+		manifest.Layers = append(manifest.Layers, desc)
+	}
+
+	manifestBytes, err := json.Marshal(manifest)
+	if err != nil {
+		return "", err
+	}
+
+	return c.PutManifest(repository, tag, MediaTypeManifest, manifestBytes)
+}
+
+// pushDockerLayer compresses an uncompressed layer tar from the archive into
+// a temporary file to compute its digest before it is uploaded.
+func (c *Client) pushDockerLayer(repository, archivePath, layer string) (Descriptor, error) {
+	tmp, err := ioutil.TempFile("", "layer")
+	if err != nil {
+		return Descriptor{}, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	counter := &countingWriter{}
+	err = WithArchiveEntry(archivePath, layer, func(r io.Reader) error {
+		gw := gzip.NewWriter(io.MultiWriter(tmp, hash, counter))
+		if _, err := io.Copy(gw, r); err != nil {
+			return err
+		}
+		return gw.Close()
+	})
+	if err != nil {
+		return Descriptor{}, err
+	}
+
+	_, err = tmp.Seek(0, 0)
+	if err != nil {
+		return Descriptor{}, err
+	}
+
+	desc := Descriptor{
+		MediaType: MediaTypeLayer,
+		Size:      counter.n,
+		Digest:    "sha256:" + hex.EncodeToString(hash.Sum(nil)),
+	}
+
+	return desc, c.PushBlob(repository, desc.Digest, desc.Size, tmp)
+}
+
+func (c *Client) pushOCIArchive(repository, tag, archivePath string, indexJSON []byte) (string, error) {
+	var index ociIndex
+	err := json.Unmarshal(indexJSON, &index)
+	if err != nil {
+		return "", err
+	}
+	if len(index.Manifests) != 1 {
+		return "", fmt.Errorf("Expected one image in archive, found %d", len(index.Manifests))
+	}
+
+	manifestBytes, err := ReadArchiveEntry(archivePath, blobPath(index.Manifests[0].Digest))
+	if err != nil {
+		return "", err
+	}
+
+	var manifest Manifest
+	err = json.Unmarshal(manifestBytes, &manifest)
+	if err != nil {
+		return "", err
+	}
+
+	for _, desc := range append([]Descriptor{manifest.Config}, manifest.Layers...) {
+		desc := desc
+		err := WithArchiveEntry(archivePath, blobPath(desc.Digest), func(r io.Reader) error {
+			return c.PushBlob(repository, desc.Digest, desc.Size, r)
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	mediaType := index.Manifests[0].MediaType
+	if mediaType == "" {
+		mediaType = MediaTypeOCIManifest
+	}
+
+	return c.PutManifest(repository, tag, mediaType, manifestBytes)
+}
+
+func blobPath(digest string) string {
+	return "blobs/" + strings.Replace(digest, ":", "/", 1)
+}
+
+// ReadArchiveEntry returns the contents of the named entry of a tar archive.
+func ReadArchiveEntry(archivePath, name string) ([]byte, error) {
+	var content []byte
+	err := WithArchiveEntry(archivePath, name, func(r io.Reader) error {
+		var err error
+		content, err = ioutil.ReadAll(r)
+		return err
+	})
+	return content, err
+}
+
+// WithArchiveEntry calls fn with a reader of the named entry of a tar
+// archive. The archive may be gzip compressed. ErrEntryNotFound is returned
+// when the archive does not contain the entry.
+func WithArchiveEntry(archivePath, name string, fn func(io.Reader) error) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = bufio.NewReader(f)
+	magic, err := r.(*bufio.Reader).Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		r = gr
+	}
+
+	name = path.Clean(name)
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return ErrEntryNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if path.Clean(header.Name) == name && header.Typeflag != tar.TypeDir {
+			return fn(tr)
+		}
+	}
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
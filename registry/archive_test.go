@@ -0,0 +1,188 @@
+package registry_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"github.com/sykesm/kubernetes-cpi/registry"
+	"github.com/sykesm/kubernetes-cpi/registry/fakes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Archive", func() {
+	var (
+		tempDir      string
+		fakeRegistry *fakes.Registry
+		server       *httptest.Server
+		client       *registry.Client
+	)
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "archive")
+		Expect(err).NotTo(HaveOccurred())
+
+		fakeRegistry = fakes.NewRegistry()
+		server = httptest.NewServer(fakeRegistry)
+		client = &registry.Client{URL: server.URL}
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.RemoveAll(tempDir)
+	})
+
+	Describe("PushArchive", func() {
+		Context("with a docker save archive", func() {
+			var archivePath string
+
+			BeforeEach(func() {
+				archivePath = filepath.Join(tempDir, "image")
+				err := fakes.WriteDockerArchive(archivePath, []byte(`{"config":{}}`), []byte("layer-one"), []byte("layer-two"))
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("pushes the image and tags it", func() {
+				digest, err := client.PushArchive("stemcell", "3312", archivePath)
+				Expect(err).NotTo(HaveOccurred())
+
+				stored, ok := fakeRegistry.Manifest("stemcell", "3312")
+				Expect(ok).To(BeTrue())
+				Expect(registry.Digest(stored.Content)).To(Equal(digest))
+				Expect(stored.MediaType).To(Equal(registry.MediaTypeManifest))
+
+				var manifest registry.Manifest
+				Expect(json.Unmarshal(stored.Content, &manifest)).To(Succeed())
+				Expect(manifest.SchemaVersion).To(Equal(2))
+				Expect(manifest.Config.Digest).To(Equal(registry.Digest([]byte(`{"config":{}}`))))
+				Expect(manifest.Layers).To(HaveLen(2))
+
+				config, ok := fakeRegistry.Blob("stemcell", manifest.Config.Digest)
+				Expect(ok).To(BeTrue())
+				Expect(config).To(Equal([]byte(`{"config":{}}`)))
+
+				for i, expected := range []string{"layer-one", "layer-two"} {
+					Expect(manifest.Layers[i].MediaType).To(Equal(registry.MediaTypeLayer))
+
+					blob, ok := fakeRegistry.Blob("stemcell", manifest.Layers[i].Digest)
+					Expect(ok).To(BeTrue())
+					Expect(manifest.Layers[i].Size).To(Equal(int64(len(blob))))
+
+					gr, err := gzip.NewReader(bytes.NewReader(blob))
+					Expect(err).NotTo(HaveOccurred())
+					layer, err := ioutil.ReadAll(gr)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(string(layer)).To(Equal(expected))
+				}
+			})
+
+			Context("when the registry uses token authentication", func() {
+				BeforeEach(func() {
+					fakeRegistry.Token = "token-value"
+				})
+
+				It("pushes the image with a single token request", func() {
+					_, err := client.PushArchive("stemcell", "3312", archivePath)
+					Expect(err).NotTo(HaveOccurred())
+
+					_, ok := fakeRegistry.Manifest("stemcell", "3312")
+					Expect(ok).To(BeTrue())
+
+					var tokenRequests int
+					for _, r := range fakeRegistry.Requests() {
+						if r == "GET /token" {
+							tokenRequests++
+						}
+					}
+					Expect(tokenRequests).To(Equal(1))
+				})
+			})
+
+			Context("when the archive is compressed", func() {
+				BeforeEach(func() {
+					content, err := ioutil.ReadFile(archivePath)
+					Expect(err).NotTo(HaveOccurred())
+
+					var buf bytes.Buffer
+					gw := gzip.NewWriter(&buf)
+					gw.Write(content)
+					gw.Close()
+					Expect(ioutil.WriteFile(archivePath, buf.Bytes(), 0644)).To(Succeed())
+				})
+
+				It("pushes the image", func() {
+					_, err := client.PushArchive("stemcell", "3312", archivePath)
+					Expect(err).NotTo(HaveOccurred())
+
+					_, ok := fakeRegistry.Manifest("stemcell", "3312")
+					Expect(ok).To(BeTrue())
+				})
+			})
+		})
+
+		Context("with an OCI image layout archive", func() {
+			var (
+				archivePath string
+				manifest    []byte
+			)
+
+			BeforeEach(func() {
+				config := []byte(`{"config":{}}`)
+				layer := []byte("compressed-layer")
+				manifest = []byte(`{"schemaVersion":2,"config":{"mediaType":"application/vnd.oci.image.config.v1+json","size":13,"digest":"` +
+					registry.Digest(config) + `"},"layers":[{"mediaType":"application/vnd.oci.image.layer.v1.tar+gzip","size":16,"digest":"` +
+					registry.Digest(layer) + `"}]}`)
+				index := []byte(`{"schemaVersion":2,"manifests":[{"mediaType":"application/vnd.oci.image.manifest.v1+json","size":1,"digest":"` +
+					registry.Digest(manifest) + `"}]}`)
+
+				blobPath := func(content []byte) string {
+					return "blobs/sha256/" + registry.Digest(content)[len("sha256:"):]
+				}
+
+				archivePath = filepath.Join(tempDir, "oci")
+				err := fakes.WriteTar(archivePath,
+					[]string{"oci-layout", "index.json", blobPath(manifest), blobPath(config), blobPath(layer)},
+					map[string][]byte{
+						"oci-layout":       []byte(`{"imageLayoutVersion":"1.0.0"}`),
+						"index.json":       index,
+						blobPath(manifest): manifest,
+						blobPath(config):   config,
+						blobPath(layer):    layer,
+					},
+				)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("pushes the blobs and the manifest unchanged", func() {
+				digest, err := client.PushArchive("stemcell", "3312", archivePath)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(digest).To(Equal(registry.Digest(manifest)))
+
+				stored, ok := fakeRegistry.Manifest("stemcell", "3312")
+				Expect(ok).To(BeTrue())
+				Expect(stored.MediaType).To(Equal(registry.MediaTypeOCIManifest))
+				Expect(stored.Content).To(Equal(manifest))
+
+				_, ok = fakeRegistry.Blob("stemcell", registry.Digest([]byte("compressed-layer")))
+				Expect(ok).To(BeTrue())
+			})
+		})
+
+		Context("when the file is not an image archive", func() {
+			It("returns an error", func() {
+				archivePath := filepath.Join(tempDir, "other")
+				Expect(fakes.WriteTar(archivePath, []string{"file"}, map[string][]byte{"file": nil})).To(Succeed())
+
+				_, err := client.PushArchive("stemcell", "3312", archivePath)
+				Expect(err).To(MatchError(archivePath + " is not a docker or OCI image archive"))
+			})
+		})
+	})
+})
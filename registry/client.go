@@ -0,0 +1,343 @@
+package registry
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	MediaTypeManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeOCIIndex     = "application/vnd.oci.image.index.v1+json"
+	MediaTypeImageConfig  = "application/vnd.docker.container.image.v1+json"
+	MediaTypeLayer        = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+)
+
+// Client talks to a registry with the Docker Registry HTTP API V2.
+type Client struct {
+	URL      string
+	Username string
+	Password string
+
+	HTTPClient *http.Client
+
+	tokens map[string]string
+}
+
+type Descriptor struct {
+	MediaType string `json:"mediaType"`
+	Size      int64  `json:"size"`
+	Digest    string `json:"digest"`
+}
+
+type Manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Config        Descriptor   `json:"config"`
+	Layers        []Descriptor `json:"layers"`
+}
+
+// Host returns the registry host as used in image references.
+func (c *Client) Host() string {
+	u, err := url.Parse(c.URL)
+	if err != nil || u.Host == "" {
+		return strings.TrimSuffix(c.URL, "/")
+	}
+	return u.Host
+}
+
+// BlobExists returns true when the repository already has the blob.
+func (c *Client) BlobExists(repository, digest string) (bool, error) {
+	resp, err := c.do("HEAD", c.url("/v2/%s/blobs/%s", repository, digest), nil, nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, statusError("HEAD", "blob "+digest, resp)
+	}
+}
+
+// PushBlob uploads a blob with a single monolithic upload unless the
+// repository already has it.
+func (c *Client) PushBlob(repository, digest string, size int64, content io.Reader) error {
+	exists, err := c.BlobExists(repository, digest)
+	if err != nil || exists {
+		return err
+	}
+
+	resp, err := c.do("POST", c.url("/v2/%s/blobs/uploads/", repository), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return statusError("POST", "blob upload", resp)
+	}
+
+	location, err := resp.Location()
+	if err != nil {
+		return err
+	}
+	query := location.Query()
+	query.Set("digest", digest)
+	location.RawQuery = query.Encode()
+
+	headers := map[string]string{
+		"Content-Type":   "application/octet-stream",
+		"Content-Length": fmt.Sprintf("%d", size),
+	}
+	resp, err = c.do("PUT", location.String(), headers, content)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return statusError("PUT", "blob "+digest, resp)
+	}
+
+	return nil
+}
+
+// PutManifest stores a manifest under the reference and returns its digest.
+func (c *Client) PutManifest(repository, reference, mediaType string, manifest []byte) (string, error) {
+	headers := map[string]string{"Content-Type": mediaType}
+	resp, err := c.do("PUT", c.url("/v2/%s/manifests/%s", repository, reference), headers, bytes.NewReader(manifest))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return "", statusError("PUT", "manifest "+reference, resp)
+	}
+
+	if digest := resp.Header.Get("Docker-Content-Digest"); digest != "" {
+		return digest, nil
+	}
+	return Digest(manifest), nil
+}
+
+// Resolve returns the digest of the manifest a tag or digest refers to.
+func (c *Client) Resolve(repository, reference string) (string, error) {
+	headers := map[string]string{
+		"Accept": strings.Join([]string{
+			MediaTypeManifest,
+			MediaTypeManifestList,
+			MediaTypeOCIManifest,
+			MediaTypeOCIIndex,
+		}, ", "),
+	}
+
+	resp, err := c.do("HEAD", c.url("/v2/%s/manifests/%s", repository, reference), headers, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", statusError("HEAD", "manifest "+repository+":"+reference, resp)
+	}
+	if digest := resp.Header.Get("Docker-Content-Digest"); digest != "" {
+		return digest, nil
+	}
+
+	// Some registries only return the digest from GET.
+	resp, err = c.do("GET", c.url("/v2/%s/manifests/%s", repository, reference), headers, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", statusError("GET", "manifest "+repository+":"+reference, resp)
+	}
+	if digest := resp.Header.Get("Docker-Content-Digest"); digest != "" {
+		return digest, nil
+	}
+
+	manifest, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return Digest(manifest), nil
+}
+
+// DeleteManifest deletes a manifest by digest. Manifests that do not exist
+// are ignored.
+func (c *Client) DeleteManifest(repository, digest string) error {
+	resp, err := c.do("DELETE", c.url("/v2/%s/manifests/%s", repository, digest), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusAccepted, http.StatusOK, http.StatusNotFound:
+		return nil
+	default:
+		return statusError("DELETE", "manifest "+digest, resp)
+	}
+}
+
+// Digest returns the sha256 digest of content.
+func Digest(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func (c *Client) url(format string, args ...interface{}) string {
+	return strings.TrimSuffix(c.URL, "/") + fmt.Sprintf(format, args...)
+}
+
+func (c *Client) do(method, rawurl string, headers map[string]string, body io.Reader) (*http.Response, error) {
+	resp, err := c.send(method, rawurl, headers, body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Registries with token authentication, like Docker Hub, reject requests
+	// without a token for the repository with a challenge. Requests with a
+	// body are only retried when the body can be rewound.
+	authenticate := resp.Header.Get("Www-Authenticate")
+	if resp.StatusCode != http.StatusUnauthorized || !strings.HasPrefix(authenticate, "Bearer ") {
+		return resp, nil
+	}
+	seeker, rewindable := body.(io.Seeker)
+	if body != nil && !rewindable {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	token, err := c.fetchToken(authenticate)
+	if err != nil {
+		return nil, err
+	}
+	if c.tokens == nil {
+		c.tokens = map[string]string{}
+	}
+	c.tokens[tokenKey(resp.Request.URL)] = token
+
+	if body != nil {
+		_, err = seeker.Seek(0, io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c.send(method, rawurl, headers, body)
+}
+
+// send makes a request with the cached token of the repository.
+func (c *Client) send(method, rawurl string, headers map[string]string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, rawurl, body)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range headers {
+		if k == "Content-Length" {
+			fmt.Sscanf(v, "%d", &req.ContentLength)
+			continue
+		}
+		req.Header.Set(k, v)
+	}
+
+	if c.Username != "" || c.Password != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+	if token, ok := c.tokens[tokenKey(req.URL)]; ok {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return c.httpClient().Do(req)
+}
+
+// tokenKey returns the key tokens are cached under: the registry host and
+// the repository of the request, so a token is reused for the uploads and
+// manifests of the repository.
+func tokenKey(u *url.URL) string {
+	repository := strings.TrimPrefix(u.Path, "/v2/")
+	for _, sep := range []string{"/blobs/", "/manifests/", "/tags/"} {
+		if i := strings.LastIndex(repository, sep); i >= 0 {
+			repository = repository[:i]
+			break
+		}
+	}
+	return u.Host + "/" + repository
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return c.HTTPClient
+}
+
+// fetchToken requests a bearer token from the realm of a challenge.
+func (c *Client) fetchToken(challenge string) (string, error) {
+	params := map[string]string{}
+	for _, param := range strings.Split(strings.TrimPrefix(challenge, "Bearer "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(kv) == 2 {
+			params[kv[0]] = strings.Trim(kv[1], `"`)
+		}
+	}
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", fmt.Errorf("Invalid registry authentication challenge %q", challenge)
+	}
+	query := realm.Query()
+	for _, key := range []string{"service", "scope"} {
+		if params[key] != "" {
+			query.Set(key, params[key])
+		}
+	}
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequest("GET", realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if c.Username != "" || c.Password != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", statusError("GET", "token", resp)
+	}
+
+	var tokenResponse struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&tokenResponse)
+	if err != nil {
+		return "", err
+	}
+	if tokenResponse.Token != "" {
+		return tokenResponse.Token, nil
+	}
+	return tokenResponse.AccessToken, nil
+}
+
+func statusError(method, what string, resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("Registry %s of %s failed with status %d: %s", method, what, resp.StatusCode, strings.TrimSpace(string(body)))
+}
@@ -0,0 +1,232 @@
+package registry_test
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/sykesm/kubernetes-cpi/registry"
+	"github.com/sykesm/kubernetes-cpi/registry/fakes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Client", func() {
+	var (
+		fakeRegistry *fakes.Registry
+		server       *httptest.Server
+		client       *registry.Client
+	)
+
+	BeforeEach(func() {
+		fakeRegistry = fakes.NewRegistry()
+		server = httptest.NewServer(fakeRegistry)
+
+		client = &registry.Client{URL: server.URL}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	Describe("Host", func() {
+		It("returns the host of the registry URL", func() {
+			Expect(client.Host()).To(Equal(strings.TrimPrefix(server.URL, "http://")))
+		})
+	})
+
+	Describe("PushBlob", func() {
+		var content []byte
+
+		BeforeEach(func() {
+			content = []byte("blob-content")
+		})
+
+		It("uploads the blob", func() {
+			err := client.PushBlob("some/repo", registry.Digest(content), int64(len(content)), bytes.NewReader(content))
+			Expect(err).NotTo(HaveOccurred())
+
+			blob, ok := fakeRegistry.Blob("some/repo", registry.Digest(content))
+			Expect(ok).To(BeTrue())
+			Expect(blob).To(Equal(content))
+		})
+
+		It("does not upload blobs the repository has", func() {
+			err := client.PushBlob("repo", registry.Digest(content), int64(len(content)), bytes.NewReader(content))
+			Expect(err).NotTo(HaveOccurred())
+			err = client.PushBlob("repo", registry.Digest(content), int64(len(content)), bytes.NewReader(content))
+			Expect(err).NotTo(HaveOccurred())
+
+			var uploads int
+			for _, r := range fakeRegistry.Requests() {
+				if strings.HasPrefix(r, "POST ") {
+					uploads++
+				}
+			}
+			Expect(uploads).To(Equal(1))
+		})
+
+		Context("when the digest does not match", func() {
+			It("returns an error", func() {
+				err := client.PushBlob("repo", registry.Digest([]byte("other")), int64(len(content)), bytes.NewReader(content))
+				Expect(err).To(MatchError(ContainSubstring("failed with status 400: digest mismatch")))
+			})
+		})
+
+		Context("when the registry requires credentials", func() {
+			BeforeEach(func() {
+				fakeRegistry.Username = "user"
+				fakeRegistry.Password = "password"
+			})
+
+			It("authenticates with basic auth", func() {
+				client.Username = "user"
+				client.Password = "password"
+				err := client.PushBlob("repo", registry.Digest(content), int64(len(content)), bytes.NewReader(content))
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("returns an error without credentials", func() {
+				err := client.PushBlob("repo", registry.Digest(content), int64(len(content)), bytes.NewReader(content))
+				Expect(err).To(MatchError(ContainSubstring("failed with status 401")))
+			})
+		})
+
+		Context("when the registry uses token authentication", func() {
+			BeforeEach(func() {
+				fakeRegistry.Token = "token-value"
+			})
+
+			It("uploads the blob with the token of the repository", func() {
+				err := client.PushBlob("some/repo", registry.Digest(content), int64(len(content)), bytes.NewReader(content))
+				Expect(err).NotTo(HaveOccurred())
+
+				blob, ok := fakeRegistry.Blob("some/repo", registry.Digest(content))
+				Expect(ok).To(BeTrue())
+				Expect(blob).To(Equal(content))
+
+				requests := fakeRegistry.Requests()
+				Expect(requests).To(HaveLen(5))
+				Expect(requests[:4]).To(Equal([]string{
+					"HEAD /v2/some/repo/blobs/" + registry.Digest(content),
+					"GET /token",
+					"HEAD /v2/some/repo/blobs/" + registry.Digest(content),
+					"POST /v2/some/repo/blobs/uploads/",
+				}))
+				Expect(requests[4]).To(HavePrefix("PUT /v2/some/repo/blobs/uploads/"))
+			})
+		})
+	})
+
+	Describe("Resolve", func() {
+		var manifest []byte
+
+		BeforeEach(func() {
+			manifest = []byte(`{"schemaVersion":2}`)
+			fakeRegistry.PutManifest("some/repo", "1.0", fakes.StoredManifest{
+				MediaType: registry.MediaTypeManifest,
+				Content:   manifest,
+			})
+		})
+
+		It("returns the digest of the tagged manifest", func() {
+			digest, err := client.Resolve("some/repo", "1.0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(digest).To(Equal(registry.Digest(manifest)))
+		})
+
+		Context("when the tag does not exist", func() {
+			It("returns an error", func() {
+				_, err := client.Resolve("some/repo", "2.0")
+				Expect(err).To(MatchError(ContainSubstring("HEAD of manifest some/repo:2.0 failed with status 404")))
+			})
+		})
+
+		Context("when the registry uses token authentication", func() {
+			BeforeEach(func() {
+				fakeRegistry.Token = "token-value"
+			})
+
+			It("gets a token and retries the request", func() {
+				digest, err := client.Resolve("some/repo", "1.0")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(digest).To(Equal(registry.Digest(manifest)))
+
+				Expect(fakeRegistry.Requests()).To(Equal([]string{
+					"HEAD /v2/some/repo/manifests/1.0",
+					"GET /token",
+					"HEAD /v2/some/repo/manifests/1.0",
+				}))
+			})
+		})
+	})
+
+	Describe("DeleteManifest", func() {
+		var digest string
+
+		BeforeEach(func() {
+			digest = fakeRegistry.PutManifest("repo", "1.0", fakes.StoredManifest{
+				MediaType: registry.MediaTypeManifest,
+				Content:   []byte(`{"schemaVersion":2}`),
+			})
+		})
+
+		It("deletes the manifest and its tags", func() {
+			Expect(client.DeleteManifest("repo", digest)).To(Succeed())
+
+			_, ok := fakeRegistry.Manifest("repo", "1.0")
+			Expect(ok).To(BeFalse())
+		})
+
+		It("ignores missing manifests", func() {
+			Expect(client.DeleteManifest("repo", registry.Digest([]byte("missing")))).To(Succeed())
+		})
+
+		Context("when the registry rejects the request", func() {
+			BeforeEach(func() {
+				fakeRegistry.Username = "user"
+			})
+
+			It("returns an error", func() {
+				Expect(client.DeleteManifest("repo", digest)).To(MatchError(ContainSubstring("failed with status 401")))
+			})
+		})
+	})
+
+	Describe("PutManifest", func() {
+		It("stores the manifest and returns its digest", func() {
+			manifest := []byte(`{"schemaVersion":2}`)
+			digest, err := client.PutManifest("repo", "1.0", registry.MediaTypeManifest, manifest)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(digest).To(Equal(registry.Digest(manifest)))
+
+			stored, ok := fakeRegistry.Manifest("repo", "1.0")
+			Expect(ok).To(BeTrue())
+			Expect(stored.MediaType).To(Equal(registry.MediaTypeManifest))
+			Expect(stored.Content).To(Equal(manifest))
+		})
+
+		Context("when the registry uses token authentication", func() {
+			BeforeEach(func() {
+				fakeRegistry.Token = "token-value"
+			})
+
+			It("gets a token and sends the manifest again", func() {
+				manifest := []byte(`{"schemaVersion":2}`)
+				_, err := client.PutManifest("repo", "1.0", registry.MediaTypeManifest, manifest)
+				Expect(err).NotTo(HaveOccurred())
+
+				stored, ok := fakeRegistry.Manifest("repo", "1.0")
+				Expect(ok).To(BeTrue())
+				Expect(stored.Content).To(Equal(manifest))
+
+				Expect(fakeRegistry.Requests()).To(Equal([]string{
+					"PUT /v2/repo/manifests/1.0",
+					"GET /token",
+					"PUT /v2/repo/manifests/1.0",
+				}))
+			})
+		})
+	})
+})
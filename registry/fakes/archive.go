@@ -0,0 +1,67 @@
+package fakes
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// WriteDockerArchive writes an archive in the format of docker save with the
+// image config and layers.
+func WriteDockerArchive(archivePath string, config []byte, layers ...[]byte) error {
+	manifest := []map[string]interface{}{{
+		"Config":   "config.json",
+		"RepoTags": []string{"image:latest"},
+		"Layers":   []string{},
+	}}
+
+	entries := map[string][]byte{"config.json": config}
+	var names []string
+	for i, layer := range layers {
+		name := fmt.Sprintf("layer-%d/layer.tar", i)
+		names = append(names, name)
+		entries[name] = layer
+	}
+	manifest[0]["Layers"] = names
+
+	manifestJSON, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	// docker save writes manifest.json last
+	order := append([]string{"config.json"}, names...)
+	order = append(order, "manifest.json")
+	entries["manifest.json"] = manifestJSON
+
+	return WriteTar(archivePath, order, entries)
+}
+
+// WriteTar writes the named entries to a tar archive in order.
+func WriteTar(archivePath string, names []string, entries map[string][]byte) error {
+	f, err := os.Create(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+	for _, name := range names {
+		content := entries[name]
+		err := tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(content)),
+			Typeflag: tar.TypeReg,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := tw.Write(content); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
@@ -0,0 +1,228 @@
+package fakes
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+type StoredManifest struct {
+	MediaType string
+	Content   []byte
+}
+
+// Registry is an in-memory implementation of the parts of the Docker
+// Registry HTTP API V2 used by the CPI.
+type Registry struct {
+	// When set, requests must use basic auth with these credentials.
+	Username string
+	Password string
+
+	// When set, requests must present this bearer token. Clients are
+	// challenged to get it from the /token endpoint.
+	Token string
+
+	mutex     sync.Mutex
+	blobs     map[string]map[string][]byte
+	manifests map[string]map[string]StoredManifest
+	uploads   map[string]string
+	requests  []string
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		blobs:     map[string]map[string][]byte{},
+		manifests: map[string]map[string]StoredManifest{},
+		uploads:   map[string]string{},
+	}
+}
+
+// Blob returns the content of a blob in a repository.
+func (r *Registry) Blob(repository, digest string) ([]byte, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	blob, ok := r.blobs[repository][digest]
+	return blob, ok
+}
+
+// Manifest returns the manifest stored under a tag or digest.
+func (r *Registry) Manifest(repository, reference string) (StoredManifest, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	manifest, ok := r.manifests[repository][reference]
+	return manifest, ok
+}
+
+// PutManifest stores a manifest under its digest and the tag.
+func (r *Registry) PutManifest(repository, tag string, manifest StoredManifest) string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.putManifest(repository, tag, manifest)
+}
+
+// Requests returns the method and path of each request served.
+func (r *Registry) Requests() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]string{}, r.requests...)
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.requests = append(r.requests, req.Method+" "+req.URL.Path)
+
+	if req.URL.Path == "/token" {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"token": %q}`, r.Token)
+		return
+	}
+
+	if r.Token != "" {
+		if req.Header.Get("Authorization") != "Bearer "+r.Token {
+			w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="fake-registry"`, req.Host))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	} else if r.Username != "" || r.Password != "" {
+		username, password, ok := req.BasicAuth()
+		if !ok || username != r.Username || password != r.Password {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+
+	p := strings.TrimPrefix(req.URL.Path, "/v2/")
+	switch {
+	case p == "" || p == "/":
+		w.WriteHeader(http.StatusOK)
+	case strings.Contains(p, "/blobs/uploads/"):
+		i := strings.Index(p, "/blobs/uploads/")
+		r.serveUpload(w, req, p[:i], p[i+len("/blobs/uploads/"):])
+	case strings.Contains(p, "/blobs/"):
+		i := strings.Index(p, "/blobs/")
+		r.serveBlob(w, req, p[:i], p[i+len("/blobs/"):])
+	case strings.Contains(p, "/manifests/"):
+		i := strings.Index(p, "/manifests/")
+		r.serveManifest(w, req, p[:i], p[i+len("/manifests/"):])
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (r *Registry) serveUpload(w http.ResponseWriter, req *http.Request, repository, id string) {
+	switch {
+	case req.Method == "POST" && id == "":
+		id = fmt.Sprintf("upload-%d", len(r.uploads)+1)
+		r.uploads[id] = repository
+		w.Header().Set("Location", "/v2/"+repository+"/blobs/uploads/"+id)
+		w.WriteHeader(http.StatusAccepted)
+
+	case req.Method == "PUT" && r.uploads[id] == repository:
+		content, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		digest := req.URL.Query().Get("digest")
+		if digest != digestOf(content) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "digest mismatch: %s", digest)
+			return
+		}
+
+		delete(r.uploads, id)
+		if r.blobs[repository] == nil {
+			r.blobs[repository] = map[string][]byte{}
+		}
+		r.blobs[repository][digest] = content
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.WriteHeader(http.StatusCreated)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (r *Registry) serveBlob(w http.ResponseWriter, req *http.Request, repository, digest string) {
+	blob, ok := r.blobs[repository][digest]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch req.Method {
+	case "HEAD":
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(blob)))
+		w.WriteHeader(http.StatusOK)
+	case "GET":
+		w.Write(blob)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *Registry) serveManifest(w http.ResponseWriter, req *http.Request, repository, reference string) {
+	if req.Method == "PUT" {
+		content, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		digest := r.putManifest(repository, reference, StoredManifest{
+			MediaType: req.Header.Get("Content-Type"),
+			Content:   content,
+		})
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	manifest, ok := r.manifests[repository][reference]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch req.Method {
+	case "HEAD", "GET":
+		w.Header().Set("Content-Type", manifest.MediaType)
+		w.Header().Set("Docker-Content-Digest", digestOf(manifest.Content))
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(manifest.Content)))
+		w.WriteHeader(http.StatusOK)
+		if req.Method == "GET" {
+			w.Write(manifest.Content)
+		}
+	case "DELETE":
+		digest := digestOf(manifest.Content)
+		for ref, m := range r.manifests[repository] {
+			if digestOf(m.Content) == digest {
+				delete(r.manifests[repository], ref)
+			}
+		}
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *Registry) putManifest(repository, reference string, manifest StoredManifest) string {
+	if r.manifests[repository] == nil {
+		r.manifests[repository] = map[string]StoredManifest{}
+	}
+	digest := digestOf(manifest.Content)
+	r.manifests[repository][digest] = manifest
+	r.manifests[repository][reference] = manifest
+	return digest
+}
+
+func digestOf(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,71 @@
+package registry
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	DockerHubHost    = "docker.io"
+	DockerHubAPIHost = "registry-1.docker.io"
+)
+
+// Reference is a parsed image reference.
+type Reference struct {
+	// Name is the image name as written, without tag or digest.
+	Name string
+
+	Host       string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// ParseReference parses an image reference of the form
+// [host[:port]/]repository[:tag][@digest]. Images without a host are on
+// Docker Hub and single component repositories there are in library.
+func ParseReference(image string) (Reference, error) {
+	ref := Reference{Name: image}
+
+	if i := strings.Index(ref.Name, "@"); i >= 0 {
+		ref.Name, ref.Digest = ref.Name[:i], ref.Name[i+1:]
+		if !strings.HasPrefix(ref.Digest, "sha256:") || len(ref.Digest) != len("sha256:")+64 {
+			return Reference{}, fmt.Errorf("Invalid digest in image reference %q", image)
+		}
+	}
+
+	if i := strings.LastIndex(ref.Name, ":"); i > strings.LastIndex(ref.Name, "/") {
+		ref.Name, ref.Tag = ref.Name[:i], ref.Name[i+1:]
+		if ref.Tag == "" {
+			return Reference{}, fmt.Errorf("Invalid tag in image reference %q", image)
+		}
+	}
+
+	if ref.Name == "" || strings.HasSuffix(ref.Name, "/") || strings.HasPrefix(ref.Name, "/") {
+		return Reference{}, fmt.Errorf("Invalid image reference %q", image)
+	}
+
+	ref.Repository = ref.Name
+	ref.Host = DockerHubHost
+	if i := strings.Index(ref.Name, "/"); i >= 0 {
+		first := ref.Name[:i]
+		if strings.ContainsAny(first, ".:") || first == "localhost" {
+			ref.Host, ref.Repository = first, ref.Name[i+1:]
+		}
+	}
+
+	if ref.Host == DockerHubHost && !strings.Contains(ref.Repository, "/") {
+		ref.Repository = "library/" + ref.Repository
+	}
+
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = "latest"
+	}
+
+	return ref, nil
+}
+
+// Pinned returns the reference with the digest and without the tag.
+func (r Reference) Pinned(digest string) string {
+	return r.Name + "@" + digest
+}
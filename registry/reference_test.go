@@ -0,0 +1,63 @@
+package registry_test
+
+import (
+	"strings"
+
+	"github.com/sykesm/kubernetes-cpi/registry"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Reference", func() {
+	var digest string
+
+	BeforeEach(func() {
+		digest = "sha256:" + strings.Repeat("a", 64)
+	})
+
+	Describe("ParseReference", func() {
+		It("places official images in the library on Docker Hub", func() {
+			ref, err := registry.ParseReference("ubuntu")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ref).To(Equal(registry.Reference{Name: "ubuntu", Host: "docker.io", Repository: "library/ubuntu", Tag: "latest"}))
+		})
+
+		It("parses Docker Hub images", func() {
+			ref, err := registry.ParseReference("sykesm/stemcell:tag")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ref).To(Equal(registry.Reference{Name: "sykesm/stemcell", Host: "docker.io", Repository: "sykesm/stemcell", Tag: "tag"}))
+		})
+
+		It("parses the registry host", func() {
+			ref, err := registry.ParseReference("registry.example.com/a/b:tag")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ref).To(Equal(registry.Reference{Name: "registry.example.com/a/b", Host: "registry.example.com", Repository: "a/b", Tag: "tag"}))
+
+			ref, err = registry.ParseReference("localhost:5000/stemcell")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ref).To(Equal(registry.Reference{Name: "localhost:5000/stemcell", Host: "localhost:5000", Repository: "stemcell", Tag: "latest"}))
+		})
+
+		It("parses digests", func() {
+			ref, err := registry.ParseReference("localhost/stemcell:tag@" + digest)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ref).To(Equal(registry.Reference{Name: "localhost/stemcell", Host: "localhost", Repository: "stemcell", Tag: "tag", Digest: digest}))
+		})
+
+		It("rejects invalid references", func() {
+			for _, image := range []string{"", "stemcell:", "stemcell@sha256:abc", "registry.example.com/"} {
+				_, err := registry.ParseReference(image)
+				Expect(err).To(HaveOccurred(), image)
+			}
+		})
+	})
+
+	Describe("Pinned", func() {
+		It("replaces the tag with the digest", func() {
+			ref, err := registry.ParseReference("registry.example.com:5000/stemcell:tag")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ref.Pinned(digest)).To(Equal("registry.example.com:5000/stemcell@" + digest))
+		})
+	})
+})